@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// walkedItems are the files the walk handed on, every one of them
+	// ends as copied, skipped, failed, earlier run or refused.
+	walkedItems atomic.Uint64
+	// earlierRunItems were before the -resume cutoff.
+	earlierRunItems atomic.Uint64
+	// refusedItems were walked but not dispatched, a cap, -min-free or an
+	// interrupt stopped the walk at them.
+	refusedItems atomic.Uint64
+
+	failedByClass = &classCounter{counts: map[errorCategory]int{}}
+)
+
+// fileSkipReasons are the skip reasons of walked files, the others are
+// recorded before the scout counts a file.
+var fileSkipReasons = []skipReason{skipLocked, skipTimeout, skipUnstable, skipConflict, skipSameFile, skipBinary, skipText}
+
+// classCounter counts failed files by the category of their error. A
+// whole sidecar group fails with the error of one file.
+type classCounter struct {
+	mu     sync.Mutex
+	counts map[errorCategory]int
+}
+
+// countFailed records n files failed with err.
+func countFailed(n int, err error) {
+	failedItems.Add(uint64(n))
+	failedByClass.mu.Lock()
+	failedByClass.counts[classifyError(err)] += n
+	failedByClass.mu.Unlock()
+}
+
+func (c *classCounter) snapshot() map[errorCategory]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[errorCategory]int, len(c.counts))
+	for class, n := range c.counts {
+		counts[class] = n
+	}
+	return counts
+}
+
+// accountingSummary says where every file the scout found went:
+// Scanned = Copied + Skipped + Failed + EarlierRun + NotReached + Vanished.
+// Vanished is only told apart from NotReached when the walk completed,
+// and is negative for files that appeared after the scout.
+type accountingSummary struct {
+	Scanned    uint64                `json:"scanned"`
+	Copied     uint64                `json:"copied"`
+	Skipped    map[skipReason]int    `json:"skipped"`
+	Failed     map[errorCategory]int `json:"failed"`
+	EarlierRun uint64                `json:"earlier_run"`
+	NotReached int64                 `json:"not_reached"`
+	Vanished   int64                 `json:"vanished"`
+	// Balanced is false when the walked files don't add up to their
+	// outcomes, which is a bug.
+	Balanced bool `json:"balanced"`
+}
+
+// runAccounting is set by settleAccounting once the workers finished.
+var runAccounting accountingSummary
+
+// settleAccounting balances the books of the run. walkComplete is false
+// when a cap, an interrupt or an error ended the walk early.
+func settleAccounting(scanned uint, walkComplete bool) accountingSummary {
+	a := accountingSummary{
+		Scanned:    uint64(scanned),
+		Copied:     copiedItems.Load(),
+		Skipped:    map[skipReason]int{},
+		Failed:     failedByClass.snapshot(),
+		EarlierRun: earlierRunItems.Load(),
+	}
+	counts := skips.snapshot()
+	for _, reason := range fileSkipReasons {
+		if counts[reason] > 0 {
+			a.Skipped[reason] = counts[reason]
+		}
+	}
+
+	walked, refused := walkedItems.Load(), refusedItems.Load()
+	skipped, failed := skippedItems.Load(), failedItems.Load()
+	a.Balanced = walked == a.Copied+skipped+failed+a.EarlierRun+refused
+	if !a.Balanced {
+		warnf("INTERNAL ERROR: the outcomes of walked files don't add up, please report this: walked %d != copied %d + skipped %d + failed %d + earlier run %d + refused %d\n",
+			walked, a.Copied, skipped, failed, a.EarlierRun, refused)
+	}
+	rest := int64(scanned) - int64(walked)
+	if walkComplete {
+		a.NotReached, a.Vanished = int64(refused), rest
+	} else {
+		a.NotReached = int64(refused) + rest
+	}
+	runAccounting = a
+	return a
+}
+
+// logAccounting prints the equation of the run.
+func logAccounting(a accountingSummary) {
+	skipped, failed := 0, 0
+	for _, n := range a.Skipped {
+		skipped += n
+	}
+	for _, n := range a.Failed {
+		failed += n
+	}
+	summaryf("accounting: found %d = copied %d + skipped %d%s + failed %d%s + earlier run %d + not reached %d + vanished %d\n",
+		a.Scanned, a.Copied, skipped, breakdown(a.Skipped, func(r skipReason) string { return string(r) }),
+		failed, breakdown(a.Failed, func(c errorCategory) string { return errorCategoryLabels[c] }),
+		a.EarlierRun, a.NotReached, a.Vanished)
+}
+
+// breakdown formats counts like " (locked 3, unstable 1)", "" if empty.
+func breakdown[K ~string](counts map[K]int, label func(K) string) string {
+	if len(counts) == 0 {
+		return ""
+	}
+	keys := make([]K, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s %d", label(k), counts[k])
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
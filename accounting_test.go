@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// outcomeFS is a source whose files in fail can't be opened and whose files
+// in gone are only listed by the first listing of their directory, the
+// scout's: they vanish before the walk.
+type outcomeFS struct {
+	fstest.MapFS
+	fail, gone map[string]bool
+
+	mu     *sync.Mutex
+	listed map[string]bool
+}
+
+func (f outcomeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := f.MapFS.ReadDir(name)
+	f.mu.Lock()
+	again := f.listed[name]
+	f.listed[name] = true
+	f.mu.Unlock()
+	if !again || err != nil {
+		return entries, err
+	}
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !f.gone[path.Join(name, entry.Name())] {
+			kept = append(kept, entry)
+		}
+	}
+	return kept, nil
+}
+
+func (f outcomeFS) Open(name string) (fs.File, error) {
+	switch {
+	case f.fail[name]:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errTestOpen}
+	case f.gone[name]:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.MapFS.Open(name)
+}
+
+// outcomeTests inject every outcome of a found file on its own, then all
+// of them together.
+var outcomeTests = []struct {
+	name                      string
+	files, fail, gone         []string
+	copied, conflicts, failed int
+	vanished                  int64
+}{
+	{name: "copied", files: []string{"a/one.txt", "b/two.txt"}, copied: 2},
+	{name: "conflict", files: []string{"a/b_c.txt", "a_b/c.txt"}, copied: 1, conflicts: 1},
+	{name: "failed", files: []string{"a/one.txt", "a/bad.txt"}, fail: []string{"a/bad.txt"}, copied: 1, failed: 1},
+	{name: "vanished", files: []string{"a/one.txt", "v/gone.txt"}, gone: []string{"v/gone.txt"}, copied: 1, vanished: 1},
+	{
+		name:   "all",
+		files:  []string{"a/one.txt", "a/b_c.txt", "a_b/c.txt", "a/bad.txt", "v/gone.txt", "v/kept.txt"},
+		fail:   []string{"a/bad.txt"},
+		gone:   []string{"v/gone.txt"},
+		copied: 3, conflicts: 1, failed: 1, vanished: 1,
+	},
+}
+
+func init() {
+	for _, test := range outcomeTests {
+		source := outcomeFS{MapFS: fstest.MapFS{}, fail: map[string]bool{}, gone: map[string]bool{}, mu: &sync.Mutex{}, listed: map[string]bool{}}
+		for _, name := range test.files {
+			source.MapFS[name] = testFile(name)
+		}
+		for _, name := range test.fail {
+			source.fail[name] = true
+		}
+		for _, name := range test.gone {
+			source.gone[name] = true
+		}
+		copyCases["outcome-"+test.name] = copyCase{source: source, args: []string{"-on-conflict", "skip"}}
+	}
+}
+
+// TestCopyAccounting checks that every found file is accounted for by
+// exactly one outcome.
+func TestCopyAccounting(t *testing.T) {
+	for _, test := range outcomeTests {
+		r := runCopyTest(t, "outcome-"+test.name)
+		a := r.summary.Accounting
+		failed := 0
+		for _, n := range a.Failed {
+			failed += n
+		}
+		if a.Scanned != uint64(len(test.files)) || a.Copied != uint64(test.copied) || a.Skipped[skipConflict] != test.conflicts || failed != test.failed || a.Vanished != test.vanished {
+			t.Errorf("%s: accounting = %+v, want %d scanned, %d copied, %d conflicts, %d failed, %d vanished",
+				test.name, a, len(test.files), test.copied, test.conflicts, test.failed, test.vanished)
+		}
+		if !a.Balanced || a.NotReached != 0 || a.EarlierRun != 0 {
+			t.Errorf("%s: accounting = %+v, want balanced with nothing not reached", test.name, a)
+		}
+		if sum := int64(a.Copied) + int64(test.conflicts) + int64(failed) + a.Vanished; sum != int64(a.Scanned) {
+			t.Errorf("%s: %d outcomes of %d found files", test.name, sum, a.Scanned)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var copyACLs bool
+
+// prepareACLs rejects -acls where readACL isn't implemented.
+func prepareACLs() error {
+	if copyACLs && aclFormat == "" {
+		return errors.New("-acls is only supported on Linux and Windows")
+	}
+	return nil
+}
+
+// copyACL copies the ACL of srcName to destPath and records it in entry
+// for restore. Missing privileges only cost the ACL, not the copy.
+func copyACL(srcName, destPath string, entry *manifestEntry) {
+	acl, err := readACL(srcName)
+	if err != nil {
+		warnf("Could not read the ACL of %q: %v\n", srcName, err)
+		return
+	}
+	if acl == nil {
+		return
+	}
+	if err := writeACL(destPath, acl); err != nil {
+		warnf("Could not copy the ACL of %q: %v\n", srcName, err)
+	}
+	entry.ACL = acl
+	entry.ACLFormat = aclFormat
+}
+
+// restoreACL applies an entry's recorded ACL to a restored file.
+func restoreACL(dst string, entry manifestEntry) error {
+	if entry.ACL == nil {
+		return nil
+	}
+	if entry.ACLFormat != aclFormat {
+		return fmt.Errorf("the recorded %s ACL can't be applied on this platform", entry.ACLFormat)
+	}
+	return writeACL(dst, entry.ACL)
+}
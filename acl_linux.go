@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// aclFormat names what readACL returns: the binary POSIX ACL xattr, like
+// getfacl and setfacl use it.
+const aclFormat = "posix"
+
+const posixACLAccess = "system.posix_acl_access"
+
+// readACL returns nil for files without an ACL beyond their mode bits, or
+// on filesystems without ACL support.
+func readACL(name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(name, posixACLAccess, nil)
+		if errors.Is(err, syscall.ENODATA) || errors.Is(err, syscall.ENOTSUP) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		acl := make([]byte, size)
+		n, err := syscall.Getxattr(name, posixACLAccess, acl)
+		if errors.Is(err, syscall.ERANGE) {
+			// the ACL grew in between
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return acl[:n], nil
+	}
+}
+
+func writeACL(name string, acl []byte) error {
+	return syscall.Setxattr(name, posixACLAccess, acl, 0)
+}
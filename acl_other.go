@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+
+package main
+
+import "errors"
+
+// aclFormat is empty where ACLs aren't supported, see prepareACLs.
+const aclFormat = ""
+
+func readACL(name string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func writeACL(name string, acl []byte) error {
+	return errors.ErrUnsupported
+}
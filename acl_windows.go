@@ -0,0 +1,51 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// aclFormat names what readACL returns: a self-relative security
+// descriptor holding the DACL.
+const aclFormat = "windows-dacl"
+
+const daclSecurityInformation = 0x4
+
+var (
+	advapi32            = syscall.NewLazyDLL("advapi32.dll")
+	procGetFileSecurity = advapi32.NewProc("GetFileSecurityW")
+	procSetFileSecurity = advapi32.NewProc("SetFileSecurityW")
+)
+
+func readACL(name string) ([]byte, error) {
+	path, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var needed uint32
+	// the first call only reports the size
+	procGetFileSecurity.Call(uintptr(unsafe.Pointer(path)), daclSecurityInformation, 0, 0, uintptr(unsafe.Pointer(&needed)))
+	if needed == 0 {
+		return nil, nil
+	}
+	sd := make([]byte, needed)
+	ok, _, err := procGetFileSecurity.Call(uintptr(unsafe.Pointer(path)), daclSecurityInformation,
+		uintptr(unsafe.Pointer(&sd[0])), uintptr(needed), uintptr(unsafe.Pointer(&needed)))
+	if ok == 0 {
+		return nil, err
+	}
+	return sd, nil
+}
+
+func writeACL(name string, acl []byte) error {
+	path, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	ok, _, err := procSetFileSecurity.Call(uintptr(unsafe.Pointer(path)), daclSecurityInformation, uintptr(unsafe.Pointer(&acl[0])))
+	if ok == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// adsMode is what happens to NTFS alternate data streams, see -ads.
+var adsMode = newChoiceValue("report", "report", "preserve")
+
+// adsDropped counts copied files whose streams were recorded but not copied.
+var adsDropped atomic.Uint64
+
+// dataStream is an alternate data stream of a file, Name without the
+// leading ":" and the ":$DATA" type, e.g. "Zone.Identifier".
+type dataStream struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// prepareADS warns about an -ads given where files have no streams.
+func prepareADS() {
+	if !adsSupported && flagWasSet(copyCommand.flags, "ads") {
+		warnf("-ads %s has no effect, files only have alternate data streams on Windows\n", adsMode.value)
+	}
+}
+
+// copyStreams records the alternate data streams of srcName in entry and,
+// with -ads preserve, copies them to destPath. Failing only costs the
+// streams, not the copy.
+func copyStreams(srcName, destPath string, entry *manifestEntry) {
+	if !adsSupported {
+		return
+	}
+	streams, err := listStreams(srcName)
+	if err != nil {
+		warnf("Could not list the alternate data streams of %q: %v\n", srcName, err)
+		return
+	}
+	if len(streams) == 0 {
+		return
+	}
+	entry.Streams = streams
+	if adsMode.value != "preserve" {
+		verbosef("%q has '%d' alternate data streams, pass -ads preserve to copy them\n", srcName, len(streams))
+		adsDropped.Add(1)
+		return
+	}
+	for _, stream := range streams {
+		if err := copyStream(srcName+":"+stream.Name, destPath+":"+stream.Name); err != nil {
+			warnf("Could not copy the alternate data stream %q of %q: %v\n", stream.Name, srcName, err)
+		}
+	}
+}
+
+func copyStream(srcName, destName string) error {
+	src, err := os.Open(srcName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := os.Create(destName)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, src); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
+
+// logDroppedStreams tells -ads report users what wasn't copied.
+func logDroppedStreams() {
+	if n := adsDropped.Load(); n > 0 {
+		summaryf("'%d' files have alternate data streams that were not copied, the manifest lists them. Pass -ads preserve to copy them\n", n)
+	}
+}
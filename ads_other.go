@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+const adsSupported = false
+
+func listStreams(name string) ([]dataStream, error) {
+	return nil, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const adsSupported = true
+
+var (
+	procFindFirstStreamW = kernel32.NewProc("FindFirstStreamW")
+	procFindNextStreamW  = kernel32.NewProc("FindNextStreamW")
+)
+
+// win32FindStreamData is WIN32_FIND_STREAM_DATA.
+type win32FindStreamData struct {
+	StreamSize int64
+	StreamName [syscall.MAX_PATH + 36]uint16
+}
+
+// listStreams returns the alternate data streams of name, leaving out the
+// unnamed main stream.
+func listStreams(name string) ([]dataStream, error) {
+	path, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	var data win32FindStreamData
+	// 0 is FindStreamInfoStandard
+	handle, _, err := procFindFirstStreamW.Call(uintptr(unsafe.Pointer(path)), 0, uintptr(unsafe.Pointer(&data)), 0)
+	if syscall.Handle(handle) == syscall.InvalidHandle {
+		if errors.Is(err, syscall.ERROR_HANDLE_EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer syscall.FindClose(syscall.Handle(handle))
+
+	var streams []dataStream
+	for {
+		// names look like ":Zone.Identifier:$DATA", the main stream is "::$DATA"
+		streamName := strings.TrimSuffix(strings.TrimPrefix(syscall.UTF16ToString(data.StreamName[:]), ":"), ":$DATA")
+		if streamName != "" {
+			streams = append(streams, dataStream{Name: streamName, Size: data.StreamSize})
+		}
+		ok, _, err := procFindNextStreamW.Call(handle, uintptr(unsafe.Pointer(&data)))
+		if ok == 0 {
+			if errors.Is(err, syscall.ERROR_HANDLE_EOF) {
+				return streams, nil
+			}
+			return streams, err
+		}
+	}
+}
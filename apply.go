@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var (
+	applyManifest   string
+	applyJournal    string
+	applyAllowDrift bool
+)
+
+var applyCommand = newCommand("apply", "PLAN", "Execute a plan written by plan -o exactly as it was reviewed.\n"+
+	"Every copy done is appended to a journal, running apply again skips those.", logFlags, hashFlags)
+
+func init() {
+	fs := applyCommand.flags
+	fs.StringVar(&applyManifest, "manifest", "", "write a manifest of every copied file, used by restore, verify and undo")
+	fs.StringVar(&applyJournal, "journal", "", "progress journal of the plan, PLAN.journal by default")
+	fs.BoolVar(&applyAllowDrift, "allow-drift", false, "copy sources whose size or modification time changed since planning")
+	applyCommand.run = runApply
+}
+
+func runApply(args []string) int {
+	if len(args) != 1 {
+		applyCommand.flags.Usage()
+		return exitUsage
+	}
+	plan, err := readPlan(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if applyJournal == "" {
+		applyJournal = args[0] + ".journal"
+	}
+	applyJournal, err = filepath.Abs(applyJournal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	done, err := readJournal(applyJournal)
+	if err != nil {
+		errorf("Could not read journal %q: %v\n", applyJournal, err)
+		return exitFailed
+	}
+	if len(done) > 0 {
+		infof("Resuming with '%d' of '%d' items already done according to %q\n", len(done), len(plan.Entries), applyJournal)
+	}
+
+	// sources and destinations are relative to the plan's directories, not
+	// to where apply runs
+	if archiveKind(plan.SourceRoot) != "" {
+		sourceArchive = plan.SourceRoot
+		err = openSourceTree()
+	} else {
+		err = os.Chdir(plan.SourceRoot)
+	}
+	if err != nil {
+		errorf("%v\n", err)
+		return exitFailed
+	}
+	outputDirectory = plan.OutputDir
+	if err := os.MkdirAll(outputDirectory, 0755); err != nil {
+		errorf("%v\n", err)
+		return exitFailed
+	}
+	writeOutputMarker(outputDirectory, plan.SourceRoot, plan.RunID, applyManifest)
+
+	journal, err := os.OpenFile(applyJournal, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		errorf("Could not open journal %q: %v\n", applyJournal, err)
+		return exitFailed
+	}
+	defer journal.Close()
+	encoder := json.NewEncoder(journal)
+
+	copied, failed := 0, 0
+	for _, planned := range plan.Entries {
+		if _, ok := done[planned.Source]; ok {
+			continue
+		}
+		entry, err := applyEntry(planned)
+		if err != nil {
+			errorf("%s: %v\n", planned.Source, err)
+			failed++
+			continue
+		}
+		entry.Group = planned.Group
+		if err := encoder.Encode(entry); err != nil {
+			errorf("Could not write journal %q: %v\n", applyJournal, err)
+			return exitFailed
+		}
+		done[planned.Source] = entry
+		copied++
+	}
+
+	if applyManifest != "" {
+		m, err := newManifest(plan.SourceRoot, plan.OutputDir)
+		if err == nil {
+			m.RunID = plan.RunID
+			if hashAlgorithm.value != "none" {
+				m.HashAlgorithm = hashAlgorithm.value
+			}
+			err = m.create(applyManifest, false)
+		}
+		if err == nil {
+			for _, entry := range done {
+				m.add(entry)
+			}
+			err = m.close(nil, nil)
+		}
+		if err != nil {
+			errorf("Could not write manifest %q: %v\n", applyManifest, err)
+		}
+	}
+
+	infof("Applied: '%d' items, '%d' failed, '%d' were already done\n", copied, failed, len(done)-copied)
+	if failed > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+func applyEntry(planned plannedCopy) (manifestEntry, error) {
+	srcName := filepath.FromSlash(planned.Source)
+	info, err := statSource(srcName)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	if !applyAllowDrift && (info.Size() != planned.Size || !info.ModTime().Equal(planned.ModTime)) {
+		return manifestEntry{}, fmt.Errorf("changed since planning (size %d, modified %s), pass -allow-drift to copy it anyway",
+			info.Size(), info.ModTime().Format("2006-01-02 15:04:05"))
+	}
+	return storeFile(srcName, planned.Destination, planned.Compression, planned.Encryption)
+}
+
+// readJournal returns the manifest entries of every copy an earlier apply
+// of the plan completed, by source. A missing journal is empty.
+func readJournal(name string) (map[string]manifestEntry, error) {
+	done := map[string]manifestEntry{}
+	file, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry manifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// the last line is cut short if apply was killed while writing it
+			verbosef("ignoring line %d of journal %q: %v\n", line, name, err)
+			continue
+		}
+		done[entry.Source] = entry
+	}
+	return done, scanner.Err()
+}
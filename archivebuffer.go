@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+)
+
+// archiveBuffer is -archive-buffer, how much file data the copy workers
+// may hold in memory while they wait for the pack writer. 0 doesn't limit
+// it.
+var archiveBuffer = sizeValue(256 << 20)
+
+// archiveStreamShare is the part of -archive-buffer from which a file is
+// streamed into its pack under the writer's lock instead: it would take so
+// much of the budget that the other workers wait either way.
+const archiveStreamShare = 16
+
+// byteBudget blocks whoever acquires more bytes than are left until others
+// release theirs. A request over the whole budget gets all of it once
+// nothing else is held.
+type byteBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int64
+	peak int64
+}
+
+var archiveBudget = newByteBudget()
+
+func newByteBudget() *byteBudget {
+	b := &byteBudget{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n bytes fit the budget and returns what it took,
+// which release gives back.
+func (b *byteBudget) acquire(n int64) int64 {
+	limit := int64(archiveBuffer)
+	if limit > 0 && n > limit {
+		n = limit
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for limit > 0 && b.used > 0 && b.used+n > limit {
+		b.cond.Wait()
+	}
+	b.used += n
+	b.peak = max(b.peak, b.used)
+	return n
+}
+
+func (b *byteBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// inUse and peakUse are the bytes held now and at most.
+func (b *byteBudget) inUse() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+func (b *byteBudget) peakUse() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.peak
+}
+
+// streamIntoPack reports whether a file of size bytes bypasses the buffer.
+func streamIntoPack(size int64) bool {
+	return archiveBuffer > 0 && size >= int64(archiveBuffer)/archiveStreamShare
+}
+
+// logArchiveBuffer says how much of -archive-buffer the packs needed.
+func logArchiveBuffer() {
+	if packs == nil {
+		return
+	}
+	limit := "unlimited"
+	if archiveBuffer > 0 {
+		limit = formatBytes(int64(archiveBuffer))
+	}
+	summaryf("Pack buffer peak: %s of -archive-buffer %s\n", formatBytes(archiveBudget.peakUse()), limit)
+}
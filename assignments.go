@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// manifestAssignment is the destination an earlier run gave a source that
+// this run didn't copy again, carried over so the run after it still
+// knows it.
+type manifestAssignment struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// maxAssignmentChanges is how many sources whose naming changed are named
+// in the log.
+const maxAssignmentChanges = 10
+
+// assignmentChange is a source whose name from the current naming flags
+// differs from the destination recorded for it.
+type assignmentChange struct {
+	source, recorded, fresh string
+}
+
+// destinationAssignments are the destinations the -manifest of earlier runs
+// into the same output directory recorded, by slash separated source
+// path. A source keeps its destination across runs even if the naming
+// flags changed, so an incremental run finds its earlier copy instead of
+// adding a second one under another name.
+type destinationAssignments struct {
+	mu       sync.Mutex
+	assigned map[string]string
+	// carried are the assignments to write to a replaced manifest at
+	// close, those of the sources this run didn't copy.
+	carried map[string]bool
+	changed int
+	samples []assignmentChange
+}
+
+var priorAssignments = &destinationAssignments{}
+
+// loadAssignments reads the assignments from the manifest name if it was
+// written for outputDir. If appending, the manifest keeps its entries and
+// nothing needs carrying over.
+func loadAssignments(name, outputDir string, appending bool) error {
+	m, err := readManifest(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if filepath.Clean(m.OutputDir) != filepath.Clean(outputDir) {
+		return nil
+	}
+
+	a := priorAssignments
+	a.assigned = make(map[string]string, len(m.Entries)+len(m.Assigned))
+	for _, entry := range m.Entries {
+		if entry.Group != "" {
+			// sidecars follow the name of their primary
+			continue
+		}
+		name := strings.TrimSuffix(entry.Destination, encryptionExtension(entry.Encryption))
+		a.assigned[entry.Source] = strings.TrimSuffix(name, compressionExtension(entry.Compression))
+	}
+	for _, assignment := range m.Assigned {
+		a.assigned[assignment.Source] = assignment.Destination
+	}
+	if !appending {
+		a.carried = make(map[string]bool, len(a.assigned))
+		for source := range a.assigned {
+			a.carried[source] = true
+		}
+	}
+	if len(a.assigned) > 0 {
+		infof("Reusing the destinations of '%d' sources recorded in %q\n", len(a.assigned), name)
+	}
+	return nil
+}
+
+// lookup returns the destination recorded for source, or fresh, the name
+// the naming flags give it now, if there is none.
+func (a *destinationAssignments) lookup(source, fresh string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	recorded, found := a.assigned[filepath.ToSlash(source)]
+	if !found {
+		return fresh
+	}
+	if recorded != fresh {
+		a.changed++
+		if len(a.samples) < maxAssignmentChanges {
+			a.samples = append(a.samples, assignmentChange{filepath.ToSlash(source), recorded, fresh})
+		}
+	}
+	return recorded
+}
+
+// copied drops source from the assignments to carry over, the manifest
+// has a new entry for it.
+func (a *destinationAssignments) copied(source string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.carried, source)
+}
+
+// carry writes the assignments of the sources this run didn't copy to m.
+func (a *destinationAssignments) carry(m *manifest) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for source := range a.carried {
+		m.addAssigned(manifestAssignment{Source: source, Destination: a.assigned[source]})
+	}
+}
+
+// logAssignmentChanges reports the sources that kept a recorded
+// destination the current naming flags would have named differently.
+func logAssignmentChanges() {
+	a := priorAssignments
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.changed == 0 {
+		return
+	}
+	warnf("'%d' sources kept the destination an earlier run recorded, the naming flags now give another name:\n", a.changed)
+	for _, change := range a.samples {
+		warnf("  %s: recorded %q, now %q\n", change.source, change.recorded, change.fresh)
+	}
+	if a.changed > len(a.samples) {
+		warnf("  and '%d' more\n", a.changed-len(a.samples))
+	}
+}
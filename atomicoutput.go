@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var (
+	atomicOutput  bool
+	cleanupOnFail bool
+)
+
+// finalOutputDirectory is -x with -atomic-output, while outputDirectory is
+// the staging directory the run writes to.
+var finalOutputDirectory string
+
+// stageOutputDirectory points outputDirectory to a hidden staging
+// directory next to -x, named after the run so a -resume with the same
+// -run-id continues in it. There is no policy for replacing a directory,
+// so -x must not exist yet.
+func stageOutputDirectory() error {
+	if !atomicOutput {
+		return nil
+	}
+	if _, err := os.Lstat(outputDirectory); err == nil {
+		return fmt.Errorf("-atomic-output: %q already exists, the staged output can't replace it", outputDirectory)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	finalOutputDirectory = outputDirectory
+	outputDirectory = filepath.Join(filepath.Dir(finalOutputDirectory), "."+filepath.Base(finalOutputDirectory)+".partial-"+runID)
+	infof("Staging the output in %q, it's moved to %q once the run completes\n", outputDirectory, finalOutputDirectory)
+	return nil
+}
+
+// finishAtomicOutput renames the staging directory to -x if the run went
+// through every file. Otherwise it's left for inspection, or removed with
+// -cleanup-on-fail.
+func finishAtomicOutput(complete bool) error {
+	if finalOutputDirectory == "" {
+		return nil
+	}
+	if !complete {
+		if cleanupOnFail {
+			infof("Removing the staged output %q\n", outputDirectory)
+			return os.RemoveAll(outputDirectory)
+		}
+		infof("The run didn't complete, the staged output stays in %q\n", outputDirectory)
+		return nil
+	}
+	if err := os.Rename(outputDirectory, finalOutputDirectory); err != nil {
+		return err
+	}
+	outputDirectory = finalOutputDirectory
+	return nil
+}
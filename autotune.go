@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// -c auto starts autoStartWorkers copy workers and adds or removes one every
+// autoInterval, depending on whether the aggregate throughput kept up.
+const (
+	autoStartWorkers = 2
+	autoInterval     = 3 * time.Second
+	// autoGain is the relative throughput change that counts as scaling.
+	autoGain = 0.1
+	// autoProbeEvery intervals a settled tuner tries one more worker again.
+	autoProbeEvery = 10
+)
+
+var autoConcurrency bool
+
+// autoMaxWorkers is the hard bound of -c auto: copying is IO bound, so more
+// workers than CPUs can pay off on NVMe drives and network shares.
+func autoMaxWorkers() int {
+	return max(16, 4*runtime.NumCPU())
+}
+
+// maxCopyWorkers caps an explicit -c: past it workers only add contention
+// and memory, even on high latency shares.
+func maxCopyWorkers() int {
+	return max(256, 32*runtime.NumCPU())
+}
+
+// concurrencyValue is the -c flag, a worker count or "auto".
+type concurrencyValue struct{}
+
+func (concurrencyValue) String() string {
+	if autoConcurrency {
+		return "auto"
+	}
+	return strconv.Itoa(maxNumCores)
+}
+
+func (concurrencyValue) Set(s string) error {
+	if s == "auto" {
+		autoConcurrency = true
+		maxNumCores = autoMaxWorkers()
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return fmt.Errorf("%d copy workers could never copy anything, use at least 1 or auto", n)
+	}
+	autoConcurrency = false
+	maxNumCores = n
+	return nil
+}
+
+// workerGate parks every copy worker whose id is at or above its limit.
+type workerGate struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int
+}
+
+func newWorkerGate(limit int) *workerGate {
+	g := &workerGate{limit: limit}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// wait blocks while worker is parked. A nil gate never parks.
+func (g *workerGate) wait(worker int) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	for worker >= g.limit {
+		g.cond.Wait()
+	}
+	g.mu.Unlock()
+}
+
+func (g *workerGate) set(limit int) {
+	g.mu.Lock()
+	g.limit = limit
+	g.mu.Unlock()
+	g.cond.Broadcast()
+}
+
+func (g *workerGate) current() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.limit
+}
+
+// tune hill climbs the gate's limit on copiedBytes until stop is closed:
+// grow while throughput scales, back off one worker and settle once it
+// plateaus or regresses.
+func (g *workerGate) tune(maxWorkers int, stop <-chan struct{}) {
+	ticker := time.NewTicker(autoInterval)
+	defer ticker.Stop()
+
+	lastBytes := copiedBytes.Load()
+	var last float64
+	grew, settledFor := false, 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		bytes := copiedBytes.Load()
+		rate := float64(bytes-lastBytes) / autoInterval.Seconds()
+		lastBytes = bytes
+		if rate == 0 {
+			// waiting on the walker or -stable-for, nothing to learn
+			continue
+		}
+
+		n := g.current()
+		switch {
+		case grew && rate > last*(1+autoGain) && n < maxWorkers:
+			n++
+		case grew:
+			if rate <= last*(1+autoGain) {
+				// the last worker didn't help
+				n--
+			}
+			grew, settledFor = false, 1
+		case settledFor%autoProbeEvery == 0 && n < maxWorkers:
+			n++
+			grew = true
+		default:
+			settledFor++
+		}
+		if n != g.current() {
+			verbosef("-c auto: %s/s with %d workers, switching to %d\n", formatBytes(int64(rate)), g.current(), n)
+			g.set(n)
+		}
+		last = rate
+	}
+}
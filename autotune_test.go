@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestConcurrencyValueSet(t *testing.T) {
+	savedWorkers, savedAuto := maxNumCores, autoConcurrency
+	t.Cleanup(func() { maxNumCores, autoConcurrency = savedWorkers, savedAuto })
+
+	tests := []struct {
+		value   string
+		workers int
+		auto    bool
+		err     string
+	}{
+		{value: "1", workers: 1},
+		{value: "16", workers: 16},
+		{value: "auto", workers: autoMaxWorkers(), auto: true},
+		{value: "0", err: "could never copy anything"},
+		{value: "-3", err: "could never copy anything"},
+		{value: "many", err: "invalid syntax"},
+		{value: "", err: "invalid syntax"},
+	}
+	for _, test := range tests {
+		maxNumCores, autoConcurrency = 7, false
+		err := concurrencyValue{}.Set(test.value)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("-c %q: err = %v, want %q", test.value, err, test.err)
+			}
+			if maxNumCores != 7 {
+				t.Errorf("-c %q changed the worker count to %d", test.value, maxNumCores)
+			}
+			continue
+		}
+		if err != nil || maxNumCores != test.workers || autoConcurrency != test.auto {
+			t.Errorf("-c %q = %d workers, auto %v, err %v, want %d, auto %v", test.value, maxNumCores, autoConcurrency, err, test.workers, test.auto)
+		}
+	}
+}
+
+// TestCopyWorkerCounts runs copies with every kind of -c: the ones that
+// can't copy fail as usage errors right away instead of hanging.
+func TestCopyWorkerCounts(t *testing.T) {
+	tests := []struct {
+		workers string
+		code    int
+		log     string
+	}{
+		{workers: "0", code: exitUsage, log: "could never copy anything"},
+		{workers: "-1", code: exitUsage, log: "could never copy anything"},
+		{workers: "1", code: exitOK},
+		{workers: "auto", code: exitOK},
+		{workers: fmt.Sprint(maxCopyWorkers() * 10), code: exitOK, log: fmt.Sprintf("using '%d'", maxCopyWorkers())},
+	}
+	for _, test := range tests {
+		t.Run(test.workers, func(t *testing.T) {
+			r := runCopyTest(t, "flatten", "-c", test.workers)
+			if r.code != test.code {
+				t.Fatalf("exit code %d, want %d\n%s", r.code, test.code, r.log)
+			}
+			if !strings.Contains(r.log, test.log) {
+				t.Errorf("log doesn't say %q:\n%s", test.log, r.log)
+			}
+			if test.code == exitOK && r.summary.CopiedItems != 5 {
+				t.Errorf("copied %d, want 5", r.summary.CopiedItems)
+			}
+		})
+	}
+}
+
+// startProcs is the GOMAXPROCS the child started with.
+var startProcs int
+
+func init() {
+	c := copyCases["flatten"]
+	c.setup = func() { startProcs = runtime.GOMAXPROCS(0) }
+	c.check = func() error {
+		want := startProcs
+		if goMaxProcs > 0 {
+			want = goMaxProcs
+		}
+		if got := runtime.GOMAXPROCS(0); got != want {
+			return fmt.Errorf("GOMAXPROCS is %d after -c %d, -gomaxprocs %d, want %d", got, maxNumCores, goMaxProcs, want)
+		}
+		return nil
+	}
+	copyCases["procs"] = c
+}
+
+// TestCopyKeepsGOMAXPROCS checks that -c only sets the copy workers,
+// GOMAXPROCS is left alone unless -gomaxprocs sets it.
+func TestCopyKeepsGOMAXPROCS(t *testing.T) {
+	workers := fmt.Sprint(runtime.NumCPU() + 1)
+	for _, args := range [][]string{
+		{},
+		{"-c", "1"},
+		{"-c", workers},
+		{"-c", "auto"},
+		{"-c", workers, "-gomaxprocs", "1"},
+	} {
+		if r := runCopyTest(t, "procs", args...); r.code != exitOK {
+			t.Errorf("%q: exit code %d, want %d\n%s", args, r.code, exitOK, r.log)
+		}
+	}
+}
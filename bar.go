@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// barFlushInterval is how often counted progress is handed to the bar.
+const barFlushInterval = 100 * time.Millisecond
+
+// batchedBar counts progress with an atomic and hands it to the bar from a
+// single goroutine. The bar takes a lock and may redraw on every Add, which
+// copy workers finishing thousands of small files a second contend on.
+type batchedBar struct {
+	bar     *progressbar.ProgressBar
+	max     int64
+	pending atomic.Int64
+	counted atomic.Int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newBatchedBar(bar *progressbar.ProgressBar, max int64) *batchedBar {
+	b := &batchedBar{bar: bar, max: max, stop: make(chan struct{}), done: make(chan struct{})}
+	go b.run()
+	return b
+}
+
+func (b *batchedBar) add(n int) {
+	b.pending.Add(int64(n))
+	b.counted.Add(int64(n))
+}
+
+func (b *batchedBar) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(barFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			b.flush()
+			return
+		case <-ticker.C:
+			b.flush()
+		}
+	}
+}
+
+func (b *batchedBar) flush() {
+	if n := b.pending.Swap(0); n > 0 {
+		barMu.Lock()
+		b.bar.Add64(n)
+		barMu.Unlock()
+	}
+}
+
+// close hands the bar what's left and stops flushing. If the run went
+// through every job, each file the scan found was counted exactly once
+// as copied, skipped or failed, unless the source changed since: that's
+// logged and the bar is completed either way.
+func (b *batchedBar) close(complete bool) {
+	close(b.stop)
+	<-b.done
+	if !complete {
+		return
+	}
+	if counted := b.counted.Load(); counted != b.max {
+		warnf("The scan found '%d' files but '%d' were copied, skipped or failed, the source changed during the run\n", b.max, counted)
+		barMu.Lock()
+		b.bar.ChangeMax64(counted)
+		barMu.Unlock()
+	}
+	barMu.Lock()
+	b.bar.Finish()
+	barMu.Unlock()
+}
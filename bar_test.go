@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+func TestBatchedBarCompletes(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int64
+		added    int
+		complete bool
+		finished bool
+	}{
+		{name: "every file", max: 5, added: 5, complete: true, finished: true},
+		{name: "source grew", max: 5, added: 7, complete: true, finished: true},
+		{name: "source shrank", max: 5, added: 3, complete: true, finished: true},
+		{name: "stopped early", max: 5, added: 3, complete: false, finished: false},
+	}
+	for _, test := range tests {
+		bar := discardProgressBar(test.max)
+		batched := newBatchedBar(bar, test.max)
+		for i := 0; i < test.added; i++ {
+			batched.add(1)
+		}
+		batched.close(test.complete)
+		if batched.counted.Load() != int64(test.added) {
+			t.Errorf("%s: counted %d, want %d", test.name, batched.counted.Load(), test.added)
+		}
+		if bar.IsFinished() != test.finished {
+			t.Errorf("%s: finished = %v, want %v", test.name, bar.IsFinished(), test.finished)
+		}
+	}
+}
+
+// copyBars are the bars the copy of a child drew, the last is its copy bar.
+var copyBars []*progressbar.ProgressBar
+
+func init() {
+	copyCases["bar"] = copyCase{
+		source: failingFS{
+			MapFS: fstest.MapFS{
+				"a/copied.txt": testFile("copied"),
+				"a/b_c.txt":    testFile("claims a_b_c.txt"),
+				"a_b/c.txt":    testFile("conflict"),
+				"a/failed.txt": testFile("failed"),
+				"a/vanished":   testFile("vanished"),
+				"b/copied.txt": testFile("copied"),
+			},
+			fail: map[string]bool{"a/failed.txt": true},
+		},
+		setup: func() {
+			newProgressBar = func(max int64, description ...string) *progressbar.ProgressBar {
+				bar := discardProgressBar(max, description...)
+				copyBars = append(copyBars, bar)
+				return bar
+			}
+		},
+		check: func() error {
+			if len(copyBars) == 0 {
+				return fmt.Errorf("the copy drew no bar")
+			}
+			bar := copyBars[len(copyBars)-1]
+			if !bar.IsFinished() || bar.GetMax64() != 6 {
+				return fmt.Errorf("the bar of 6 files ended with max %d, finished %v", bar.GetMax64(), bar.IsFinished())
+			}
+			return nil
+		},
+	}
+}
+
+// TestCopyBarReachesMax copies files that are copied, skipped and failed:
+// every one of them moves the bar, which completes without a warning.
+func TestCopyBarReachesMax(t *testing.T) {
+	r := runCopyTest(t, "bar", "-on-conflict", "skip")
+	if r.code != exitFailed {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitFailed, r.log)
+	}
+	if s := r.summary; s.CopiedItems != 4 || s.SkippedItems != 1 || s.FailedItems != 1 {
+		t.Errorf("copied/skipped/failed = %d/%d/%d, want 4/1/1", s.CopiedItems, s.SkippedItems, s.FailedItems)
+	}
+	if !r.summary.Accounting.Balanced {
+		t.Errorf("accounting = %+v, want balanced", r.summary.Accounting)
+	}
+	if strings.Contains(r.log, "the source changed during the run") {
+		t.Errorf("the bar warned of a changed source:\n%s", r.log)
+	}
+}
+
+// BenchmarkBar has copy workers finish one file each per op on a bar set
+// up like progressbar.Default, drawn nowhere: adding to it directly, under
+// barMu as before, or through a batchedBar.
+func BenchmarkBar(b *testing.B) {
+	newBar := func() *progressbar.ProgressBar {
+		return progressbar.NewOptions64(int64(b.N), progressbar.OptionSetWriter(io.Discard), progressbar.OptionThrottle(65*time.Millisecond),
+			progressbar.OptionShowCount(), progressbar.OptionShowIts(), progressbar.OptionFullWidth(), progressbar.OptionSetRenderBlankState(true))
+	}
+	b.Run("direct", func(b *testing.B) {
+		bar := newBar()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				barMu.Lock()
+				bar.Add64(1)
+				barMu.Unlock()
+			}
+		})
+	})
+	b.Run("batched", func(b *testing.B) {
+		batched := newBatchedBar(newBar(), int64(b.N))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				batched.add(1)
+			}
+		})
+		batched.close(true)
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+var (
+	bigFileThreshold = sizeValue(256 << 20)
+	bigFileInterval  = 5 * time.Second
+)
+
+// bigFileReader logs the progress of a single large file every
+// bigFileInterval, so an hour long copy doesn't look stuck.
+type bigFileReader struct {
+	r          io.Reader
+	name       string
+	size       int64
+	done       int64
+	startedAt  time.Time
+	lastReport time.Time
+}
+
+func newBigFileReader(r io.Reader, name string, size int64) io.Reader {
+	if bigFileThreshold <= 0 || size < int64(bigFileThreshold) {
+		return r
+	}
+	now := time.Now()
+	return &bigFileReader{r: r, name: name, size: size, startedAt: now, lastReport: now}
+}
+
+func (b *bigFileReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.done += int64(n)
+
+	if now := time.Now(); now.Sub(b.lastReport) >= bigFileInterval {
+		b.lastReport = now
+		rate := float64(b.done) / now.Sub(b.startedAt).Seconds()
+		infof("big-file %s %.0f%% (%s/%s) at %s/s\n",
+			b.name, float64(b.done)/float64(b.size)*100, formatBytes(b.done), formatBytes(b.size), formatBytes(int64(rate)))
+	}
+	return n, err
+}
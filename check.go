@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	checkManifest string
+	checkHash     bool
+	checkReport   string
+)
+
+var checkCommand = newCommand("check", "", "Compare an output directory with its manifest: files the manifest doesn't know, missing files,\n"+
+	"size and, with -hash, checksum mismatches. Every problem is written as a JSON line to -report.", outputFlags, logFlags, hashWorkerFlags)
+
+func init() {
+	fs := checkCommand.flags
+	fs.StringVar(&checkManifest, "manifest", "", "manifest written by a previous copy run")
+	fs.BoolVar(&checkHash, "hash", false, "also compare checksums, if the manifest has them")
+	fs.StringVar(&checkReport, "report", "-", "file the problems are written to, - for stdout")
+	checkCommand.run = runCheck
+}
+
+// checkProblem is one line of the check report.
+type checkProblem struct {
+	// Kind is untracked, missing, size, hash, link or error.
+	Kind string `json:"kind"`
+	// Path is the slash separated path relative to the output directory.
+	Path   string `json:"path"`
+	Source string `json:"source,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func runCheck(args []string) int {
+	m, outputDir, ok := loadManifestFlag(checkCommand, checkManifest)
+	if !ok {
+		return exitUsage
+	}
+	if hashWorkers < 1 {
+		fmt.Fprintln(os.Stderr, "flatten check: -hash-workers must be at least 1")
+		return exitUsage
+	}
+	if outputDir == "" {
+		outputDir = m.OutputDir
+	}
+
+	var out io.Writer = os.Stdout
+	if checkReport != "-" {
+		file, err := os.Create(checkReport)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "flatten check: %v\n", err)
+			return exitUsage
+		}
+		defer file.Close()
+		out = file
+	}
+	encoder := json.NewEncoder(out)
+
+	algorithm := ""
+	if checkHash {
+		algorithm = m.HashAlgorithm
+		if algorithm == "" {
+			warnf("The manifest %q has no hashes, only comparing sizes\n", checkManifest)
+		}
+	}
+
+	var problems []checkProblem
+	verifyEntries(m, outputDir, algorithm, func(entry manifestEntry, err error) {
+		if err != nil {
+			problems = append(problems, checkProblem{Kind: problemKind(err), Path: entry.Destination, Source: entry.Source, Detail: err.Error()})
+		}
+	})
+
+	untracked, err := untrackedFiles(m, outputDir)
+	if err != nil {
+		errorf("Could not read %q: %v\n", outputDir, err)
+		return exitFailed
+	}
+	for _, name := range untracked {
+		problems = append(problems, checkProblem{Kind: "untracked", Path: name})
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Path < problems[j].Path })
+	for _, problem := range problems {
+		if err := encoder.Encode(problem); err != nil {
+			errorf("Could not write report %q: %v\n", checkReport, err)
+			return exitFailed
+		}
+	}
+
+	infof("Checked: '%d' manifest entries, '%d' problems\n", len(m.Entries), len(problems))
+	if len(problems) > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+func problemKind(err error) string {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return "missing"
+	case errors.Is(err, errSizeMismatch):
+		return "size"
+	case errors.Is(err, errHashMismatch):
+		return "hash"
+	case errors.Is(err, errLinkMismatch):
+		return "link"
+	}
+	return "error"
+}
+
+// untrackedFiles lists the files in outputDir that no manifest entry
+// produced, leaving out the manifest itself, the output marker and the
+// empty directory markers.
+func untrackedFiles(m *manifest, outputDir string) ([]string, error) {
+	known := make(map[string]struct{}, len(m.Entries)+len(m.EmptyDirMarkers))
+	for _, entry := range m.Entries {
+		known[entry.Destination] = struct{}{}
+		if entry.Pack != "" {
+			known[entry.Pack] = struct{}{}
+		}
+	}
+	for _, marker := range m.EmptyDirMarkers {
+		known[marker] = struct{}{}
+	}
+	manifestPath, _ := filepath.Abs(checkManifest)
+
+	var untracked []string
+	err := filepath.WalkDir(outputDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if name == manifestPath || d.Name() == outputMarkerName {
+			return nil
+		}
+		rel, err := filepath.Rel(outputDir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := known[rel]; !ok {
+			untracked = append(untracked, rel)
+		}
+		return nil
+	})
+	return untracked, err
+}
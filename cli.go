@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// command is a single flatten subcommand with its own flag set.
+type command struct {
+	name        string
+	args        string
+	description string
+	hidden      bool
+	flags       *flag.FlagSet
+	run         func(args []string) int
+}
+
+// defaultCommand runs when no subcommand is given, so "flatten -x out"
+// keeps behaving like it did before subcommands existed.
+const defaultCommand = "copy"
+
+var commands []*command
+
+// Shared flags. They are registered on every command that needs them through
+// the flag groups below, so each one is only defined once.
+var (
+	outputDirectory string
+	maxNumCores     int
+	goMaxProcs      int
+	verbose         bool
+	logFilePath     string
+)
+
+type flagGroup func(fs *flag.FlagSet)
+
+func outputFlags(fs *flag.FlagSet) {
+	fs.StringVar(&outputDirectory, "x", "output", "output directory. For copy and plan a text/template expanded once per run, with\n"+
+		"Now and RunID, e.g. 'backups/{{.Now.Format \"2006-01-02_1504\"}}'")
+}
+
+// prepareOutputDirectory turns -x into a clean absolute path, so it can't
+// be escaped with ".." and every use of it (including leaving it out of the
+// walk) agrees on where it is.
+func prepareOutputDirectory() error {
+	if outputDirectory == "" {
+		return fmt.Errorf("-x must not be empty")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	workingDirectory = wd
+	if !filepath.IsAbs(outputDirectory) {
+		outputDirectory = filepath.Join(wd, outputDirectory)
+	}
+	outputDirectory = filepath.Clean(outputDirectory)
+	return nil
+}
+
+// workingDirectory is the source root, set by prepareOutputDirectory.
+var workingDirectory string
+
+// isOutputDirectory reports whether dir, relative to the working
+// directory, is the output directory, the literal root of -output-template
+// or one of the subdirectories copies were put in. Those are inside the
+// output directory and only reached when it's the working directory or one
+// of its parents. Nothing in a -src archive is.
+func isOutputDirectory(dir string) bool {
+	if sourceFS != nil {
+		return false
+	}
+	abs := filepath.Join(workingDirectory, dir)
+	if abs == outputDirectory {
+		return true
+	}
+	rel, err := filepath.Rel(outputDirectory, abs)
+	if err != nil || !filepath.IsLocal(rel) {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == outputTemplateRoot {
+		return true
+	}
+	_, created := createdOutputDirs.Load(rel)
+	return created
+}
+
+func concurrencyFlags(fs *flag.FlagSet) {
+	maxNumCores = runtime.NumCPU()
+	fs.Var(concurrencyValue{}, "c", "number of copy workers, or auto to adapt it to the observed throughput")
+	fs.IntVar(&goMaxProcs, "gomaxprocs", 0, "set GOMAXPROCS, the threads running Go code at once. 0 leaves the runtime's default,\n"+
+		"-c is the number of copy workers either way")
+	fs.IntVar(&queueSize, "queue-size", defaultQueueSize, "number of walked files waiting for a copy worker, beyond that the walk waits")
+	fs.IntVar(&smallBatchSize, "small-batch", smallBatchSize, "copy up to this many small files of a directory as one job, 1 copies every file\n"+
+		"as its own job")
+	fs.BoolVar(&fairSchedule, "fair", false, "hand files to the copy workers round-robin across directories, so a huge directory\n"+
+		"doesn't hold every worker. The walk doesn't wait for the workers then, walked files are kept in memory")
+	fs.Var(&smallFileSize, "small-file-size", "files smaller than this are batched, see -small-batch")
+	lowPriorityFlag(fs)
+}
+
+func logFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&verbose, "v", false, "verbose logging")
+	fs.StringVar(&logFilePath, "log-file", "", "also append log output to the provided file")
+	fs.Var(logTimestamps, "log-timestamps", "what every log line starts with: none, time, datetime or rfc3339")
+	fs.Var(colorMode, "color", "color errors and the summary on stderr: auto (only on a terminal without NO_COLOR), always, never")
+}
+
+func newCommand(name, args, description string, groups ...flagGroup) *command {
+	cmd := &command{
+		name:        name,
+		args:        args,
+		description: description,
+		flags:       flag.NewFlagSet(name, flag.ContinueOnError),
+	}
+	for _, group := range groups {
+		group(cmd.flags)
+	}
+	configFlags(cmd.flags)
+	cmd.flags.Usage = func() {
+		out := cmd.flags.Output()
+		fmt.Fprintf(out, "usage: %s\n\n%s\n\nflags:\n", strings.TrimSpace("flatten "+cmd.name+" [flags] "+cmd.args), cmd.description)
+		cmd.flags.PrintDefaults()
+	}
+	return cmd
+}
+
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printUsage(out io.Writer) {
+	fmt.Fprintf(out, "usage: flatten [command] [flags]\n\ncommands:\n")
+	for _, cmd := range commands {
+		if cmd.hidden {
+			continue
+		}
+		fmt.Fprintf(out, "  %-10s %s\n", cmd.name, firstLine(cmd.description))
+	}
+	fmt.Fprintf(out, "\nwithout a command, %q is assumed. Run \"flatten <command> -h\" for the flags of a command.\n", defaultCommand)
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// dispatch picks the subcommand from args, parses its flags and runs it,
+// returning the process exit code.
+func dispatch(args []string) int {
+	name := defaultCommand
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+
+	if name == "help" {
+		if len(args) > 0 {
+			if cmd := lookupCommand(args[0]); cmd != nil {
+				cmd.flags.SetOutput(os.Stdout)
+				cmd.flags.Usage()
+				return exitOK
+			}
+		}
+		printUsage(os.Stdout)
+		return exitOK
+	}
+
+	cmd := lookupCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage(os.Stderr)
+		return exitUsage
+	}
+
+	args, err := parseFlags(cmd.flags, args)
+	if errors.Is(err, flag.ErrHelp) {
+		cmd.flags.SetOutput(os.Stdout)
+		cmd.flags.Usage()
+		return exitOK
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "flatten %s: %v\nRun \"flatten help %s\" for its flags.\n", cmd.name, err, cmd.name)
+		return exitUsage
+	}
+
+	if configPath != "" {
+		if err := applyConfig(cmd, configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "flatten %s: %v\n", cmd.name, err)
+			return exitUsage
+		}
+	}
+
+	if cmd.flags.Lookup("x") != nil {
+		if cmd.flags.Lookup("run-id") != nil {
+			if err := expandOutputDirectory(); err != nil {
+				fmt.Fprintf(os.Stderr, "flatten %s: %v\n", cmd.name, err)
+				return exitUsage
+			}
+		}
+		if err := prepareOutputDirectory(); err != nil {
+			fmt.Fprintf(os.Stderr, "flatten %s: %v\n", cmd.name, err)
+			return exitUsage
+		}
+	}
+
+	closeLog, err := setupLogging()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	defer closeLog()
+
+	return cmd.run(args)
+}
+
+// parseFlags parses args into fs and returns the positional arguments.
+// Flags may follow them, up to a "--", after which everything is
+// positional. Unknown flags get the closest registered one suggested.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	// the flag package's own message and usage dump are replaced below
+	fs.SetOutput(io.Discard)
+	defer fs.SetOutput(nil)
+
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			if name, unknown := strings.CutPrefix(err.Error(), "flag provided but not defined: -"); unknown {
+				err = fmt.Errorf("unknown flag -%s", name)
+				if suggestion := suggestFlag(fs, name); suggestion != "" {
+					err = fmt.Errorf("%w, did you mean -%s?", err, suggestion)
+				}
+			}
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// suggestFlag is the registered flag closest to the unknown name: one it's
+// a prefix of, or the one within a small edit distance. "" if none is.
+func suggestFlag(fs *flag.FlagSet, name string) string {
+	best, bestDistance := "", len(name)/3+2
+	fs.VisitAll(func(f *flag.Flag) {
+		distance := editDistance(name, f.Name)
+		if strings.HasPrefix(f.Name, name) {
+			// shorter completions first, but ahead of any misspelling
+			distance = len(f.Name) - len(name) - 1<<16
+		}
+		if distance < bestDistance {
+			best, bestDistance = f.Name, distance
+		}
+	})
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b in bytes.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// flagWasSet reports whether the flag was given explicitly on the command line.
+func flagWasSet(fs *flag.FlagSet, name string) (set bool) {
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
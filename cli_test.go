@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"verbose", "verbose", 0},
+		{"verbsoe", "verbose", 2},
+		{"exclude", "exclde", 1},
+		{"kitten", "sitting", 3},
+		{"c", "xyz", 3},
+	}
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func testFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("output", "", "")
+	fs.String("out-format", "", "")
+	fs.Bool("verbose", false, "")
+	fs.String("exclude", "", "")
+	fs.String("exclude-re", "", "")
+	fs.Int("c", 1, "")
+	return fs
+}
+
+func TestSuggestFlag(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"verbos", "verbose"},
+		{"o", "output"},
+		{"out-f", "out-format"},
+		{"exclud", "exclude"},
+		{"vrebose", "verbose"},
+		{"exclude-ref", "exclude-re"},
+		{"ouptut", "output"},
+		{"xyz", ""},
+		{"completely-unrelated", ""},
+	}
+	for _, test := range tests {
+		if got := suggestFlag(testFlagSet(), test.name); got != test.want {
+			t.Errorf("suggestFlag(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		args       []string
+		positional []string
+		err        string
+	}{
+		{args: []string{"-verbose", "a", "b"}, positional: []string{"a", "b"}},
+		{args: []string{"a", "-verbose", "b"}, positional: []string{"a", "b"}},
+		{args: []string{"a", "--", "-verbose"}, positional: []string{"a", "-verbose"}},
+		{args: []string{}, positional: nil},
+		{args: []string{"-verbos"}, err: "unknown flag -verbos, did you mean -verbose?"},
+		{args: []string{"a", "-xyz"}, err: "unknown flag -xyz"},
+		{args: []string{"-c", "many"}, err: `invalid value "many" for flag -c: parse error`},
+	}
+	for _, test := range tests {
+		positional, err := parseFlags(testFlagSet(), test.args)
+		switch {
+		case test.err != "":
+			if err == nil || err.Error() != test.err {
+				t.Errorf("parseFlags(%q) = %q, %v, want error %q", test.args, positional, err, test.err)
+			}
+		case err != nil || !reflect.DeepEqual(positional, test.positional):
+			t.Errorf("parseFlags(%q) = %q, %v, want %q", test.args, positional, err, test.positional)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import "time"
+
+// clock is where a run reads the time for -time, the elapsed time of the
+// summary, the default -run-id and the Now of a templated -x, so they can
+// be driven by a fixed clock.
+type clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                  { return time.Now() }
+func (systemClock) Since(t time.Time) time.Duration { return time.Since(t) }
+
+var runClock clock = systemClock{}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+var colorMode = newChoiceValue("auto", "auto", "always", "never")
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+)
+
+// levelColors maps the level tag of a log line to its color.
+var levelColors = []struct {
+	tag   []byte
+	color string
+}{
+	{[]byte("[ERROR]"), ansiRed},
+	{[]byte("[WARN]"), ansiYellow},
+	{[]byte("[SUMMARY]"), ansiBold},
+}
+
+// useColor reports whether log lines on stderr get colored: with -color
+// auto only on a terminal, and never if NO_COLOR is set.
+func useColor() bool {
+	switch colorMode.value {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return stderrIsTerminal()
+}
+
+// colorWriter colors whole log entries by their level tag. The log package
+// writes every entry with a single Write, so an entry is never split.
+type colorWriter struct {
+	w io.Writer
+}
+
+func (c colorWriter) Write(p []byte) (int, error) {
+	for _, level := range levelColors {
+		if !bytes.Contains(p, level.tag) {
+			continue
+		}
+		line := bytes.TrimSuffix(p, []byte("\n"))
+		colored := make([]byte, 0, len(p)+len(level.color)+len(ansiReset))
+		colored = append(colored, level.color...)
+		colored = append(colored, line...)
+		colored = append(colored, ansiReset...)
+		colored = append(colored, p[len(line):]...)
+		if _, err := c.w.Write(colored); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return c.w.Write(p)
+}
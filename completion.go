@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The completion scripts are generated from the registered commands and
+// their flag sets, so new flags show up without touching this file. Flags
+// whose value implements choiceFlag complete their allowed values.
+
+var completionCommand = newCommand("completion", "bash|zsh|fish|powershell",
+	"Print a shell completion script, for example:\n"+
+		"  source <(flatten completion bash)")
+
+func init() {
+	completionCommand.hidden = true
+	completionCommand.run = runCompletion
+}
+
+// choiceFlag is implemented by flag values restricted to a fixed set.
+type choiceFlag interface {
+	flag.Value
+	choices() []string
+}
+
+// choiceValue is a string flag that only accepts one of its choices.
+type choiceValue struct {
+	value   string
+	allowed []string
+}
+
+func newChoiceValue(def string, allowed ...string) *choiceValue {
+	return &choiceValue{value: def, allowed: allowed}
+}
+
+func (c *choiceValue) String() string {
+	if c == nil {
+		return ""
+	}
+	return c.value
+}
+
+func (c *choiceValue) Set(s string) error {
+	for _, allowed := range c.allowed {
+		if s == allowed {
+			c.value = s
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(c.allowed, ", "))
+}
+
+func (c *choiceValue) Get() any { return c.value }
+
+func (c *choiceValue) choices() []string { return c.allowed }
+
+type completionFlag struct {
+	name    string
+	usage   string
+	isBool  bool
+	choices []string
+}
+
+type completionCommandInfo struct {
+	name        string
+	description string
+	flags       []completionFlag
+}
+
+func completionInfo() []completionCommandInfo {
+	var infos []completionCommandInfo
+	for _, cmd := range commands {
+		if cmd.hidden {
+			continue
+		}
+		info := completionCommandInfo{name: cmd.name, description: firstLine(cmd.description)}
+		cmd.flags.VisitAll(func(f *flag.Flag) {
+			cf := completionFlag{name: f.Name, usage: f.Usage}
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				cf.isBool = true
+			}
+			if c, ok := f.Value.(choiceFlag); ok {
+				cf.choices = c.choices()
+			}
+			info.flags = append(info.flags, cf)
+		})
+		infos = append(infos, info)
+	}
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].name < infos[j].name })
+	return infos
+}
+
+func runCompletion(args []string) int {
+	if len(args) != 1 {
+		completionCommand.flags.Usage()
+		return exitUsage
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	infos := completionInfo()
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(w, infos)
+	case "zsh":
+		fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit")
+		writeBashCompletion(w, infos)
+	case "fish":
+		writeFishCompletion(w, infos)
+	case "powershell":
+		writePowershellCompletion(w, infos)
+	default:
+		fmt.Fprintf(os.Stderr, "flatten completion: unsupported shell %q\n", args[0])
+		return exitUsage
+	}
+	return exitOK
+}
+
+func commandNames(infos []completionCommandInfo) []string {
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.name)
+	}
+	return names
+}
+
+func flagNames(info completionCommandInfo) string {
+	names := make([]string, 0, len(info.flags))
+	for _, f := range info.flags {
+		names = append(names, "-"+f.name)
+	}
+	return strings.Join(names, " ")
+}
+
+func writeBashCompletion(w io.Writer, infos []completionCommandInfo) {
+	names := strings.Join(commandNames(infos), " ")
+
+	fmt.Fprintf(w, `_flatten() {
+	local cur prev cmd=%s word
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+	for word in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+		case "$word" in
+		%s) cmd="$word"; break ;;
+		esac
+	done
+
+	case "$cmd $prev" in
+`, defaultCommand, strings.ReplaceAll(names, " ", "|"))
+
+	for _, info := range infos {
+		for _, f := range info.flags {
+			if len(f.choices) > 0 {
+				fmt.Fprintf(w, "\t%q) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n",
+					info.name+" -"+f.name, strings.Join(f.choices, " "))
+			}
+		}
+	}
+
+	fmt.Fprintf(w, `	esac
+
+	if [[ $COMP_CWORD -eq 1 && "$cur" != -* ]]; then
+		COMPREPLY=($(compgen -W %q -- "$cur"))
+		return
+	fi
+
+	case "$cmd" in
+`, names)
+
+	for _, info := range infos {
+		fmt.Fprintf(w, "\t%s) [[ \"$cur\" == -* ]] && COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", info.name, flagNames(info))
+	}
+
+	fmt.Fprintf(w, `	esac
+}
+complete -o default -F _flatten flatten
+`)
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), "'", `\'`) + "'"
+}
+
+func writeFishCompletion(w io.Writer, infos []completionCommandInfo) {
+	names := strings.Join(commandNames(infos), " ")
+
+	fmt.Fprintf(w, "complete -c flatten -f\n")
+	for _, info := range infos {
+		fmt.Fprintf(w, "complete -c flatten -n '__fish_use_subcommand' -a %s -d %s\n", info.name, fishQuote(info.description))
+	}
+
+	for _, info := range infos {
+		condition := fmt.Sprintf("__fish_seen_subcommand_from %s", info.name)
+		if info.name == defaultCommand {
+			condition = fmt.Sprintf("not __fish_seen_subcommand_from %s", names)
+		}
+		for _, f := range info.flags {
+			line := fmt.Sprintf("complete -c flatten -n %s -o %s -d %s", fishQuote(condition), f.name, fishQuote(f.usage))
+			switch {
+			case len(f.choices) > 0:
+				line += fmt.Sprintf(" -x -a %s", fishQuote(strings.Join(f.choices, " ")))
+			case !f.isBool:
+				line += " -r -F"
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+func powershellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func writePowershellCompletion(w io.Writer, infos []completionCommandInfo) {
+	fmt.Fprintf(w, "$flattenCommands = @{\n")
+	for _, info := range infos {
+		fmt.Fprintf(w, "    %s = @{\n", powershellQuote(info.name))
+		for _, f := range info.flags {
+			choices := make([]string, 0, len(f.choices))
+			for _, choice := range f.choices {
+				choices = append(choices, powershellQuote(choice))
+			}
+			fmt.Fprintf(w, "        %s = @(%s)\n", powershellQuote("-"+f.name), strings.Join(choices, ", "))
+		}
+		fmt.Fprintf(w, "    }\n")
+	}
+	fmt.Fprintf(w, `}
+
+Register-ArgumentCompleter -Native -CommandName flatten -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+
+    $words = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })
+    $command = %s
+    foreach ($word in $words[1..($words.Count - 1)]) {
+        if ($flattenCommands.ContainsKey($word)) { $command = $word; break }
+    }
+
+    $previous = if ($wordToComplete) { $words[-2] } else { $words[-1] }
+    $flags = $flattenCommands[$command]
+    if ($flags.ContainsKey($previous) -and $flags[$previous].Count -gt 0) {
+        $candidates = $flags[$previous]
+    } elseif ($wordToComplete -like '-*') {
+        $candidates = $flags.Keys
+    } elseif ($words.Count -le 2) {
+        $candidates = $flattenCommands.Keys
+    } else {
+        return
+    }
+
+    $candidates | Where-Object { $_ -like "$wordToComplete*" } | Sort-Object | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`, powershellQuote(defaultCommand))
+}
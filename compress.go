@@ -0,0 +1,119 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	compressAlgorithm = newChoiceValue("none", "none", "gzip", "zstd")
+	compressLevel     int
+	compressAll       bool
+)
+
+func compressionFlags(fs *flag.FlagSet) {
+	fs.Var(compressAlgorithm, "compress", "store every copied file compressed: none, gzip, zstd")
+	fs.IntVar(&compressLevel, "compress-level", 0, "compression level, gzip 1-9 or zstd 1-22, 0 picks the algorithm's default")
+	fs.BoolVar(&compressAll, "compress-all", false, "also compress files whose extension says they are already compressed")
+	fs.Var(&encryptTo, "encrypt", "encrypt every copied file after compressing it, age:RECIPIENT with the age tool or gpg:KEYID\n"+
+		"with gpg, appending .age or .gpg to its name. restore and verify decrypt them, see their -identity")
+}
+
+// alreadyCompressed lists extensions of formats that don't get smaller when
+// compressed again, -compress skips them unless -compress-all is given.
+var alreadyCompressed = map[string]bool{
+	".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".lz4": true, ".br": true,
+	".zip": true, ".7z": true, ".rar": true, ".jar": true, ".apk": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".epub": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true,
+	".mp4": true, ".m4v": true, ".mkv": true, ".mov": true, ".avi": true, ".webm": true,
+}
+
+func validateCompression() error {
+	switch compressAlgorithm.value {
+	case "gzip":
+		if compressLevel < 0 || compressLevel > gzip.BestCompression {
+			return fmt.Errorf("-compress-level for gzip must be between 1 and %d", gzip.BestCompression)
+		}
+	case "zstd":
+		if compressLevel < 0 || compressLevel > 22 {
+			return fmt.Errorf("-compress-level for zstd must be between 1 and 22")
+		}
+	default:
+		if compressLevel != 0 || compressAll {
+			return fmt.Errorf("-compress-level and -compress-all need -compress")
+		}
+	}
+	return nil
+}
+
+// compressionFor picks the algorithm a file is stored with, "" for none.
+func compressionFor(fileName string) string {
+	algorithm := compressAlgorithm.value
+	if algorithm == "none" {
+		return ""
+	}
+	if !compressAll && alreadyCompressed[strings.ToLower(filepath.Ext(fileName))] {
+		return ""
+	}
+	return algorithm
+}
+
+func compressionExtension(algorithm string) string {
+	switch algorithm {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	}
+	return ""
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newCompressor wraps w so that closing the result flushes the compressed
+// stream, but doesn't close w itself.
+func newCompressor(algorithm string, w io.Writer) (io.WriteCloser, error) {
+	switch algorithm {
+	case "gzip":
+		level := gzip.DefaultCompression
+		if compressLevel != 0 {
+			level = compressLevel
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		if compressLevel != 0 {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compressLevel)), zstd.WithEncoderConcurrency(1))
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// newDecompressor reverses newCompressor for restore.
+func newDecompressor(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case "":
+		return io.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Job configuration files are a small TOML subset: top level keys apply to
+// every command that defines a flag with that name, keys inside a [command]
+// table only to that command. Values are strings, numbers, booleans or
+// arrays of those; arrays are only accepted by repeatable flags.
+//
+// Flags given explicitly on the command line always win. For repeatable
+// flags the command line replaces the configured list instead of extending
+// it, so a job can be narrowed down without editing the file.
+
+var configPath string
+
+func configFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configPath, "config", "", "read flag values from a TOML job file, explicit flags take precedence")
+}
+
+// repeatableFlag is implemented by flag values that accumulate every Set call.
+type repeatableFlag interface {
+	flag.Value
+	repeatable()
+}
+
+// flagsWithoutConfigKey can't be set from a job file.
+var flagsWithoutConfigKey = map[string]bool{"config": true, "version": true}
+
+type configValue struct {
+	items []string
+	array bool
+	line  int
+}
+
+// configTables maps a table name ("" for the top level) to its keys.
+type configTables map[string]map[string]configValue
+
+func parseConfig(r io.Reader, name string) (configTables, error) {
+	tables := configTables{"": {}}
+	table := ""
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: malformed table header %q", name, lineNo, line)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := tables[table]; !ok {
+				tables[table] = map[string]configValue{}
+			}
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", name, lineNo)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		raw = strings.TrimSpace(raw)
+		start := lineNo
+
+		// arrays may span several lines
+		for strings.HasPrefix(raw, "[") && !configArrayClosed(raw) && scanner.Scan() {
+			lineNo++
+			raw += " " + strings.TrimSpace(stripConfigComment(scanner.Text()))
+		}
+
+		value, err := parseConfigValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", name, start, key, err)
+		}
+		value.line = start
+
+		if _, dup := tables[table][key]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate key %q", name, start, key)
+		}
+		tables[table][key] = value
+	}
+	return tables, scanner.Err()
+}
+
+// stripConfigComment removes a trailing # comment that is not inside a string.
+func stripConfigComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func configArrayClosed(raw string) bool {
+	_, rest, err := parseConfigScalar(raw, true)
+	return err == nil && strings.TrimSpace(rest) == ""
+}
+
+func parseConfigValue(raw string) (configValue, error) {
+	items, rest, err := parseConfigScalar(raw, true)
+	if err != nil {
+		return configValue{}, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return configValue{}, fmt.Errorf("unexpected %q after value", strings.TrimSpace(rest))
+	}
+	return configValue{items: items, array: strings.HasPrefix(raw, "[")}, nil
+}
+
+// parseConfigScalar parses one value from the start of raw and returns it
+// together with the unparsed remainder.
+func parseConfigScalar(raw string, allowArray bool) ([]string, string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+
+	switch raw[0] {
+	case '[':
+		if !allowArray {
+			return nil, "", fmt.Errorf("nested arrays are not supported")
+		}
+		var items []string
+		rest := strings.TrimSpace(raw[1:])
+		for {
+			if strings.HasPrefix(rest, "]") {
+				return items, rest[1:], nil
+			}
+			item, after, err := parseConfigScalar(rest, false)
+			if err != nil {
+				return nil, "", err
+			}
+			items = append(items, item...)
+			rest = strings.TrimSpace(after)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return nil, "", fmt.Errorf("unterminated array")
+			}
+		}
+	case '"':
+		for i := 1; i < len(raw); i++ {
+			switch raw[i] {
+			case '\\':
+				i++
+			case '"':
+				s, err := strconv.Unquote(raw[:i+1])
+				if err != nil {
+					return nil, "", fmt.Errorf("invalid string %s: %w", raw[:i+1], err)
+				}
+				return []string{s}, raw[i+1:], nil
+			}
+		}
+		return nil, "", fmt.Errorf("unterminated string")
+	case '\'':
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return []string{raw[1 : end+1]}, raw[end+2:], nil
+	}
+
+	end := strings.IndexAny(raw, ",] \t")
+	if end < 0 {
+		end = len(raw)
+	}
+	word := raw[:end]
+	if word != "true" && word != "false" {
+		if _, err := strconv.ParseFloat(strings.ReplaceAll(word, "_", ""), 64); err != nil {
+			return nil, "", fmt.Errorf("invalid value %q, strings must be quoted", word)
+		}
+		word = strings.ReplaceAll(word, "_", "")
+	}
+	return []string{word}, raw[end:], nil
+}
+
+// applyConfig sets every flag of cmd that the job file mentions and that
+// was not already given on the command line.
+func applyConfig(cmd *command, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tables, err := parseConfig(file, name)
+	if err != nil {
+		return err
+	}
+
+	var unknown []string
+	for table, keys := range tables {
+		if table != "" && lookupCommand(table) == nil {
+			unknown = append(unknown, fmt.Sprintf("[%s]", table))
+			continue
+		}
+		for key, value := range keys {
+			if !configKeyKnown(table, key) {
+				if table != "" {
+					key = table + "." + key
+				}
+				unknown = append(unknown, fmt.Sprintf("%s (line %d)", key, value.line))
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown keys: %s", name, strings.Join(unknown, ", "))
+	}
+
+	explicit := map[string]bool{}
+	cmd.flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	// command tables override the top level
+	merged := map[string]configValue{}
+	for key, value := range tables[""] {
+		merged[key] = value
+	}
+	for key, value := range tables[cmd.name] {
+		merged[key] = value
+	}
+
+	for key, value := range merged {
+		f := cmd.flags.Lookup(key)
+		if f == nil || explicit[key] {
+			continue
+		}
+		if _, ok := f.Value.(repeatableFlag); !ok && (value.array || len(value.items) != 1) {
+			return fmt.Errorf("%s:%d: %s takes a single value", name, value.line, key)
+		}
+		for _, item := range value.items {
+			if err := cmd.flags.Set(key, item); err != nil {
+				return fmt.Errorf("%s:%d: %s: %w", name, value.line, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configKeyKnown reports whether key names a flag of the command table, or
+// of any command for top level keys.
+func configKeyKnown(table, key string) bool {
+	if flagsWithoutConfigKey[key] {
+		return false
+	}
+	for _, cmd := range commands {
+		if (table == "" || table == cmd.name) && cmd.flags.Lookup(key) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+var configInitCommand = newCommand("config-init", "", "Print a commented job file template with the current defaults of every command.")
+
+func init() {
+	configInitCommand.run = runConfigInit
+}
+
+func runConfigInit(args []string) int {
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	writeConfigTemplate(w)
+	return exitOK
+}
+
+// writeConfigTemplate writes every flag of every command commented out,
+// so removing the "# " of a key line sets it.
+func writeConfigTemplate(w io.Writer) {
+	fmt.Fprintf(w, "# flatten job file, use with: flatten <command> -config FILE\n")
+	fmt.Fprintf(w, "# Keys at the top level apply to every command defining that flag,\n")
+	fmt.Fprintf(w, "# keys in a [command] table only to that command. Uncomment to change a default.\n")
+
+	for _, cmd := range commands {
+		if cmd.hidden || cmd == configInitCommand {
+			continue
+		}
+		fmt.Fprintf(w, "\n[%s]\n", cmd.name)
+		cmd.flags.VisitAll(func(f *flag.Flag) {
+			if flagsWithoutConfigKey[f.Name] {
+				return
+			}
+			fmt.Fprintf(w, "# %s\n# %s = %s\n", strings.ReplaceAll(f.Usage, "\n", "\n# "), f.Name, configLiteral(f))
+		})
+	}
+}
+
+func configLiteral(f *flag.Flag) string {
+	if _, ok := f.Value.(repeatableFlag); ok {
+		if f.DefValue == "" {
+			return "[]"
+		}
+		return fmt.Sprintf("[%s]", strconv.Quote(f.DefValue))
+	}
+	if size, ok := f.Value.(*sizeValue); ok {
+		// in bytes, the default reads 256.0 MiB which isn't a number
+		return strconv.FormatInt(int64(*size), 10)
+	}
+	if getter, ok := f.Value.(flag.Getter); ok {
+		switch getter.Get().(type) {
+		case bool, int, int64, uint, uint64, float64:
+			return f.DefValue
+		}
+	}
+	return strconv.Quote(f.DefValue)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestConfigTemplateRoundTrip uncomments every key of the config-init
+// template: the result has to parse and set every flag to its default.
+func TestConfigTemplateRoundTrip(t *testing.T) {
+	var template strings.Builder
+	writeConfigTemplate(&template)
+
+	var uncommented strings.Builder
+	table := ""
+	keys := 0
+	for _, line := range strings.Split(template.String(), "\n") {
+		if strings.HasPrefix(line, "[") {
+			table = strings.Trim(line, "[]")
+		}
+		if key, _, ok := strings.Cut(strings.TrimPrefix(line, "# "), " = "); ok && strings.HasPrefix(line, "# ") {
+			if cmd := lookupCommand(table); cmd != nil && cmd.flags.Lookup(key) != nil {
+				line = strings.TrimPrefix(line, "# ")
+				keys++
+			}
+		}
+		uncommented.WriteString(line + "\n")
+	}
+	if keys == 0 {
+		t.Fatal("the template has no keys")
+	}
+
+	tables, err := parseConfig(strings.NewReader(uncommented.String()), "job.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range tables {
+		if name == "" {
+			continue
+		}
+		cmd := lookupCommand(name)
+		for key, value := range values {
+			f := cmd.flags.Lookup(key)
+			for _, item := range value.items {
+				if err := f.Value.Set(item); err != nil {
+					t.Errorf("[%s] %s = %q: %v", name, key, item, err)
+				}
+			}
+			if _, ok := f.Value.(repeatableFlag); !ok && f.Value.String() != f.DefValue {
+				t.Errorf("[%s] %s = %q reads back as %q", name, key, f.DefValue, f.Value.String())
+			}
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]map[string][]string
+		err   string
+	}{
+		{
+			name:  "top level and tables",
+			input: "v = true\n[copy]\nx = \"out\" # the output\nc = 4\n",
+			want:  map[string]map[string][]string{"": {"v": {"true"}}, "copy": {"x": {"out"}, "c": {"4"}}},
+		},
+		{
+			name:  "multi-line array",
+			input: "exclude = [\n  '*.tmp',\n  \"*.bak\",\n]\n",
+			want:  map[string]map[string][]string{"": {"exclude": {"*.tmp", "*.bak"}}},
+		},
+		{name: "unquoted string", input: "x = out\n", err: "strings must be quoted"},
+		{name: "humanized size", input: "archive-buffer = 256.0 MiB\n", err: `unexpected "MiB" after value`},
+		{name: "no value", input: "# a comment\nmulti\nline\n", err: "job.toml:2: expected key = value"},
+		{name: "duplicate", input: "c = 1\nc = 2\n", err: "duplicate key"},
+	}
+	for _, test := range tests {
+		tables, err := parseConfig(strings.NewReader(test.input), "job.toml")
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: err = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for table, keys := range test.want {
+			for key, items := range keys {
+				if got := tables[table][key].items; strings.Join(got, "\x00") != strings.Join(items, "\x00") {
+					t.Errorf("%s: [%s] %s = %q, want %q", test.name, table, key, got, items)
+				}
+			}
+		}
+	}
+}
+
+// TestApplyConfig applies job files to a copy command with a few of its
+// flags, after the command line args were parsed. want are the flag
+// values afterwards.
+func TestApplyConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		want   map[string]string
+		err    string
+	}{
+		{
+			name:   "file sets unset flags",
+			config: "x = \"out\"\nc = 8\nexclude-re = ['\\.tmp$', '\\.bak$']\n",
+			want:   map[string]string{"x": "out", "c": "8", "exclude-re": `\.tmp$ \.bak$`},
+		},
+		{
+			name:   "explicit flag wins",
+			config: "x = \"out\"\nc = 8\n",
+			args:   []string{"-c", "2"},
+			want:   map[string]string{"x": "out", "c": "2"},
+		},
+		{
+			name:   "command table overrides top level",
+			config: "x = \"top\"\nc = 3\n[copy]\nx = \"copy\"\n[restore]\nc = 5\n",
+			want:   map[string]string{"x": "copy", "c": "3"},
+		},
+		{
+			name:   "command line replaces a configured list",
+			config: "exclude-re = ['\\.tmp$', '\\.bak$']\n",
+			args:   []string{"-exclude-re", `\.log$`},
+			want:   map[string]string{"exclude-re": `\.log$`},
+		},
+		{
+			name:   "array for a single value",
+			config: "c = 1\nx = [\"a\", \"b\"]\n",
+			err:    "job.toml:2: x takes a single value",
+		},
+		{
+			name:   "unknown keys and tables",
+			config: "nope = 1\n[copy]\nx = \"out\"\nbogus = true\n[nosuch]\nc = 1\n",
+			err:    "job.toml: unknown keys: [nosuch], copy.bogus (line 4), nope (line 1)",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "job.toml")
+			if err := os.WriteFile(name, []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var excludes patternList
+			fs := flag.NewFlagSet("copy", flag.ContinueOnError)
+			fs.String("x", "", "")
+			fs.Int("c", 1, "")
+			fs.Var(&excludes, "exclude-re", "")
+			if _, err := parseFlags(fs, test.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := applyConfig(&command{name: "copy", flags: fs}, name)
+			if test.err != "" {
+				if err == nil || strings.ReplaceAll(err.Error(), name, "job.toml") != test.err {
+					t.Fatalf("err = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range test.want {
+				if got := fs.Lookup(key).Value.String(); got != want {
+					t.Errorf("-%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
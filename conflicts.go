@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// conflictKind is what -conflict-compare found about a source whose
+// destination was taken.
+type conflictKind string
+
+const (
+	conflictIdentical conflictKind = "identical_duplicate"
+	conflictDifferent conflictKind = "conflicting_content"
+	// conflictUnknown is a destination that can't be compared: packed,
+	// compressed, a link, or not compared at all.
+	conflictUnknown conflictKind = "not_compared"
+)
+
+var conflictKindLabels = map[conflictKind]string{
+	conflictIdentical: "identical duplicate",
+	conflictDifferent: "conflicting content",
+	conflictUnknown:   "not compared",
+}
+
+var (
+	conflictCompare bool
+	onConflict      = conflictPolicy{identical: "error", different: "error"}
+
+	identicalDuplicates atomic.Uint64
+	conflictingContent  atomic.Uint64
+)
+
+// conflictPolicy is -on-conflict: what happens to a source whose
+// destination is taken, for identical and for different content. A
+// conflict that couldn't be compared counts as different.
+type conflictPolicy struct {
+	identical string
+	different string
+}
+
+func (p *conflictPolicy) String() string {
+	if p.identical == p.different {
+		return p.identical
+	}
+	return p.identical + "-identical," + p.different + "-different"
+}
+
+// Set takes an action for both kinds, "skip" or "error", or a comma
+// separated list of ACTION-identical and ACTION-different.
+func (p *conflictPolicy) Set(s string) error {
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(rule)
+		action, kind, _ := strings.Cut(rule, "-")
+		if action != "skip" && action != "error" {
+			return fmt.Errorf("unknown action in %q, must be skip or error", rule)
+		}
+		switch kind {
+		case "":
+			p.identical, p.different = action, action
+		case "identical":
+			p.identical = action
+		case "different":
+			p.different = action
+		default:
+			return fmt.Errorf("unknown conflict %q, must be identical or different", kind)
+		}
+	}
+	return nil
+}
+
+// choices are the policies completion offers, any other list of rules
+// is taken too.
+func (p *conflictPolicy) choices() []string {
+	return []string{"skip", "error", "skip-identical,error-different", "error-identical,skip-different"}
+}
+
+func (p *conflictPolicy) action(kind conflictKind) string {
+	if kind == conflictIdentical {
+		return p.identical
+	}
+	return p.different
+}
+
+// comparingConflicts reports whether taken destinations are compared to
+// the source, which -on-conflict needs when it tells the kinds apart.
+func comparingConflicts() bool {
+	return conflictCompare || onConflict.identical != onConflict.different
+}
+
+func isConflict(err error) bool {
+	return errors.Is(err, errDestinationTaken) || errors.Is(err, errDestinationExists)
+}
+
+// writingDestinations holds a channel per destination storeFile is still
+// writing, closed once it's done, so a conflict isn't compared to half a
+// file.
+var writingDestinations sync.Map
+
+// startWriting marks destName as being written until the returned
+// function is called. It's a no-op without conflict comparison.
+func startWriting(destName string) func() {
+	if !comparingConflicts() {
+		return func() {}
+	}
+	done := make(chan struct{})
+	key := collisionKey(destName)
+	writingDestinations.Store(key, done)
+	return func() {
+		writingDestinations.Delete(key)
+		close(done)
+	}
+}
+
+// compareConflict compares the source srcName with the file already at
+// destName in the output directory, by size and then content.
+func compareConflict(srcName, destName string) conflictKind {
+	if compressionFor(filepath.Base(srcName)) != "" || encryptTo.scheme != "" || isLinkPath(srcName) {
+		return conflictUnknown
+	}
+	if done, writing := writingDestinations.Load(collisionKey(destName)); writing {
+		<-done.(chan struct{})
+	}
+	destPath := filepath.Join(outputDirectory, filepath.FromSlash(destName))
+	destInfo, err := os.Lstat(destPath)
+	if err != nil || !destInfo.Mode().IsRegular() {
+		return conflictUnknown
+	}
+	srcInfo, err := statSource(srcName)
+	if err != nil {
+		return conflictUnknown
+	}
+	if srcInfo.Size() != destInfo.Size() {
+		return conflictDifferent
+	}
+	identical, err := sameContent(srcName, destPath)
+	if err != nil {
+		verbosef("Could not compare %q with %q: %v\n", srcName, destPath, err)
+		return conflictUnknown
+	}
+	if identical {
+		return conflictIdentical
+	}
+	return conflictDifferent
+}
+
+func sameContent(srcName, destPath string) (bool, error) {
+	src, err := openSource(srcName)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	dest, err := os.Open(destPath)
+	if err != nil {
+		return false, err
+	}
+	defer dest.Close()
+
+	a := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(a)
+	b := make([]byte, len(*a))
+	for {
+		n, errA := io.ReadFull(src, *a)
+		m, errB := io.ReadFull(dest, b)
+		if n != m || !bytes.Equal((*a)[:n], b[:m]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// resolveConflict decides about a source whose destination was taken. It
+// records the conflict in the manifest and reports whether the file is
+// skipped rather than failed.
+func resolveConflict(srcName, destName string) (conflictKind, bool) {
+	kind := conflictUnknown
+	if comparingConflicts() {
+		kind = compareConflict(srcName, destName)
+	}
+	switch kind {
+	case conflictIdentical:
+		identicalDuplicates.Add(1)
+	case conflictDifferent:
+		conflictingContent.Add(1)
+	}
+	action := onConflict.action(kind)
+	copyManifest.addConflict(manifestConflict{Source: filepath.ToSlash(srcName), Destination: destName, Kind: kind, Action: action})
+	return kind, action == "skip"
+}
+
+// logConflicts prints what -conflict-compare found.
+func logConflicts() {
+	identical, different := identicalDuplicates.Load(), conflictingContent.Load()
+	if identical == 0 && different == 0 {
+		return
+	}
+	summaryf("name collisions: '%d' %s (%s), '%d' %s (%s)\n",
+		identical, conflictKindLabels[conflictIdentical], onConflict.identical,
+		different, conflictKindLabels[conflictDifferent], onConflict.different)
+}
+
+// conflictSkipped resolves the conflict err of srcName, logging it, and
+// reports whether -on-conflict skips the file instead of failing it.
+func conflictSkipped(srcName, destName string, err error) bool {
+	kind, skip := resolveConflict(srcName, destName)
+	if kind != conflictUnknown {
+		verbosef("%s: %v, %s\n", srcName, err, conflictKindLabels[kind])
+	}
+	if skip {
+		infof("Skipping %q, %s of %q\n", srcName, conflictKindLabels[kind], destName)
+	}
+	return skip
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConflictPolicySet(t *testing.T) {
+	tests := []struct {
+		value                string
+		identical, different string
+		err                  string
+	}{
+		{value: "skip", identical: "skip", different: "skip"},
+		{value: "error", identical: "error", different: "error"},
+		{value: "skip-identical", identical: "skip", different: "error"},
+		{value: "skip-identical, error-different", identical: "skip", different: "error"},
+		{value: "error-identical,skip-different", identical: "error", different: "skip"},
+		{value: "skip,error-different", identical: "skip", different: "error"},
+		{value: "overwrite", err: "unknown action"},
+		{value: "skip-similar", err: "unknown conflict"},
+		{value: "", err: "unknown action"},
+	}
+	for _, test := range tests {
+		p := conflictPolicy{identical: "error", different: "error"}
+		err := p.Set(test.value)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Set(%q) = %v, want %q", test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil || p.identical != test.identical || p.different != test.different {
+			t.Errorf("Set(%q) = %+v, %v, want %s-identical,%s-different", test.value, p, err, test.identical, test.different)
+		}
+	}
+}
+
+// TestOnConflictCompletion checks that completion offers the -on-conflict
+// policies and that every one of them is taken.
+func TestOnConflictCompletion(t *testing.T) {
+	var offered []string
+	for _, info := range completionInfo() {
+		if info.name != "copy" {
+			continue
+		}
+		for _, f := range info.flags {
+			if f.name == "on-conflict" {
+				offered = f.choices
+			}
+		}
+	}
+	if len(offered) == 0 {
+		t.Fatal("completion offers no values for -on-conflict")
+	}
+	for _, choice := range offered {
+		var p conflictPolicy
+		if err := p.Set(choice); err != nil || p.String() != choice {
+			t.Errorf("the offered -on-conflict %q reads back as %q, %v", choice, p.String(), err)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	controlAddress  string
+	controlInterval = time.Second
+)
+
+const (
+	// controlBacklog is how many frames wait for a slow client, progress
+	// frames are dropped past it.
+	controlBacklog = 64
+	// controlWriteTimeout is how long a client may take to read a frame
+	// before it's disconnected.
+	controlWriteTimeout = 5 * time.Second
+)
+
+// controlProgress is the frame a -control client gets every
+// -control-interval. eta_seconds is null while unknown.
+type controlProgress struct {
+	Type         string   `json:"type"`
+	State        string   `json:"state"`
+	DirsScanned  uint64   `json:"dirs_scanned"`
+	FilesScanned uint64   `json:"files_scanned"`
+	FilesDone    uint64   `json:"files_done"`
+	FilesTotal   int64    `json:"files_total"`
+	BytesCopied  int64    `json:"bytes_copied"`
+	BytesTotal   int64    `json:"bytes_total"`
+	BytesPerSec  float64  `json:"bytes_per_second"`
+	ETASeconds   *float64 `json:"eta_seconds"`
+	Errors       uint64   `json:"errors"`
+}
+
+// controlMessage is every other frame: a state change, an error, the
+// summary at the end and the reply to a command.
+type controlMessage struct {
+	Type    string      `json:"type"`
+	State   string      `json:"state,omitempty"`
+	By      string      `json:"by,omitempty"`
+	At      *time.Time  `json:"at,omitempty"`
+	Command string      `json:"command,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Summary *runSummary `json:"summary,omitempty"`
+}
+
+// controlCommand is a line a client sends: pause, resume or cancel.
+type controlCommand struct {
+	Command string `json:"command"`
+}
+
+// controlServer is -control: every client gets line delimited JSON frames
+// and may send commands, which the copy workers honor between files. It's
+// an Events receiver for the errors and the summary. Its methods do nothing
+// on nil.
+type controlServer struct {
+	listener  net.Listener
+	startedAt time.Time
+
+	filesTotal, bytesTotal atomic.Int64
+	totalsKnown            atomic.Bool
+	dirsSeen, filesSeen    atomic.Uint64
+
+	mu      sync.Mutex
+	clients map[*controlClient]bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+var control *controlServer
+
+type controlClient struct {
+	conn   net.Conn
+	mu     sync.Mutex
+	out    chan []byte
+	closed bool
+}
+
+// startControl opens -control, if given, and returns the func closing it
+// once everything happened is sent.
+func startControl(startedAt time.Time) (func(), error) {
+	if controlAddress == "" {
+		return func() {}, nil
+	}
+	network, address, err := parseControlAddress(controlAddress)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		// a socket left behind by a killed run
+		if info, err := os.Lstat(address); err == nil && info.Mode()&fs.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("-control: %w", err)
+	}
+	control = &controlServer{
+		listener:  listener,
+		startedAt: startedAt,
+		clients:   map[*controlClient]bool{},
+		stop:      make(chan struct{}),
+	}
+	events.attach(control)
+	infof("Control socket listening on %s:%s\n", network, listener.Addr())
+	control.wg.Add(2)
+	go control.accept()
+	go control.tick()
+	return control.close, nil
+}
+
+// parseControlAddress takes unix:/path, tcp:host:port or host:port, a TCP
+// host must be a loopback address. A bare port listens on 127.0.0.1.
+func parseControlAddress(s string) (network, address string, err error) {
+	if path, ok := strings.CutPrefix(s, "unix:"); ok {
+		if path == "" {
+			return "", "", errors.New("-control unix: needs a socket path")
+		}
+		return "unix", path, nil
+	}
+	address = strings.TrimPrefix(s, "tcp:")
+	if !strings.Contains(address, ":") {
+		address = ":" + address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", "", fmt.Errorf("-control %q: %w", s, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", "", fmt.Errorf("-control only listens on loopback addresses, not %q", host)
+	}
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
+// setTotals gives the progress frames what the scan found.
+func (c *controlServer) setTotals(files uint, bytes int64) {
+	if c == nil {
+		return
+	}
+	c.filesTotal.Store(int64(files))
+	c.bytesTotal.Store(bytes)
+	c.totalsKnown.Store(true)
+}
+
+func (c *controlServer) accept() {
+	defer c.wg.Done()
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		client := &controlClient{conn: conn, out: make(chan []byte, controlBacklog)}
+		c.mu.Lock()
+		select {
+		case <-c.stop:
+			c.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		c.clients[client] = true
+		c.mu.Unlock()
+		verbosef("Control client connected from %s\n", conn.RemoteAddr())
+		c.wg.Add(1)
+		go c.write(client)
+		go c.read(client)
+		client.send(c.progress(), true)
+	}
+}
+
+func (c *controlServer) tick() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(controlInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.broadcast(c.progress(), true)
+		}
+	}
+}
+
+func (c *controlServer) progress() []byte {
+	frame := controlProgress{
+		Type:         "progress",
+		State:        runPause.state(),
+		DirsScanned:  c.dirsSeen.Load(),
+		FilesScanned: c.filesSeen.Load(),
+		FilesDone:    copiedItems.Load() + failedItems.Load() + skippedItems.Load(),
+		FilesTotal:   c.filesTotal.Load(),
+		BytesCopied:  copiedBytes.Load(),
+		BytesTotal:   c.bytesTotal.Load(),
+		Errors:       failedItems.Load(),
+	}
+	if !c.totalsKnown.Load() {
+		frame.State = "scanning"
+	}
+	if elapsed := (time.Since(c.startedAt) - runPause.pausedTime()).Seconds(); elapsed > 0 {
+		frame.BytesPerSec = float64(frame.BytesCopied) / elapsed
+	}
+	if frame.BytesPerSec > 0 && c.totalsKnown.Load() && frame.BytesTotal >= frame.BytesCopied {
+		eta := float64(frame.BytesTotal-frame.BytesCopied) / frame.BytesPerSec
+		frame.ETASeconds = &eta
+	}
+	data, _ := json.Marshal(frame)
+	return data
+}
+
+// read runs the commands of a client until it disconnects.
+func (c *controlServer) read(client *controlClient) {
+	scanner := bufio.NewScanner(client.conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var command controlCommand
+		if err := json.Unmarshal([]byte(line), &command); err != nil {
+			client.sendMessage(controlMessage{Type: "reply", Error: "not a JSON command: " + err.Error()})
+			continue
+		}
+		reply := controlMessage{Type: "reply", Command: command.Command}
+		switch command.Command {
+		case "pause":
+			if !runPause.pause("the control socket") {
+				reply.Error = "not running"
+			}
+		case "resume":
+			if !runPause.resume("the control socket") {
+				reply.Error = "not paused"
+			}
+		case "cancel":
+			if !runPause.cancel("the control socket") {
+				reply.Error = "already stopping"
+			}
+		default:
+			reply.Error = "unknown command, use pause, resume or cancel"
+		}
+		reply.State = runPause.state()
+		client.sendMessage(reply)
+	}
+	c.drop(client)
+}
+
+// write sends the frames of a client, it ends once out is closed.
+func (c *controlServer) write(client *controlClient) {
+	defer c.wg.Done()
+	defer client.conn.Close()
+	for frame := range client.out {
+		client.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+		if _, err := client.conn.Write(append(frame, '\n')); err != nil {
+			verbosef("Control client %s: %v\n", client.conn.RemoteAddr(), err)
+			c.drop(client)
+			for range client.out {
+			}
+			return
+		}
+	}
+}
+
+// send queues a frame, a droppable one only if there is room.
+func (client *controlClient) send(frame []byte, droppable bool) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closed {
+		return
+	}
+	if droppable {
+		select {
+		case client.out <- frame:
+		default:
+		}
+		return
+	}
+	select {
+	case client.out <- frame:
+	case <-time.After(controlWriteTimeout):
+	}
+}
+
+func (client *controlClient) sendMessage(message controlMessage) {
+	data, _ := json.Marshal(message)
+	client.send(data, false)
+}
+
+// close ends the writer of the client once it sent what's queued.
+func (client *controlClient) close() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if !client.closed {
+		client.closed = true
+		close(client.out)
+	}
+}
+
+func (c *controlServer) drop(client *controlClient) {
+	c.mu.Lock()
+	delete(c.clients, client)
+	c.mu.Unlock()
+	client.close()
+}
+
+func (c *controlServer) broadcast(frame []byte, droppable bool) {
+	c.mu.Lock()
+	clients := make([]*controlClient, 0, len(c.clients))
+	for client := range c.clients {
+		clients = append(clients, client)
+	}
+	c.mu.Unlock()
+	for _, client := range clients {
+		client.send(frame, droppable)
+	}
+}
+
+func (c *controlServer) broadcastMessage(message controlMessage) {
+	data, _ := json.Marshal(message)
+	c.broadcast(data, false)
+}
+
+// broadcastState tells every client about a pause, resume or cancel.
+func (c *controlServer) broadcastState(change stateChange) {
+	if c == nil {
+		return
+	}
+	go c.broadcastMessage(controlMessage{Type: "state", State: change.State, By: change.By, At: &change.At})
+}
+
+func (c *controlServer) OnScanProgress(dirsSeen, filesSeen uint64) {
+	c.dirsSeen.Store(dirsSeen)
+	c.filesSeen.Store(filesSeen)
+}
+
+func (c *controlServer) OnFileStart(src, dst string, size int64) {}
+func (c *controlServer) OnFileDone(result reportRow)             {}
+
+func (c *controlServer) OnError(err error) {
+	c.broadcastMessage(controlMessage{Type: "error", Error: err.Error()})
+}
+
+func (c *controlServer) OnSummary(summary runSummary) {
+	c.broadcastMessage(controlMessage{Type: "summary", Summary: &summary})
+}
+
+// close sends what's pending, the summary last, and disconnects every
+// client.
+func (c *controlServer) close() {
+	events.sync()
+	c.broadcast(c.progress(), false)
+	c.mu.Lock()
+	close(c.stop)
+	clients := c.clients
+	c.clients = map[*controlClient]bool{}
+	c.mu.Unlock()
+	c.listener.Close()
+	for client := range clients {
+		client.close()
+	}
+	c.wg.Wait()
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// A copy run keeps its counters, flags and summary in package state, so
+// every copy test runs one in a child process of the test binary: TestMain
+// runs the case named by copyCaseEnv against its in-memory source tree, with
+// the fixed clock and the flags in copyArgsEnv, and exits with the run's
+// exit code.
+const (
+	copyCaseEnv = "FLATTEN_TEST_COPY_CASE"
+	copyArgsEnv = "FLATTEN_TEST_COPY_ARGS"
+)
+
+// exitCheckFailed is the exit code of a child whose check failed.
+const exitCheckFailed = 99
+
+func TestMain(m *testing.M) {
+	if name := os.Getenv(copyCaseEnv); name != "" {
+		os.Exit(runCopyCase(name))
+	}
+	os.Exit(m.Run())
+}
+
+// testEpoch is the time of the fixed clock and of every source file.
+var testEpoch = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// fixedClock reads Now as start and every Since as if elapsed had passed
+// since start.
+type fixedClock struct {
+	start   time.Time
+	elapsed time.Duration
+}
+
+func (c fixedClock) Now() time.Time                  { return c.start }
+func (c fixedClock) Since(t time.Time) time.Duration { return c.start.Add(c.elapsed).Sub(t) }
+
+// failingFS is a source whose files named in fail can't be opened, though
+// their directories list them.
+type failingFS struct {
+	fstest.MapFS
+	fail map[string]bool
+}
+
+var errTestOpen = errors.New("injected open failure")
+
+func (f failingFS) Open(name string) (fs.File, error) {
+	if f.fail[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errTestOpen}
+	}
+	return f.MapFS.Open(name)
+}
+
+func testFile(content string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(content), Mode: 0644, ModTime: testEpoch}
+}
+
+// copyCase is a source tree and the copy flags it's flattened with, the
+// child adds -x out and -json-summary. Without a source the run copies the
+// working directory. setup runs in the child before the copy, check after
+// it, its error fails the child with exitCheckFailed.
+type copyCase struct {
+	source fs.FS
+	args   []string
+	setup  func()
+	check  func() error
+}
+
+var copyCases = map[string]copyCase{
+	"flatten": {source: fstest.MapFS{
+		"top.txt":       testFile("not nested"),
+		"a/one.txt":     testFile("1"),
+		"a/b/two.txt":   testFile("22"),
+		"a/b/c/3.txt":   testFile("333"),
+		"d/four.txt":    testFile("4444"),
+		"d/e/empty.txt": testFile(""),
+	}},
+	"conflicts": {source: fstest.MapFS{
+		"a/b_c.txt":  testFile("first"),
+		"a_b/c.txt":  testFile("second"),
+		"x/same.txt": testFile("same"),
+	}, args: []string{"-on-conflict", "skip"}},
+	"filters": {source: fstest.MapFS{
+		"src/main.go":     testFile("package main"),
+		"src/debug.log":   testFile("log line"),
+		"logs/run.log":    testFile("log line"),
+		"docs/readme.txt": testFile("read me"),
+	}, args: []string{"-exclude-re", `\.log$`}},
+	"errors": {source: failingFS{
+		MapFS: fstest.MapFS{
+			"a/good.txt":  testFile("good"),
+			"a/bad.txt":   testFile("bad"),
+			"b/worse.txt": testFile("worse"),
+		},
+		fail: map[string]bool{"a/bad.txt": true, "b/worse.txt": true},
+	}},
+}
+
+// discardProgressBar draws the bar nowhere.
+func discardProgressBar(max int64, description ...string) *progressbar.ProgressBar {
+	return progressbar.NewOptions64(max, progressbar.OptionSetWriter(io.Discard))
+}
+
+func runCopyCase(name string) int {
+	c, ok := copyCases[name]
+	if !ok {
+		return exitUsage
+	}
+	if c.source != nil {
+		sourceFS = c.source
+	}
+	runClock = fixedClock{start: testEpoch, elapsed: 90 * time.Second}
+	newProgressBar = discardProgressBar
+	if c.setup != nil {
+		c.setup()
+	}
+	args := append([]string{"copy", "-x", "out", "-json-summary", "summary.json"}, c.args...)
+	var extra []string
+	if err := json.Unmarshal([]byte(os.Getenv(copyArgsEnv)), &extra); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", copyArgsEnv, err)
+		return exitCheckFailed
+	}
+	args = append(args, extra...)
+	code := dispatch(args)
+	if c.check != nil {
+		if err := c.check(); err != nil {
+			fmt.Fprintf(os.Stderr, "check failed: %v\n", err)
+			return exitCheckFailed
+		}
+	}
+	return code
+}
+
+// copyResult is what a copy case left behind. files are its output files
+// by slash separated path in out. summary is zero if the run wrote none, a
+// usage error doesn't.
+type copyResult struct {
+	wd      string
+	code    int
+	summary runSummary
+	files   map[string]string
+	log     string
+}
+
+// runCopyTest runs the copy case name with the extra flags args in a child
+// process, in a temporary working directory.
+func runCopyTest(t testing.TB, name string, args ...string) copyResult {
+	t.Helper()
+	return runCopyTestIn(t, t.TempDir(), name, args...)
+}
+
+// runCopyTestIn is runCopyTest in the working directory wd, which a case
+// without a source copies and which later runs can continue in.
+func runCopyTestIn(t testing.TB, wd, name string, args ...string) copyResult {
+	t.Helper()
+	if _, ok := copyCases[name]; !ok {
+		t.Fatalf("no copy case %q", name)
+	}
+	os.Remove(filepath.Join(wd, "summary.json"))
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Dir = wd
+	encoded, err := json.Marshal(append([]string{}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Env = append(os.Environ(), copyCaseEnv+"="+name, copyArgsEnv+"="+string(encoded))
+	out, err := cmd.CombinedOutput()
+	result := copyResult{wd: wd, log: string(out), files: map[string]string{}}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		result.code = exitErr.ExitCode()
+	case err != nil:
+		t.Fatal(err)
+	}
+	if result.code == exitCheckFailed {
+		t.Fatalf("the check of %q failed:\n%s", name, out)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(wd, "summary.json")); err == nil {
+		if err := json.Unmarshal(data, &result.summary); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outDir := filepath.Join(wd, "out")
+	filepath.WalkDir(outDir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() || entry.Name() == outputMarkerName {
+			return nil
+		}
+		content, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(outDir, name)
+		result.files[filepath.ToSlash(rel)] = string(content)
+		return nil
+	})
+	return result
+}
+
+func (r copyResult) names() []string {
+	names := make([]string, 0, len(r.files))
+	for name := range r.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCopyFlattens(t *testing.T) {
+	r := runCopyTest(t, "flatten")
+	if r.code != exitOK {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+	}
+	want := map[string]string{
+		"a_one.txt":     "1",
+		"a_b_two.txt":   "22",
+		"a_b_c_3.txt":   "333",
+		"d_four.txt":    "4444",
+		"d_e_empty.txt": "",
+	}
+	for name, content := range want {
+		if got, ok := r.files[name]; !ok || got != content {
+			t.Errorf("%s = %q (present %v), want %q", name, got, ok, content)
+		}
+	}
+	if len(r.files) != len(want) {
+		t.Errorf("output has %q, want %d files", r.names(), len(want))
+	}
+
+	s := r.summary
+	if s.FoundItems != 5 || s.CopiedItems != 5 || s.FailedItems != 0 || s.SkippedItems != 0 {
+		t.Errorf("found/copied/failed/skipped = %d/%d/%d/%d, want 5/5/0/0", s.FoundItems, s.CopiedItems, s.FailedItems, s.SkippedItems)
+	}
+	if s.SourceBytes != 10 {
+		t.Errorf("source bytes = %d, want 10", s.SourceBytes)
+	}
+	if s.ElapsedSeconds != 90 || !s.StartedAt.Equal(testEpoch) {
+		t.Errorf("started %v, elapsed %vs, want the fixed clock's %v and 90s", s.StartedAt, s.ElapsedSeconds, testEpoch)
+	}
+	if a := s.Accounting; !a.Balanced || a.Scanned != 5 || a.Copied != 5 {
+		t.Errorf("accounting = %+v, want 5 scanned and copied, balanced", a)
+	}
+}
+
+func TestCopyConflicts(t *testing.T) {
+	r := runCopyTest(t, "conflicts")
+	if r.code != exitOK {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+	}
+	// the walk is sorted, a/b_c.txt claims a_b_c.txt first
+	if got := r.files["a_b_c.txt"]; got != "first" {
+		t.Errorf("a_b_c.txt = %q, want the first source's content", got)
+	}
+	if _, ok := r.files["x_same.txt"]; !ok || len(r.files) != 2 {
+		t.Errorf("output has %q, want a_b_c.txt and x_same.txt", r.names())
+	}
+	s := r.summary
+	if s.FoundItems != 3 || s.CopiedItems != 2 || s.SkippedItems != 1 {
+		t.Errorf("found/copied/skipped = %d/%d/%d, want 3/2/1", s.FoundItems, s.CopiedItems, s.SkippedItems)
+	}
+	if a := s.Accounting; !a.Balanced || a.Skipped[skipConflict] != 1 {
+		t.Errorf("accounting = %+v, want one conflict skip, balanced", a)
+	}
+}
+
+func TestCopyFilters(t *testing.T) {
+	r := runCopyTest(t, "filters")
+	if r.code != exitOK {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+	}
+	if len(r.files) != 2 || r.files["src_main.go"] != "package main" || r.files["docs_readme.txt"] != "read me" {
+		t.Errorf("output has %q, want src_main.go and docs_readme.txt", r.names())
+	}
+	s := r.summary
+	if s.CopiedItems != 2 || s.Filters["exclude-re"] == "" {
+		t.Errorf("copied %d with filters %v, want 2 and exclude-re", s.CopiedItems, s.Filters)
+	}
+	// filtered files are left out before they're counted as found
+	if s.FoundItems != 2 || s.SkippedByReason[skipFiltered] != 2 {
+		t.Errorf("found %d, skipped %v, want 2 found and 2 filtered", s.FoundItems, s.SkippedByReason)
+	}
+	if a := s.Accounting; !a.Balanced || a.Scanned != 2 {
+		t.Errorf("accounting = %+v, want 2 scanned, balanced", a)
+	}
+}
+
+func TestCopyErrorAccounting(t *testing.T) {
+	r := runCopyTest(t, "errors")
+	if r.code != exitFailed {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitFailed, r.log)
+	}
+	if len(r.files) != 1 || r.files["a_good.txt"] != "good" {
+		t.Errorf("output has %q, want a_good.txt", r.names())
+	}
+	s := r.summary
+	if s.FoundItems != 3 || s.CopiedItems != 1 || s.FailedItems != 2 {
+		t.Errorf("found/copied/failed = %d/%d/%d, want 3/1/2", s.FoundItems, s.CopiedItems, s.FailedItems)
+	}
+	failed := 0
+	for _, n := range s.Errors {
+		failed += n
+	}
+	if failed != 2 {
+		t.Errorf("errors by category = %v, want 2 in total", s.Errors)
+	}
+	if a := s.Accounting; !a.Balanced || a.Copied != 1 {
+		t.Errorf("accounting = %+v, want one copied, balanced", a)
+	}
+}
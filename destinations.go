@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	errDestinationTaken  = errors.New("destination already written by this run")
+	errDestinationExists = errors.New("destination already exists in the output directory")
+	// errSameFile is a destination that resolves to its own source, which
+	// creating it would truncate.
+	errSameFile = errors.New("skipped: destination is the source file itself")
+)
+
+var (
+	// copyDestinations holds the destination of every file the run copied,
+	// and every file already in the output directory when it started.
+	copyDestinations = newDestinationSet()
+	// existingDestinations are the files that were already there.
+	existingDestinations = newDestinationSet()
+	// existingCollisions counts destinations refused because they existed.
+	existingCollisions atomic.Uint64
+)
+
+// isSourceFile reports whether destPath is the same file as srcName, through
+// a link or a path into the output directory flattening to itself.
+func isSourceFile(srcName, destPath string) bool {
+	if sourceFS != nil {
+		return false
+	}
+	destInfo, err := os.Stat(destPath)
+	if err != nil {
+		return false
+	}
+	srcInfo, err := os.Stat(srcName)
+	return err == nil && os.SameFile(srcInfo, destInfo)
+}
+
+// claimDestination reserves name in the output directory for the file
+// source, "" for one that isn't copied from a source file. A name another
+// source of the run took is recorded for the conflict hotspots.
+func claimDestination(name, source string) error {
+	key := collisionKey(name)
+	free, owner := copyDestinations.claimFor(key, source)
+	if free {
+		return nil
+	}
+	if existingDestinations.contains(key) {
+		existingCollisions.Add(1)
+		return fmt.Errorf("%w: %s", errDestinationExists, name)
+	}
+	conflictPairs.record(source, owner, name)
+	return fmt.Errorf("%w: %s", errDestinationTaken, name)
+}
+
+// seedExistingDestinations puts every file already in the output directory,
+// its subdirectories included, into copyDestinations, so a run never
+// truncates the output of an earlier one. It returns how many there were.
+func seedExistingDestinations() (int, error) {
+	n := 0
+	err := filepath.WalkDir(outputDirectory, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == outputMarkerName {
+			return err
+		}
+		if isJournalFile(d.Name()) {
+			// an interrupted copy, -resume continues it and a new run starts it over
+			return nil
+		}
+		rel, err := filepath.Rel(outputDirectory, name)
+		if err != nil {
+			return err
+		}
+		key := collisionKey(filepath.ToSlash(rel))
+		copyDestinations.claim(key)
+		existingDestinations.claim(key)
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// destinationSet remembers destination names so two sources flattening to
+// the same name don't overwrite each other. It has to hold every name of
+// the run, so names are appended NUL terminated to a single byte arena and
+// indexed by their 64 bit FNV-1a hash; a hash hit is compared exactly, and
+// the rare different name with the same hash goes to overflow. The source
+// that claimed a name follows it in the arena, NUL terminated too, so a
+// conflict can name both sides.
+//
+// BenchmarkDestinationSet claims 5M names of 37.5 bytes on average with no
+// source: 78 bytes of heap per name, 39.5 of them in the arena, the name and
+// its two NULs, and the rest in the index. A source adds its length.
+type destinationSet struct {
+	mu       sync.Mutex
+	arena    []byte
+	index    map[uint64]uint64
+	overflow map[string]string
+}
+
+func newDestinationSet() *destinationSet {
+	return &destinationSet{index: map[uint64]uint64{}, overflow: map[string]string{}}
+}
+
+// claim records name and reports whether it was still free.
+func (s *destinationSet) claim(name string) bool {
+	free, _ := s.lookup(name, "", true)
+	return free
+}
+
+// claimFor is claim for the file source, returning the source that holds
+// name if it was taken.
+func (s *destinationSet) claimFor(name, source string) (free bool, owner string) {
+	return s.lookup(name, source, true)
+}
+
+// contains reports whether name was claimed.
+func (s *destinationSet) contains(name string) bool {
+	free, _ := s.lookup(name, "", false)
+	return !free
+}
+
+// lookup reports whether name is free, recording it for source if claim is
+// set, or which source holds it.
+func (s *destinationSet) lookup(name, source string, claim bool) (bool, string) {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	sum := h.Sum64()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, hit := s.index[sum]
+	if !hit {
+		if !claim {
+			return true, ""
+		}
+		s.index[sum] = uint64(len(s.arena))
+		s.arena = append(s.arena, name...)
+		s.arena = append(s.arena, 0)
+		s.arena = append(s.arena, source...)
+		s.arena = append(s.arena, 0)
+		return true, ""
+	}
+
+	stored := s.arena[offset:]
+	end := bytes.IndexByte(stored, 0)
+	if string(stored[:end]) == name {
+		owner := stored[end+1:]
+		return false, string(owner[:bytes.IndexByte(owner, 0)])
+	}
+	if owner, taken := s.overflow[name]; taken {
+		return false, owner
+	}
+	if claim {
+		s.overflow[name] = source
+	}
+	return true, ""
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func init() {
+	copyCases["workdir"] = copyCase{}
+}
+
+// TestCopySameFile copies a tree whose output directory links back into the
+// source, the destination of src/keep.txt is src/keep.txt itself: the file
+// is skipped and left as it was instead of being truncated.
+func TestCopySameFile(t *testing.T) {
+	wd := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(wd, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(wd, "src", "keep.txt"), []byte("precious"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(wd, "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..", "src"), filepath.Join(wd, "out", "src")); err != nil {
+		t.Skipf("can't link the output back into the source: %v", err)
+	}
+
+	r := runCopyTestIn(t, wd, "workdir", "-group-by", "root")
+	if content, err := os.ReadFile(filepath.Join(wd, "src", "keep.txt")); err != nil || string(content) != "precious" {
+		t.Fatalf("src/keep.txt = %q, %v after the copy, want it untouched\n%s", content, err, r.log)
+	}
+	if s := r.summary; s.SkippedByReason[skipSameFile] != 1 || s.CopiedItems != 0 || !s.Accounting.Balanced {
+		t.Errorf("copied %d, skipped %v, accounting %+v, want one same_file skip, balanced", s.CopiedItems, s.SkippedByReason, s.Accounting)
+	}
+	if r.code != exitOK {
+		t.Errorf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+	}
+}
+
+// BenchmarkDestinationSet claims b.N names like those of a big photo tree,
+// 37 bytes on average, and reports the heap the set holds per name:
+//
+//	go test -run '^$' -bench DestinationSet -benchtime 5000000x
+func BenchmarkDestinationSet(b *testing.B) {
+	b.ReportAllocs()
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	set := newDestinationSet()
+	buf := make([]byte, 0, 64)
+	nameBytes := 0
+	for i := 0; i < b.N; i++ {
+		buf = append(buf[:0], "photos_"...)
+		buf = strconv.AppendInt(buf, int64(2000+i%25), 10)
+		buf = append(buf, "_trip_"...)
+		buf = strconv.AppendInt(buf, int64(i/1000), 10)
+		buf = append(buf, "_IMG_"...)
+		buf = strconv.AppendInt(buf, int64(i), 10)
+		buf = append(buf, ".jpeg"...)
+		nameBytes += len(buf)
+		if !set.claim(string(buf)) {
+			b.Fatalf("%s was claimed twice", buf)
+		}
+	}
+
+	b.StopTimer()
+	runtime.GC()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(nameBytes)/float64(b.N), "name-bytes/op")
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "heap-bytes/op")
+	b.ReportMetric(float64(len(set.arena))/float64(b.N), "arena-bytes/op")
+	runtime.KeepAlive(set)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var diffFormat = newChoiceValue("text", "text", "json")
+
+var diffCommand = newCommand("diff", "OLD NEW", "Compare the manifests of two copy runs: files only in one of them, files whose size,\n"+
+	"modification time or hash changed and files renamed, found by their hash. Exits 1 if they differ.", logFlags)
+
+func init() {
+	fs := diffCommand.flags
+	fs.Var(diffFormat, "format", "output format: text, or json for a JSON line per difference")
+	diffCommand.run = runDiff
+}
+
+// manifestChange is one difference between two manifests.
+type manifestChange struct {
+	// Kind is added, removed, changed or renamed.
+	Kind string `json:"kind"`
+	// Source is the slash separated path relative to the source root, for
+	// renamed files in the new manifest, Old is their path in the old one.
+	Source string `json:"source"`
+	Old    string `json:"old,omitempty"`
+	// Fields are the changed fields: size, mod_time and hash.
+	Fields []string `json:"fields,omitempty"`
+}
+
+func runDiff(args []string) int {
+	if len(args) != 2 {
+		diffCommand.flags.Usage()
+		return exitUsage
+	}
+	var manifests [2]*manifest
+	for i, name := range args {
+		m, err := readManifest(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "flatten diff: %v\n", err)
+			return exitUsage
+		}
+		if m.Partial {
+			warnf("The manifest %q has no footer, the run writing it didn't finish. Using its '%d' entries\n", name, len(m.Entries))
+		}
+		manifests[i] = m
+	}
+
+	changes := diffManifests(manifests[0], manifests[1])
+	if diffFormat.value == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, change := range changes {
+			if err := encoder.Encode(change); err != nil {
+				errorf("%v\n", err)
+				return exitFailed
+			}
+		}
+	} else {
+		for _, change := range changes {
+			switch change.Kind {
+			case "renamed":
+				fmt.Printf("renamed  %s -> %s\n", change.Old, change.Source)
+			case "changed":
+				fmt.Printf("changed  %s (%s)\n", change.Source, strings.Join(change.Fields, ", "))
+			default:
+				fmt.Printf("%-8s %s\n", change.Kind, change.Source)
+			}
+		}
+	}
+
+	if len(changes) > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// diffManifests compares entries by Source. A resumed run appends to its
+// manifest, so the last entry of a source counts. Hashes are only compared
+// when both manifests used the same -hash algorithm, and a removed file is
+// taken to be renamed to an added one with the same size and hash.
+func diffManifests(from, to *manifest) []manifestChange {
+	oldEntries, newEntries := entriesBySource(from), entriesBySource(to)
+	hashed := from.HashAlgorithm != "" && from.HashAlgorithm == to.HashAlgorithm
+
+	var changes, removed []manifestChange
+	for source, before := range oldEntries {
+		after, ok := newEntries[source]
+		if !ok {
+			removed = append(removed, manifestChange{Kind: "removed", Source: source})
+			continue
+		}
+		var fields []string
+		if before.Size != after.Size {
+			fields = append(fields, "size")
+		}
+		if !before.ModTime.Equal(after.ModTime) {
+			fields = append(fields, "mod_time")
+		}
+		if hashed && before.Hash != after.Hash {
+			fields = append(fields, "hash")
+		}
+		if len(fields) > 0 {
+			changes = append(changes, manifestChange{Kind: "changed", Source: source, Fields: fields})
+		}
+	}
+
+	type content struct {
+		size int64
+		hash string
+	}
+	added := map[content][]string{}
+	var addedSources []string
+	for source := range newEntries {
+		if _, ok := oldEntries[source]; !ok {
+			addedSources = append(addedSources, source)
+		}
+	}
+	sort.Strings(addedSources)
+	if hashed {
+		for _, source := range addedSources {
+			after := newEntries[source]
+			if after.Hash != "" {
+				key := content{after.Size, after.Hash}
+				added[key] = append(added[key], source)
+			}
+		}
+	}
+
+	renamedTo := map[string]bool{}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Source < removed[j].Source })
+	for _, change := range removed {
+		before := oldEntries[change.Source]
+		key := content{before.Size, before.Hash}
+		if candidates := added[key]; hashed && before.Hash != "" && len(candidates) > 0 {
+			added[key] = candidates[1:]
+			renamedTo[candidates[0]] = true
+			changes = append(changes, manifestChange{Kind: "renamed", Source: candidates[0], Old: change.Source})
+			continue
+		}
+		changes = append(changes, change)
+	}
+	for _, source := range addedSources {
+		if !renamedTo[source] {
+			changes = append(changes, manifestChange{Kind: "added", Source: source})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Source < changes[j].Source })
+	return changes
+}
+
+func entriesBySource(m *manifest) map[string]manifestEntry {
+	entries := make(map[string]manifestEntry, len(m.Entries))
+	for _, entry := range m.Entries {
+		entries[entry.Source] = entry
+	}
+	return entries
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// dryRun is -dry-run. diff compares what a copy would write with the
+// output directory as it is, without writing anything. A plain listing of
+// what would be copied is the plan command.
+var dryRun = newChoiceValue("off", "off", "diff")
+
+// dryRunMarker is the status of one file in the -dry-run diff listing.
+type dryRunMarker string
+
+const (
+	// dryRunAdded would be created.
+	dryRunAdded dryRunMarker = "A"
+	// dryRunModified is in the output directory with other content, the
+	// copy would run into it as a name collision.
+	dryRunModified dryRunMarker = "M"
+	// dryRunSame is in the output directory with the same content, up to
+	// date.
+	dryRunSame dryRunMarker = "S"
+	// dryRunUnknown is in the output directory but couldn't be compared:
+	// compressed without -hash, or unreadable.
+	dryRunUnknown dryRunMarker = "?"
+	// dryRunCollision would be taken by another source of the same run.
+	dryRunCollision dryRunMarker = "C"
+)
+
+// runDryRunDiff walks like a copy and prints a marker per file instead of
+// copying it. It exits 1 when the copy would change the output directory
+// or can't tell.
+func runDryRunDiff() int {
+	if packSmall > 0 {
+		fmt.Fprintln(os.Stderr, "-dry-run diff can't be combined with -pack-small, packed files aren't compared")
+		return exitUsage
+	}
+	counts := map[dryRunMarker]int{}
+	claimed := map[string]bool{}
+	err := walkNestedFiles(func(dirName string, group []string) error {
+		primaryDest, err := destinationName(dirName, group[0])
+		if err != nil {
+			errorf("%v\n", err)
+			return nil
+		}
+		for _, fileName := range group {
+			srcName := filepath.Join(dirName, fileName)
+			compression := compressionFor(fileName)
+			destName := sidecarDestination(primaryDest, group[0], fileName) + compressionExtension(compression) + encryptionExtension(encryptTo.String())
+			marker := dryRunCollision
+			if key := collisionKey(destName); !claimed[key] {
+				claimed[key] = true
+				marker = compareDestination(srcName, filepath.Join(outputDirectory, filepath.FromSlash(destName)), compression)
+			}
+			counts[marker]++
+			fmt.Printf("%s %s -> %s\n", marker, srcName, destName)
+		}
+		return nil
+	})
+	if err != nil {
+		errorf("%v\n", err)
+		return exitFailed
+	}
+
+	summaryf("-dry-run diff: '%d' added, '%d' differing, '%d' up to date, '%d' not compared, '%d' colliding within the run\n",
+		counts[dryRunAdded], counts[dryRunModified], counts[dryRunSame], counts[dryRunUnknown], counts[dryRunCollision])
+	if counts[dryRunAdded]+counts[dryRunModified]+counts[dryRunUnknown]+counts[dryRunCollision] > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// compareDestination compares the source srcName with what's at destPath:
+// by -hash if given, by size otherwise.
+func compareDestination(srcName, destPath, compression string) dryRunMarker {
+	destInfo, err := os.Lstat(destPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return dryRunAdded
+	}
+	if err != nil || !destInfo.Mode().IsRegular() || encryptTo.scheme != "" {
+		// copy can't decrypt, it takes no -identity
+		return dryRunUnknown
+	}
+
+	if hashAlgorithm.value == "none" {
+		if compression != "" {
+			return dryRunUnknown
+		}
+		srcInfo, err := statSource(srcName)
+		if err != nil {
+			return dryRunUnknown
+		}
+		if srcInfo.Size() != destInfo.Size() {
+			return dryRunModified
+		}
+		return dryRunSame
+	}
+
+	srcHash, err := hashSource(srcName)
+	if err != nil {
+		verbosef("Could not hash %q: %v\n", srcName, err)
+		return dryRunUnknown
+	}
+	destHash, _, err := hashStoredFile(destPath, hashAlgorithm.value, manifestEntry{Compression: compression})
+	if err != nil {
+		verbosef("Could not hash %q: %v\n", destPath, err)
+		return dryRunUnknown
+	}
+	if srcHash != destHash {
+		return dryRunModified
+	}
+	return dryRunSame
+}
+
+func hashSource(srcName string) (string, error) {
+	file, err := openSource(srcName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := newHasher(hashAlgorithm.value)
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hashSum(h), nil
+}
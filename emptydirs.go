@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var (
+	emptyDirsMode  = newChoiceValue("ignore", "ignore", "list", "marker")
+	emptyDirSuffix string
+
+	// emptyDirectories are found by the scout pass, as slash separated
+	// paths relative to the source root.
+	emptyDirectories []string
+	// emptyDirMarkers are the slash separated destination names of the
+	// markers created for them, recorded in the manifest.
+	emptyDirMarkers []string
+)
+
+func emptyDirFlags(fs *flag.FlagSet) {
+	fs.Var(emptyDirsMode, "empty-dirs", "what to do with directories without files to copy and without subdirectories:\n"+
+		"ignore, list (in the manifest and JSON summary), marker (also create an empty file named after the directory)")
+	fs.StringVar(&emptyDirSuffix, "empty-dir-suffix", ".emptydir", "suffix of the files -empty-dirs marker creates")
+}
+
+// recordEmptyDirectory is called by the scout for a directory without
+// selected files or subdirectories.
+func recordEmptyDirectory(dir string) {
+	if emptyDirsMode.value == "ignore" {
+		return
+	}
+	emptyDirectories = append(emptyDirectories, filepath.ToSlash(dir))
+}
+
+// createEmptyDirMarkers creates one empty file per empty directory, named
+// like a file in it would be without its own name.
+func createEmptyDirMarkers() {
+	if emptyDirsMode.value != "marker" {
+		return
+	}
+	for _, dir := range emptyDirectories {
+		name := fatSafe(namePrefix + pathReplacer.ReplaceAllString(dir, "_") + emptyDirSuffix)
+		if err := claimDestination(name, ""); errors.Is(err, errDestinationExists) {
+			verbosef("empty directory %q is already marked as %q\n", dir, name)
+			continue
+		} else if err != nil {
+			errorf("Not creating the marker of empty directory %q: %v\n", dir, err)
+			continue
+		}
+		file, err := os.Create(filepath.Join(outputDirectory, name))
+		if err == nil {
+			err = file.Close()
+		}
+		if err != nil {
+			errorf("Could not create the marker of empty directory %q: %v\n", dir, err)
+			continue
+		}
+		emptyDirMarkers = append(emptyDirMarkers, name)
+		verbosef("empty directory %q marked as %q\n", dir, name)
+	}
+}
+
+// removeEmptyDirMarkers removes the empty directory markers of m from
+// outputDir, or the output directory m recorded if it's empty. A marker
+// that isn't empty anymore is left in place unless force is set. It
+// returns how many were removed and left.
+func removeEmptyDirMarkers(m *manifest, outputDir string, force, dryRun bool) (removed, left int) {
+	for _, marker := range m.EmptyDirMarkers {
+		dst := m.destinationPath(outputDir, manifestEntry{Destination: marker})
+		info, err := os.Lstat(dst)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			verbosef("%q is already gone\n", dst)
+			continue
+		case err != nil:
+			errorf("%q: %v\n", dst, err)
+			left++
+			continue
+		case (!info.Mode().IsRegular() || info.Size() != 0) && !force:
+			errorf("%q changed since it was created as an empty directory marker, skipping...\n", dst)
+			left++
+			continue
+		}
+		if dryRun {
+			infof("Would remove %q\n", dst)
+			continue
+		}
+		if err := os.Remove(dst); err != nil {
+			errorf("%v\n", err)
+			left++
+			continue
+		}
+		removed++
+	}
+	return removed, left
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func init() {
+	copyCases["empty dirs"] = copyCase{source: fstest.MapFS{
+		"a/one.txt":  testFile("1"),
+		"a/empty":    {Mode: fs.ModeDir | 0755, ModTime: testEpoch},
+		"b/c/nested": {Mode: fs.ModeDir | 0755, ModTime: testEpoch},
+	}, args: []string{"-empty-dirs", "marker", "-manifest", "manifest.json"}}
+}
+
+// TestEmptyDirMarkers copies empty directories as markers: the manifest
+// records them, check doesn't report them and undo removes them.
+func TestEmptyDirMarkers(t *testing.T) {
+	r := runCopyTest(t, "empty dirs")
+	if r.code != exitOK {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+	}
+	want := []string{"a_empty.emptydir", "b_c_nested.emptydir"}
+	for _, marker := range want {
+		if _, ok := r.files[marker]; !ok {
+			t.Errorf("output has %q, want the marker %s", r.names(), marker)
+		}
+	}
+	manifestName := filepath.Join(r.wd, "manifest.json")
+	m, err := readManifest(manifestName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.EmptyDirMarkers) != len(want) {
+		t.Errorf("the manifest has the markers %q, want %q", m.EmptyDirMarkers, want)
+	}
+
+	outDir := filepath.Join(r.wd, "out")
+	if code := dispatch([]string{"check", "-manifest", manifestName, "-x", outDir, "-report", filepath.Join(r.wd, "check.json")}); code != exitOK {
+		report, _ := os.ReadFile(filepath.Join(r.wd, "check.json"))
+		t.Errorf("check = %d, want %d:\n%s", code, exitOK, report)
+	}
+	if code := dispatch([]string{"undo", "-manifest", manifestName, "-x", outDir}); code != exitOK {
+		t.Errorf("undo = %d, want %d", code, exitOK)
+	}
+	for _, name := range append(want, "a_one.txt") {
+		if _, err := os.Lstat(filepath.Join(outDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is still there after undo: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// encryptTo is -encrypt, nothing is encrypted without it.
+var encryptTo encryptionValue
+
+// ageIdentity is -identity, the age identity file restore and verify
+// decrypt with. gpg finds its keys in its own keyring.
+var ageIdentity string
+
+// errEncryption classifies the failures of the encryption tool apart from
+// the IO errors of the copy.
+var errEncryption = errors.New("encryption failed")
+
+// encryptionValue is scheme:recipient, age:RECIPIENT or gpg:KEYID. The
+// manifest records it as it was given, so restore knows the scheme.
+type encryptionValue struct {
+	scheme    string
+	recipient string
+}
+
+func (e *encryptionValue) String() string {
+	if e == nil || e.scheme == "" {
+		return ""
+	}
+	return e.scheme + ":" + e.recipient
+}
+
+// Set takes "" as the default, nothing is encrypted, so a job file can
+// turn -encrypt off again.
+func (e *encryptionValue) Set(s string) error {
+	if s == "" {
+		e.scheme, e.recipient = "", ""
+		return nil
+	}
+	scheme, recipient, _ := strings.Cut(s, ":")
+	if scheme != "age" && scheme != "gpg" {
+		return fmt.Errorf("unknown encryption %q, use age:RECIPIENT or gpg:KEYID", s)
+	}
+	if recipient = strings.TrimSpace(recipient); recipient == "" {
+		return fmt.Errorf("-encrypt %s: needs a recipient", scheme)
+	}
+	e.scheme, e.recipient = scheme, recipient
+	return nil
+}
+
+func decryptFlags(fs *flag.FlagSet) {
+	fs.StringVar(&ageIdentity, "identity", "", "age identity file to decrypt files copied with -encrypt age:, gpg uses its own keyring")
+}
+
+func encryptionScheme(encryption string) string {
+	scheme, _, _ := strings.Cut(encryption, ":")
+	return scheme
+}
+
+// encryptionExtension is added after the compression extension.
+func encryptionExtension(encryption string) string {
+	switch encryptionScheme(encryption) {
+	case "age":
+		return ".age"
+	case "gpg":
+		return ".gpg"
+	}
+	return ""
+}
+
+// validateEncryption checks that the tool of -encrypt runs and takes the
+// recipient, by encrypting nothing, before anything is copied. The content
+// hash is what verify checks an encrypted file by, so -hash defaults to
+// sha256 for it where the command has -hash.
+func validateEncryption(fs *flag.FlagSet) error {
+	if encryptTo.scheme == "" {
+		return nil
+	}
+	if packSmall > 0 {
+		return errors.New("-encrypt can't be combined with -pack-small, packs are stored as plain zip files")
+	}
+	w, err := newEncryptor(encryptTo.String(), io.Discard)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("-encrypt %s: %w", encryptTo.String(), err)
+	}
+	if fs.Lookup("hash") != nil && !flagWasSet(fs, "hash") {
+		hashAlgorithm.value = "sha256"
+		infof("-encrypt: recording sha256 hashes of the plaintext for verify, pass -hash to pick another\n")
+	}
+	return nil
+}
+
+// encryptCommand is the command line encrypting to the recipient of
+// encryption, reading the plaintext on stdin.
+func encryptCommand(encryption string) (*exec.Cmd, error) {
+	scheme, recipient, _ := strings.Cut(encryption, ":")
+	switch scheme {
+	case "age":
+		return exec.Command("age", "--encrypt", "--recipient", recipient), nil
+	case "gpg":
+		// the key was named explicitly, don't ask whether to trust it, and
+		// don't look it up on the network
+		return exec.Command("gpg", "--batch", "--quiet", "--no-tty", "--trust-model", "always", "--auto-key-locate", "local",
+			"--recipient", recipient, "--output", "-", "--encrypt"), nil
+	}
+	return nil, fmt.Errorf("unknown encryption %q", encryption)
+}
+
+func decryptCommand(encryption string) (*exec.Cmd, error) {
+	switch encryptionScheme(encryption) {
+	case "age":
+		if ageIdentity == "" {
+			return nil, fmt.Errorf("%w: -identity is needed to decrypt age files", errEncryption)
+		}
+		return exec.Command("age", "--decrypt", "--identity", ageIdentity), nil
+	case "gpg":
+		return exec.Command("gpg", "--batch", "--quiet", "--no-tty", "--output", "-", "--decrypt"), nil
+	}
+	return nil, fmt.Errorf("unknown encryption %q", encryption)
+}
+
+// encryptor pipes what's written to it through the encryption tool into w.
+// The tool's output is copied by a goroutine that keeps draining it after
+// w failed, so the tool never blocks on a full pipe.
+type encryptor struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+	copied chan struct{}
+
+	mu      sync.Mutex
+	copyErr error
+}
+
+// newEncryptor wraps w so that closing the result waits for the whole
+// encrypted stream to be written, but doesn't close w itself. Without
+// encryption it's w as it is.
+func newEncryptor(encryption string, w io.Writer) (io.WriteCloser, error) {
+	if encryption == "" {
+		return nopWriteCloser{w}, nil
+	}
+	cmd, err := encryptCommand(encryption)
+	if err != nil {
+		return nil, err
+	}
+	e := &encryptor{cmd: cmd, copied: make(chan struct{})}
+	cmd.Stderr = &e.stderr
+	if e.stdin, err = cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errEncryption, err)
+	}
+	go func() {
+		defer close(e.copied)
+		if _, err := io.Copy(w, stdout); err != nil {
+			e.mu.Lock()
+			e.copyErr = err
+			e.mu.Unlock()
+			io.Copy(io.Discard, stdout)
+		}
+	}()
+	return e, nil
+}
+
+func (e *encryptor) failed() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.copyErr
+}
+
+func (e *encryptor) Write(p []byte) (int, error) {
+	if err := e.failed(); err != nil {
+		return 0, err
+	}
+	n, err := e.stdin.Write(p)
+	if err != nil {
+		// the tool exited, Close says why
+		return n, fmt.Errorf("%w: %s stopped reading: %v", errEncryption, e.cmd.Args[0], err)
+	}
+	return n, nil
+}
+
+// Close returns a write error of the destination as it is, so a full disk
+// is still one.
+func (e *encryptor) Close() error {
+	e.stdin.Close()
+	<-e.copied
+	err := e.cmd.Wait()
+	if copyErr := e.failed(); copyErr != nil {
+		return copyErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v: %s", errEncryption, err, strings.TrimSpace(e.stderr.String()))
+	}
+	return nil
+}
+
+// decryptor reads the plaintext out of the decryption tool. It only
+// returns EOF once the tool exited fine, a truncated or tampered file
+// fails the read.
+type decryptor struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	done   bool
+}
+
+// newDecryptor reverses newEncryptor for restore and verify.
+func newDecryptor(encryption string, r io.Reader) (io.ReadCloser, error) {
+	if encryption == "" {
+		return io.NopCloser(r), nil
+	}
+	cmd, err := decryptCommand(encryption)
+	if err != nil {
+		return nil, err
+	}
+	d := &decryptor{cmd: cmd}
+	cmd.Stdin = r
+	cmd.Stderr = &d.stderr
+	if d.stdout, err = cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errEncryption, err)
+	}
+	return d, nil
+}
+
+func (d *decryptor) Read(p []byte) (int, error) {
+	n, err := d.stdout.Read(p)
+	if errors.Is(err, io.EOF) {
+		if waitErr := d.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (d *decryptor) wait() error {
+	if d.done {
+		return nil
+	}
+	d.done = true
+	if err := d.cmd.Wait(); err != nil {
+		return fmt.Errorf("%w: %v: %s", errEncryption, err, strings.TrimSpace(d.stderr.String()))
+	}
+	return nil
+}
+
+// Close stops a tool that wasn't read to the end.
+func (d *decryptor) Close() error {
+	if d.done {
+		return nil
+	}
+	d.stdout.Close()
+	if d.cmd.Process != nil {
+		d.cmd.Process.Kill()
+	}
+	d.done = true
+	d.cmd.Wait()
+	return nil
+}
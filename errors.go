@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+type errorCategory string
+
+const (
+	errPermission  errorCategory = "permission_denied"
+	errNotFound    errorCategory = "not_found"
+	errNameTooLong errorCategory = "name_too_long"
+	errDiskFull    errorCategory = "disk_full"
+	errIO          errorCategory = "io_error"
+	errCollision   errorCategory = "name_collision"
+	errTimeout     errorCategory = "timeout"
+	errNameMapping errorCategory = "naming"
+	errSizeChange  errorCategory = "size_mismatch"
+	errEncrypting  errorCategory = "encryption"
+	errOther       errorCategory = "other"
+)
+
+var errorCategoryLabels = map[errorCategory]string{
+	errPermission:  "permission denied",
+	errNotFound:    "not found",
+	errNameTooLong: "name too long",
+	errDiskFull:    "disk full",
+	errIO:          "IO error",
+	errCollision:   "name collision",
+	errTimeout:     "timeout",
+	errNameMapping: "naming",
+	errSizeChange:  "size mismatch",
+	errEncrypting:  "encryption",
+	errOther:       "other",
+}
+
+func classifyError(err error) errorCategory {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return errPermission
+	case errors.Is(err, fs.ErrNotExist):
+		return errNotFound
+	case isNameTooLong(err):
+		return errNameTooLong
+	case isDiskFull(err):
+		return errDiskFull
+	case errors.Is(err, syscall.EIO):
+		return errIO
+	case errors.Is(err, errDestinationTaken), errors.Is(err, errDestinationExists):
+		return errCollision
+	case errors.Is(err, errIOTimeout):
+		return errTimeout
+	case errors.Is(err, errNaming):
+		return errNameMapping
+	case errors.Is(err, errSourceSize):
+		return errSizeChange
+	case errors.Is(err, errEncryption):
+		return errEncrypting
+	}
+
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		// anything else the OS reports for an operation on a path is an IO problem
+		return errIO
+	}
+	return errOther
+}
+
+// errorCollector counts the errors of a run by category and remembers the
+// paths that failed with permission denied.
+type errorCollector struct {
+	mu     sync.Mutex
+	counts map[errorCategory]int
+	denied []string
+}
+
+var (
+	copyErrors = &errorCollector{counts: map[errorCategory]int{}}
+
+	// abortCopy is set once continuing the run is pointless: copies that
+	// haven't started yet are skipped and running ones fail with errCopyAborted.
+	abortCopy atomic.Bool
+
+	errCopyAborted = errors.New("copy aborted")
+)
+
+func (c *errorCollector) record(path string, err error) errorCategory {
+	category := classifyError(err)
+
+	c.mu.Lock()
+	c.counts[category]++
+	if category == errPermission {
+		c.denied = append(c.denied, path)
+	}
+	c.mu.Unlock()
+
+	events.error(path, err)
+
+	if category == errDiskFull && abortCopy.CompareAndSwap(false, true) {
+		errorf("The output directory %q is out of space, stopping: %v\n", outputDirectory, err)
+	}
+	return category
+}
+
+func (c *errorCollector) snapshot() map[errorCategory]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make(map[errorCategory]int, len(c.counts))
+	for category, n := range c.counts {
+		counts[category] = n
+	}
+	return counts
+}
+
+func (c *errorCollector) String() string {
+	counts := c.snapshot()
+	categories := make([]string, 0, len(counts))
+	for category := range counts {
+		categories = append(categories, string(category))
+	}
+	sort.Strings(categories)
+
+	parts := make([]string, 0, len(categories))
+	for _, category := range categories {
+		parts = append(parts, fmt.Sprintf("%s: %d", errorCategoryLabels[errorCategory(category)], counts[errorCategory(category)]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (c *errorCollector) writeDeniedList(name string) error {
+	c.mu.Lock()
+	denied := append([]string(nil), c.denied...)
+	c.mu.Unlock()
+
+	sort.Strings(denied)
+	var b strings.Builder
+	for _, path := range denied {
+		b.WriteString(path)
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(name, []byte(b.String()), 0644)
+}
@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+
+package main
+
+func isDiskFull(err error) bool { return false }
+
+func isNameTooLong(err error) bool { return false }
+
+func isLocked(err error) bool { return false }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	errorHandleDiskFull     syscall.Errno = 39
+	errorDiskFull           syscall.Errno = 112
+	errorFilenameExcedRange syscall.Errno = 206
+)
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, errorDiskFull) || errors.Is(err, errorHandleDiskFull)
+}
+
+func isNameTooLong(err error) bool {
+	return errors.Is(err, errorFilenameExcedRange)
+}
+
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// isLocked reports whether another process has the file open without sharing it.
+func isLocked(err error) bool {
+	return errors.Is(err, errorSharingViolation) || errors.Is(err, errorLockViolation)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Events receives the progress of a copy run. Every method is called from
+// the one goroutine of the dispatcher, so implementations needn't be safe
+// for concurrent use. A slow implementation delays later events but never
+// the copy workers: scan progress is coalesced and file starts are dropped
+// while it's behind, file results, errors and the summary are all kept.
+type Events interface {
+	OnScanProgress(dirsSeen, filesSeen uint64)
+	OnFileStart(src, dst string, size int64)
+	// OnFileDone gets every file that was copied, skipped or failed.
+	OnFileDone(result reportRow)
+	OnError(err error)
+	OnSummary(summary runSummary)
+}
+
+// fileStartBacklog is how many file starts wait for a slow Events before
+// new ones are dropped.
+const fileStartBacklog = 256
+
+// events is the dispatcher of the running copy. Its methods do nothing on
+// nil, for the commands that don't have one.
+var events *eventDispatcher
+
+type eventDispatcher struct {
+	mu       sync.Mutex
+	handlers []Events
+	// queue holds the events that are never dropped, in order
+	queue []func(Events)
+	// barriers are closed once everything queued before them was delivered
+	barriers []chan struct{}
+
+	starts              chan fileStartEvent
+	dirsSeen, filesSeen atomic.Uint64
+	scanChanged         atomic.Bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+type fileStartEvent struct {
+	src, dst string
+	size     int64
+}
+
+func newEventDispatcher() *eventDispatcher {
+	d := &eventDispatcher{
+		starts: make(chan fileStartEvent, fileStartBacklog),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// attach adds a receiver for the events from now on.
+func (d *eventDispatcher) attach(h Events) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.handlers = append(d.handlers, h)
+	d.mu.Unlock()
+}
+
+func (d *eventDispatcher) scanProgress(dirsSeen, filesSeen uint64) {
+	if d == nil {
+		return
+	}
+	d.dirsSeen.Store(dirsSeen)
+	d.filesSeen.Store(filesSeen)
+	d.scanChanged.Store(true)
+	d.signal()
+}
+
+func (d *eventDispatcher) fileStart(src, dst string, size int64) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.starts <- fileStartEvent{src, dst, size}:
+		d.signal()
+	default:
+	}
+}
+
+func (d *eventDispatcher) fileDone(results ...reportRow) {
+	for _, result := range results {
+		d.enqueue(func(h Events) { h.OnFileDone(result) })
+	}
+}
+
+func (d *eventDispatcher) error(path string, err error) {
+	err = fmt.Errorf("%s: %w", path, err)
+	d.enqueue(func(h Events) { h.OnError(err) })
+}
+
+func (d *eventDispatcher) summary(s runSummary) {
+	d.enqueue(func(h Events) { h.OnSummary(s) })
+}
+
+func (d *eventDispatcher) enqueue(event func(Events)) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.queue = append(d.queue, event)
+	d.mu.Unlock()
+	d.signal()
+}
+
+func (d *eventDispatcher) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *eventDispatcher) run() {
+	defer close(d.done)
+	for {
+		select {
+		case <-d.wake:
+			d.deliver()
+		case <-d.stop:
+			d.deliver()
+			return
+		}
+	}
+}
+
+// deliver hands everything pending to the handlers: scan progress first,
+// then file starts, then the rest in the order it happened. A file's start
+// is always pending before its result.
+func (d *eventDispatcher) deliver() {
+	d.mu.Lock()
+	handlers := d.handlers
+	queue, barriers := d.queue, d.barriers
+	d.queue, d.barriers = nil, nil
+	d.mu.Unlock()
+
+	if d.scanChanged.Swap(false) {
+		dirs, files := d.dirsSeen.Load(), d.filesSeen.Load()
+		for _, h := range handlers {
+			h.OnScanProgress(dirs, files)
+		}
+	}
+	for pending := len(d.starts); pending > 0; pending-- {
+		start := <-d.starts
+		for _, h := range handlers {
+			h.OnFileStart(start.src, start.dst, start.size)
+		}
+	}
+	for _, event := range queue {
+		for _, h := range handlers {
+			event(h)
+		}
+	}
+	for _, barrier := range barriers {
+		close(barrier)
+	}
+}
+
+// sync waits until everything that happened so far was delivered.
+func (d *eventDispatcher) sync() {
+	if d == nil {
+		return
+	}
+	barrier := make(chan struct{})
+	d.mu.Lock()
+	d.barriers = append(d.barriers, barrier)
+	d.mu.Unlock()
+	d.signal()
+	<-barrier
+}
+
+// close delivers what's pending and stops the dispatcher.
+func (d *eventDispatcher) close() {
+	if d == nil {
+		return
+	}
+	close(d.stop)
+	<-d.done
+}
+
+// barEvents is the Events of the command line: it moves the progress bar.
+type barEvents struct {
+	bar *batchedBar
+}
+
+func (b barEvents) OnScanProgress(dirsSeen, filesSeen uint64) {}
+func (b barEvents) OnFileStart(src, dst string, size int64)   {}
+func (b barEvents) OnFileDone(result reportRow)               { b.bar.add(1) }
+func (b barEvents) OnError(err error)                         {}
+func (b barEvents) OnSummary(summary runSummary)              {}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	execAfter   string
+	execWorkers int
+	execTimeout time.Duration
+	execStrict  bool
+)
+
+// hookFailures counts -exec-after runs that exited non-zero or timed out.
+var hookFailures atomic.Uint64
+
+func execFlags(fs *flag.FlagSet) {
+	fs.StringVar(&execAfter, "exec-after", "", "run this command for every copied file, {} is replaced by the destination and {src} by the source,\n"+
+		"e.g. 'clamscan {}'. It isn't run through a shell")
+	fs.IntVar(&execWorkers, "exec-workers", runtime.NumCPU(), "number of -exec-after commands run at the same time, separate from the copy workers")
+	fs.DurationVar(&execTimeout, "exec-timeout", time.Minute, "kill an -exec-after command running longer than this")
+	fs.BoolVar(&execStrict, "exec-strict", false, "a failed -exec-after command fails the run instead of logging a warning")
+}
+
+// hookRunner runs -exec-after for copied files on its own goroutines. It
+// queues without bound, a slow command never holds up a copy worker.
+type hookRunner struct {
+	args []string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending [][2]string
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+var hooks *hookRunner
+
+// startHooks parses -exec-after and starts its workers, if given.
+func startHooks() error {
+	if execAfter == "" {
+		return nil
+	}
+	args, err := splitCommandLine(execAfter)
+	if err != nil {
+		return fmt.Errorf("-exec-after: %w", err)
+	}
+	if len(args) == 0 {
+		return errors.New("-exec-after: no command given")
+	}
+	if execWorkers < 1 {
+		return errors.New("-exec-workers must be at least 1")
+	}
+	hooks = &hookRunner{args: args}
+	hooks.cond = sync.NewCond(&hooks.mu)
+	hooks.wg.Add(execWorkers)
+	for i := 0; i < execWorkers; i++ {
+		go hooks.work()
+	}
+	return nil
+}
+
+// queue runs the command for a copied file, source and destination being
+// relative to the working directory.
+func (h *hookRunner) queue(source, destination string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.pending = append(h.pending, [2]string{source, destination})
+	h.mu.Unlock()
+	h.cond.Signal()
+}
+
+// wait runs the commands still queued and returns once all finished.
+func (h *hookRunner) wait() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+	h.cond.Broadcast()
+	h.wg.Wait()
+	if n := hookFailures.Load(); n > 0 {
+		summaryf("'%d' -exec-after commands failed\n", n)
+	}
+}
+
+func (h *hookRunner) work() {
+	defer h.wg.Done()
+	for {
+		h.mu.Lock()
+		for len(h.pending) == 0 && !h.closed {
+			h.cond.Wait()
+		}
+		if len(h.pending) == 0 {
+			h.mu.Unlock()
+			return
+		}
+		file := h.pending[0]
+		h.pending = h.pending[1:]
+		h.mu.Unlock()
+		h.run(file[0], file[1])
+	}
+}
+
+func (h *hookRunner) run(source, destination string) {
+	args := make([]string, len(h.args))
+	for i, arg := range h.args {
+		arg = strings.ReplaceAll(arg, "{src}", source)
+		args[i] = strings.ReplaceAll(arg, "{}", destination)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if len(output) > 0 {
+		verbosef("-exec-after %s: %s\n", destination, strings.TrimRight(string(output), "\n"))
+	}
+	if err == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("killed after %s", execTimeout)
+	}
+	hookFailures.Add(1)
+	if execStrict {
+		errorf("-exec-after failed for %q: %v\n", destination, err)
+	} else {
+		warnf("-exec-after failed for %q: %v\n", destination, err)
+	}
+}
+
+// queueHooks hands the destinations of copied entries to -exec-after.
+// Files stored in a -pack-small pack have no file of their own.
+func queueHooks(entries []manifestEntry) {
+	if hooks == nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Pack == "" {
+			hooks.queue(filepath.FromSlash(entry.Source), filepath.Join(outputDirectory, filepath.FromSlash(entry.Destination)))
+		}
+	}
+}
+
+// splitCommandLine splits s into arguments at spaces outside of single or
+// double quotes, which are removed. There are no escapes.
+func splitCommandLine(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
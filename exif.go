@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// exifHeaderBytes is how much of a file is read looking for EXIF data. The
+// metadata of JPEGs and TIFF based RAW formats lives at the start of the
+// file, so the rest of it is never read.
+const exifHeaderBytes = 256 << 10
+
+var exifExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".tif": true, ".tiff": true, ".heic": true, ".heif": true,
+	".cr2": true, ".nef": true, ".arw": true, ".dng": true, ".orf": true, ".rw2": true, ".pef": true, ".srw": true,
+}
+
+func hasExifExtension(name string) bool {
+	return exifExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+type exifInfo struct {
+	DateTimeOriginal time.Time
+	Model            string
+}
+
+var errNoExif = errors.New("no EXIF header found")
+
+func readExif(name string) (exifInfo, error) {
+	f, err := openSourceFile(name)
+	if err != nil {
+		return exifInfo{}, err
+	}
+	defer f.Close()
+
+	header := make([]byte, exifHeaderBytes)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return exifInfo{}, err
+	}
+	return parseExif(header[:n])
+}
+
+// parseExif finds the TIFF structure holding the EXIF tags: at the start of
+// TIFF and most RAW files, in the APP1 segment of JPEGs, and after the
+// "Exif\0\0" marker of the Exif item in HEIC files.
+func parseExif(header []byte) (exifInfo, error) {
+	switch {
+	case bytes.HasPrefix(header, []byte("II*\x00")) || bytes.HasPrefix(header, []byte("MM\x00*")):
+		return parseTIFF(header)
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8}):
+		return parseJPEGExif(header)
+	}
+
+	if i := bytes.Index(header, []byte("Exif\x00\x00")); i >= 0 {
+		return parseTIFF(header[i+6:])
+	}
+	return exifInfo{}, errNoExif
+}
+
+func parseJPEGExif(data []byte) (exifInfo, error) {
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return exifInfo{}, errors.New("corrupt JPEG marker")
+		}
+		marker := data[pos+1]
+		if marker == 0xD9 || marker == 0xDA {
+			// end of image or start of scan, metadata segments come before
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 {
+			return exifInfo{}, errors.New("corrupt JPEG segment length")
+		}
+		segment := data[pos+4 : min(pos+2+length, len(data))]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return parseTIFF(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return exifInfo{}, errNoExif
+}
+
+const (
+	tagModel            = 0x0110
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+	tagDateTime         = 0x0132
+)
+
+func parseTIFF(data []byte) (exifInfo, error) {
+	if len(data) < 8 {
+		return exifInfo{}, errors.New("truncated TIFF header")
+	}
+
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return exifInfo{}, errors.New("invalid TIFF byte order")
+	}
+
+	info := exifInfo{}
+	var dateTime string
+
+	ifd0, err := readIFD(data, order, order.Uint32(data[4:]))
+	if err != nil {
+		return info, err
+	}
+	if value, ok := ifd0[tagModel]; ok {
+		info.Model = value.ascii(data, order)
+	}
+	if value, ok := ifd0[tagDateTime]; ok {
+		dateTime = value.ascii(data, order)
+	}
+
+	if value, ok := ifd0[tagExifIFD]; ok {
+		exifIFD, err := readIFD(data, order, value.offset(order))
+		if err == nil {
+			if value, ok := exifIFD[tagDateTimeOriginal]; ok {
+				dateTime = value.ascii(data, order)
+			}
+		}
+	}
+
+	if dateTime != "" {
+		t, err := time.ParseInLocation("2006:01:02 15:04:05", strings.TrimSpace(dateTime), time.Local)
+		if err != nil {
+			return info, err
+		}
+		info.DateTimeOriginal = t
+	}
+	return info, nil
+}
+
+type ifdEntry struct {
+	kind  uint16
+	count uint32
+	value [4]byte
+}
+
+func (e ifdEntry) offset(order binary.ByteOrder) uint32 {
+	return order.Uint32(e.value[:])
+}
+
+func (e ifdEntry) ascii(data []byte, order binary.ByteOrder) string {
+	const asciiType = 2
+	if e.kind != asciiType {
+		return ""
+	}
+	var raw []byte
+	if e.count <= 4 {
+		raw = e.value[:e.count]
+	} else {
+		start := uint64(e.offset(order))
+		end := start + uint64(e.count)
+		if end > uint64(len(data)) {
+			return ""
+		}
+		raw = data[start:end]
+	}
+	return strings.TrimRight(string(raw), "\x00 ")
+}
+
+func readIFD(data []byte, order binary.ByteOrder, offset uint32) (map[uint16]ifdEntry, error) {
+	if uint64(offset)+2 > uint64(len(data)) {
+		return nil, errors.New("IFD offset outside of the header")
+	}
+	count := int(order.Uint16(data[offset:]))
+	pos := int(offset) + 2
+	if pos+count*12 > len(data) {
+		return nil, errors.New("IFD extends outside of the header")
+	}
+
+	entries := make(map[uint16]ifdEntry, count)
+	for i := 0; i < count; i++ {
+		raw := data[pos+i*12:]
+		entry := ifdEntry{kind: order.Uint16(raw[2:]), count: order.Uint32(raw[4:])}
+		copy(entry.value[:], raw[8:12])
+		entries[order.Uint16(raw)] = entry
+	}
+	return entries, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+var strictMode bool
+
+// Exit codes of the copy command. They are a contract for scripts: a
+// value keeps its meaning across releases and new outcomes get new values.
+const (
+	exitOK = 0
+	// exitFailed means at least one file could not be copied, with -strict
+	// that one was skipped or a warning was logged, or with -exec-strict
+	// that an -exec-after command failed, or -atomic-output couldn't be
+	// renamed.
+	exitFailed = 1
+	// exitUsage means the flags or arguments were invalid.
+	exitUsage = 2
+	// exitInterrupted means SIGINT or SIGTERM stopped the run with work
+	// remaining, -state recorded where.
+	exitInterrupted = 3
+	// exitCapReached means -max-files, -max-bytes or -min-free stopped the run with work remaining.
+	exitCapReached = 4
+	// exitDiskFull means the run stopped because the output filesystem was full.
+	exitDiskFull = 5
+	// exitEmpty means no file was selected for copying and -allow-empty wasn't given.
+	exitEmpty = 6
+)
+
+// runOutcome is how a copy run ended, copyExitCode maps it to the exit code.
+type runOutcome struct {
+	diskFull    bool
+	interrupted bool
+	capReached  bool
+	failed      uint64
+	skipped     uint64
+	warnings    uint64
+	hookFailed  bool
+	// outputFailed is set when -atomic-output couldn't be moved in place.
+	outputFailed bool
+}
+
+// exitCode is the one place deciding the exit code of a copy run. When
+// several apply, the first of this order wins: the output filesystem
+// filled up, files failed, -strict found skips or warnings, the run was
+// interrupted, a cap or -min-free stopped it.
+func (o runOutcome) exitCode() int {
+	switch {
+	case o.diskFull:
+		return exitDiskFull
+	case o.failed > 0, o.hookFailed, o.outputFailed:
+		return exitFailed
+	case strictMode && (o.skipped > 0 || o.warnings > 0):
+		return exitFailed
+	case o.interrupted:
+		return exitInterrupted
+	case o.capReached:
+		return exitCapReached
+	}
+	return exitOK
+}
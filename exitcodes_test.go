@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestRunOutcomeExitCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		outcome runOutcome
+		strict  bool
+		want    int
+	}{
+		{name: "clean", want: exitOK},
+		{name: "failed", outcome: runOutcome{failed: 1}, want: exitFailed},
+		{name: "hook failed", outcome: runOutcome{hookFailed: true}, want: exitFailed},
+		{name: "atomic output failed", outcome: runOutcome{outputFailed: true}, want: exitFailed},
+		{name: "skipped", outcome: runOutcome{skipped: 3}, want: exitOK},
+		{name: "skipped strict", outcome: runOutcome{skipped: 3}, strict: true, want: exitFailed},
+		{name: "warned strict", outcome: runOutcome{warnings: 1}, strict: true, want: exitFailed},
+		{name: "interrupted", outcome: runOutcome{interrupted: true}, want: exitInterrupted},
+		{name: "cap", outcome: runOutcome{capReached: true}, want: exitCapReached},
+		{name: "disk full", outcome: runOutcome{diskFull: true}, want: exitDiskFull},
+		{name: "disk full beats failed", outcome: runOutcome{diskFull: true, failed: 2}, want: exitDiskFull},
+		{name: "failed beats interrupted", outcome: runOutcome{failed: 1, interrupted: true}, want: exitFailed},
+		{name: "strict beats interrupted", outcome: runOutcome{skipped: 1, interrupted: true}, strict: true, want: exitFailed},
+		{name: "interrupted beats cap", outcome: runOutcome{interrupted: true, capReached: true}, want: exitInterrupted},
+	}
+	saved := strictMode
+	t.Cleanup(func() { strictMode = saved })
+	for _, test := range tests {
+		strictMode = test.strict
+		if got := test.outcome.exitCode(); got != test.want {
+			t.Errorf("%s: exit code %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// interruptingFS sends the process signals interrupts when the first file
+// is opened, and gives the handler time to see each before the copy goes
+// on.
+type interruptingFS struct {
+	fstest.MapFS
+	once    *sync.Once
+	signals int
+}
+
+func (f interruptingFS) Open(name string) (fs.File, error) {
+	if info, err := fs.Stat(f.MapFS, name); err == nil && !info.IsDir() {
+		f.once.Do(func() {
+			// the copy starts before the interrupt handler may be in place
+			time.Sleep(200 * time.Millisecond)
+			process, _ := os.FindProcess(os.Getpid())
+			for i := 0; i < f.signals; i++ {
+				process.Signal(os.Interrupt)
+				time.Sleep(300 * time.Millisecond)
+			}
+		})
+	}
+	return f.MapFS.Open(name)
+}
+
+func manyFiles(n int) fstest.MapFS {
+	tree := fstest.MapFS{}
+	for i := 0; i < n; i++ {
+		tree[fmt.Sprintf("d%d/f%d.txt", i%5, i)] = testFile(fmt.Sprint(i))
+	}
+	return tree
+}
+
+func init() {
+	copyCases["many"] = copyCase{source: manyFiles(20)}
+	copyCases["interrupt"] = copyCase{source: interruptingFS{MapFS: manyFiles(20), once: &sync.Once{}, signals: 1}}
+	// the quit cleanup leaves a file behind to show it ran
+	copyCases["interrupt twice"] = copyCase{
+		source: interruptingFS{MapFS: manyFiles(20), once: &sync.Once{}, signals: 2},
+		setup: func() {
+			atQuit(func() { os.WriteFile("cleaned-up", nil, 0644) })
+		},
+	}
+	copyCases["empty"] = copyCase{source: fstest.MapFS{"top.txt": testFile("not nested")}}
+}
+
+// TestCopyExitCodes runs a copy for every exit code of the contract.
+func TestCopyExitCodes(t *testing.T) {
+	tests := []struct {
+		name  string
+		cases string
+		args  []string
+		want  int
+	}{
+		{name: "copied", cases: "flatten", want: exitOK},
+		{name: "failed", cases: "errors", want: exitFailed},
+		{name: "unknown flag", cases: "flatten", args: []string{"-no-such-flag"}, want: exitUsage},
+		{name: "bad value", cases: "flatten", args: []string{"-queue-size", "-1"}, want: exitUsage},
+		{name: "max files", cases: "many", args: []string{"-max-files", "3"}, want: exitCapReached},
+		{name: "max bytes", cases: "many", args: []string{"-max-bytes", "4", "-c", "1"}, want: exitCapReached},
+		{name: "empty", cases: "empty", want: exitEmpty},
+		{name: "empty allowed", cases: "empty", args: []string{"-allow-empty"}, want: exitOK},
+		{name: "skipped", cases: "conflicts", want: exitOK},
+		{name: "skipped strict", cases: "conflicts", args: []string{"-strict"}, want: exitFailed},
+		{name: "interrupted", cases: "interrupt", args: []string{"-c", "1", "-queue-size", "1", "-small-batch", "1"}, want: exitInterrupted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.cases == "interrupt" && runtime.GOOS == "windows" {
+				t.Skip("a process can't interrupt itself on Windows")
+			}
+			r := runCopyTest(t, test.cases, test.args...)
+			if r.code != test.want {
+				t.Errorf("exit code %d, want %d\n%s", r.code, test.want, r.log)
+			}
+		})
+	}
+}
+
+// TestCopyResumeAfterCap stops a run at -max-files and resumes it from its
+// -state: the second run copies the rest and exits 0.
+func TestCopyResumeAfterCap(t *testing.T) {
+	wd := t.TempDir()
+	first := runCopyTestIn(t, wd, "many", "-max-files", "7", "-state", "state.json", "-c", "1")
+	if first.code != exitCapReached {
+		t.Fatalf("first run: exit code %d, want %d\n%s", first.code, exitCapReached, first.log)
+	}
+	if first.summary.CopiedItems != 7 || len(first.files) != 7 {
+		t.Errorf("first run copied %d, output %d files, want 7", first.summary.CopiedItems, len(first.files))
+	}
+
+	second := runCopyTestIn(t, wd, "many", "-resume", "-state", "state.json", "-c", "1")
+	if second.code != exitOK {
+		t.Fatalf("resumed run: exit code %d, want %d\n%s", second.code, exitOK, second.log)
+	}
+	if second.summary.CopiedItems != 13 || len(second.files) != 20 {
+		t.Errorf("resumed run copied %d, output %d files, want 13 and 20", second.summary.CopiedItems, len(second.files))
+	}
+	if a := second.summary.Accounting; !a.Balanced || a.EarlierRun != 7 {
+		t.Errorf("accounting = %+v, want 7 from the earlier run, balanced", a)
+	}
+}
+
+// TestCopyInterruptTwice quits on the second interrupt, without finishing
+// the run but after its quit cleanups.
+func TestCopyInterruptTwice(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("a process can't interrupt itself on Windows")
+	}
+	r := runCopyTest(t, "interrupt twice", "-c", "1", "-queue-size", "1", "-small-batch", "1")
+	if r.code != exitInterrupted {
+		t.Errorf("exit code %d, want %d\n%s", r.code, exitInterrupted, r.log)
+	}
+	if !r.summary.StartedAt.IsZero() {
+		t.Errorf("the run finished and wrote its summary, copied %d", r.summary.CopiedItems)
+	}
+	if _, err := os.Stat(filepath.Join(r.wd, "cleaned-up")); err != nil {
+		t.Errorf("the quit cleanups didn't run: %v\n%s", err, r.log)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	failedListName string
+	filesFromName  string
+	nullSeparated  bool
+)
+
+// filesFrom holds the slash separated source paths of -files-from, nil
+// without it.
+var filesFrom map[string]struct{}
+
+func filesFromFlags(fs *flag.FlagSet) {
+	fs.StringVar(&filesFromName, "files-from", "", "only copy the files listed in this file, one source path relative to the source root\n"+
+		"per line, as written by -failed-list")
+	fs.BoolVar(&nullSeparated, "null", false, "-files-from and -failed-list separate paths with NUL instead of newlines")
+}
+
+// loadFilesFrom reads -files-from, if given.
+func loadFilesFrom() error {
+	if filesFromName == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filesFromName)
+	if err != nil {
+		return fmt.Errorf("-files-from: %w", err)
+	}
+	separator := []byte("\n")
+	if nullSeparated {
+		separator = []byte{0}
+	}
+	filesFrom = map[string]struct{}{}
+	for _, line := range bytes.Split(data, separator) {
+		name := strings.TrimSuffix(string(line), "\r")
+		if name == "" {
+			continue
+		}
+		filesFrom[filepath.ToSlash(filepath.Clean(name))] = struct{}{}
+	}
+	return nil
+}
+
+// listedInFilesFrom reports whether -files-from, if given, lists name.
+func listedInFilesFrom(name string) bool {
+	if filesFrom == nil {
+		return true
+	}
+	_, ok := filesFrom[filepath.ToSlash(name)]
+	return ok
+}
+
+// failedList streams the source of every failed file to -failed-list as
+// it fails, so an interrupted or killed run leaves a complete list too.
+type failedList struct {
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	count int
+	err   error
+}
+
+var failures *failedList
+
+func openFailedList() error {
+	if failedListName == "" {
+		return nil
+	}
+	file, err := os.Create(failedListName)
+	if err != nil {
+		return err
+	}
+	failures = &failedList{file: file, w: bufio.NewWriter(file)}
+	return nil
+}
+
+// add records the failed rows among rows.
+func (l *failedList) add(rows ...reportRow) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, row := range rows {
+		if row.Outcome != outcomeFailed || l.err != nil {
+			continue
+		}
+		separator := "\n"
+		if nullSeparated {
+			separator = "\x00"
+		}
+		if _, l.err = l.w.WriteString(row.Source + separator); l.err == nil {
+			l.err = l.w.Flush()
+		}
+		l.count++
+	}
+}
+
+// close finishes the list and prints the command retrying its files.
+func (l *failedList) close(fs *flag.FlagSet) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Close(); l.err == nil {
+		l.err = err
+	}
+	if l.err == nil && l.count > 0 {
+		summaryf("'%d' files failed, retry them with: %s\n", l.count, retryCommand(fs))
+	}
+	return l.err
+}
+
+// retryCommand is the command line copying the -failed-list files again,
+// with every other flag the run was given.
+func retryCommand(fs *flag.FlagSet) string {
+	args := []string{"flatten", "copy"}
+	var flags []string
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "failed-list", "files-from", "resume", "state", "config":
+			return
+		}
+		flags = append(flags, "-"+f.Name+"="+shellQuote(f.Value.String()))
+	})
+	sort.Strings(flags)
+	args = append(args, flags...)
+	list, err := filepath.Abs(failedListName)
+	if err != nil {
+		list = failedListName
+	}
+	return strings.Join(append(args, "-files-from="+shellQuote(list)), " ")
+}
+
+// shellQuote quotes s for a POSIX shell if it needs it.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:,=+@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
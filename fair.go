@@ -0,0 +1,201 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fairSchedule is -fair.
+var fairSchedule bool
+
+// fairLogInterval is how often -fair -v logs the directories holding workers.
+const fairLogInterval = 10 * time.Second
+
+// fairScheduler hands walked jobs to the copy workers round-robin across
+// their directories, so a directory with hundreds of thousands of files
+// doesn't hold every worker while the rest of the tree waits. The walk
+// never waits for it: jobs are kept in memory until a worker is free, so
+// -queue-size doesn't apply. Each directory has a quota of jobs being
+// copied, which is only exceeded when every directory with jobs left is at
+// it.
+type fairScheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dirs    map[string]*fairDir
+	ring    *list.List
+	cursor  *list.Element
+	parked  int
+	quota   int
+	stopped bool
+	done    chan struct{}
+}
+
+// fairDir is a directory with jobs waiting or in flight. It's in the ring
+// while it has jobs waiting.
+type fairDir struct {
+	name     string
+	jobs     []copyJob
+	inFlight int
+	elem     *list.Element
+}
+
+// newFairScheduler starts feeding queue, with a quota of a quarter of the
+// workers per directory.
+func newFairScheduler(queue *jobQueue, workers int) *fairScheduler {
+	f := &fairScheduler{
+		dirs:  map[string]*fairDir{},
+		ring:  list.New(),
+		quota: max(1, workers/4),
+		done:  make(chan struct{}),
+	}
+	f.cond = sync.NewCond(&f.mu)
+	go f.feed(queue)
+	return f
+}
+
+func (f *fairScheduler) add(job copyJob) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dir := f.dirs[job.dir]
+	if dir == nil {
+		dir = &fairDir{name: job.dir}
+		f.dirs[job.dir] = dir
+	}
+	if dir.elem == nil {
+		dir.elem = f.ring.PushBack(dir)
+	}
+	dir.jobs = append(dir.jobs, job)
+	f.parked++
+	f.cond.Signal()
+}
+
+// feed sends the next job of the ring whenever the queue takes one.
+func (f *fairScheduler) feed(queue *jobQueue) {
+	defer close(f.done)
+	for {
+		f.mu.Lock()
+		for f.parked == 0 && !f.stopped {
+			f.cond.Wait()
+		}
+		if f.parked == 0 {
+			f.mu.Unlock()
+			return
+		}
+		job := f.next()
+		f.mu.Unlock()
+		queue.push(job)
+	}
+}
+
+// next takes the job to send from the first directory under its quota,
+// going round from the cursor, or from the one with the fewest jobs in
+// flight if all are at it. f.mu must be held and a job be waiting.
+func (f *fairScheduler) next() copyJob {
+	if f.cursor == nil {
+		f.cursor = f.ring.Front()
+	}
+	var pick *fairDir
+	e := f.cursor
+	for i := 0; i < f.ring.Len(); i++ {
+		dir := e.Value.(*fairDir)
+		if dir.inFlight < f.quota {
+			pick = dir
+			break
+		}
+		if pick == nil || dir.inFlight < pick.inFlight {
+			pick = dir
+		}
+		if e = e.Next(); e == nil {
+			e = f.ring.Front()
+		}
+	}
+
+	job := pick.jobs[0]
+	pick.jobs = pick.jobs[1:]
+	pick.inFlight++
+	f.parked--
+	f.cursor = pick.elem.Next()
+	if len(pick.jobs) == 0 {
+		f.ring.Remove(pick.elem)
+		pick.elem, pick.jobs = nil, nil
+	}
+	return job
+}
+
+// release ends a job of dirName in flight.
+func (f *fairScheduler) release(dirName string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dir := f.dirs[dirName]
+	if dir == nil {
+		return
+	}
+	dir.inFlight--
+	if dir.inFlight <= 0 && dir.elem == nil {
+		delete(f.dirs, dirName)
+	}
+	f.cond.Signal()
+}
+
+// stop ends feeding once no job is waiting any more.
+func (f *fairScheduler) stop() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.stopped = true
+	f.mu.Unlock()
+	f.cond.Broadcast()
+	<-f.done
+}
+
+// heldDirectories lists the directories of the files the copy workers are
+// busy with, with how many workers each holds.
+func (s *runStatus) heldDirectories() string {
+	held := map[string]int{}
+	for worker := range s.current {
+		if name := s.current[worker].Load(); name != nil {
+			held[filepath.Dir(*name)]++
+		}
+	}
+	dirs := make([]string, 0, len(held))
+	for dir := range held {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if held[dirs[i]] != held[dirs[j]] {
+			return held[dirs[i]] > held[dirs[j]]
+		}
+		return dirs[i] < dirs[j]
+	})
+	parts := make([]string, len(dirs))
+	for i, dir := range dirs {
+		parts[i] = fmt.Sprintf("%s (%d)", dir, held[dir])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// logHeldDirectories logs heldDirectories every fairLogInterval until stop
+// is closed, for -fair -v.
+func logHeldDirectories(stop <-chan struct{}) {
+	ticker := time.NewTicker(fairLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if held := status.heldDirectories(); held != "" {
+				verbosef("Directories holding copy workers: %s\n", held)
+			}
+		}
+	}
+}
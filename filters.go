@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	allowEmpty bool
+
+	includePatterns patternList
+	excludePatterns patternList
+
+	ownerFilter string
+	groupFilter string
+	permFilter  string
+)
+
+// filterFlagNames lists the flags that narrow down which files are
+// selected. They're reported when a run selects nothing, and in the JSON
+// summary.
+var filterFlagNames = []string{"resume", "stable-for", "max-files", "max-bytes", "owner", "group", "perm", "symlinks", "include-re", "exclude-re", "files-from", "only", "only-text", "only-binary"}
+
+// filterFlags are shared by copy and plan, so a plan shows the same selection.
+func filterFlags(fs *flag.FlagSet) {
+	linkFlags(fs)
+	filesFromFlags(fs)
+	fs.StringVar(&ownerFilter, "owner", "", "only copy files owned by this user name or uid (Unix only)")
+	fs.StringVar(&groupFilter, "group", "", "only copy files of this group name or gid (Unix only)")
+	fs.StringVar(&permFilter, "perm", "", "only copy files with these octal permission bits like find(1): exactly MODE,\n"+
+		"all of -MODE or any of /MODE (Unix only)")
+	fs.Var(&onlyRoots, "only", "only walk these comma separated directories relative to the source root, like dirA,dirB/sub,\n"+
+		"can be repeated")
+	fs.Var(&includePatterns, "include-re", "only copy files whose slash separated path relative to the source root matches this RE2\n"+
+		"regular expression, can be repeated to match any of them")
+	fs.Var(&excludePatterns, "exclude-re", "don't copy files whose slash separated path relative to the source root matches this RE2\n"+
+		"regular expression, can be repeated. Excludes apply after includes and win")
+	fs.BoolVar(&includePreviousOutput, "include-previous-output", false, "copy directories holding the output of an earlier run, see "+outputMarkerName)
+}
+
+// fileFilters must all accept a file for it to be selected.
+var fileFilters []func(info os.FileInfo) bool
+
+func prepareFilters() error {
+	fileFilters = nil
+	if err := loadFilesFrom(); err != nil {
+		return err
+	}
+	return prepareOwnerFilters()
+}
+
+// filterSkipDetail says why selected left out entry, for the skip records.
+func filterSkipDetail(name string, entry os.DirEntry) string {
+	if entry.Name() == outputMarkerName {
+		return "output marker of flatten"
+	}
+	if !onlySelected(name) {
+		return "outside of -only"
+	}
+	if !pathSelected(name) {
+		return "excluded by -files-from, -include-re or -exclude-re"
+	}
+	return "excluded by -owner, -group or -perm"
+}
+
+// selected applies the path patterns and fileFilters to a directory entry,
+// name being its path relative to the source root. Files that can't be
+// stat'ed are selected, so the copy reports the error.
+func selected(name string, entry os.DirEntry) bool {
+	if entry.Name() == outputMarkerName || !pathSelected(name) {
+		return false
+	}
+	if len(fileFilters) == 0 {
+		return true
+	}
+	info, err := entry.Info()
+	if err != nil {
+		return true
+	}
+	for _, accept := range fileFilters {
+		if !accept(info) {
+			return false
+		}
+	}
+	return true
+}
+
+// patternList is a repeatable flag of regular expressions, compiled as
+// they're parsed so an invalid one is a usage error.
+type patternList []*regexp.Regexp
+
+func (l *patternList) String() string {
+	if l == nil {
+		return ""
+	}
+	patterns := make([]string, len(*l))
+	for i, re := range *l {
+		patterns[i] = re.String()
+	}
+	return strings.Join(patterns, " ")
+}
+
+func (l *patternList) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, re)
+	return nil
+}
+
+func (l *patternList) repeatable() {}
+
+// matchesAny reports whether any pattern of the list matches name.
+func (l patternList) matchesAny(name string) bool {
+	for _, re := range l {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathSelected applies -only, -files-from, -include-re and then
+// -exclude-re to name, which is relative to the source root.
+func pathSelected(name string) bool {
+	name = filepath.ToSlash(name)
+	if !onlySelected(name) {
+		return false
+	}
+	if !listedInFilesFrom(name) {
+		return false
+	}
+	if len(includePatterns) > 0 && !includePatterns.matchesAny(name) {
+		return false
+	}
+	return !excludePatterns.matchesAny(name)
+}
+
+// activeFilters returns the filter flags given explicitly, with their values.
+func activeFilters(fs *flag.FlagSet) map[string]string {
+	active := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range filterFlagNames {
+			if f.Name == name {
+				active[name] = f.Value.String()
+			}
+		}
+	})
+	return active
+}
+
+func describeFilters(filters map[string]string) string {
+	if len(filters) == 0 {
+		return "no filters were active"
+	}
+	parts := make([]string, 0, len(filters))
+	for name, value := range filters {
+		parts = append(parts, fmt.Sprintf("-%s=%s", name, value))
+	}
+	sort.Strings(parts)
+	return "active filters: " + strings.Join(parts, " ")
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func prepareOwnerFilters() error {
+	if ownerFilter != "" || groupFilter != "" || permFilter != "" {
+		return errors.New("-owner, -group and -perm are only supported on Unix, this platform has no owners or permission bits to match")
+	}
+	return nil
+}
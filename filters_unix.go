@@ -0,0 +1,103 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+func prepareOwnerFilters() error {
+	if ownerFilter != "" {
+		uid, err := lookupID(ownerFilter, "user")
+		if err != nil {
+			return fmt.Errorf("-owner: %w", err)
+		}
+		fileFilters = append(fileFilters, func(info os.FileInfo) bool {
+			st, ok := info.Sys().(*syscall.Stat_t)
+			return ok && st.Uid == uid
+		})
+	}
+	if groupFilter != "" {
+		gid, err := lookupID(groupFilter, "group")
+		if err != nil {
+			return fmt.Errorf("-group: %w", err)
+		}
+		fileFilters = append(fileFilters, func(info os.FileInfo) bool {
+			st, ok := info.Sys().(*syscall.Stat_t)
+			return ok && st.Gid == gid
+		})
+	}
+	if permFilter != "" {
+		match, err := parsePerm(permFilter)
+		if err != nil {
+			return fmt.Errorf("-perm: %w", err)
+		}
+		fileFilters = append(fileFilters, func(info os.FileInfo) bool {
+			st, ok := info.Sys().(*syscall.Stat_t)
+			return ok && match(uint32(st.Mode)&07777)
+		})
+	}
+	return nil
+}
+
+// parsePerm parses a find(1) style octal -perm argument.
+func parsePerm(s string) (func(mode uint32) bool, error) {
+	kind := byte(0)
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "/") {
+		kind, s = s[0], s[1:]
+	}
+	bits, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || bits > 07777 {
+		return nil, fmt.Errorf("%q is not an octal mode like 644, -644 or /022", s)
+	}
+	want := uint32(bits)
+	switch kind {
+	case '-':
+		return func(mode uint32) bool { return mode&want == want }, nil
+	case '/':
+		// like find, /000 matches every file
+		return func(mode uint32) bool { return want == 0 || mode&want != 0 }, nil
+	}
+	return func(mode uint32) bool { return mode == want }, nil
+}
+
+var idCache sync.Map
+
+// lookupID resolves a user or group name to its id, numeric values are used
+// as they are.
+func lookupID(nameOrID, kind string) (uint32, error) {
+	if id, err := strconv.ParseUint(nameOrID, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	key := kind + ":" + nameOrID
+	if id, ok := idCache.Load(key); ok {
+		return id.(uint32), nil
+	}
+
+	var raw string
+	if kind == "user" {
+		u, err := user.Lookup(nameOrID)
+		if err != nil {
+			return 0, err
+		}
+		raw = u.Uid
+	} else {
+		g, err := user.LookupGroup(nameOrID)
+		if err != nil {
+			return 0, err
+		}
+		raw = g.Gid
+	}
+	id, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s %q has non numeric id %q", kind, nameOrID, raw)
+	}
+	idCache.Store(key, uint32(id))
+	return uint32(id), nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	genDirs        int
+	genFiles       int
+	genDepth       int
+	genFanout      int
+	genSizeDist    = newChoiceValue("smallbias", "smallbias", "uniform", "fixed")
+	genMaxSize     = sizeValue(256 << 10)
+	genDupRatio    float64
+	genCollisions  float64
+	genWeirdNames  float64
+	genSymlinks    float64
+	genSeed        int64
+	genAllowExists bool
+)
+
+var genTreeCommand = newCommand("gen-tree", "DIR", "Create a synthetic source tree to test and benchmark against. The same flags and -seed\n"+
+	"always create the same tree, names, contents and the modification times of files and directories included.", logFlags)
+
+func init() {
+	fs := genTreeCommand.flags
+	fs.IntVar(&genDirs, "dirs", 100, "number of directories below DIR")
+	fs.IntVar(&genFiles, "files", 1000, "number of files, spread over the directories. DIR itself gets none, copy leaves them out")
+	fs.IntVar(&genDepth, "depth", 4, "how deep directories are nested at most, the deepest path always reaches it")
+	fs.IntVar(&genFanout, "fanout", 0, "subdirectories per directory at most, 0 doesn't limit it")
+	fs.Var(genSizeDist, "size-dist", "file sizes up to -max-size: smallbias (log-uniform, most files are small), uniform, or fixed")
+	fs.Var(&genMaxSize, "max-size", "largest file size, e.g. 64K or 10M")
+	fs.Float64Var(&genDupRatio, "dup-ratio", 0.1, "share of files with the content of an earlier file")
+	fs.Float64Var(&genCollisions, "collisions", 0.1, "share of files named like a file of another directory, so they collide when flattened")
+	fs.Float64Var(&genWeirdNames, "weird-names", 0.05, "share of names with spaces, punctuation, non-ASCII characters or over 200 bytes")
+	fs.Float64Var(&genSymlinks, "symlinks", 0, "symbolic links to earlier files, as a share of -files")
+	fs.Int64Var(&genSeed, "seed", 1, "seed of the tree, quote it in a bug report instead of the data")
+	fs.BoolVar(&genAllowExists, "allow-existing", false, "write into DIR even if it isn't empty, same-named files are overwritten")
+	genTreeCommand.run = runGenTree
+}
+
+// genEpoch is the earliest modification time of a generated file, they
+// spread over the three years after it.
+var genEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const genMtimeSpan = 3 * 365 * 24 * 60 * 60
+
+var (
+	genTextExtensions   = []string{".txt", ".md", ".go", ".csv", ".log", ".json"}
+	genBinaryExtensions = []string{".jpg", ".png", ".bin", ".zip", ".pdf", ""}
+)
+
+// genDir is a generated directory, path relative to DIR. The root is the
+// first one.
+type genDir struct {
+	path     string
+	depth    int
+	children int
+}
+
+// genFile is a generated file. Files with the same contentSeed, size and
+// text have the same content.
+type genFile struct {
+	path        string
+	name        string
+	size        int64
+	text        bool
+	contentSeed int64
+}
+
+func runGenTree(args []string) int {
+	if len(args) != 1 {
+		genTreeCommand.flags.Usage()
+		return exitUsage
+	}
+	if err := validateGenTree(); err != nil {
+		fmt.Fprintf(os.Stderr, "flatten gen-tree: %v\n", err)
+		return exitUsage
+	}
+	root := args[0]
+	if err := prepareGenRoot(root); err != nil {
+		fmt.Fprintf(os.Stderr, "flatten gen-tree: %v\n", err)
+		return exitUsage
+	}
+
+	// everything is drawn from rng in a fixed order, so the tree only
+	// depends on the flags
+	rng := rand.New(rand.NewSource(genSeed))
+	dirs := genDirectories(rng)
+	for _, dir := range dirs[1:] {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir.path)), 0755); err != nil {
+			errorf("%v\n", err)
+			return exitFailed
+		}
+	}
+
+	var (
+		files      []genFile
+		total      int64
+		duplicates int
+		collisions int
+		weird      int
+	)
+	used := map[string]bool{}
+	for i := 0; i < genFiles; i++ {
+		dir := dirs[1+rng.Intn(len(dirs)-1)]
+		file := genFile{contentSeed: rng.Int63()}
+		switch {
+		case len(files) > 0 && rng.Float64() < genDupRatio:
+			original := files[rng.Intn(len(files))]
+			file.size, file.text, file.contentSeed = original.size, original.text, original.contentSeed
+			duplicates++
+		default:
+			file.size = genSize(rng)
+			file.text = rng.Intn(2) == 0
+		}
+		ext := genBinaryExtensions[rng.Intn(len(genBinaryExtensions))]
+		if file.text {
+			ext = genTextExtensions[rng.Intn(len(genTextExtensions))]
+		}
+		switch {
+		case len(files) > 0 && rng.Float64() < genCollisions:
+			file.name = files[rng.Intn(len(files))].name
+			collisions++
+		case rng.Float64() < genWeirdNames:
+			file.name = genWeirdName(rng, i) + ext
+			weird++
+		default:
+			file.name = fmt.Sprintf("file%06d%s", i, ext)
+		}
+		file.path = genUniquePath(used, dir.path, file.name)
+
+		name := filepath.Join(root, filepath.FromSlash(file.path))
+		if err := writeGenFile(name, file); err != nil {
+			errorf("%v\n", err)
+			return exitFailed
+		}
+		mtime := genEpoch.Add(time.Duration(rng.Int63n(genMtimeSpan)) * time.Second)
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			errorf("%v\n", err)
+			return exitFailed
+		}
+		verbosef("%s %s\n", file.path, formatBytes(file.size))
+		files = append(files, file)
+		total += file.size
+	}
+
+	links := 0
+	if len(files) > 0 {
+		for i := 0; i < int(float64(genFiles)*genSymlinks); i++ {
+			dir := dirs[1+rng.Intn(len(dirs)-1)]
+			target := files[rng.Intn(len(files))]
+			linkPath := genUniquePath(used, dir.path, fmt.Sprintf("link%06d", i))
+			relative, err := filepath.Rel(filepath.FromSlash(dir.path), filepath.FromSlash(target.path))
+			if err == nil {
+				err = os.Symlink(relative, filepath.Join(root, filepath.FromSlash(linkPath)))
+			}
+			if err != nil {
+				errorf("%v\n", err)
+				return exitFailed
+			}
+			links++
+		}
+	}
+
+	// last, creating their entries changed them
+	for i := len(dirs) - 1; i > 0; i-- {
+		mtime := genEpoch.Add(time.Duration(rng.Int63n(genMtimeSpan)) * time.Second)
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(dirs[i].path)), mtime, mtime); err != nil {
+			errorf("%v\n", err)
+			return exitFailed
+		}
+	}
+
+	infof("Generated '%d' directories and '%d' files of %s in %q with -seed '%d'\n", len(dirs)-1, len(files), formatBytes(total), root, genSeed)
+	infof("'%d' duplicate contents, '%d' colliding names, '%d' weird names, '%d' symlinks\n", duplicates, collisions, weird, links)
+	return exitOK
+}
+
+func validateGenTree() error {
+	switch {
+	case genDirs < 1:
+		return errors.New("-dirs must be at least 1, files are only put below DIR")
+	case genFiles < 0:
+		return errors.New("-files must not be negative")
+	case genDepth < 1:
+		return errors.New("-depth must be at least 1")
+	case genFanout < 0:
+		return errors.New("-fanout must not be negative")
+	case genMaxSize < 0:
+		return errors.New("-max-size must not be negative")
+	}
+	for _, ratio := range []struct {
+		name  string
+		value float64
+	}{{"dup-ratio", genDupRatio}, {"collisions", genCollisions}, {"weird-names", genWeirdNames}} {
+		if ratio.value < 0 || ratio.value > 1 {
+			return fmt.Errorf("-%s must be between 0 and 1", ratio.name)
+		}
+	}
+	if genSymlinks < 0 {
+		return errors.New("-symlinks must not be negative")
+	}
+	if genFanout > 0 {
+		// a full tree of the fanout and depth is the most it holds
+		capacity := 0.0
+		for level := 1; level <= genDepth; level++ {
+			capacity += math.Pow(float64(genFanout), float64(level))
+		}
+		if float64(genDirs) > capacity {
+			return fmt.Errorf("-fanout %d can't hold '%d' directories within -depth %d", genFanout, genDirs, genDepth)
+		}
+	}
+	return nil
+}
+
+// prepareGenRoot creates DIR, refusing one with entries unless
+// -allow-existing.
+func prepareGenRoot(root string) error {
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.MkdirAll(root, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 && !genAllowExists {
+		return fmt.Errorf("%q isn't empty, pass -allow-existing to write into it anyway", root)
+	}
+	return nil
+}
+
+// genDirectories lays out the directories. The first ones form a chain
+// down to -depth, the rest hang below any directory that still takes
+// children, so the fan-out varies like in a real tree.
+func genDirectories(rng *rand.Rand) []*genDir {
+	dirs := []*genDir{{}}
+	open := []*genDir{dirs[0]}
+	add := func(parent *genDir) *genDir {
+		name := fmt.Sprintf("dir%05d", len(dirs))
+		if rng.Float64() < genWeirdNames {
+			name = genWeirdName(rng, len(dirs))
+		}
+		dir := &genDir{path: strings.TrimPrefix(parent.path+"/"+name, "/"), depth: parent.depth + 1}
+		parent.children++
+		dirs = append(dirs, dir)
+		if dir.depth < genDepth {
+			open = append(open, dir)
+		}
+		return dir
+	}
+	full := func(dir *genDir) bool {
+		return genFanout > 0 && dir.children >= genFanout
+	}
+
+	parent := dirs[0]
+	for i := 0; i < genDirs && i < genDepth; i++ {
+		parent = add(parent)
+	}
+	for len(dirs)-1 < genDirs {
+		i := rng.Intn(len(open))
+		parent := open[i]
+		if full(parent) {
+			open[i] = open[len(open)-1]
+			open = open[:len(open)-1]
+			continue
+		}
+		add(parent)
+	}
+	return dirs
+}
+
+func genSize(rng *rand.Rand) int64 {
+	limit := int64(genMaxSize)
+	switch genSizeDist.value {
+	case "fixed":
+		return limit
+	case "uniform":
+		return rng.Int63n(limit + 1)
+	}
+	// log-uniform: as many files of 1-10 bytes as of 100-1000
+	return int64(math.Exp(rng.Float64()*math.Log(float64(limit)+1))) - 1
+}
+
+// genWeirdName is a name copy has to get right on every platform: no
+// separators, none of the characters Windows refuses and no trailing space
+// it would drop.
+func genWeirdName(rng *rand.Rand, i int) string {
+	switch rng.Intn(5) {
+	case 0:
+		return fmt.Sprintf("name with  spaces %d", i)
+	case 1:
+		return fmt.Sprintf("%s_%d", []string{"résumé", "日本語のファイル", "Ünïcödé", "emoji_😀", "Ελληνικά"}[rng.Intn(5)], i)
+	case 2:
+		// long enough to hit filename limits once a directory prefix is added
+		return fmt.Sprintf("%s_%d", strings.Repeat("very_long_name_", 14), i)
+	case 3:
+		return fmt.Sprintf("-dash #%d (copy) [1] & 'quoted' !%%+=", i)
+	}
+	return fmt.Sprintf(".hidden_%d", i)
+}
+
+// genUniquePath joins dir and name, numbering the name if dir already has
+// one like it, case-insensitively so the tree is the same on every
+// filesystem.
+func genUniquePath(used map[string]bool, dir, name string) string {
+	candidate := name
+	base, ext := splitExt(name)
+	for n := 2; used[strings.ToLower(dir+"/"+candidate)]; n++ {
+		candidate = fmt.Sprintf("%s_%d%s", base, n, ext)
+	}
+	used[strings.ToLower(dir+"/"+candidate)] = true
+	return strings.TrimPrefix(dir+"/"+candidate, "/")
+}
+
+func writeGenFile(name string, file genFile) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	content := &genContent{rng: rand.New(rand.NewSource(file.contentSeed)), text: file.text}
+	if _, err := io.CopyN(f, content, file.size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// genText is what text files are made of, weighted towards letters.
+const genText = "abcdefghijklmnopqrstuvwxyz     etaoinshr\n"
+
+// genContent is an endless stream of pseudo-random bytes, printable lines
+// for text files.
+type genContent struct {
+	rng  *rand.Rand
+	text bool
+}
+
+func (c *genContent) Read(p []byte) (int, error) {
+	c.rng.Read(p)
+	if c.text {
+		for i, b := range p {
+			p[i] = genText[int(b)%len(genText)]
+		}
+	}
+	return len(p), nil
+}
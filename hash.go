@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"hash"
+	"io"
+
+	"github.com/cespare/xxhash/v2"
+	"lukechampine.com/blake3"
+)
+
+// hashAlgorithm is the -hash choice shared by every feature that hashes
+// file contents. Copy hashes by teeing the stream it already reads, so
+// enabling it never causes a second read of the source. xxh64 is the
+// default, fast enough to tell duplicates apart at no noticeable cost.
+var hashAlgorithm = newChoiceValue("xxh64", "none", "md5", "sha1", "sha256", "xxh64", "blake3")
+
+func hashFlags(fs *flag.FlagSet) {
+	fs.Var(hashAlgorithm, "hash", "hash file contents while copying and record them in the manifest: none, md5, sha1, sha256\n"+
+		"(the default with -encrypt), xxh64 (fastest), blake3")
+}
+
+// newHasher returns nil for "none" and empty algorithms.
+func newHasher(algorithm string) hash.Hash {
+	switch algorithm {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "xxh64":
+		return xxhash.New()
+	case "blake3":
+		return blake3.New(32, nil)
+	}
+	return nil
+}
+
+func hashSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashStoredFile hashes the original content of a flattened file, undoing
+// its encryption and compression first.
+func hashStoredFile(name, algorithm string, entry manifestEntry) (string, int64, error) {
+	f, err := openStored(name, entry)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	plain, err := newDecryptor(entry.Encryption, f)
+	if err != nil {
+		return "", 0, err
+	}
+	defer plain.Close()
+	content, err := newDecompressor(entry.Compression, plain)
+	if err != nil {
+		return "", 0, err
+	}
+	defer content.Close()
+
+	h := newHasher(algorithm)
+	n, err := io.Copy(h, content)
+	if err != nil {
+		return "", n, err
+	}
+	return hashSum(h), n, nil
+}
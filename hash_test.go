@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCopyHashDefault copies with a manifest: without -hash its entries
+// have xxh64 hashes, -hash none leaves them out.
+func TestCopyHashDefault(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{want: "xxh64"},
+		{args: []string{"-hash", "sha256"}, want: "sha256"},
+		{args: []string{"-hash", "none"}, want: ""},
+	}
+	for _, test := range tests {
+		r := runCopyTest(t, "flatten", append([]string{"-manifest", "manifest.json"}, test.args...)...)
+		if r.code != exitOK {
+			t.Fatalf("%q: exit code %d, want %d\n%s", test.args, r.code, exitOK, r.log)
+		}
+		m, err := readManifest(filepath.Join(r.wd, "manifest.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.HashAlgorithm != test.want {
+			t.Errorf("%q: the manifest's hashes are %q, want %q", test.args, m.HashAlgorithm, test.want)
+		}
+		for _, entry := range m.Entries {
+			h := newHasher(test.want)
+			if h == nil {
+				if entry.Hash != "" {
+					t.Errorf("%q: %s has the hash %s, want none", test.args, entry.Source, entry.Hash)
+				}
+				continue
+			}
+			io.Copy(h, strings.NewReader(r.files[entry.Destination]))
+			if got := hashSum(h); entry.Hash != got {
+				t.Errorf("%q: %s has the hash %q, want %q", test.args, entry.Source, entry.Hash, got)
+			}
+		}
+	}
+}
+
+// BenchmarkHash copies 1MiB the way storeFile does, teeing the stream into
+// every -hash algorithm, none being the copy alone. xxh64 is the fastest.
+func BenchmarkHash(b *testing.B) {
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	buf := make([]byte, 32<<10)
+	for _, algorithm := range hashAlgorithm.choices() {
+		b.Run(algorithm, func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var source io.Reader = struct{ io.Reader }{bytes.NewReader(content)}
+				if h := newHasher(algorithm); h != nil {
+					source = io.TeeReader(source, h)
+				}
+				if _, err := io.CopyBuffer(io.Discard, source, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
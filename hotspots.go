@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxConflictPairs bounds the collisions kept for the hotspots, the ones
+// past it are only counted.
+const maxConflictPairs = 100000
+
+// conflictPair is a source whose destination another source of the run
+// took first, its owner.
+type conflictPair struct {
+	source      string
+	owner       string
+	destination string
+}
+
+// conflictRecorder keeps the collisions of the run for logConflictHotspots.
+type conflictRecorder struct {
+	mu    sync.Mutex
+	pairs []conflictPair
+	count int
+}
+
+var conflictPairs = &conflictRecorder{}
+
+func (r *conflictRecorder) record(source, owner, destination string) {
+	if source == "" || owner == "" {
+		// an empty directory marker, nothing to suggest a name for
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count++
+	if len(r.pairs) < maxConflictPairs {
+		r.pairs = append(r.pairs, conflictPair{filepath.ToSlash(source), filepath.ToSlash(owner), destination})
+	}
+}
+
+func (r *conflictRecorder) snapshot() ([]conflictPair, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]conflictPair(nil), r.pairs...), r.count
+}
+
+// conflictCandidate is a naming the colliding files are named again with,
+// keeping the innermost depth directories or, below 0, all of them.
+type conflictCandidate struct {
+	depth int
+	flag  string
+}
+
+var conflictCandidates = []conflictCandidate{
+	{1, `-name-template '{{lastDirs 1 .Dir}}_{{.Name}}'`},
+	{2, `-name-template '{{lastDirs 2 .Dir}}_{{.Name}}'`},
+	{3, `-name-template '{{lastDirs 3 .Dir}}_{{.Name}}'`},
+	{-1, "the default naming, without -name-template or -relative-to"},
+}
+
+func (c conflictCandidate) name(source string) string {
+	dir, name := path.Split(source)
+	dir = strings.TrimSuffix(dir, "/")
+	if c.depth >= 0 {
+		dir = lastDirs(c.depth, dir)
+	} else {
+		dir = strings.ReplaceAll(dir, "/", "_")
+	}
+	if dir == "" {
+		return name
+	}
+	return dir + "_" + name
+}
+
+// avoided counts the collisions of pairs the candidate names apart. A
+// destination with n sources had n-1 collisions, it keeps one per source
+// beyond the distinct names the candidate gives them. Only the colliding
+// files are looked at, others could still take the new names.
+func (c conflictCandidate) avoided(pairs []conflictPair) int {
+	groups := map[string]map[string]bool{}
+	for _, p := range pairs {
+		key := collisionKey(p.destination)
+		if groups[key] == nil {
+			groups[key] = map[string]bool{p.owner: true}
+		}
+		groups[key][p.source] = true
+	}
+	avoided := 0
+	for _, sources := range groups {
+		names := map[string]bool{}
+		for source := range sources {
+			names[collisionKey(c.name(source))] = true
+		}
+		avoided += len(names) - 1
+	}
+	return avoided
+}
+
+// conflictPattern is what a collision has in common with others: the file
+// name both sides had, and the directory both are under.
+type conflictPattern struct {
+	name   string
+	parent string
+}
+
+func patternOf(p conflictPair) conflictPattern {
+	sourceDir, sourceName := path.Split(p.source)
+	ownerDir, ownerName := path.Split(p.owner)
+	var pattern conflictPattern
+	if sourceName == ownerName {
+		pattern.name = sourceName
+	}
+	a, b := strings.Split(strings.Trim(sourceDir, "/"), "/"), strings.Split(strings.Trim(ownerDir, "/"), "/")
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	pattern.parent = strings.Join(a[:i], "/")
+	return pattern
+}
+
+// logConflictHotspots says which files caused most of the collisions of
+// the run, by name, parent directory and extension, and which naming
+// would have avoided the most of them.
+func logConflictHotspots() {
+	pairs, count := conflictPairs.snapshot()
+	if count == 0 {
+		return
+	}
+	if count > len(pairs) {
+		summaryf("Conflict hotspots of the first '%d' of '%d' name collisions:\n", len(pairs), count)
+	} else {
+		summaryf("Conflict hotspots of the '%d' name collisions:\n", count)
+	}
+
+	patterns := map[conflictPattern]int{}
+	extensions := map[string]int{}
+	for _, p := range pairs {
+		patterns[patternOf(p)]++
+		_, ext := splitExt(path.Base(p.source))
+		extensions[strings.ToLower(ext)]++
+	}
+	ranked := make([]conflictPattern, 0, len(patterns))
+	for pattern := range patterns {
+		ranked = append(ranked, pattern)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if patterns[ranked[i]] != patterns[ranked[j]] {
+			return patterns[ranked[i]] > patterns[ranked[j]]
+		}
+		return ranked[i].name+"/"+ranked[i].parent < ranked[j].name+"/"+ranked[j].parent
+	})
+	for _, pattern := range ranked[:min(3, len(ranked))] {
+		files := "files flattened to the same name"
+		if pattern.name != "" {
+			files = fmt.Sprintf("files named %s", pattern.name)
+		}
+		under := "from different top level directories"
+		if pattern.parent != "" {
+			under = fmt.Sprintf("from different directories under %s", pattern.parent)
+		}
+		n := patterns[pattern]
+		summaryf("  %d%% ('%d') are %s %s\n", n*100/len(pairs), n, files, under)
+	}
+
+	exts := make([]string, 0, len(extensions))
+	for ext := range extensions {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		if extensions[exts[i]] != extensions[exts[j]] {
+			return extensions[exts[i]] > extensions[exts[j]]
+		}
+		return exts[i] < exts[j]
+	})
+	byExt := make([]string, 0, 5)
+	for _, ext := range exts[:min(5, len(exts))] {
+		label := ext
+		if label == "" {
+			label = "(none)"
+		}
+		byExt = append(byExt, fmt.Sprintf("%s %d", label, extensions[ext]))
+	}
+	summaryf("  by extension: %s\n", strings.Join(byExt, ", "))
+
+	// the first candidate avoiding the most wins, it keeps the names shortest
+	best, bestAvoided := conflictCandidate{}, 0
+	for _, candidate := range conflictCandidates {
+		if n := candidate.avoided(pairs); n > bestAvoided {
+			best, bestAvoided = candidate, n
+		}
+	}
+	if bestAvoided > 0 {
+		summaryf("  %s would have avoided '%d' of them, judging by the colliding files alone\n", best.flag, bestAvoided)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// interrupted is set by the first SIGINT or SIGTERM of a copy run, the
+// dispatch limiter then stops the walk like a cap would.
+var interrupted atomic.Bool
+
+// watchInterrupt handles the first interrupt until stop is closed. A
+// second one quits right away with exitInterrupted.
+func watchInterrupt(stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case <-stop:
+		return
+	case sig := <-signals:
+		interrupted.Store(true)
+		runPause.wake()
+		infof("Got %v, finishing the copies already dispatched and stopping. Interrupt again to quit right away\n", sig)
+	}
+	select {
+	case <-stop:
+	case sig := <-signals:
+		warnf("Got %v again, quitting without finishing the copies\n", sig)
+		quit(exitInterrupted)
+	}
+}
+
+// quitCleanups undo what a run changed besides its output, like the mode
+// of the terminal or a snapshot of the source. Deferred calls don't run
+// when quit exits, these do.
+var quitCleanups struct {
+	sync.Mutex
+	funcs []func()
+}
+
+// atQuit has quit run cleanup. The returned func runs it too, for the
+// deferred call of a run that ends normally, and either only runs it once.
+func atQuit(cleanup func()) func() {
+	var once sync.Once
+	run := func() { once.Do(cleanup) }
+	quitCleanups.Lock()
+	quitCleanups.funcs = append(quitCleanups.funcs, run)
+	quitCleanups.Unlock()
+	return run
+}
+
+// quit runs the quit cleanups, the latest first like deferred calls, and
+// exits with code.
+func quit(code int) {
+	quitCleanups.Lock()
+	for i := len(quitCleanups.funcs) - 1; i >= 0; i-- {
+		quitCleanups.funcs[i]()
+	}
+	os.Exit(code)
+}
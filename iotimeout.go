@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ioTimeout time.Duration
+
+	// timedOutOps counts the filesystem operations given up on, hangingOps
+	// those of them still blocked in their goroutine.
+	timedOutOps atomic.Uint64
+	hangingOps  atomic.Int64
+
+	errIOTimeout = errors.New("skipped: timeout")
+)
+
+// withIOTimeout runs op, giving up on it after -io-timeout. A syscall
+// blocked on a hung network mount can't be interrupted, so its goroutine is
+// left behind; abandon, if not nil, is called with a result that arrives
+// after all, to release it.
+func withIOTimeout[T any](op func() (T, error), abandon func(T)) (T, error) {
+	if ioTimeout <= 0 {
+		return op()
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := op()
+		done <- result{value, err}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ioTimeout)
+	defer cancel()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-ctx.Done():
+	}
+
+	timedOutOps.Add(1)
+	hangingOps.Add(1)
+	go func() {
+		r := <-done
+		hangingOps.Add(-1)
+		if r.err == nil && abandon != nil {
+			abandon(r.value)
+		}
+	}()
+	var zero T
+	return zero, errIOTimeout
+}
+
+func readDirWithTimeout(name string) ([]os.DirEntry, error) {
+	return withIOTimeout(func() ([]os.DirEntry, error) { return readSourceDir(name) }, nil)
+}
+
+// readDirBatch is how many entries readDirBatches reads at a time.
+const readDirBatch = 4096
+
+// readDirBatches calls fn with the entries of a directory readDirBatch at a
+// time, in directory order, with -io-timeout applying to every read. Unlike
+// readDirWithTimeout it never holds all entries of a huge directory. A -src
+// archive's directories are read at once, their index is in memory anyway.
+func readDirBatches(name string, fn func([]os.DirEntry) error) error {
+	if sourceFS != nil {
+		entries, err := readDirWithTimeout(name)
+		if err != nil {
+			return err
+		}
+		return fn(entries)
+	}
+
+	dir, err := openWithTimeout(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	for {
+		entries, err := withIOTimeout(func() ([]os.DirEntry, error) { return dir.ReadDir(readDirBatch) }, nil)
+		if len(entries) > 0 {
+			if err := fn(entries); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func openWithTimeout(name string) (*os.File, error) {
+	return withIOTimeout(func() (*os.File, error) { return os.Open(name) }, func(f *os.File) { f.Close() })
+}
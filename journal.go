@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	chunkThreshold  = sizeValue(1 << 30)
+	checkpointEvery = sizeValue(64 << 20)
+)
+
+// A journaled copy writes to destination+partialSuffix and records its
+// checkpoints in destination+journalSuffix, both are gone once it
+// completes.
+const (
+	partialSuffix = ".flatten-partial"
+	journalSuffix = ".flatten-journal"
+)
+
+// copyJournal is the sidecar of a file of at least -chunk-threshold being
+// copied. A checkpoint every -checkpoint-every records how much of the
+// partial file is known to be on disk, and the SHA-256 of that prefix, so a
+// -resume after a crash or kill continues from there instead of byte zero.
+type copyJournal struct {
+	Source  string    `json:"source"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Offset is the length of the synced prefix, PrefixHash its hex encoded
+	// SHA-256.
+	Offset     int64  `json:"offset"`
+	PrefixHash string `json:"prefix_hash,omitempty"`
+
+	partial string
+	name    string
+	// resumable is set when the journal on disk matches the source and
+	// -resume asks to continue it.
+	resumable bool
+	hash      hash.Hash
+	pending   int64
+	// putBack makes a kept partial file read-only again, nil unless it
+	// was read-only before this run continued or restarted it.
+	putBack func(name string) error
+}
+
+// journalFor returns the journal of a copy of srcName to destPath, nil if
+// the file is copied in one go: it's smaller than -chunk-threshold, or
+// compressed, encrypted, transformed or read from an archive, where the
+// destination bytes can't be matched with a source offset.
+func journalFor(srcName, destPath, compression, encryption string) *copyJournal {
+	if chunkThreshold <= 0 || compression != "" || encryption != "" || len(textTransforms) > 0 || sourceFS != nil {
+		return nil
+	}
+	info, err := statSource(srcName)
+	if err != nil || info.Size() < int64(chunkThreshold) {
+		return nil
+	}
+	j := &copyJournal{
+		Source:  filepath.ToSlash(srcName),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		partial: destPath + partialSuffix,
+		name:    destPath + journalSuffix,
+		hash:    sha256.New(),
+	}
+	if !resumeFromCut {
+		return j
+	}
+	data, err := os.ReadFile(j.name)
+	if err != nil {
+		return j
+	}
+	var recorded copyJournal
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		warnf("Could not parse journal %q, copying %q from the start: %v\n", j.name, srcName, err)
+		return j
+	}
+	if recorded.Source != j.Source || recorded.Size != j.Size || !recorded.ModTime.Equal(j.ModTime) {
+		infof("%q changed since its interrupted copy, copying it from the start\n", srcName)
+		return j
+	}
+	j.Offset, j.PrefixHash = recorded.Offset, recorded.PrefixHash
+	j.resumable = j.Offset > 0
+	return j
+}
+
+// isJournalFile reports whether name is the partial file or journal of a
+// copy that didn't complete.
+func isJournalFile(name string) bool {
+	return strings.HasSuffix(name, partialSuffix) || strings.HasSuffix(name, journalSuffix)
+}
+
+// create opens the file a copy to destPath writes, the partial file for a
+// journaled copy. That is only truncated when it can't be continued. A
+// read-only file already there is made writable, putBack makes destPath
+// read-only again once the copy finished, it's nil if nothing was changed.
+func (j *copyJournal) create(destPath string) (file *os.File, putBack func(name string) error, err error) {
+	name, flag := destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC
+	if j != nil {
+		name, flag = j.partial, os.O_RDWR|os.O_CREATE
+	}
+	if j == nil || !j.resumable {
+		file, err := createDestination(name)
+		if !errors.Is(err, fs.ErrPermission) {
+			return file, nil, err
+		}
+		flag |= os.O_TRUNC
+	}
+	// a destination or the partial file of an earlier run may have become
+	// read-only, like from -preserve or being copied off a read-only medium
+	file, putBack, err = openWritable(name, flag, 0666)
+	if j != nil {
+		j.putBack = putBack
+	}
+	return file, putBack, err
+}
+
+// resume checks the prefix of the partial file against the journal and
+// positions dest and src after it, returning its length. content is fed
+// the prefix too, it's the hasher of the manifest if there is one. A prefix
+// that doesn't match is thrown away and the copy starts from byte zero.
+func (j *copyJournal) resume(dest *os.File, src fs.File, content hash.Hash) (int64, error) {
+	if j == nil || !j.resumable {
+		return 0, nil
+	}
+	seeker, ok := src.(io.Seeker)
+	if !ok {
+		return 0, j.restart(dest, content)
+	}
+	var w io.Writer = j.hash
+	if content != nil {
+		w = io.MultiWriter(j.hash, content)
+	}
+	n, err := io.CopyN(w, dest, j.Offset)
+	if err != nil || n != j.Offset || hex.EncodeToString(j.hash.Sum(nil)) != j.PrefixHash {
+		warnf("The partial copy %q doesn't match its journal, copying %q from the start\n", j.partial, j.Source)
+		return 0, j.restart(dest, content)
+	}
+	// what was written after the last checkpoint may not have made it to disk
+	if err := dest.Truncate(j.Offset); err != nil {
+		return 0, err
+	}
+	if _, err := seeker.Seek(j.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	infof("Resuming %q at %s of %s\n", j.Source, formatBytes(j.Offset), formatBytes(j.Size))
+	return j.Offset, nil
+}
+
+func (j *copyJournal) restart(dest *os.File, content hash.Hash) error {
+	j.Offset, j.PrefixHash, j.resumable = 0, "", false
+	j.hash.Reset()
+	if content != nil {
+		content.Reset()
+	}
+	if err := dest.Truncate(0); err != nil {
+		return err
+	}
+	_, err := dest.Seek(0, io.SeekStart)
+	return err
+}
+
+// wrap returns the writer a copy writes dest through, checkpointing a
+// journaled one.
+func (j *copyJournal) wrap(dest *os.File) io.Writer {
+	if j == nil {
+		return dest
+	}
+	return &checkpointWriter{j: j, f: dest}
+}
+
+// checkpointWriter syncs the partial file and records a checkpoint in the
+// journal every -checkpoint-every bytes.
+type checkpointWriter struct {
+	j *copyJournal
+	f *os.File
+}
+
+func (w *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.j.hash.Write(p[:n])
+	w.j.pending += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if checkpointEvery > 0 && w.j.pending >= int64(checkpointEvery) {
+		if err := w.j.checkpoint(w.f); err != nil {
+			return n, fmt.Errorf("could not write journal %q: %w", w.j.name, err)
+		}
+	}
+	return n, nil
+}
+
+// checkpoint syncs f and records everything written so far as the prefix
+// a -resume can continue from.
+func (j *copyJournal) checkpoint(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	j.Offset += j.pending
+	j.pending = 0
+	j.PrefixHash = hex.EncodeToString(j.hash.Sum(nil))
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	// write and rename so a crash never leaves a truncated journal behind
+	tmp := j.name + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.name)
+}
+
+// finish moves the completed partial file to destPath and removes the
+// journal.
+func (j *copyJournal) finish(destPath string) error {
+	if j == nil {
+		return nil
+	}
+	if err := os.Rename(j.partial, destPath); err != nil {
+		return err
+	}
+	if err := os.Remove(j.name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// discard cleans up after a failed copy to destPath. A journaled copy that
+// got past a checkpoint is kept for -resume, its partial file name doesn't
+// look like a complete copy.
+func (j *copyJournal) discard(destPath string) {
+	if j == nil {
+		os.Remove(destPath)
+		return
+	}
+	if j.Offset > 0 {
+		infof("Keeping the partial copy of %q up to %s, -resume continues it\n", j.Source, formatBytes(j.Offset))
+		if j.putBack != nil {
+			j.putBack(j.partial)
+		}
+		return
+	}
+	os.Remove(j.partial)
+	os.Remove(j.name)
+}
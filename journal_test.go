@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	// the killed case is killed once a journaled copy recorded its first
+	// checkpoint, that's a crash mid-copy
+	copyCases["killed"] = copyCase{setup: func() {
+		go func() {
+			for {
+				if found, _ := filepath.Glob(filepath.Join("out", "*"+journalSuffix)); len(found) > 0 {
+					self, _ := os.FindProcess(os.Getpid())
+					self.Kill()
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+	}}
+}
+
+// TestCopyJournalResume kills a copy of a big file after a checkpoint, then
+// the -resume run continues the partial copy instead of starting over. A
+// partial copy that became read-only in between is made writable, and is
+// read-only again once it's complete.
+func TestCopyJournalResume(t *testing.T) {
+	t.Run("writable", func(t *testing.T) { testCopyJournalResume(t, 0644) })
+	t.Run("read-only", func(t *testing.T) { testCopyJournalResume(t, 0444) })
+}
+
+func testCopyJournalResume(t *testing.T, partialMode os.FileMode) {
+	wd := t.TempDir()
+	content := make([]byte, 32<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err := os.Mkdir(filepath.Join(wd, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(wd, "data", "big.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	journaled := []string{"-chunk-threshold", "1048576", "-checkpoint-every", "32768", "-state", filepath.Join(t.TempDir(), "state.json")}
+
+	r := runCopyTestIn(t, wd, "killed", journaled...)
+	if r.code == exitOK {
+		t.Fatalf("the copy completed before it could be killed\n%s", r.log)
+	}
+	data, err := os.ReadFile(filepath.Join(wd, "out", "data_big.bin"+journalSuffix))
+	if err != nil {
+		t.Fatalf("the killed copy left no journal: %v\n%s", err, r.log)
+	}
+	var journal copyJournal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		t.Fatal(err)
+	}
+	if journal.Offset <= 0 || journal.Offset >= int64(len(content)) {
+		t.Fatalf("the journal of the killed copy is at %d of %d", journal.Offset, len(content))
+	}
+	partial := filepath.Join(wd, "out", "data_big.bin"+partialSuffix)
+	if err := os.Chmod(partial, partialMode); err != nil {
+		t.Fatal(err)
+	}
+
+	r = runCopyTestIn(t, wd, "workdir", append(journaled, "-resume")...)
+	if r.code != exitOK {
+		t.Fatalf("exit code %d of the resumed run, want %d\n%s", r.code, exitOK, r.log)
+	}
+	if !strings.Contains(r.log, "Resuming \"data/big.bin\" at ") {
+		t.Errorf("the resumed run didn't continue the partial copy:\n%s", r.log)
+	}
+	if got := r.files["data_big.bin"]; !bytes.Equal([]byte(got), content) {
+		t.Errorf("the resumed copy has %d bytes, not the %d of the source", len(got), len(content))
+	}
+	if info, err := os.Stat(filepath.Join(wd, "out", "data_big.bin")); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != partialMode {
+		t.Errorf("the resumed copy has mode %v, want the %v of the partial copy", info.Mode().Perm(), partialMode)
+	}
+	for name := range r.files {
+		if isJournalFile(name) {
+			t.Errorf("%s was left behind by the completed copy", name)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "os"
+
+// watchKeyboard reads single keys from the terminal while a copy runs: p
+// pauses dispatching new copies, r resumes and s prints a status line. It
+// does nothing unless both stdin and stderr are terminals. The returned
+// func puts the terminal back the way it was.
+func watchKeyboard() func() {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 || !stderrIsTerminal() {
+		return func() {}
+	}
+	restore, err := cbreakTerminal(os.Stdin)
+	if err != nil {
+		verbosef("Not reading keys from the terminal: %v\n", err)
+		return func() {}
+	}
+	infof("Press p to pause, r to resume, s for a status line\n")
+
+	// the read can't be interrupted, the goroutine ends with the process
+	go func() {
+		key := make([]byte, 1)
+		for {
+			if n, err := os.Stdin.Read(key); err != nil {
+				return
+			} else if n == 0 {
+				continue
+			}
+			switch key[0] {
+			case 'p', 'P':
+				runPause.pause("the keyboard")
+			case 'r', 'R':
+				runPause.resume("the keyboard")
+			case 's', 'S':
+				if s := status; s != nil {
+					s.logLines()
+				}
+			}
+		}
+	}()
+	return restore
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func cbreakTerminal(f *os.File) (func(), error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,34 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// cbreakTerminal turns off line buffering and echo of the terminal f, so
+// single keys can be read. Ctrl-C still sends SIGINT.
+func cbreakTerminal(f *os.File) (func(), error) {
+	fd := f.Fd()
+	var saved syscall.Termios
+	if err := termiosIoctl(fd, ioctlGetTermios, &saved); err != nil {
+		return nil, err
+	}
+	cbreak := saved
+	cbreak.Lflag &^= syscall.ICANON | syscall.ECHO
+	cbreak.Cc[syscall.VMIN] = 1
+	cbreak.Cc[syscall.VTIME] = 0
+	if err := termiosIoctl(fd, ioctlSetTermios, &cbreak); err != nil {
+		return nil, err
+	}
+	return func() { termiosIoctl(fd, ioctlSetTermios, &saved) }, nil
+}
+
+func termiosIoctl(fd, request uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var procSetConsoleMode = kernel32.NewProc("SetConsoleMode")
+
+// ENABLE_LINE_INPUT and ENABLE_ECHO_INPUT of the console input mode.
+const (
+	consoleLineInput = 0x0002
+	consoleEchoInput = 0x0004
+)
+
+// cbreakTerminal turns off line buffering and echo of the console f, so
+// single keys can be read. Ctrl-C still interrupts.
+func cbreakTerminal(f *os.File) (func(), error) {
+	handle := syscall.Handle(f.Fd())
+	var saved uint32
+	if err := syscall.GetConsoleMode(handle, &saved); err != nil {
+		return nil, err
+	}
+	if err := setConsoleMode(handle, saved&^(consoleLineInput|consoleEchoInput)); err != nil {
+		return nil, err
+	}
+	return func() { setConsoleMode(handle, saved) }, nil
+}
+
+func setConsoleMode(handle syscall.Handle, mode uint32) error {
+	r, _, err := procSetConsoleMode.Call(uintptr(handle), uintptr(mode))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// symlinkPolicy applies to symbolic links and, on Windows, to directory
+// junctions alike.
+var symlinkPolicy = newChoiceValue("follow", "follow", "skip", "preserve")
+
+func linkFlags(fs *flag.FlagSet) {
+	fs.Var(symlinkPolicy, "symlinks", "symbolic links and Windows junctions: follow (copy what they point to and descend into\n"+
+		"linked directories), skip, preserve (recreate the link in the output directory)")
+}
+
+type entryKind int
+
+const (
+	entryFile entryKind = iota
+	entryDir
+	// entrySkipped is a link left out by -symlinks skip.
+	entrySkipped
+)
+
+// classifyEntry decides how the walk treats a directory entry, path being
+// the entry's path relative to the working directory. Links preserved as
+// links are files, whatever they point to.
+func classifyEntry(path string, entry fs.DirEntry) entryKind {
+	if sourceFS != nil {
+		return classifyArchiveEntry(path, entry)
+	}
+	if !isLink(path, entry) {
+		if entry.IsDir() {
+			return entryDir
+		}
+		return entryFile
+	}
+
+	switch symlinkPolicy.value {
+	case "skip":
+		verbosef("skipping link %q\n", path)
+		return entrySkipped
+	case "preserve":
+		return entryFile
+	}
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		return entryDir
+	}
+	// dangling links fail when they're copied
+	return entryFile
+}
+
+// classifyArchiveEntry is classifyEntry for -src: links inside an archive
+// can't be followed, nor recreated without what they point to.
+func classifyArchiveEntry(path string, entry fs.DirEntry) entryKind {
+	switch {
+	case entry.IsDir():
+		return entryDir
+	case entry.Type()&fs.ModeSymlink != 0:
+		verbosef("skipping link %q of the archive\n", path)
+		return entrySkipped
+	}
+	return entryFile
+}
+
+// enterDirectory returns the ancestors to descend into dir's subdirectories
+// with. With -symlinks follow a link can lead back to a directory the walk
+// is already in, like the "Application Data" junction of Windows profiles,
+// so dir isn't entered if it's one of its own ancestors. The caller reports it.
+func enterDirectory(dir string, ancestors []os.FileInfo) ([]os.FileInfo, bool) {
+	if symlinkPolicy.value != "follow" || sourceFS != nil {
+		return nil, true
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		// reading it will report the error
+		return ancestors, true
+	}
+	for _, ancestor := range ancestors {
+		if os.SameFile(ancestor, info) {
+			return nil, false
+		}
+	}
+	return append(ancestors[:len(ancestors):len(ancestors)], info), true
+}
+
+// isLinkPath is isLink for a path instead of a directory entry.
+func isLinkPath(path string) bool {
+	if sourceFS != nil {
+		return false
+	}
+	info, err := os.Lstat(path)
+	return err == nil && isLink(path, fs.FileInfoToDirEntry(info))
+}
+
+// preserveLink recreates the link srcName as destName. Relative targets
+// are made absolute, they would point elsewhere from the output directory.
+func preserveLink(srcName, destName string) (manifestEntry, error) {
+	if err := claimDestination(destName, srcName); err != nil {
+		return manifestEntry{}, err
+	}
+	if err := ensureDestinationDir(destName); err != nil {
+		return manifestEntry{}, err
+	}
+
+	target, err := os.Readlink(srcName)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	if !filepath.IsAbs(target) {
+		dir, err := filepath.Abs(filepath.Dir(srcName))
+		if err != nil {
+			return manifestEntry{}, err
+		}
+		target = filepath.Join(dir, target)
+	}
+	info, err := os.Lstat(srcName)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	if err := os.Symlink(target, filepath.Join(outputDirectory, filepath.FromSlash(destName))); err != nil {
+		return manifestEntry{}, err
+	}
+	return manifestEntry{
+		Source:      filepath.ToSlash(srcName),
+		Destination: destName,
+		ModTime:     info.ModTime(),
+		LinkTarget:  target,
+	}, nil
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "io/fs"
+
+// isLink reports whether the entry is a symbolic link.
+func isLink(path string, entry fs.DirEntry) bool {
+	return entry.Type()&fs.ModeSymlink != 0
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// Reparse tags of the reparse points that are links. Other reparse points,
+// like OneDrive placeholders or deduplicated files, are regular files.
+const (
+	reparseTagMountPoint = 0xA0000003
+	reparseTagSymlink    = 0xA000000C
+)
+
+// isLink reports whether the entry is a symbolic link or a junction. How
+// ReadDir classifies those changed between Go versions, so the Win32
+// attributes and reparse tag are checked directly.
+func isLink(path string, entry fs.DirEntry) bool {
+	info, err := entry.Info()
+	if err != nil {
+		return entry.Type()&fs.ModeSymlink != 0
+	}
+	attrs, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok || attrs.FileAttributes&syscall.FILE_ATTRIBUTE_REPARSE_POINT == 0 {
+		return false
+	}
+
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return false
+	}
+	var data syscall.Win32finddata
+	handle, err := syscall.FindFirstFile(name, &data)
+	if err != nil {
+		return info.Mode()&fs.ModeSymlink != 0
+	}
+	syscall.FindClose(handle)
+	// for reparse points, Reserved0 holds the reparse tag
+	return data.Reserved0 == reparseTagMountPoint || data.Reserved0 == reparseTagSymlink
+}
@@ -0,0 +1,43 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCopyJunctionCycle copies a tree with a junction back to its parent,
+// like the "Application Data" junction of Windows profiles: the walk ends
+// and reports the cycle once, the files are copied once.
+func TestCopyJunctionCycle(t *testing.T) {
+	wd := t.TempDir()
+	profile := filepath.Join(wd, "profile")
+	if err := os.MkdirAll(filepath.Join(profile, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(profile, "docs", "note.txt"), []byte("note"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	junction := filepath.Join(profile, "docs", "Application Data")
+	if out, err := exec.Command("cmd", "/c", "mklink", "/J", junction, profile).CombinedOutput(); err != nil {
+		t.Skipf("could not create a junction: %v\n%s", err, out)
+	}
+
+	r := runCopyTestIn(t, wd, "workdir")
+	if r.code != exitOK {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+	}
+	if len(r.files) != 1 || r.files["profile_docs_note.txt"] != "note" {
+		t.Errorf("output has %q, want profile_docs_note.txt", r.names())
+	}
+	if n := r.summary.SkippedByReason[skipLoop]; n != 1 {
+		t.Errorf("%d loops skipped, want the junction once", n)
+	}
+	if n := strings.Count(r.log, "links back to one of its parent directories"); n != 1 {
+		t.Errorf("the cycle is reported %d times, want once:\n%s", n, r.log)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// Every log line goes through these, so the level tags stay consistent and
+// lines printed while the progress bar is shown don't splice into it.
+
+func infof(format string, args ...any) {
+	log.Printf("[INFO] "+format, args...)
+}
+
+// warnf is for problems that don't make the run fail.
+// warnings counts warnf calls, -strict fails a run that logged any.
+var warnings atomic.Uint64
+
+func warnf(format string, args ...any) {
+	warnings.Add(1)
+	log.Printf("[WARN] "+format, args...)
+}
+
+func errorf(format string, args ...any) {
+	log.Printf("[ERROR] "+format, args...)
+}
+
+// summaryf prints the end of run summary lines.
+func summaryf(format string, args ...any) {
+	log.Printf("[SUMMARY] "+format, args...)
+}
+
+func verbosef(format string, args ...any) {
+	if verbose {
+		log.Printf("[DEBUG] "+format, args...)
+	}
+}
+
+// logTimestamps is -log-timestamps, datetime is how log lines always began.
+var logTimestamps = newChoiceValue("datetime", "none", "time", "datetime", "rfc3339")
+
+var timestampLayouts = map[string]string{
+	"time":     "15:04:05",
+	"datetime": "2006/01/02 15:04:05",
+	"rfc3339":  time.RFC3339,
+}
+
+// timestampWriter starts every log entry with the -log-timestamps time, in
+// place of the log package's own so the -log-file gets the same.
+type timestampWriter struct {
+	w      io.Writer
+	layout string
+}
+
+func (t timestampWriter) Write(p []byte) (int, error) {
+	if t.layout == "" {
+		return t.w.Write(p)
+	}
+	entry := append([]byte(runClock.Now().Format(t.layout)+" "), p...)
+	if _, err := t.w.Write(entry); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// setupLogging applies the shared log flags. Colors only go to stderr,
+// never into the -log-file.
+func setupLogging() (func(), error) {
+	log.SetFlags(0)
+	stamp := func(w io.Writer) io.Writer { return timestampWriter{w, timestampLayouts[logTimestamps.value]} }
+	var stderr io.Writer = os.Stderr
+	if useColor() {
+		stderr = colorWriter{os.Stderr}
+	}
+	stderr = barWriter{stderr}
+	if logFilePath == "" {
+		log.SetOutput(stamp(stderr))
+		return resetLogging, nil
+	}
+
+	file, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open log file: %w", err)
+	}
+	log.SetOutput(stamp(io.MultiWriter(stderr, file)))
+	return func() {
+		resetLogging()
+		file.Close()
+	}, nil
+}
+
+func resetLogging() {
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+}
+
+// barWriter moves the progress bar, if one is shown, below every log entry:
+// it clears the bar's line, writes the entry and draws the bar again.
+type barWriter struct {
+	w io.Writer
+}
+
+func (b barWriter) Write(p []byte) (int, error) {
+	barMu.Lock()
+	defer barMu.Unlock()
+	bar := progressBar.Load()
+	if bar == nil {
+		return b.w.Write(p)
+	}
+	bar.Clear()
+	n, err := b.w.Write(p)
+	bar.RenderBlank()
+	return n, err
+}
+
+// redrawOnResize redraws the progress bar whenever the terminal is resized,
+// until stop is closed. The bar measures the terminal on every draw, the
+// old line has to be cleared first though or its tail is left behind.
+func redrawOnResize(stop <-chan struct{}) {
+	sigs := resizeSignals()
+	if len(sigs) == 0 {
+		return
+	}
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, sigs...)
+	defer signal.Stop(resized)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-resized:
+			withBar(func(bar *progressbar.ProgressBar) {
+				bar.Clear()
+				bar.RenderBlank()
+			})
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCopyLogTimestamps starts every log line with the time of the run's
+// clock in the -log-timestamps layout.
+func TestCopyLogTimestamps(t *testing.T) {
+	r := runCopyTest(t, "flatten", "-log-timestamps", "rfc3339")
+	if r.code != exitOK {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+	}
+	stamp := testEpoch.Format(time.RFC3339) + " ["
+	lines := strings.Split(strings.TrimSuffix(r.log, "\n"), "\n")
+	for _, line := range lines {
+		if !strings.HasPrefix(line, stamp) {
+			t.Errorf("log line %q doesn't start with the clock's %s", line, testEpoch.Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "flag"
+
+// lowPriority is -low-priority.
+var lowPriority bool
+
+func lowPriorityFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&lowPriority, "low-priority", false, "keep the machine usable: idle IO priority and the lowest CPU priority where the\n"+
+		"platform has them, and half the default number of workers")
+}
+
+// applyLowPriority lowers the priority of the process for -low-priority
+// and halves *workers unless -c set it. Where the platform can't, only the
+// workers are reduced.
+func applyLowPriority(fs *flag.FlagSet, workers *int) {
+	if !lowPriority {
+		return
+	}
+	if !flagWasSet(fs, "c") {
+		*workers = max(1, *workers/2)
+	}
+	if err := lowerPriority(); err != nil {
+		infof("-low-priority: could not lower the priority of the process (%v), only using fewer workers\n", err)
+		return
+	}
+	verbosef("-low-priority: running with %s\n", lowPriorityMode)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// ioprio_set(2) constants, the idle class gets disk time only when no other
+// process wants it.
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+const lowPriorityMode = "the idle IO scheduling class and niceness 19"
+
+// lowerPriority sets the IO class and niceness of every thread: both are
+// per thread on Linux, and threads the runtime starts later inherit them
+// from the one they are cloned from.
+func lowerPriority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+		if errno != 0 {
+			return errno
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, 19); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package main
+
+import "errors"
+
+const lowPriorityMode = ""
+
+func lowerPriority() error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,23 @@
+package main
+
+import "syscall"
+
+var procSetPriorityClass = kernel32.NewProc("SetPriorityClass")
+
+// processModeBackgroundBegin is PROCESS_MODE_BACKGROUND_BEGIN, it lowers
+// the CPU, IO and memory priority of the process.
+const processModeBackgroundBegin = 0x00100000
+
+const lowPriorityMode = "background processing mode"
+
+func lowerPriority() error {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	r, _, err := procSetPriorityClass.Call(uintptr(process), processModeBackgroundBegin)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
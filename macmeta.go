@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	macMetadata bool
+	// appleDouble is what -mac-metadata does with an AppleDouble "._X"
+	// file next to X: pair copies it next to X's destination, merge sets
+	// the attributes it holds on X's destination instead (macOS only).
+	appleDouble = newChoiceValue("pair", "pair", "merge")
+)
+
+// macXattrs are the extended attributes -mac-metadata copies: Finder tags,
+// Finder info (with the label color) and the resource fork.
+var macXattrs = []string{"com.apple.metadata:_kMDItemUserTags", "com.apple.FinderInfo", "com.apple.ResourceFork"}
+
+// prepareMacMetadata warns about -mac-metadata where there are no xattrs
+// to copy, only the pairing of AppleDouble files is left then.
+func prepareMacMetadata() {
+	if !macMetadata || xattrsSupported {
+		return
+	}
+	warnf("-mac-metadata only copies Finder tags and resource forks on macOS, AppleDouble files are only paired with their primary\n")
+	appleDouble.value = "pair"
+}
+
+// isAppleDouble reports whether name is an AppleDouble file, which macOS
+// writes as "._X" next to X on filesystems without xattrs. They're only
+// told apart with -mac-metadata.
+func isAppleDouble(name string) bool {
+	return macMetadata && len(name) > 2 && strings.HasPrefix(name, "._")
+}
+
+// appleDoubleDestination keeps "._X" next to X however X was named, at
+// "._" and the base of X's destination.
+func appleDoubleDestination(primaryDest string) string {
+	dir, base := filepath.Split(filepath.FromSlash(primaryDest))
+	return filepath.ToSlash(dir) + "._" + base
+}
+
+// copyMacMetadata sets the macXattrs of srcName on destPath. A missing
+// attribute is nothing to copy, one that can't be copied only a warning.
+func copyMacMetadata(srcName, destPath string, entry *manifestEntry) {
+	if !macMetadata || !xattrsSupported {
+		return
+	}
+	for _, attr := range macXattrs {
+		value, err := getXattr(srcName, attr)
+		if err != nil {
+			warnf("Could not read %s of %q: %v\n", attr, srcName, err)
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		if err := setXattr(destPath, attr, value); err != nil {
+			warnf("Could not copy %s of %q: %v\n", attr, srcName, err)
+			continue
+		}
+		entry.Xattrs = append(entry.Xattrs, attr)
+	}
+}
+
+// mergeIntoPrimary merges the AppleDouble file name of a group into its
+// copied primary with -apple-double merge. It reports false when the file
+// has to be copied like any sidecar instead: for other modes, other files,
+// primaries without a file of their own, or when merging failed.
+func mergeIntoPrimary(fullPath string, group []string, name string, entries []manifestEntry) (reportRow, bool) {
+	if appleDouble.value != "merge" || name != "._"+group[0] || len(entries) == 0 {
+		return reportRow{}, false
+	}
+	primary := &entries[0]
+	if primary.Pack != "" || primary.LinkTarget != "" || primary.Compression != "" || primary.Encryption != "" {
+		return reportRow{}, false
+	}
+	start := time.Now()
+	srcName := filepath.Join(fullPath, name)
+	size, err := mergeAppleDouble(srcName, filepath.Join(outputDirectory, filepath.FromSlash(primary.Destination)), primary)
+	if err != nil {
+		warnf("Could not merge %q into the attributes of its primary, copying it instead: %v\n", srcName, err)
+		return reportRow{}, false
+	}
+	return reportRow{
+		Source:      filepath.ToSlash(srcName),
+		Destination: primary.Destination,
+		Size:        size,
+		Start:       start,
+		Duration:    time.Since(start),
+		Outcome:     outcomeCopied,
+	}, true
+}
+
+// mergeAppleDouble sets the attributes stored in the AppleDouble file
+// srcName on destPath and returns the file's size.
+func mergeAppleDouble(srcName, destPath string, entry *manifestEntry) (int64, error) {
+	file, err := openSource(srcName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+	attrs, err := parseAppleDouble(data)
+	if err != nil {
+		return 0, err
+	}
+	for _, attr := range attrs {
+		if err := setXattr(destPath, attr.name, attr.value); err != nil {
+			return 0, fmt.Errorf("%s: %w", attr.name, err)
+		}
+		entry.Xattrs = append(entry.Xattrs, attr.name)
+	}
+	return int64(len(data)), nil
+}
+
+type xattr struct {
+	name  string
+	value []byte
+}
+
+var errNotAppleDouble = errors.New("not an AppleDouble file")
+
+// AppleDouble entry IDs, see RFC 1740.
+const (
+	appleDoubleResourceFork = 2
+	appleDoubleFinderInfo   = 9
+)
+
+// parseAppleDouble returns the attributes an AppleDouble file holds: the
+// Finder info, the resource fork and the extended attributes macOS
+// appends to the Finder info in an "ATTR" block. Everything is big endian.
+func parseAppleDouble(data []byte) ([]xattr, error) {
+	if len(data) < 26 || binary.BigEndian.Uint32(data) != 0x00051607 {
+		return nil, errNotAppleDouble
+	}
+	var attrs []xattr
+	n := int(binary.BigEndian.Uint16(data[24:]))
+	for i := 0; i < n; i++ {
+		header := 26 + i*12
+		if header+12 > len(data) {
+			return nil, errNotAppleDouble
+		}
+		id := binary.BigEndian.Uint32(data[header:])
+		offset := int(binary.BigEndian.Uint32(data[header+4:]))
+		length := int(binary.BigEndian.Uint32(data[header+8:]))
+		if offset < 0 || length < 0 || offset+length > len(data) {
+			return nil, fmt.Errorf("entry %d reaches past the end of the file", id)
+		}
+		value := data[offset : offset+length]
+		switch id {
+		case appleDoubleResourceFork:
+			if length > 0 {
+				attrs = append(attrs, xattr{"com.apple.ResourceFork", value})
+			}
+		case appleDoubleFinderInfo:
+			if length < 32 {
+				continue
+			}
+			if !bytes.Equal(value[:32], make([]byte, 32)) {
+				attrs = append(attrs, xattr{"com.apple.FinderInfo", value[:32]})
+			}
+			extended, err := parseAppleDoubleAttrs(data, offset+34, offset+length)
+			if err != nil {
+				return nil, err
+			}
+			attrs = append(attrs, extended...)
+		}
+	}
+	return attrs, nil
+}
+
+// parseAppleDoubleAttrs reads the "ATTR" block at start, if there is one
+// before end. Its entry offsets are relative to the start of the file.
+func parseAppleDoubleAttrs(data []byte, start, end int) ([]xattr, error) {
+	if start+36 > end || string(data[start:start+4]) != "ATTR" {
+		return nil, nil
+	}
+	var attrs []xattr
+	n := int(binary.BigEndian.Uint16(data[start+34:]))
+	pos := start + 36
+	for i := 0; i < n; i++ {
+		if pos+11 > end {
+			return nil, errors.New("truncated extended attribute entry")
+		}
+		offset := int(binary.BigEndian.Uint32(data[pos:]))
+		length := int(binary.BigEndian.Uint32(data[pos+4:]))
+		nameLen := int(data[pos+10])
+		if pos+11+nameLen > end || offset < 0 || length < 0 || offset+length > len(data) {
+			return nil, errors.New("extended attribute entry reaches past the end of the file")
+		}
+		name := strings.TrimRight(string(data[pos+11:pos+11+nameLen]), "\x00")
+		attrs = append(attrs, xattr{name, data[offset : offset+length]})
+		// entries are aligned to 4 bytes
+		pos += (11 + nameLen + 3) &^ 3
+	}
+	return attrs, nil
+}
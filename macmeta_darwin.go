@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+const xattrsSupported = true
+
+// getXattr returns nil for an attribute the file doesn't have.
+func getXattr(name, attr string) ([]byte, error) {
+	for {
+		size, err := unix.Getxattr(name, attr, nil)
+		if errors.Is(err, unix.ENOATTR) || errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		n, err := unix.Getxattr(name, attr, value)
+		if errors.Is(err, unix.ERANGE) {
+			// the attribute grew in between
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+}
+
+func setXattr(name, attr string, value []byte) error {
+	return unix.Setxattr(name, attr, value, 0)
+}
@@ -0,0 +1,17 @@
+//go:build !darwin
+
+package main
+
+import "errors"
+
+// xattrsSupported is false where -mac-metadata has no attributes to copy,
+// see prepareMacMetadata.
+const xattrsSupported = false
+
+func getXattr(name, attr string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func setXattr(name, attr string, value []byte) error {
+	return errors.ErrUnsupported
+}
@@ -1,79 +1,255 @@
 package main
 
 import (
-	"flag"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
 	"runtime"
-	"strings"
 	"sync"
 	"time"
-
-	"github.com/schollz/progressbar/v3"
 )
 
 var (
-	outputDirectory = flag.String("x", "output", "output directory")
-	namePrefix      = flag.String("prefix", "", "prefix all entries with the provided value")
-	maxNumCores     = flag.Int("c", runtime.NumCPU(), "set's the maximum number of cores for use")
-	timeExecution   = flag.Bool("time", false, "time program execution")
-	helpFlag        = flag.Bool("h", false, "display available flags and usage")
-
-	semaphore chan struct{}
+	timeExecution  bool
+	jsonSummary    string
+	manifestFile   string
+	versionFlag    bool
+	statusInterval time.Duration
+	deniedList     string
+
+	copyManifest *manifest
+	status       *runStatus
 )
 
-var pathReplacer = regexp.MustCompile(`[\\\/]`)
+var copyCommand = newCommand("copy", "", "Copy every nested file of the working directory into the output directory.\n"+
+	"This is the default command.", outputFlags, concurrencyFlags, logFlags, sourceFlags, namingFlags, filterFlags, compressionFlags, hashFlags, stateFlags, execFlags)
 
 func init() {
-	flag.Parse()
+	fs := copyCommand.flags
+	fs.BoolVar(&timeExecution, "time", false, "time program execution")
+	fs.StringVar(&jsonSummary, "json-summary", "", "write a JSON summary of the run to the provided file")
+	fs.StringVar(&manifestFile, "manifest", "", "write a manifest of every copied file, used by restore, verify and undo")
+	fs.Var(&extraManifestFields, "manifest-fields", "extra manifest columns, comma separated: parent_mtime, depth, owner, inode")
+	fs.BoolVar(&versionFlag, "version", false, "print version and build information")
+	fs.StringVar(&reportFile, "report", "", "stream a row per file with timing and outcome to the provided file, JSON lines if it ends in .json, CSV otherwise")
+	fs.BoolVar(&copyACLs, "acls", false, "also copy POSIX ACLs (Linux) or the DACL (Windows), recorded in the manifest for restore")
+	fs.BoolVar(&macMetadata, "mac-metadata", false, "copy Finder tags, Finder info and resource forks (macOS) and keep AppleDouble \"._X\" files\n"+
+		"with X")
+	fs.Var(appleDouble, "apple-double", "what -mac-metadata does with \"._X\" files: pair (copy them next to X), merge (set their\n"+
+		"attributes on X, macOS only)")
+	fs.Var(adsMode, "ads", "NTFS alternate data streams (Windows): report lists them in the manifest, preserve also copies them")
+	emptyDirFlags(fs)
+	fs.StringVar(&skippedList, "skipped-list", "", "write every file and directory that was left out, with the reason, to the provided TSV file")
+	fs.StringVar(&failedListName, "failed-list", "", "write the source of every file that failed to the provided file, to retry them with -files-from")
+	fs.StringVar(&mapStreamName, "map-stream", "", "write a JSON line with source, destination, size and hash of every copied file to the\n"+
+		"provided file, named pipe or Unix socket as soon as it's in place")
+	fs.Var(&mapStreamBuffer, "map-stream-buffer", "warn when more than this is queued for a slow -map-stream consumer")
+	fs.BoolVar(&conflictCompare, "conflict-compare", false, "compare a source whose destination is taken with the file there, and report\n"+
+		"identical duplicates and conflicting content apart")
+	fs.Var(&onConflict, "on-conflict", "what happens to a source whose destination is taken: skip or error, or per kind\n"+
+		"like skip-identical,error-different, which compares them")
+	fs.StringVar(&deniedList, "denied-list", "", "write the paths that failed with permission denied to the provided file")
+	fs.Var(preallocateMode, "preallocate", "reserve the space of destinations before copying to limit fragmentation: auto (files of\n"+
+		"64MiB and more), on, off. Ignored where the filesystem can't")
+	fs.BoolVar(&trustStatSize, "trust-stat-size", true, "take file sizes from stat, false records the bytes actually read and doesn't take\n"+
+		"files stat calls empty to be small, for /sys, FUSE or network filesystems reporting size 0")
+	fs.Var(&bigFileThreshold, "big-file-threshold", "log the progress of files at least this big while they copy, 0 disables it")
+	fs.DurationVar(&bigFileInterval, "big-file-interval", bigFileInterval, "how often the progress of big files is logged")
+	fs.DurationVar(&ioTimeout, "io-timeout", 0, "give up on directory reads and file opens blocked for this long, e.g. on a hung network mount,\n"+
+		"and skip the directory or file")
+	fs.BoolVar(&copySnapshot, "snapshot", false, "copy from a read-only snapshot of the source taken at the start and removed at the end,\n"+
+		"if it's on btrfs or ZFS and the privileges allow it, otherwise only files unchanged for -stable-for or a minute")
+	fs.DurationVar(&stableFor, "stable-for", 0, "only copy files not modified for this long, files changed more recently are retried later")
+	fs.BoolVar(&strictMode, "strict", false, "exit 1 when a file was skipped or a warning was logged, not only when a copy failed")
+	fs.BoolVar(&deterministicWalk, "deterministic", false, "copy in sorted order, reading every directory completely first.\n"+
+		"Implied by -sidecars and -state")
+	fs.BoolVar(&atomicOutput, "atomic-output", false, "write into a hidden staging directory next to -x and rename it to -x once every file\n"+
+		"was handled, -x must not exist")
+	fs.BoolVar(&cleanupOnFail, "cleanup-on-fail", false, "remove the -atomic-output staging directory of a run that didn't complete")
+	fs.Var(&dirMode, "dir-mode", "octal permissions of the directories created for the output, before the umask")
+	fs.BoolVar(&mergeLatest, "merge-latest", false, "take the top level directories as generations of one tree and of the files at the same\n"+
+		"path below them only copy the newest: by modification time, then size, then the directory sorting last")
+	fs.Var(dryRun, "dry-run", "diff: copy nothing, list what the copy would do to the output directory as it is: A added,\n"+
+		"M differing (a name collision), S up to date, ? not compared, C colliding within the run. Compares\n"+
+		"by -hash or by size, exits 1 unless everything is up to date. For a plain listing use plan")
+	fs.StringVar(&controlAddress, "control", "", "serve line delimited JSON progress frames on unix:/path or a loopback TCP port like\n"+
+		"127.0.0.1:7070, and take the commands pause, resume and cancel, sent as {\"command\": \"pause\"}")
+	fs.DurationVar(&controlInterval, "control-interval", controlInterval, "how often -control clients get a progress frame")
+	fs.Var(&textTransforms, "text-transform", "rewrite text files while copying, a comma separated list of strip-bom, crlf-to-lf\n"+
+		"and lf-to-crlf. Text is UTF-8 or UTF-16 with a BOM and no NUL bytes in the first 8K, other files\n"+
+		"are copied as they are. The manifest keeps the original size of the files changed")
+	fs.BoolVar(&onlyText, "only-text", false, "only copy text files: UTF-8 without NUL bytes in the first 8K, or UTF-16 with a BOM.\n"+
+		"The copy workers look at each file before copying it, the others are skipped: binary")
+	fs.BoolVar(&onlyBinary, "only-binary", false, "only copy the files -only-text leaves out, text files are skipped: text")
+	fs.BoolVar(&forceSource, "force", false, "copy a source root holding the "+outputMarkerName+" of an earlier run, or inside the\n"+
+		"output directory recorded in -state, instead of refusing to flatten an output again")
+	fs.BoolVar(&allowEmpty, "allow-empty", false, "succeed even if no file is selected for copying")
+	fs.Var(&packSmall, "pack-small", "store files smaller than this in shared zip packs in the output directory instead of one file each,\n"+
+		"uncompressed, e.g. 4K. restore, verify and undo read them through the manifest")
+	fs.Var(&archiveBuffer, "archive-buffer", "file data the copy workers may hold while waiting to write into a -pack-small pack, 0 for\n"+
+		"no limit. Files of at least a sixteenth of it are streamed into the pack without buffering")
+	fs.DurationVar(&statusInterval, "status-interval", 0, "print a status line at this interval, e.g. 30s (SIGUSR1 prints one on demand)")
+	copyCommand.run = runCopy
+
+	commands = append(commands, copyCommand, planCommand, applyCommand, restoreCommand, verifyCommand, checkCommand, diffCommand, undoCommand, removeRunCommand, genTreeCommand, configInitCommand, completionCommand)
+}
+
+func main() {
+	os.Exit(dispatch(os.Args[1:]))
+}
 
-	if *helpFlag {
-		flag.PrintDefaults()
-		os.Exit(0)
+func runCopy(args []string) int {
+	if versionFlag {
+		fmt.Println(readBuildInfo())
+		return exitOK
 	}
 
-	semaphore = make(chan struct{}, *maxNumCores)
+	startedAt := runClock.Now()
+	events = newEventDispatcher()
+	defer events.close()
 
-	if *namePrefix != "" && !strings.HasSuffix(*namePrefix, "_") {
-		*namePrefix += "_"
+	if err := prepareNaming(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := prepareFilters(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := validateContentFilter(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := prepareACLs(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	prepareADS()
+	prepareMacMetadata()
+	if err := validateCompression(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := validateEncryption(copyCommand.flags); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := openSourceTree(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := prepareOnlyRoots(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if dryRun.value == "diff" {
+		return runDryRunDiff()
+	}
+	stopControl, err := startControl(startedAt)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	defer stopControl()
+	if err := startHooks(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
 	}
 
-	totalCoresAvailable := runtime.GOMAXPROCS(*maxNumCores)
-	log.Printf("[INFO] Using '%d' cores for processing, maximum available is '%d'\n", *maxNumCores, totalCoresAvailable)
-}
+	if queueSize < 0 {
+		fmt.Fprintln(os.Stderr, "-queue-size must not be negative")
+		return exitUsage
+	}
+	if !autoConcurrency && maxNumCores > maxCopyWorkers() {
+		warnf("-c %d is more copy workers than can help, using '%d'\n", maxNumCores, maxCopyWorkers())
+		maxNumCores = maxCopyWorkers()
+	}
+	applyLowPriority(copyCommand.flags, &maxNumCores)
+	if goMaxProcs < 0 {
+		fmt.Fprintln(os.Stderr, "-gomaxprocs must not be negative")
+		return exitUsage
+	}
+	if goMaxProcs > 0 {
+		runtime.GOMAXPROCS(goMaxProcs)
+	}
+	// -c only limits the copy workers, the scout and the walk are one
+	// goroutine and GOMAXPROCS is left to the runtime unless -gomaxprocs
+	if autoConcurrency {
+		infof("copy workers: '%d' to start with, adapting up to '%d', scan workers: '1', CPUs: '%d', GOMAXPROCS: '%d'\n",
+			autoStartWorkers, maxNumCores, runtime.NumCPU(), runtime.GOMAXPROCS(0))
+	} else {
+		infof("copy workers: '%d', scan workers: '1', CPUs: '%d', GOMAXPROCS: '%d'\n", maxNumCores, runtime.NumCPU(), runtime.GOMAXPROCS(0))
+	}
 
-func main() {
-	if *timeExecution {
-		timeNow := time.Now()
-		log.Println("[INFO] Requested timed execution")
+	if timeExecution {
+		timeNow := runClock.Now()
+		infof("Requested timed execution\n")
 
 		defer func(timeNow time.Time) {
-			log.Printf("\n[INFO] finished execution, time elapsed: %.2fs\n", time.Since(timeNow).Seconds())
+			infof("finished execution, time elapsed: %s\n", formatDuration(runClock.Since(timeNow)))
+			logPhases()
 		}(timeNow)
 	}
 
 	wd, err := os.Getwd()
 	if err != nil {
-		log.Fatal(err)
+		errorf("%v\n", err)
+		return exitFailed
+	}
+	if err := checkSourceRoot(wd); err != nil {
+		errorf("%v\n", err)
+		return exitUsage
+	}
+	if copySnapshot {
+		leaveSnapshot, err := enterSnapshot(wd)
+		if err != nil {
+			errorf("%v\n", err)
+			return exitFailed
+		}
+		defer atQuit(leaveSnapshot)()
 	}
 
-	entries, err := os.ReadDir(wd)
+	phases.begin("scan")
+	entries, err := readSourceDir(".")
 	if err != nil {
-		log.Fatal(err)
+		errorf("%v\n", err)
+		return exitFailed
 	}
 
 	// since we're on the root folder, pass "" as it's parent path
-	totalItems := scoutDirectory(&entries, "")
-	log.Printf("[INFO] Found: '%d' nested items to copy\n", totalItems)
+	stopScanProgress := showScanProgress()
+	totalItems, totalBytes := scoutDirectory(&entries, "", rootAncestors())
+	stopScanProgress()
+	if mergeLatest {
+		// older versions are left out before the walk hands files on
+		totalItems -= supersededItems
+		totalBytes -= supersededBytes
+		infof("-merge-latest: '%d' files are older versions of a path in another top level directory, not copying them\n", supersededItems)
+	}
+	infof("Found: '%d' nested items to copy\n", totalItems)
+	control.setTotals(totalItems, totalBytes)
+	if n := len(unreadable.snapshot()); n > 0 {
+		warnf("'%d' directories could not be read, the counts are lower bounds\n", n)
+	}
 
-	outputDirEntry, err := os.Stat(*outputDirectory)
-	if outputDirEntry != nil && err != nil {
-		log.Fatal(err)
+	if totalItems == 0 && !allowEmpty {
+		errorf("Nothing to copy, %s. Pass -allow-empty if that's expected\n", describeFilters(activeFilters(copyCommand.flags)))
+		phases.end()
+		writeSummary(startedAt, totalItems)
+		return exitEmpty
+	}
+	phases.begin("plan")
+
+	if outputDirectoryTemplate != "" {
+		infof("Output directory: %q, from -x %q\n", outputDirectory, outputDirectoryTemplate)
+	}
+	if err := stageOutputDirectory(); err != nil {
+		errorf("%v\n", err)
+		return exitUsage
 	}
 
 	/*
@@ -98,98 +274,727 @@ func main() {
 		| ------rwx  | 0007 | Other |
 		+------------+------+-------+
 	*/
-	if outputDirEntry == nil {
-		err = os.Mkdir(*outputDirectory, 0666)
+	if err := createOutputDirectory(); err != nil {
+		errorf("%v\n", err)
+		return exitFailed
+	}
+	writeOutputMarker(outputDirectory, sourceRoot(wd), runID, manifestFile)
+	existing, err := seedExistingDestinations()
+	if err != nil {
+		errorf("Could not read the output directory %q: %v\n", outputDirectory, err)
+		return exitFailed
+	}
+	if existing > 0 {
+		infof("The output directory already holds '%d' files, sources flattening to their names are not copied\n", existing)
+	}
+	if packSmall > 0 {
+		packs = newPackWriter()
+	}
+
+	if minFree.set() {
+		free, required, err := checkFreeSpace(outputDirectory)
+		if err != nil {
+			errorf("%v\n", err)
+			return exitUsage
+		}
+		if lowSpace.Load() {
+			warnf("Only %s free on the filesystem of %q, -min-free keeps %s: not copying anything\n",
+				formatBytes(int64(free)), outputDirectory, formatBytes(int64(required)))
+		}
+	}
+
+	if manifestFile != "" {
+		copyManifest, err = newManifest(sourceRoot(wd), outputDirectory)
+		if err == nil && finalOutputDirectory != "" {
+			copyManifest.OutputDir = finalOutputDirectory
+		}
+		if err != nil {
+			errorf("%v\n", err)
+			return exitFailed
+		}
+		if hashAlgorithm.value != "none" {
+			copyManifest.HashAlgorithm = hashAlgorithm.value
+		}
+		if groupBy.value != "none" {
+			copyManifest.GroupBy = groupBy.value
+		}
+		if groupBy.value == "size" {
+			copyManifest.SizeBuckets = sizeBuckets
+		}
+		copyManifest.RunID = runID
+		copyManifest.Fields = extraManifestFields.names()
+		copyManifest.RelativeTo = relativeTo
+		copyManifest.OutputTemplate = outputTemplate
+	}
+
+	if reportFile != "" {
+		opsReport, err = openReport(reportFile)
 		if err != nil {
-			log.Println(err)
-			os.Exit(1)
+			errorf("Could not create report %q: %v\n", reportFile, err)
+			return exitFailed
+		}
+	}
+	if err := openSkippedList(); err != nil {
+		errorf("Could not create skipped list %q: %v\n", skippedList, err)
+		return exitFailed
+	}
+	if err := openFailedList(); err != nil {
+		errorf("Could not create failed list %q: %v\n", failedListName, err)
+		return exitFailed
+	}
+	openMapStream()
+
+	limiter, err := newDispatchLimiter()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	if copyManifest != nil {
+		// a resumed run continues the manifest of the run it resumes
+		appending := limiter.resumeAt != ""
+		if err := loadAssignments(manifestFile, copyManifest.OutputDir, appending); err != nil {
+			errorf("Could not read the destinations recorded in %q: %v\n", manifestFile, err)
+			return exitFailed
+		}
+		if err := copyManifest.create(manifestFile, appending); err != nil {
+			errorf("Could not create manifest %q: %v\n", manifestFile, err)
+			return exitFailed
 		}
 	}
 
-	bar := progressbar.Default(int64(totalItems))
+	phases.begin("copy")
+	queue := newJobQueue(queueSize)
+	if fairSchedule {
+		// jobs wait in the scheduler, a worker gets the next one when it's free
+		queue = newJobQueue(0)
+		queue.fair = newFairScheduler(queue, maxNumCores)
+	}
+	status = newRunStatus(startedAt, totalItems, maxNumCores, queue)
+	stopStatus := make(chan struct{})
+	go status.report(statusInterval, stopStatus)
+	defer close(stopStatus)
+
+	rawBar := newProgressBar(int64(totalItems))
+	progressBar.Store(rawBar)
+	defer progressBar.Store(nil)
+	bar := newBatchedBar(rawBar, int64(totalItems))
+	events.attach(barEvents{bar})
+	go redrawOnResize(stopStatus)
+	go watchInterrupt(stopStatus)
+	defer atQuit(watchKeyboard())()
+	if fairSchedule && verbose {
+		go logHeldDirectories(stopStatus)
+	}
+	if minFree.set() {
+		go watchFreeSpace(outputDirectory, stopStatus)
+	}
 
+	// The walker feeds a fixed pool of copy workers. Every worker is added to
+	// the WaitGroup before it starts and the walker is the only sender, so
+	// Wait can only return once the walk finished and every job was copied.
+	// The queue holds at most -queue-size jobs, a walk faster than the
+	// copies waits for them.
 	var wg sync.WaitGroup
-	for _, entry := range entries {
-		if entry.IsDir() && entry.Name() != *outputDirectory {
-			wg.Add(1)
-			go expandDirectory(bar, &wg, entry.Name())
+	var gate *workerGate
+	stopTuning := make(chan struct{})
+	if autoConcurrency {
+		gate = newWorkerGate(autoStartWorkers)
+		go gate.tune(maxNumCores, stopTuning)
+	}
+	stats := make([]workerStat, maxNumCores)
+	wg.Add(maxNumCores)
+	for worker := 0; worker < maxNumCores; worker++ {
+		go copyWorker(&wg, worker, queue, gate, &stats[worker])
+	}
+
+	batcher := &smallBatcher{queue: queue}
+	walkErr := walkNestedFiles(func(dirName string, group []string) error {
+		job := copyJob{dir: dirName, files: group}
+		walkedItems.Add(uint64(len(group)))
+		admitted, err := limiter.admit(job)
+		if err != nil {
+			refusedItems.Add(uint64(len(group)))
 		}
+		if admitted {
+			if !batcher.add(job) {
+				queue.send(job)
+			}
+		} else if err == nil {
+			// before the -resume cutoff, copied by an earlier run
+			earlier := make([]reportRow, len(group))
+			for i, name := range group {
+				earlier[i] = reportRow{Source: filepath.ToSlash(filepath.Join(dirName, name)), Outcome: outcomeSkipped, Error: "copied by an earlier run"}
+				recordSkip(earlier[i].Source, skipEarlierRun, "before the -resume cutoff")
+			}
+			earlierRunItems.Add(uint64(len(group)))
+			events.fileDone(earlier...)
+		}
+		return err
+	})
+	batcher.flush()
+	if walkErr != nil {
+		errorf("%v\n", walkErr)
+	}
+	queue.drain()
+	close(stopTuning)
+	if gate != nil {
+		settledWorkers = gate.current()
+		summaryf("-c auto settled on '%d' copy workers\n", settledWorkers)
+		// unpark the rest so they see the closed queue
+		gate.set(maxNumCores)
+	} else {
+		settledWorkers = maxNumCores
 	}
 	wg.Wait()
+	limiter.leftOut(runPause.resumeAt())
+	hooks.wait()
+	events.sync()
+	// a cap, an interrupt or a failed walk leaves jobs undone, the bar stays short
+	bar.close(limiter.cutoff == "" && walkErr == nil)
+	if err := packs.close(); err != nil {
+		errorf("Could not finish the last pack: %v\n", err)
+	}
+	phases.begin("finalize")
+	// the bar is complete, don't draw it again below the summary
+	progressBar.Store(nil)
+	workerStats = stats
+	peakQueueDepth = queue.peak.Load()
+	if !abortCopy.Load() {
+		createEmptyDirMarkers()
+	}
+	logScan()
+	// the rates leave out the time the run was paused
+	logThroughput(runClock.Since(startedAt)-runPause.pausedTime(), workerStats)
+	logTreeStats()
+	logConflicts()
+	logConflictHotspots()
+	logUnreadable()
+	logPauses()
+	logAssignmentChanges()
+	logTextTransforms()
+	logOnlyRoots()
+	logSizeDivergences()
+	logArchiveBuffer()
+	logVerifiedBytes()
+	logAccounting(settleAccounting(totalItems, limiter.cutoff == "" && walkErr == nil))
+	logDroppedStreams()
+
+	if stateFile != "" {
+		if err := limiter.state().writeFile(stateFile); err != nil {
+			errorf("Could not write state %q: %v\n", stateFile, err)
+		}
+	}
+
+	if n := timedOutOps.Load(); n > 0 {
+		summaryf("'%d' filesystem operations timed out after %s, '%d' of them are still blocked, the source looks unhealthy\n", n, ioTimeout, hangingOps.Load())
+	}
+	if n := existingCollisions.Load(); n > 0 {
+		summaryf("'%d' destinations already existed in %q and were left alone\n", n, outputDirectory)
+	}
+	if errorsSummary := copyErrors.String(); errorsSummary != "" {
+		summaryf("Errors by category: %s\n", errorsSummary)
+	}
+	if deniedList != "" {
+		if err := copyErrors.writeDeniedList(deniedList); err != nil {
+			errorf("Could not write denied list %q: %v\n", deniedList, err)
+		}
+	}
+
+	if err := opsReport.close(); err != nil {
+		errorf("Could not write report %q: %v\n", reportFile, err)
+	}
+	if err := closeSkippedList(); err != nil {
+		errorf("Could not write skipped list %q: %v\n", skippedList, err)
+	}
+	if err := failures.close(copyCommand.flags); err != nil {
+		errorf("Could not write failed list %q: %v\n", failedListName, err)
+	}
+	if err := mapStreamOut.close(); err != nil {
+		errorf("Could not write map stream %q: %v\n", mapStreamName, err)
+	}
+
+	if copyManifest != nil {
+		priorAssignments.carry(copyManifest)
+		if err := copyManifest.close(emptyDirectories, emptyDirMarkers); err != nil {
+			errorf("Could not write manifest %q: %v\n", manifestFile, err)
+		}
+	}
+
+	outcome := runOutcome{
+		diskFull:    abortCopy.Load(),
+		interrupted: interrupted.Load(),
+		capReached:  limiter.cutoff != "",
+		failed:      failedItems.Load(),
+		skipped:     skippedItems.Load(),
+		warnings:    warnings.Load(),
+		hookFailed:  execStrict && hookFailures.Load() > 0,
+	}
+	complete := !outcome.diskFull && !outcome.interrupted && !outcome.capReached && walkErr == nil
+	if err := finishAtomicOutput(complete); err != nil {
+		errorf("Could not finish the -atomic-output %q: %v\n", finalOutputDirectory, err)
+		outcome.outputFailed = true
+	}
+
+	phases.end()
+	writeSummary(startedAt, totalItems)
+
+	switch {
+	case outcome.diskFull:
+		remaining := totalBytes - completedBytes.Load()
+		errorf("Stopped because %q is full: '%d' of '%d' items were copied, about %s more space is needed for the rest\n",
+			outputDirectory, copiedItems.Load(), totalItems, formatBytes(remaining))
+	case outcome.interrupted && limiter.cutoff != "":
+		infof("Interrupted before %q, run again with -resume to continue\n", limiter.cutoff)
+	case lowSpace.Load() && limiter.cutoff != "":
+		infof("Stopped before %q to keep -min-free space on %q, run again with -resume to continue\n", limiter.cutoff, outputDirectory)
+	case limiter.cutoff != "":
+		infof("Stopped at the -max-files/-max-bytes cap before %q, run again with -resume to continue\n", limiter.cutoff)
+	}
+	if strictMode && outcome.failed == 0 && (outcome.skipped > 0 || outcome.warnings > 0) {
+		errorf("-strict: '%d' files were skipped and '%d' warnings logged\n", outcome.skipped, outcome.warnings)
+	}
+	return outcome.exitCode()
 }
 
-func scoutDirectory(dir *[]fs.DirEntry, parentPath string) (total uint) {
+// scoutVisited keeps scoutDirectory from counting a directory twice, the
+// walk has a set of its own.
+var scoutVisited = newVisitedDirs()
+
+func scoutDirectory(dir *[]fs.DirEntry, parentPath string, ancestors []os.FileInfo) (total uint, size int64) {
 	total = 0
 	for i := 0; i < len(*dir); i++ {
 		currentDirEntryName := filepath.Join(parentPath, (*dir)[i].Name())
-		if currentDirEntryName == *outputDirectory {
+		if isOutputDirectory(currentDirEntryName) || classifyEntry(currentDirEntryName, (*dir)[i]) != entryDir || !inOnlyScope(currentDirEntryName) {
 			continue
 		}
-		dirs, err := os.ReadDir(currentDirEntryName)
-		if err != nil {
-			log.Printf("[ERROR] Could not read entry %q, skipping...\n", currentDirEntryName)
+		nestedAncestors, ok := enterDirectory(currentDirEntryName, ancestors)
+		if !ok || !scoutVisited.first(currentDirEntryName) {
+			continue
+		}
+		if isPreviousOutput(currentDirEntryName) {
 			continue
 		}
 
-		dirsOnly := make([]fs.DirEntry, 0, len(dirs))
-
-		for _, entry := range dirs {
-			if entry.IsDir() {
-				dirsOnly = append(dirsOnly, entry)
-			} else {
-				total++
+		var dirsOnly []fs.DirEntry
+		files, children, dirSize := 0, 0, int64(0)
+		err := readDirBatches(currentDirEntryName, func(entries []fs.DirEntry) error {
+			children += len(entries)
+			for _, entry := range entries {
+				entryPath := filepath.Join(currentDirEntryName, entry.Name())
+				switch classifyEntry(entryPath, entry) {
+				case entryDir:
+					dirsOnly = append(dirsOnly, entry)
+				case entryFile:
+					if !selected(entryPath, entry) {
+						continue
+					}
+					files++
+					if info, err := entry.Info(); err == nil {
+						dirSize += info.Size()
+						tree.file(entryPath, info.Size())
+						offerVersion(entryPath, info.ModTime(), info.Size())
+					}
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			// what was read of it isn't counted, the walk leaves it out too
+			unreadable.record(currentDirEntryName, err)
+			copyErrors.record(currentDirEntryName, err)
+			errorf("Could not read directory %q, nothing below it is counted or copied: %v\n", currentDirEntryName, err)
+			continue
+		}
+		scoutedDirs.Add(1)
+
+		total += uint(files)
+		size += dirSize
+		countOnlyFound(currentDirEntryName, files)
+		scoutedFiles.Add(uint64(files))
+		tree.directory(currentDirEntryName, children)
+		events.scanProgress(scoutedDirs.Load(), scoutedFiles.Load())
+		if files == 0 && len(dirsOnly) == 0 {
+			recordEmptyDirectory(currentDirEntryName)
 		}
 
-		total += scoutDirectory(&dirsOnly, currentDirEntryName)
+		nestedTotal, nestedSize := scoutDirectory(&dirsOnly, currentDirEntryName, nestedAncestors)
+		total += nestedTotal
+		size += nestedSize
 	}
 	return
 }
 
-func expandDirectory(bar *progressbar.ProgressBar, wg *sync.WaitGroup, dirName string) {
+// copyJob is a file together with its sidecars, see groupSidecars, or
+// with batch set independent small files of one directory, see
+// smallBatcher.
+type copyJob struct {
+	dir   string
+	files []string
+	batch bool
+
+	// firstSeen and readyAt are used by -stable-for
+	firstSeen time.Time
+	readyAt   time.Time
+}
+
+func copyWorker(wg *sync.WaitGroup, worker int, queue *jobQueue, gate *workerGate, stats *workerStat) {
 	defer wg.Done()
+	defer status.setCurrent(worker, "")
+	defer stats.finish()
+	stats.Worker = worker
+
+	for {
+		// time parked by -c auto is neither busy nor idle
+		gate.wait(worker)
+		waitStart := time.Now()
+		job, ok := <-queue.jobs
+		stats.idle += time.Since(waitStart)
+		if !ok {
+			return
+		}
+		// a paused run holds the job here, that time is neither busy nor idle
+		runPause.wait()
+		if runPause.leaveOut(job) {
+			refusedItems.Add(uint64(len(job.files)))
+			queue.done(job)
+			continue
+		}
+		start := time.Now()
+
+		switch waitForStable(queue, job) {
+		case jobStable:
+			files := filterContent(worker, job)
+			switch {
+			case len(files) == 0:
+			case job.batch:
+				stats.Bytes += copyBatch(worker, job.dir, files)
+			default:
+				stats.Bytes += copyFilesFromSource(worker, job.dir, files)
+			}
+			stats.Files += uint64(len(job.files))
+		case jobUnstable:
+			recordGroup(worker, job.dir, job.files, outcomeSkipped, errSourceUnstable)
+			stats.Files += uint64(len(job.files))
+		}
+		queue.done(job)
+		stats.busy += time.Since(start)
+	}
+}
+
+// copyFilesFromSource copies a file together with its sidecars as one unit:
+// if any of them fails, the ones already copied are removed again. It
+// returns the source bytes of the files copied.
+func copyFilesFromSource(worker int, fullPath string, group []string) int64 {
+	copied, rows := copyGroup(worker, fullPath, group)
+	recordResults(rows...)
+	return copied
+}
+
+// copyGroup is copyFilesFromSource without recording the results, it
+// returns the rows of the group instead.
+func copyGroup(worker int, fullPath string, group []string) (copied int64, rows []reportRow) {
+	if abortCopy.Load() {
+		countFailed(len(group), errCopyAborted)
+		return 0, groupRows(worker, fullPath, group, outcomeFailed, errCopyAborted)
+	}
 
-	dirEntries, err := os.ReadDir(dirName)
+	primaryDest, err := destinationName(fullPath, group[0])
 	if err != nil {
-		log.Println(err)
-		return
+		errorf("%v\n", err)
+		copyErrors.record(filepath.Join(fullPath, group[0]), err)
+		countFailed(len(group), err)
+		return 0, groupRows(worker, fullPath, group, outcomeFailed, err)
 	}
 
-	for _, entry := range dirEntries {
-		if entry.IsDir() {
-			wg.Add(1)
-			go expandDirectory(bar, wg, filepath.Join(dirName, entry.Name()))
-		} else {
-			wg.Add(1)
-			go copyFilesFromSource(bar, wg, dirName, entry.Name())
+	entries := make([]manifestEntry, 0, len(group))
+	rows = make([]reportRow, 0, len(group))
+	for i, copyingFileName := range group {
+		status.setCurrent(worker, filepath.Join(fullPath, copyingFileName))
+		if row, merged := mergeIntoPrimary(fullPath, group, copyingFileName, entries); merged {
+			row.Worker = worker
+			rows = append(rows, row)
+			continue
+		}
+
+		destName := sidecarDestination(primaryDest, group[0], copyingFileName)
+		tree.destination(destName)
+		start := time.Now()
+		entry, err := copyFile(fullPath, copyingFileName, destName)
+		if entry.Destination == "" {
+			entry.Destination = destName
+		}
+		rows = append(rows, reportRow{
+			Source:      filepath.ToSlash(filepath.Join(fullPath, copyingFileName)),
+			Destination: entry.Destination,
+			Size:        entry.Size,
+			Start:       start,
+			Duration:    time.Since(start),
+			Worker:      worker,
+			Outcome:     outcomeCopied,
+		})
+		if err != nil {
+			outcome := outcomeFailed
+			switch {
+			case errors.Is(err, errSourceLocked), errors.Is(err, errIOTimeout), errors.Is(err, errSameFile):
+				if errors.Is(err, errSameFile) {
+					warnf("NOT COPYING %q, creating its destination would erase it: %v\n", filepath.Join(fullPath, copyingFileName), err)
+				} else {
+					errorf("%s: %v\n", filepath.Join(fullPath, copyingFileName), err)
+				}
+				outcome = outcomeSkipped
+				skippedItems.Add(uint64(len(group)))
+				reason := skipLocked
+				switch {
+				case errors.Is(err, errIOTimeout):
+					reason = skipTimeout
+				case errors.Is(err, errSameFile):
+					reason = skipSameFile
+				}
+				for _, name := range group {
+					recordSkip(filepath.ToSlash(filepath.Join(fullPath, name)), reason, err.Error())
+				}
+			case isConflict(err) && conflictSkipped(filepath.Join(fullPath, copyingFileName), destName, err):
+				outcome = outcomeSkipped
+				skippedItems.Add(uint64(len(group)))
+				for _, name := range group {
+					recordSkip(filepath.ToSlash(filepath.Join(fullPath, name)), skipConflict, err.Error())
+				}
+			case errors.Is(err, errCopyAborted):
+				countFailed(len(group), err)
+			default:
+				if copyErrors.record(filepath.Join(fullPath, copyingFileName), err) != errDiskFull {
+					errorf("Error copying file %s: %v\n", copyingFileName, err)
+				}
+				if len(group) > 1 {
+					errorf("Not copying %q and its sidecars %q\n", group[0], group[1:])
+				}
+				countFailed(len(group), err)
+			}
+			for _, copied := range entries {
+				// packed content stays in its pack, unreferenced
+				if copied.Pack == "" {
+					os.Remove(filepath.Join(outputDirectory, filepath.FromSlash(copied.Destination)))
+				}
+			}
+
+			// the rest of the group shares the outcome, copied members were removed again
+			for j := range rows {
+				rows[j].Outcome = outcome
+				rows[j].Error = err.Error()
+				if j < i {
+					rows[j].Error = fmt.Sprintf("removed, %s failed: %v", copyingFileName, err)
+				}
+			}
+			return 0, append(rows, groupRows(worker, fullPath, group[i+1:], outcome, fmt.Errorf("not copied, %s failed: %w", copyingFileName, err))...)
 		}
+		if len(group) > 1 && copyingFileName != group[0] {
+			entry.Group = filepath.ToSlash(filepath.Join(fullPath, group[0]))
+		}
+		addManifestFields(&entry, filepath.Join(fullPath, copyingFileName))
+		entries = append(entries, entry)
 	}
+
+	copiedItems.Add(uint64(len(group)))
+	countOnlyCopied(fullPath, len(group))
+	for _, entry := range entries {
+		completedBytes.Add(entry.sourceSize())
+		copyManifest.add(entry)
+		copied += entry.sourceSize()
+	}
+	queueHooks(entries)
+	mapStreamOut.add(entries)
+	return copied, rows
 }
 
-func copyFilesFromSource(bar *progressbar.ProgressBar, wg *sync.WaitGroup, fullPath, copyingFileName string) {
-	defer wg.Done()
-	defer bar.Add(1)
+func copyFile(fullPath, copyingFileName, destName string) (manifestEntry, error) {
+	if symlinkPolicy.value == "preserve" && isLinkPath(filepath.Join(fullPath, copyingFileName)) {
+		return preserveLink(filepath.Join(fullPath, copyingFileName), destName)
+	}
+	if packs != nil {
+		if info, err := statSource(filepath.Join(fullPath, copyingFileName)); err == nil && smallByStat(info.Size(), int64(packSmall)) {
+			return packs.store(filepath.Join(fullPath, copyingFileName), destName)
+		}
+	}
+	compression, encryption := compressionFor(copyingFileName), encryptTo.String()
+	return storeFile(filepath.Join(fullPath, copyingFileName), destName+compressionExtension(compression)+encryptionExtension(encryption), compression, encryption)
+}
 
-	// Acquire a "slot" in the semaphore
-	semaphore <- struct{}{}
-	defer func() { <-semaphore }() // Release the "slot" when done
+// createDestination creates the destination files storeFile writes, and
+// closeDestination closes them once they're written.
+var (
+	createDestination = os.Create
+	closeDestination  = (*os.File).Close
+)
 
-	destName := filepath.Join(*outputDirectory, fmt.Sprintf("%s%s_%s", *namePrefix, pathReplacer.ReplaceAllString(fullPath, "_"), copyingFileName))
-	destFile, err := os.Create(destName)
+// storeFile copies srcName to destName in the output directory, compressed
+// with compression, then encrypted with encryption. destName already
+// carries their extensions.
+func storeFile(srcName, destName, compression, encryption string) (entry manifestEntry, err error) {
+	if err := claimDestination(destName, srcName); err != nil {
+		return manifestEntry{}, err
+	}
+	defer startWriting(destName)()
+
+	if err := ensureDestinationDir(destName); err != nil {
+		return manifestEntry{}, err
+	}
+
+	destPath := filepath.Join(outputDirectory, filepath.FromSlash(destName))
+	if isSourceFile(srcName, destPath) {
+		return manifestEntry{}, fmt.Errorf("%w: %s", errSameFile, destPath)
+	}
+	journal := journalFor(srcName, destPath, compression, encryption)
+	destFile, putBack, err := journal.create(destPath)
 	if err != nil {
-		log.Println(err)
-		return
+		return manifestEntry{}, err
 	}
-	defer destFile.Close()
+	closed := false
+	defer func() {
+		if !closed {
+			destFile.Close()
+		}
+		if err != nil {
+			// don't leave a partial file behind, it would look like a complete copy
+			journal.discard(destPath)
+		}
+	}()
 
-	srcFile, err := os.Open(filepath.Join(fullPath, copyingFileName))
+	srcFile, err := openSource(srcName)
 	if err != nil {
-		log.Println(err)
-		return
+		return manifestEntry{}, err
 	}
 	defer srcFile.Close()
 
-	if _, err := io.Copy(destFile, srcFile); err != nil {
-		log.Printf("Error copying file %s: %v\n", copyingFileName, err)
+	info, err := srcFile.Stat()
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	events.fileStart(srcName, destName, info.Size())
+	hasher := newHasher(hashAlgorithm.value)
+	offset, err := journal.resume(destFile, srcFile, hasher)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	preallocated := preallocate(destFile, info.Size(), compression)
+
+	stored := &countingWriter{w: journal.wrap(destFile)}
+	encryptor, err := newEncryptor(encryption, stored)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	defer func() {
+		if err != nil {
+			// stops the tool of a copy that failed before its Close below
+			encryptor.Close()
+		}
+	}()
+	compressor, err := newCompressor(compression, encryptor)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	source, transform, err := transformText(countingReader{newBigFileReader(srcFile, srcName, info.Size())})
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	if hasher != nil {
+		source = io.TeeReader(source, hasher)
+	}
+
+	buf := copyBuffers.Get().(*[]byte)
+	read, err := io.CopyBuffer(compressor, source, *buf)
+	copyBuffers.Put(buf)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	if err := compressor.Close(); err != nil {
+		return manifestEntry{}, err
+	}
+	if err := encryptor.Close(); err != nil {
+		return manifestEntry{}, err
+	}
+	// a resumed copy only read and wrote what came after the prefix
+	read += offset
+	if err := checkCopiedSize(srcName, info.Size(), transform.sourceRead(read)); err != nil {
+		return manifestEntry{}, err
+	}
+	if preallocated && offset+stored.n < info.Size() {
+		// the source shrank, give back the blocks reserved past the end
+		if err := destFile.Truncate(offset + stored.n); err != nil {
+			return manifestEntry{}, err
+		}
+	}
+	// a full quota or an NFS write-behind error may only show up here, the
+	// file isn't copied until it's closed
+	closed = true
+	if err := closeDestination(destFile); err != nil {
+		return manifestEntry{}, err
+	}
+	if err := journal.finish(destPath); err != nil {
+		return manifestEntry{}, err
+	}
+	if putBack != nil {
+		if err := putBack(destPath); err != nil {
+			return manifestEntry{}, err
+		}
+	}
+	entry = manifestEntry{
+		Source:      filepath.ToSlash(srcName),
+		Destination: destName,
+		Size:        recordedSize(srcName, info.Size(), transform.sourceRead(read)),
+		ModTime:     info.ModTime(),
+		Mode:        info.Mode().Perm(),
+		Compression: compression,
+		Encryption:  encryption,
+	}
+	transform.record(&entry, read)
+	if compression != "" || encryption != "" {
+		entry.StoredSize = stored.n
+	}
+	if hasher != nil {
+		entry.Hash = hashSum(hasher)
+	}
+	if copyACLs {
+		copyACL(srcName, destPath, &entry)
+	}
+	if sourceFS == nil {
+		copyStreams(srcName, destPath, &entry)
+		copyMacMetadata(srcName, destPath, &entry)
+	}
+	if relativeTo != "" {
+		entry.SourceAbs = filepath.ToSlash(filepath.Join(workingDirectory, srcName))
+		if dir, err := namePath(filepath.Dir(srcName)); err == nil {
+			entry.SourceRel = path.Join(dir, filepath.Base(srcName))
+		}
+	}
+	return entry, nil
+}
+
+// countingReader adds every byte read from a source file to the copiedBytes
+// total as it happens, so status lines reflect progress inside big files too.
+type countingReader struct {
+	r io.Reader
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	if abortCopy.Load() {
+		return 0, errCopyAborted
 	}
+	n, err := c.r.Read(p)
+	copiedBytes.Add(int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes that actually reach the destination,
+// which differs from what was read once -compress is active.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	storedBytes.Add(int64(n))
+	return n, err
 }
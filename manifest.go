@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// manifestVersion 2 manifests are an append log, see manifest.create.
+// Version 1 manifests were a single JSON document and can still be read.
+// Version 3 added the -manifest-fields columns, which are optional.
+const manifestVersion = 3
+
+// manifestFlushInterval is how often buffered manifest entries are written
+// out while copying.
+const manifestFlushInterval = 2 * time.Second
+
+// manifest records every file a copy run produced, so the output can later
+// be verified, restored into its original layout or undone.
+type manifest struct {
+	Version    int       `json:"version"`
+	Build      buildInfo `json:"build"`
+	CreatedAt  time.Time `json:"created_at"`
+	SourceRoot string    `json:"source_root"`
+	OutputDir  string    `json:"output_dir"`
+	// RunID is the -run-id of the run, remove-run finds its files by it.
+	RunID string `json:"run_id,omitempty"`
+	// RelativeTo is the -relative-to directory names were made relative to.
+	RelativeTo string `json:"relative_to,omitempty"`
+	// GroupBy is the -group-by mode, Destination starts with the group's
+	// directory unless it's "none".
+	GroupBy string `json:"group_by,omitempty"`
+	// SizeBuckets are the -size-buckets boundaries of -group-by size.
+	SizeBuckets []int64 `json:"size_buckets,omitempty"`
+	// OutputTemplate is the -output-template Destination directories came from.
+	OutputTemplate string `json:"output_template,omitempty"`
+	// HashAlgorithm is the -hash algorithm of the entries' Hash values.
+	HashAlgorithm string `json:"hash_algorithm,omitempty"`
+	// Fields are the -manifest-fields every entry has.
+	Fields []string `json:"fields,omitempty"`
+
+	// Entries and EmptyDirs are only filled in by readManifest, a manifest
+	// being written streams its entries to the file instead.
+	Entries []manifestEntry `json:"entries,omitempty"`
+	// EmptyDirs are the source directories without files, with -empty-dirs
+	// list or marker. Restore recreates them.
+	EmptyDirs []string `json:"empty_dirs,omitempty"`
+	// EmptyDirMarkers are the destinations of the files -empty-dirs marker
+	// created for them, of every run writing to the manifest.
+	EmptyDirMarkers []string `json:"empty_dir_markers,omitempty"`
+	// Conflicts are the sources not copied for a taken destination.
+	Conflicts []manifestConflict `json:"conflicts,omitempty"`
+	// Superseded are the older versions -merge-latest didn't copy.
+	Superseded []manifestSuperseded `json:"superseded,omitempty"`
+	// Assigned are the destinations of earlier runs carried over.
+	Assigned []manifestAssignment `json:"assigned,omitempty"`
+	// Partial is set by readManifest when the log has no footer after its
+	// last entry: the run writing it didn't finish.
+	Partial bool `json:"-"`
+
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	encoder *json.Encoder
+	err     error
+	written int
+	bytes   int64
+	stop    chan struct{}
+}
+
+// manifestRecord is one line of a version 2 manifest after the header.
+type manifestRecord struct {
+	Entry      *manifestEntry      `json:"entry,omitempty"`
+	Conflict   *manifestConflict   `json:"conflict,omitempty"`
+	Superseded *manifestSuperseded `json:"superseded,omitempty"`
+	Assigned   *manifestAssignment `json:"assigned,omitempty"`
+	Footer     *manifestFooter     `json:"footer,omitempty"`
+}
+
+// manifestConflict is a source that wasn't copied because its destination
+// was taken, by this run or one before it.
+type manifestConflict struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// Kind is what -conflict-compare found, Action the -on-conflict
+	// action taken: skip or error.
+	Kind   conflictKind `json:"kind"`
+	Action string       `json:"action"`
+}
+
+// manifestSuperseded is a source -merge-latest didn't copy, because the
+// file at the same path in another top level directory is newer.
+type manifestSuperseded struct {
+	Source       string `json:"source"`
+	SupersededBy string `json:"superseded_by"`
+}
+
+// manifestFooter ends a run. A resumed run appends to the manifest of the
+// run it continues, so a footer can be followed by more entries.
+type manifestFooter struct {
+	FinishedAt time.Time `json:"finished_at"`
+	// Entries and Bytes count what this run added.
+	Entries         int      `json:"entries"`
+	Bytes           int64    `json:"bytes"`
+	EmptyDirs       []string `json:"empty_dirs,omitempty"`
+	EmptyDirMarkers []string `json:"empty_dir_markers,omitempty"`
+}
+
+type manifestEntry struct {
+	// Source is the slash separated path relative to SourceRoot.
+	Source string `json:"source"`
+	// SourceRaw holds the bytes of a Source that isn't valid UTF-8, JSON
+	// strings can't.
+	SourceRaw []byte `json:"source_raw,omitempty"`
+	// SourceAbs is the absolute and SourceRel the path relative to
+	// RelativeTo of Source, both only with -relative-to.
+	SourceAbs string `json:"source_abs,omitempty"`
+	SourceRel string `json:"source_rel,omitempty"`
+	// Destination is the slash separated path relative to OutputDir.
+	Destination string      `json:"destination"`
+	Size        int64       `json:"size"`
+	ModTime     time.Time   `json:"mod_time"`
+	Mode        fs.FileMode `json:"mode"`
+	// Compression is the -compress algorithm the destination was stored
+	// with, StoredSize its size on disk then. Size is always the source size.
+	Compression string `json:"compression,omitempty"`
+	StoredSize  int64  `json:"stored_size,omitempty"`
+	// Encryption is the -encrypt the destination was stored with, after
+	// compressing it. StoredSize is then the size of the encrypted file.
+	Encryption string `json:"encryption,omitempty"`
+	// Hash is the hex encoded hash of the source content.
+	Hash string `json:"hash,omitempty"`
+	// TextTransform lists the -text-transform steps that changed the
+	// content. Size and Hash are then of the transformed content and
+	// OriginalSize is the source size.
+	TextTransform string `json:"text_transform,omitempty"`
+	OriginalSize  int64  `json:"original_size,omitempty"`
+	// Group is the Source of the primary file when this entry is one of its sidecars.
+	Group string `json:"group,omitempty"`
+	// LinkTarget is set for links copied with -symlinks preserve, the
+	// destination is a link to it.
+	LinkTarget string `json:"link_target,omitempty"`
+	// Pack is set for files copied with -pack-small: the content is the
+	// Size bytes at PackOffset of the pack, a slash separated path relative
+	// to OutputDir.
+	Pack       string `json:"pack,omitempty"`
+	PackOffset int64  `json:"pack_offset,omitempty"`
+	// ACL is the source's ACL copied with -acls, in the platform's ACLFormat.
+	ACL       []byte `json:"acl,omitempty"`
+	ACLFormat string `json:"acl_format,omitempty"`
+	// Streams are the source's NTFS alternate data streams, copied with
+	// -ads preserve.
+	Streams []dataStream `json:"streams,omitempty"`
+	// Xattrs are the macOS extended attributes -mac-metadata set on the
+	// destination, from the source or its merged AppleDouble file.
+	Xattrs []string `json:"xattrs,omitempty"`
+
+	// The -manifest-fields columns. ParentModTime is the modification time
+	// of the source's directory, Depth the number of its directories below
+	// the source root, Owner the user name or uid and Inode the source's
+	// inode number.
+	ParentModTime *time.Time `json:"parent_mtime,omitempty"`
+	Depth         int        `json:"depth,omitempty"`
+	Owner         string     `json:"owner,omitempty"`
+	Inode         uint64     `json:"inode,omitempty"`
+}
+
+func newManifest(sourceRoot, outputDir string) (*manifest, error) {
+	absOutput, err := filepath.Abs(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest{
+		Version:    manifestVersion,
+		Build:      readBuildInfo(),
+		CreatedAt:  runClock.Now(),
+		SourceRoot: sourceRoot,
+		OutputDir:  absOutput,
+	}, nil
+}
+
+// create starts writing the manifest to name: a header line with the run
+// parameters, then a line per entry as files complete, flushed every
+// manifestFlushInterval, and a footer written by close. If appending, a
+// manifest already in name is continued instead of replaced.
+func (m *manifest) create(name string, appending bool) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appending {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(name, flags, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	m.file = file
+	m.w = bufio.NewWriter(file)
+	m.encoder = json.NewEncoder(m.w)
+	if info.Size() == 0 {
+		if err := m.encoder.Encode(m); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	m.stop = make(chan struct{})
+	go m.flushEvery(manifestFlushInterval)
+	return nil
+}
+
+func (m *manifest) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		m.mu.Lock()
+		if m.err == nil {
+			m.err = m.w.Flush()
+		}
+		m.mu.Unlock()
+	}
+}
+
+// add is safe to call from several copy goroutines. Write errors are kept
+// for close.
+func (m *manifest) add(entry manifestEntry) {
+	if m == nil {
+		return
+	}
+	if !utf8.ValidString(entry.Source) {
+		entry.SourceRaw = []byte(entry.Source)
+	}
+	priorAssignments.copied(entry.Source)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = m.encoder.Encode(manifestRecord{Entry: &entry})
+		m.written++
+		m.bytes += entry.Size
+	}
+}
+
+// addConflict records a source not copied for its taken destination.
+func (m *manifest) addConflict(conflict manifestConflict) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = m.encoder.Encode(manifestRecord{Conflict: &conflict})
+	}
+}
+
+// addSuperseded records a source left out for a newer version.
+func (m *manifest) addSuperseded(superseded manifestSuperseded) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = m.encoder.Encode(manifestRecord{Superseded: &superseded})
+	}
+}
+
+// addAssigned records the destination of an earlier run for a source this
+// run didn't copy.
+func (m *manifest) addAssigned(assignment manifestAssignment) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = m.encoder.Encode(manifestRecord{Assigned: &assignment})
+	}
+}
+
+// close writes the footer and closes the file.
+func (m *manifest) close(emptyDirs, emptyDirMarkers []string) error {
+	close(m.stop)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	footer := manifestFooter{FinishedAt: runClock.Now(), Entries: m.written, Bytes: m.bytes, EmptyDirs: emptyDirs, EmptyDirMarkers: emptyDirMarkers}
+	if m.err == nil {
+		m.err = m.encoder.Encode(manifestRecord{Footer: &footer})
+	}
+	if m.err == nil {
+		m.err = m.w.Flush()
+	}
+	if err := m.file.Close(); m.err == nil {
+		m.err = err
+	}
+	return m.err
+}
+
+func readManifest(name string) (*manifest, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	m := &manifest{}
+	if err := decoder.Decode(m); err != nil {
+		return nil, fmt.Errorf("could not parse manifest %q: %w", name, err)
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("manifest %q has version %d, this build understands up to %d", name, m.Version, manifestVersion)
+	}
+
+	if m.Version >= 2 {
+		m.Partial = true
+		for {
+			var record manifestRecord
+			err := decoder.Decode(&record)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				// a crashed run can leave its last line cut short
+				verbosef("manifest %q ends in an incomplete entry: %v\n", name, err)
+				break
+			}
+			switch {
+			case record.Entry != nil:
+				m.Entries = append(m.Entries, *record.Entry)
+				m.Partial = true
+			case record.Conflict != nil:
+				m.Conflicts = append(m.Conflicts, *record.Conflict)
+			case record.Superseded != nil:
+				m.Superseded = append(m.Superseded, *record.Superseded)
+			case record.Assigned != nil:
+				m.Assigned = append(m.Assigned, *record.Assigned)
+			case record.Footer != nil:
+				m.EmptyDirs = record.Footer.EmptyDirs
+				m.EmptyDirMarkers = append(m.EmptyDirMarkers, record.Footer.EmptyDirMarkers...)
+				m.Partial = false
+			}
+		}
+	}
+
+	for i, entry := range m.Entries {
+		if len(entry.SourceRaw) > 0 {
+			entry.Source = string(entry.SourceRaw)
+			m.Entries[i].Source = entry.Source
+		}
+		if !filepath.IsLocal(filepath.FromSlash(entry.Source)) || !filepath.IsLocal(filepath.FromSlash(entry.Destination)) {
+			return nil, fmt.Errorf("manifest %q contains a path escaping its root: %q -> %q", name, entry.Source, entry.Destination)
+		}
+		if entry.Pack != "" && !filepath.IsLocal(filepath.FromSlash(entry.Pack)) {
+			return nil, fmt.Errorf("manifest %q contains a pack escaping its root: %q", name, entry.Pack)
+		}
+	}
+	for _, dir := range m.EmptyDirs {
+		if !filepath.IsLocal(filepath.FromSlash(dir)) {
+			return nil, fmt.Errorf("manifest %q contains a path escaping its root: %q", name, dir)
+		}
+	}
+	for _, marker := range m.EmptyDirMarkers {
+		if !filepath.IsLocal(filepath.FromSlash(marker)) {
+			return nil, fmt.Errorf("manifest %q contains a path escaping its root: %q", name, marker)
+		}
+	}
+	return m, nil
+}
+
+// sourceSize is the size of the source, which -text-transform may have
+// changed in the copy.
+func (e manifestEntry) sourceSize() int64 {
+	if e.TextTransform != "" {
+		return e.OriginalSize
+	}
+	return e.Size
+}
+
+// storedSize is the size the destination file should have.
+func (e manifestEntry) storedSize() int64 {
+	if e.Compression != "" || e.Encryption != "" {
+		return e.StoredSize
+	}
+	return e.Size
+}
+
+// destinationPath resolves the file holding an entry's flattened content,
+// its pack with -pack-small, honoring an explicit output directory over
+// the one recorded at copy time.
+func (m *manifest) destinationPath(outputDir string, entry manifestEntry) string {
+	if outputDir == "" {
+		outputDir = m.OutputDir
+	}
+	if entry.Pack != "" {
+		return filepath.Join(outputDir, filepath.FromSlash(entry.Pack))
+	}
+	return filepath.Join(outputDir, filepath.FromSlash(entry.Destination))
+}
+
+// loadManifestFlag reads the manifest for the restore, verify and undo
+// commands, which cannot do anything without one.
+func loadManifestFlag(cmd *command, name string) (*manifest, string, bool) {
+	if name == "" {
+		fmt.Fprintf(os.Stderr, "flatten %s: the -manifest flag is required\n", cmd.name)
+		return nil, "", false
+	}
+
+	m, err := readManifest(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "flatten %s: %v\n", cmd.name, err)
+		return nil, "", false
+	}
+	if m.Partial {
+		warnf("The manifest %q has no footer, the run writing it didn't finish. Using its '%d' entries\n", name, len(m.Entries))
+	}
+
+	outputDir := ""
+	if flagWasSet(cmd.flags, "x") {
+		outputDir = outputDirectory
+	}
+	return m, outputDir, true
+}
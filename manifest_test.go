@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCopyManifestTimes reads the header and footer times of a copy's
+// manifest, they're the run's clock like the summary's.
+func TestCopyManifestTimes(t *testing.T) {
+	r := runCopyTest(t, "flatten", "-manifest", "manifest.json")
+	if r.code != exitOK {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+	}
+	file, err := os.Open(filepath.Join(r.wd, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	var header manifest
+	if err := decoder.Decode(&header); err != nil {
+		t.Fatal(err)
+	}
+	if !header.CreatedAt.Equal(testEpoch) {
+		t.Errorf("created at %v, want the clock's %v", header.CreatedAt, testEpoch)
+	}
+	var footer *manifestFooter
+	for decoder.More() {
+		var record manifestRecord
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Footer != nil {
+			footer = record.Footer
+		}
+	}
+	if footer == nil || !footer.FinishedAt.Equal(testEpoch) {
+		t.Errorf("footer %+v, want one finished at the clock's %v", footer, testEpoch)
+	}
+}
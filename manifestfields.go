@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestFieldNames are the extra columns -manifest-fields can add to
+// every manifest entry.
+var manifestFieldNames = []string{"parent_mtime", "depth", "owner", "inode"}
+
+// manifestFields is -manifest-fields, a comma separated list of names.
+type manifestFields map[string]bool
+
+var extraManifestFields = manifestFields{}
+
+func (f *manifestFields) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.names(), ",")
+}
+
+func (f *manifestFields) Set(s string) error {
+	fields := manifestFields{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, candidate := range manifestFieldNames {
+			known = known || name == candidate
+		}
+		if !known {
+			return fmt.Errorf("unknown manifest field %q, use %s", name, strings.Join(manifestFieldNames, ", "))
+		}
+		fields[name] = true
+	}
+	*f = fields
+	return nil
+}
+
+// names are the fields in manifestFieldNames order.
+func (f manifestFields) names() []string {
+	var names []string
+	for _, name := range manifestFieldNames {
+		if f[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parentModTimes caches the modification time of source directories by path.
+var parentModTimes sync.Map
+
+// addManifestFields fills in the -manifest-fields of an entry copied from
+// name, relative to the source root. Values the platform or a -src archive
+// doesn't have are left out.
+func addManifestFields(entry *manifestEntry, name string) {
+	if len(extraManifestFields) == 0 {
+		return
+	}
+	if extraManifestFields["depth"] {
+		entry.Depth = strings.Count(filepath.ToSlash(name), "/")
+	}
+	if extraManifestFields["parent_mtime"] {
+		dir := filepath.Dir(name)
+		if cached, ok := parentModTimes.Load(dir); ok {
+			modTime := cached.(time.Time)
+			entry.ParentModTime = &modTime
+		} else if info, err := statSource(dir); err == nil {
+			modTime := info.ModTime()
+			entry.ParentModTime = &modTime
+			parentModTimes.Store(dir, modTime)
+		}
+	}
+	if extraManifestFields["owner"] || extraManifestFields["inode"] {
+		info, err := statSource(name)
+		if err != nil {
+			return
+		}
+		owner, inode := fileOwnerAndInode(info)
+		if extraManifestFields["owner"] {
+			entry.Owner = owner
+		}
+		if extraManifestFields["inode"] {
+			entry.Inode = inode
+		}
+	}
+}
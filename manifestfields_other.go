@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func fileOwnerAndInode(info os.FileInfo) (string, uint64) {
+	return "", 0
+}
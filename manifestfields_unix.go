@@ -0,0 +1,30 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// fileOwnerAndInode returns the owner's user name, or the uid if it has
+// none, and the inode number.
+func fileOwnerAndInode(info os.FileInfo) (string, uint64) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", 0
+	}
+	uid := strconv.FormatUint(uint64(st.Uid), 10)
+	key := "uid:" + uid
+	if name, ok := idCache.Load(key); ok {
+		return name.(string), uint64(st.Ino)
+	}
+	name := uid
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	}
+	idCache.Store(key, name)
+	return name, uint64(st.Ino)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+var (
+	mapStreamName   string
+	mapStreamBuffer = sizeValue(16 << 20)
+)
+
+// mapStreamLine is one -map-stream record, written once the file is in
+// place. src is relative to the source root and dst to the output
+// directory, like in the manifest. The hash is called sha256 for -hash
+// sha256, any other -hash fills hash and hash_algorithm.
+type mapStreamLine struct {
+	Src           string `json:"src"`
+	Dst           string `json:"dst"`
+	Size          int64  `json:"size"`
+	SHA256        string `json:"sha256,omitempty"`
+	Hash          string `json:"hash,omitempty"`
+	HashAlgorithm string `json:"hash_algorithm,omitempty"`
+}
+
+// mapStream writes -map-stream on its own goroutine, so a slow consumer
+// only holds up that goroutine: copy workers queue lines and go on. The
+// queue isn't bounded, past -map-stream-buffer a warning says the consumer
+// is behind.
+type mapStream struct {
+	name string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending [][]byte
+	queued  int64
+	warned  bool
+	closed  bool
+	err     error
+	done    chan struct{}
+}
+
+var mapStreamOut *mapStream
+
+// openMapStream starts writing -map-stream, if given. A named pipe is only
+// opened once its reader is there, so that happens on the writer
+// goroutine too.
+func openMapStream() {
+	if mapStreamName == "" {
+		return
+	}
+	mapStreamOut = &mapStream{name: mapStreamName, done: make(chan struct{})}
+	mapStreamOut.cond = sync.NewCond(&mapStreamOut.mu)
+	go mapStreamOut.write()
+}
+
+// openMapStreamTarget opens name for writing: it connects to a Unix
+// socket, opens a named pipe as is and creates anything else as a file.
+func openMapStreamTarget(name string) (io.WriteCloser, error) {
+	if info, err := os.Stat(name); err == nil {
+		switch {
+		case info.Mode()&os.ModeSocket != 0:
+			return net.Dial("unix", name)
+		case info.Mode()&os.ModeNamedPipe != 0:
+			return os.OpenFile(name, os.O_WRONLY, 0)
+		}
+	}
+	return os.Create(name)
+}
+
+// add queues the lines of copied entries.
+func (s *mapStream) add(entries []manifestEntry) {
+	if s == nil {
+		return
+	}
+	lines := make([][]byte, 0, len(entries))
+	var size int64
+	for _, entry := range entries {
+		line := mapStreamLine{Src: entry.Source, Dst: entry.Destination, Size: entry.Size}
+		switch {
+		case entry.Hash == "":
+		case hashAlgorithm.value == "sha256":
+			line.SHA256 = entry.Hash
+		default:
+			line.Hash, line.HashAlgorithm = entry.Hash, hashAlgorithm.value
+		}
+		data, err := json.Marshal(line)
+		if err != nil {
+			continue
+		}
+		lines = append(lines, append(data, '\n'))
+		size += int64(len(data)) + 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.pending = append(s.pending, lines...)
+	s.queued += size
+	if s.queued > int64(mapStreamBuffer) && !s.warned {
+		s.warned = true
+		warnf("-map-stream %q is falling behind, more than %s are queued for it\n", s.name, formatBytes(int64(mapStreamBuffer)))
+	}
+	s.cond.Signal()
+}
+
+func (s *mapStream) write() {
+	defer close(s.done)
+	w, err := openMapStreamTarget(s.name)
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	defer func() {
+		if err := w.Close(); err != nil {
+			s.fail(err)
+		}
+	}()
+	for {
+		s.mu.Lock()
+		for len(s.pending) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		lines := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		if len(lines) == 0 {
+			return
+		}
+		// a line at a time, so the consumer sees each file as it's done
+		for _, line := range lines {
+			if _, err := w.Write(line); err != nil {
+				s.fail(err)
+				return
+			}
+			s.mu.Lock()
+			s.queued -= int64(len(line))
+			if s.queued <= int64(mapStreamBuffer)/2 {
+				s.warned = false
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// fail stops the stream, the lines still queued are dropped.
+func (s *mapStream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.pending = nil
+}
+
+// close writes the lines still queued and returns the first error.
+func (s *mapStream) close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	<-s.done
+	return s.err
+}
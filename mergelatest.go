@@ -0,0 +1,96 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// mergeLatest is -merge-latest: the top level directories are taken as
+// generations of one tree, like root2021, root2022 and root2023, and of the
+// files at the same path in several of them only the newest is copied.
+var mergeLatest bool
+
+// latestVersion is the newest file found so far for a path below the top
+// level directories.
+type latestVersion struct {
+	path    string
+	root    string
+	modTime time.Time
+	size    int64
+}
+
+// newer reports whether v wins over other: by modification time, then by
+// size, then by the top level directory sorting last.
+func (v latestVersion) newer(other latestVersion) bool {
+	if !v.modTime.Equal(other.modTime) {
+		return v.modTime.After(other.modTime)
+	}
+	if v.size != other.size {
+		return v.size > other.size
+	}
+	return v.root > other.root
+}
+
+var (
+	// latestVersions are filled in by the scout, keyed by the slash
+	// separated path below the top level directory.
+	latestVersions = map[string]latestVersion{}
+	// supersededItems and supersededBytes are the older versions the
+	// scout found, the walk leaves them out.
+	supersededItems uint
+	supersededBytes int64
+)
+
+// splitRoot splits a slash separated source path into its top level
+// directory and the path below it.
+func splitRoot(name string) (root, rest string) {
+	root, rest, _ = strings.Cut(filepath.ToSlash(name), "/")
+	return root, rest
+}
+
+// offerVersion is called by the scout for every selected file.
+func offerVersion(name string, modTime time.Time, size int64) {
+	if !mergeLatest {
+		return
+	}
+	root, rest := splitRoot(name)
+	if rest == "" {
+		return
+	}
+	v := latestVersion{path: filepath.ToSlash(name), root: root, modTime: modTime, size: size}
+	current, found := latestVersions[rest]
+	switch {
+	case !found:
+		latestVersions[rest] = v
+		return
+	case v.newer(current):
+		latestVersions[rest] = v
+		supersededBytes += current.size
+	default:
+		supersededBytes += v.size
+	}
+	supersededItems++
+}
+
+// supersededBy returns the newer version of the file name that is copied
+// instead of it, "" if name is the one copied.
+func supersededBy(name string) string {
+	if !mergeLatest {
+		return ""
+	}
+	_, rest := splitRoot(name)
+	latest, found := latestVersions[rest]
+	if !found || latest.path == filepath.ToSlash(name) {
+		return ""
+	}
+	return latest.path
+}
+
+// leaveOutSuperseded records that the walk left out name for newer.
+func leaveOutSuperseded(name, newer string) {
+	source := filepath.ToSlash(name)
+	verbosef("Not copying %q, %q is newer\n", source, newer)
+	recordSkip(source, skipSuperseded, "superseded by "+newer)
+	copyManifest.addSuperseded(manifestSuperseded{Source: source, SupersededBy: newer})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// minFreeInterval is how often the output filesystem's free space is
+// checked against -min-free during a run.
+const minFreeInterval = 5 * time.Second
+
+// minFreeValue is the -min-free flag: a size like 5G or a percentage of
+// the output filesystem like 5%.
+type minFreeValue struct {
+	bytes   int64
+	percent float64
+}
+
+var minFree minFreeValue
+
+func (v *minFreeValue) String() string {
+	if v == nil || v.bytes == 0 && v.percent == 0 {
+		return "0"
+	}
+	if v.percent > 0 {
+		return strconv.FormatFloat(v.percent, 'f', -1, 64) + "%"
+	}
+	return formatBytes(v.bytes)
+}
+
+func (v *minFreeValue) Set(s string) error {
+	if percent, ok := strings.CutSuffix(strings.TrimSpace(s), "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p >= 100 {
+			return fmt.Errorf("invalid percentage %q", s)
+		}
+		*v = minFreeValue{percent: p}
+		return nil
+	}
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*v = minFreeValue{bytes: n}
+	return nil
+}
+
+func (v *minFreeValue) set() bool { return v.bytes > 0 || v.percent > 0 }
+
+// required is the free space to keep on a filesystem of total bytes.
+func (v *minFreeValue) required(total uint64) uint64 {
+	if v.percent > 0 {
+		return uint64(float64(total) * v.percent / 100)
+	}
+	return uint64(v.bytes)
+}
+
+// lowSpace is set once the output filesystem has less than -min-free left,
+// the dispatch limiter then stops the walk.
+var lowSpace atomic.Bool
+
+// checkFreeSpace sets lowSpace if dir's filesystem is below -min-free,
+// returning the free and required bytes.
+func checkFreeSpace(dir string) (free, required uint64, err error) {
+	free, total, err := diskSpace(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	required = minFree.required(total)
+	if free < required {
+		lowSpace.Store(true)
+	}
+	return free, required, nil
+}
+
+// watchFreeSpace checks dir every minFreeInterval until stop is closed or
+// the space ran low.
+func watchFreeSpace(dir string, stop <-chan struct{}) {
+	ticker := time.NewTicker(minFreeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		free, required, err := checkFreeSpace(dir)
+		if err != nil {
+			warnf("Could not check the free space of %q: %v\n", dir, err)
+			continue
+		}
+		if lowSpace.Load() {
+			warnf("Only %s free on the filesystem of %q, -min-free keeps %s: finishing the copies in flight and stopping\n",
+				formatBytes(int64(free)), dir, formatBytes(int64(required)))
+			return
+		}
+	}
+}
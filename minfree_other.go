@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "errors"
+
+func diskSpace(dir string) (free, total uint64, err error) {
+	return 0, 0, errors.New("-min-free is not supported on this platform")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	// nameEncoding is -name-encoding, the charset source names that aren't
+	// valid UTF-8 are decoded with. auto tries Shift-JIS, then Latin-1.
+	nameEncoding  = newChoiceValue("none", "none", "latin1", "sjis", "auto")
+	transliterate bool
+)
+
+var nameCharsets = map[string]encoding.Encoding{
+	"latin1": charmap.ISO8859_1,
+	"sjis":   japanese.ShiftJIS,
+}
+
+// portableName is the slash separated source path name as destination
+// names encode it: components that aren't valid UTF-8 decoded with
+// -name-encoding, and with -transliterate only ASCII left. Bytes neither
+// can represent are percent-encoded. Without either flag name is returned
+// unchanged, raw bytes included.
+func portableName(name string) string {
+	if nameEncoding.value == "none" && !transliterate {
+		return name
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if !utf8.ValidString(part) {
+			part = decodeName(part)
+		}
+		if transliterate {
+			part = asciiName(part)
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, "/")
+}
+
+// decodeName decodes a path component that isn't valid UTF-8.
+func decodeName(part string) string {
+	switch nameEncoding.value {
+	case "none":
+		return decodeWith(part, nil)
+	case "auto":
+		if decoded, escaped := decodeCharset(part, nameCharsets["sjis"]); escaped == 0 {
+			return decoded
+		}
+		return decodeWith(part, nameCharsets["latin1"])
+	}
+	return decodeWith(part, nameCharsets[nameEncoding.value])
+}
+
+func decodeWith(part string, charset encoding.Encoding) string {
+	decoded, _ := decodeCharset(part, charset)
+	return decoded
+}
+
+// decodeCharset decodes part one character at a time, ASCII as is and
+// everything else with charset, or as UTF-8 without one. It returns how
+// many bytes had to be percent-encoded: those not decoding to a printable
+// character.
+func decodeCharset(part string, charset encoding.Encoding) (string, int) {
+	var b strings.Builder
+	escaped := 0
+	for i := 0; i < len(part); {
+		if part[i] < utf8.RuneSelf {
+			b.WriteByte(part[i])
+			i++
+			continue
+		}
+		n, decoded := 0, ""
+		if charset == nil {
+			if r, size := utf8.DecodeRuneInString(part[i:]); r != utf8.RuneError {
+				n, decoded = size, part[i:i+size]
+			}
+		} else {
+			// Latin-1 characters are one byte, Shift-JIS ones up to two
+			for size := 1; size <= 2 && i+size <= len(part); size++ {
+				s, err := charset.NewDecoder().String(part[i : i+size])
+				if r, _ := utf8.DecodeRuneInString(s); err == nil && s != "" && !strings.ContainsRune(s, utf8.RuneError) && !unicode.IsControl(r) {
+					n, decoded = size, s
+					break
+				}
+			}
+		}
+		if n == 0 {
+			fmt.Fprintf(&b, "%%%02X", part[i])
+			escaped++
+			i++
+			continue
+		}
+		b.WriteString(decoded)
+		i += n
+	}
+	return b.String(), escaped
+}
+
+// asciiReplacements are the -transliterate replacements for letters and
+// punctuation that don't decompose into an ASCII letter and marks.
+var asciiReplacements = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'ł': "l", 'Ł': "L", 'þ': "th", 'Þ': "Th", 'ı': "i",
+	'‘': "'", '’': "'", '“': `"`, '”': `"`, '–': "-", '—': "-", '…': "...", ' ': " ",
+}
+
+// asciiName maps a valid UTF-8 component to ASCII: accents are dropped,
+// asciiReplacements applied and anything else percent-encoded.
+func asciiName(part string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(part) {
+		switch {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+		case asciiReplacements[r] != "":
+			b.WriteString(asciiReplacements[r])
+		default:
+			var buf [utf8.UTFMax]byte
+			for _, c := range buf[:utf8.EncodeRune(buf[:], r)] {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// errNaming wraps every error of naming a destination, they're counted
+// as their own category.
+var errNaming = errors.New("could not name the destination")
+
+// nameMapper names the destination file of a source, before the group
+// directory, FAT sanitizing, the length cap and collision handling apply to
+// it. Every naming mode is one, so one that looks names up elsewhere only
+// has to implement it and be set as names. flatten is a command, not a
+// package others import, so it stays unexported: a mapper is added to this
+// tree next to these, and gets the nameData the templates see.
+type nameMapper interface {
+	// mapName returns the file name, which must not be empty or contain
+	// separators.
+	mapName(data nameData) (string, error)
+}
+
+// names is the nameMapper of the run, set by prepareNaming.
+var names nameMapper = flatNames{}
+
+// flatNames is the default naming: -prefix, the flattened directory and
+// the file name, joined by "_".
+type flatNames struct{}
+
+func (flatNames) mapName(data nameData) (string, error) {
+	if data.FlatDir == "" {
+		return data.Prefix + data.Name, nil
+	}
+	return fmt.Sprintf("%s%s_%s", data.Prefix, data.FlatDir, data.Name), nil
+}
+
+// templateNames is -name-template.
+type templateNames struct {
+	tmpl *template.Template
+}
+
+func (n templateNames) mapName(data nameData) (string, error) {
+	var b bytes.Buffer
+	if err := n.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("-name-template: %w", err)
+	}
+	return b.String(), nil
+}
+
+// mapDestination runs names for data and checks what it returned.
+func mapDestination(data nameData) (string, error) {
+	source := path.Join(data.Dir, data.Name)
+	name, err := names.mapName(data)
+	if err != nil {
+		return "", fmt.Errorf("%w %q: %w", errNaming, source, err)
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("%w %q: got %q, names can't be empty or contain separators", errNaming, source, name)
+	}
+	return capDestination(source, name), nil
+}
+
+// capDestination caps the file name of the slash separated destination
+// name of source, see capNameLength.
+func capDestination(source, name string) string {
+	dir, file := path.Split(name)
+	// the compression and encryption extensions are added after naming
+	limit := maxNameBytes - len(compressionExtension(compressAlgorithm.value)) - len(encryptionExtension(encryptTo.String()))
+	capped := capNameLength(file, limit)
+	if capped == file {
+		return name
+	}
+	verbosef("Shortened the destination of %q to %q, names can have at most %d bytes\n", source, capped, maxNameBytes)
+	return dir + capped
+}
+
+// maxNameBytes is the longest file name most filesystems take.
+const maxNameBytes = 255
+
+// capNameLength shortens a name longer than limit bytes, cutting its base
+// on a UTF-8 boundary. The extension is kept, and a hash of the whole name
+// takes the place of what was cut so names sharing a long start stay apart.
+func capNameLength(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+	base, ext := splitExt(name)
+	if len(ext) > limit/4 {
+		// that's no extension anyone opens the file by
+		base, ext = name, ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	tag := fmt.Sprintf("~%08x", h.Sum32())
+	cut := limit - len(tag) - len(ext)
+	for cut > 0 && !utf8.RuneStart(base[cut]) {
+		cut--
+	}
+	return base[:cut] + tag + ext
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"unicode/utf8"
+)
+
+func TestCapNameLength(t *testing.T) {
+	tests := []struct {
+		name string
+		// ext is what the capped name must end with
+		ext string
+	}{
+		{name: strings.Repeat("a", 300) + ".txt", ext: ".txt"},
+		{name: strings.Repeat("b", 300) + ".tar.gz", ext: ".tar.gz"},
+		{name: strings.Repeat("é", 200) + ".jpeg", ext: ".jpeg"},
+		{name: strings.Repeat("日本", 100) + ".md", ext: ".md"},
+		{name: strings.Repeat("c", 300)},
+		{name: "x." + strings.Repeat("d", 300)},
+		{name: strings.Repeat("e", 255), ext: strings.Repeat("e", 255)},
+		{name: "short.txt", ext: "short.txt"},
+	}
+	for _, test := range tests {
+		got := capNameLength(test.name, maxNameBytes)
+		if len(got) > maxNameBytes || !utf8.ValidString(got) || !strings.HasSuffix(got, test.ext) {
+			t.Errorf("capNameLength(%q) = %q (%d bytes), want at most %d bytes of UTF-8 ending in %q", test.name, got, len(got), maxNameBytes, test.ext)
+		}
+		if len(test.name) <= maxNameBytes && got != test.name {
+			t.Errorf("capNameLength(%q) = %q, want it unchanged", test.name, got)
+		}
+	}
+
+	// names only differing past the cut stay apart
+	first := capNameLength(strings.Repeat("f", 300)+"1.txt", maxNameBytes)
+	second := capNameLength(strings.Repeat("f", 300)+"2.txt", maxNameBytes)
+	if first == second {
+		t.Errorf("two long names were both capped to %q", first)
+	}
+	if again := capNameLength(strings.Repeat("f", 300)+"1.txt", maxNameBytes); again != first {
+		t.Errorf("capping a name twice gave %q and %q", first, again)
+	}
+	if got := capNameLength(strings.Repeat("g", 300)+".txt", 100); len(got) > 100 {
+		t.Errorf("capped to %d bytes, want at most 100", len(got))
+	}
+}
+
+func init() {
+	copyCases["long names"] = copyCase{source: fstest.MapFS{
+		strings.Repeat("deep/", 60) + "report.pdf":     testFile("report"),
+		strings.Repeat("deep/", 60) + "report.pdf.xmp": testFile("sidecar"),
+		"short/name.txt": testFile("short"),
+	}, args: []string{"-sidecars", ".xmp"}}
+}
+
+// TestCopyLongNames flattens a path too long to be a file name, its
+// destination and that of its sidecar are capped and keep their extension
+// and compression suffix.
+func TestCopyLongNames(t *testing.T) {
+	for _, args := range [][]string{{}, {"-compress", "gzip"}} {
+		r := runCopyTest(t, "long names", args...)
+		if r.code != exitOK {
+			t.Fatalf("%q: exit code %d, want %d\n%s", args, r.code, exitOK, r.log)
+		}
+		compressed := ""
+		if len(args) > 0 {
+			compressed = ".gz"
+		}
+		capped := map[string]string{}
+		for name := range r.files {
+			if strings.HasPrefix(name, "deep_") {
+				capped[path.Ext(strings.TrimSuffix(name, compressed))] = name
+			}
+		}
+		if len(capped) != 2 || len(r.files) != 3 {
+			t.Fatalf("%q: output has %q, want the long name and its sidecar", args, r.names())
+		}
+		for _, ext := range []string{".pdf", ".xmp"} {
+			if name, ok := capped[ext]; !ok || len(name) > maxNameBytes {
+				t.Errorf("%q: output has %q, want a name ending in %s capped to %d bytes", args, r.names(), ext+compressed, maxNameBytes)
+			}
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	namePrefix   string
+	nameTemplate string
+	readExifData bool
+	groupBy      = newChoiceValue("none", "none", "root", "exif-date", "size")
+	sizeBuckets  = sizeList{1 << 20, 100 << 20, 1 << 30}
+	relativeTo   string
+	runID        string
+
+	outputTemplate string
+	// outputTemplateRoot is the directory every -output-template directory
+	// is in, its literal text up to the first action, if any.
+	outputTemplateRoot string
+
+	compiledNameTemplate   *template.Template
+	compiledOutputTemplate *template.Template
+)
+
+var pathReplacer = regexp.MustCompile(`[\\\/]`)
+
+func namingFlags(fs *flag.FlagSet) {
+	fs.StringVar(&namePrefix, "prefix", "", "prefix all entries with the provided value")
+	fs.StringVar(&nameTemplate, "name-template", "", "text/template for destination names, e.g. '{{.ExifDate.Format \"2006-01-02\"}}_{{.Name}}'\n"+
+		"fields: Prefix, Dir, Root, FlatDir, Name, Base, Ext, Size, ModTime, ExifDate, Camera, RunID.\n"+
+		"{{beforeExt .Name \"_\" .RunID}} adds to a name before its extension, .tar.gz included,\n"+
+		"{{lastDirs 2 .Dir}} is the innermost two directories joined by \"_\"")
+	fs.StringVar(&runID, "run-id", "", "label of this run, recorded in the manifest for remove-run and available as {{.RunID}},\n"+
+		"the start time like 20060102-150405 by default")
+	fs.BoolVar(&readExifData, "exif", false, "read EXIF headers of photos for {{.ExifDate}}, {{.Camera}} and -group-by exif-date")
+	fs.Var(&sidecarExtensions, "sidecars", "comma separated extensions copied as one unit with the same named file, e.g. \".xmp,.srt,.thm\"")
+	fs.StringVar(&relativeTo, "relative-to", "", "encode the source path relative to this directory into names instead of relative to\n"+
+		"the working directory, it may be above it")
+	fs.StringVar(&outputTemplate, "output-template", "", "text/template for the output subdirectory of each file, relative to -x, e.g. '{{.Ext}}'\n"+
+		"or '{{.Size | bucket}}', with the fields of -name-template")
+	fs.Var(targetFS, "target-fs", "filesystem of the output directory: auto (detect FAT and exFAT), native, fat (sanitize names\n"+
+		"and compare them without case)")
+	fs.Var(nameEncoding, "name-encoding", "charset of source names that aren't valid UTF-8: none (keep the bytes), latin1, sjis\n"+
+		"or auto, bytes it can't decode are percent-encoded")
+	fs.BoolVar(&transliterate, "transliterate", false, "turn names into ASCII: drop accents, replace letters like ß with ss and\n"+
+		"percent-encode the rest")
+	fs.Var(groupBy, "group-by", "put files into output subdirectories: none, root (one per top level directory of the source),\n"+
+		"exif-date (one per day), size (one per -size-buckets range)")
+	fs.Var(&sizeBuckets, "size-buckets", "boundaries of the -group-by size directories, up to 5, e.g. 1M,100M,1G for\n"+
+		"tiny, small, medium and large")
+}
+
+// prepareNaming validates and applies the naming flags shared by copy and plan.
+func prepareNaming() error {
+	prepareTargetFS()
+
+	if strings.ContainsAny(namePrefix, `/\`) || namePrefix == ".." {
+		return fmt.Errorf("-prefix %q must not contain path separators or \"..\"", namePrefix)
+	}
+	if namePrefix != "" && !strings.HasSuffix(namePrefix, "_") {
+		namePrefix += "_"
+	}
+
+	if groupBy.value == "exif-date" {
+		readExifData = true
+	}
+
+	if runID == "" {
+		runID = runClock.Now().Format("20060102-150405")
+	}
+	if strings.ContainsAny(runID, `/\`) || runID == "." || runID == ".." {
+		return fmt.Errorf("-run-id %q must not contain path separators", runID)
+	}
+
+	if len(sizeBuckets) > len(sizeBucketNames)-1 {
+		return fmt.Errorf("-size-buckets has %d sizes, at most %d are supported", len(sizeBuckets), len(sizeBucketNames)-1)
+	}
+
+	if relativeTo != "" {
+		base, err := filepath.Abs(relativeTo)
+		if err != nil {
+			return fmt.Errorf("-relative-to: %w", err)
+		}
+		relativeTo = base
+	}
+
+	var err error
+	if compiledNameTemplate, err = parseNameTemplate("-name-template", nameTemplate); err != nil {
+		return err
+	}
+	if compiledNameTemplate != nil {
+		names = templateNames{compiledNameTemplate}
+	}
+	if outputTemplate != "" && groupBy.value != "none" {
+		return errors.New("-output-template and -group-by can't be combined, use {{.Root}} or {{.ExifDate.Format \"2006-01-02\"}} in the template")
+	}
+	compiledOutputTemplate, err = parseNameTemplate("-output-template", outputTemplate)
+	if err != nil {
+		return err
+	}
+	literal, _, _ := strings.Cut(strings.ReplaceAll(outputTemplate, `\`, "/"), "{{")
+	if i := strings.LastIndexByte(literal, '/'); i > 0 {
+		if root := path.Clean(literal[:i]); filepath.IsLocal(filepath.FromSlash(root)) {
+			outputTemplateRoot = root
+		}
+	}
+	return nil
+}
+
+// outputDirectoryTemplate is the -x template of the run, if it was one.
+var outputDirectoryTemplate string
+
+// outputDirectoryData is what a templated -x is executed with.
+type outputDirectoryData struct {
+	// Now is when the run started.
+	Now time.Time
+	// RunID is the -run-id of the run.
+	RunID string
+}
+
+// expandOutputDirectory replaces a templated -x by its expansion. It's
+// expanded once, so every part of the run agrees on one directory. The
+// default -run-id is chosen here then, from the same time.
+func expandOutputDirectory() error {
+	if !strings.Contains(outputDirectory, "{{") {
+		return nil
+	}
+	now := runClock.Now()
+	if runID == "" {
+		runID = now.Format("20060102-150405")
+	}
+	tmpl, err := template.New("-x").Option("missingkey=error").Parse(outputDirectory)
+	if err != nil {
+		return fmt.Errorf("invalid -x: %w", err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, outputDirectoryData{Now: now, RunID: runID}); err != nil {
+		return fmt.Errorf("invalid -x: %w", err)
+	}
+	if strings.TrimSpace(b.String()) == "" {
+		return fmt.Errorf("-x %q expanded to an empty path", outputDirectory)
+	}
+	outputDirectoryTemplate, outputDirectory = outputDirectory, b.String()
+	return nil
+}
+
+// templateFuncs are the functions -name-template and -output-template can use.
+var templateFuncs = template.FuncMap{
+	"bucket":    sizeBucket,
+	"beforeExt": beforeExt,
+	"lastDirs":  lastDirs,
+}
+
+// multiPartExtensions are the extensions splitExt keeps whole, the
+// compressed tar ones.
+var multiPartExtensions = []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tar.zst", ".tar.lz4", ".tar.lzma", ".tar.z"}
+
+// splitExt splits name into its base and its extension, where a known
+// multi-part extension like .tar.gz is one. A leading dot doesn't start an
+// extension, .bashrc has none.
+func splitExt(name string) (base, ext string) {
+	lower := strings.ToLower(name)
+	for _, multi := range multiPartExtensions {
+		if strings.HasSuffix(lower, multi) && len(name) > len(multi) {
+			return name[:len(name)-len(multi)], name[len(name)-len(multi):]
+		}
+	}
+	ext = filepath.Ext(name)
+	if ext == name {
+		return name, ""
+	}
+	return name[:len(name)-len(ext)], ext
+}
+
+// beforeExt inserts parts, like a counter or the run ID, between the base
+// and the extension of name, so the name still opens with the program of
+// its type: report.pdf becomes report_2.pdf, not report.pdf_2. A
+// compression extension is still added after it, decompressors need it
+// last.
+func beforeExt(name string, parts ...string) string {
+	base, ext := splitExt(name)
+	return base + strings.Join(parts, "") + ext
+}
+
+// lastDirs is the innermost n directories of the slash separated dir,
+// joined by "_" like FlatDir.
+func lastDirs(n int, dir string) string {
+	if dir == "" || dir == "." || n <= 0 {
+		return ""
+	}
+	parts := strings.Split(dir, "/")
+	if len(parts) > n {
+		parts = parts[len(parts)-n:]
+	}
+	return strings.Join(parts, "_")
+}
+
+// sizeBucket names the power of 1024 range size falls in, e.g. "1KiB-1MiB".
+func sizeBucket(size int64) string {
+	bounds := []string{"0", "1KiB", "1MiB", "1GiB", "1TiB"}
+	i := 0
+	for limit := int64(1024); i < len(bounds)-1 && size >= limit; limit *= 1024 {
+		i++
+	}
+	if i == len(bounds)-1 {
+		return bounds[i] + "+"
+	}
+	return bounds[i] + "-" + bounds[i+1]
+}
+
+// sizeBucketNames name the -group-by size directories, from the smallest.
+// With fewer -size-buckets the first names are used.
+var sizeBucketNames = []string{"tiny", "small", "medium", "large", "huge", "giant"}
+
+// sizeBucketName is the -group-by size directory of a file of size bytes.
+func sizeBucketName(size int64) string {
+	i := 0
+	for i < len(sizeBuckets) && size >= sizeBuckets[i] {
+		i++
+	}
+	return sizeBucketNames[i]
+}
+
+// parseNameTemplate parses the text of a templating flag, nil without one.
+func parseNameTemplate(flagName, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	if !readExifData && (strings.Contains(text, ".ExifDate") || strings.Contains(text, ".Camera")) {
+		return nil, fmt.Errorf("%s uses EXIF fields, pass -exif to read them", flagName)
+	}
+
+	tmpl, err := template.New(flagName).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", flagName, err)
+	}
+	// catch unknown fields now instead of once per file
+	if err := tmpl.Execute(io.Discard, nameData{}); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", flagName, err)
+	}
+	return tmpl, nil
+}
+
+// nameData is what -name-template is executed with.
+type nameData struct {
+	// Prefix is the -prefix value, including its trailing "_".
+	Prefix string
+	// Dir is the slash separated directory of the file, relative to the
+	// source root or -relative-to.
+	Dir string
+	// Root is the first component of Dir, the top level directory the file is in.
+	Root string
+	// FlatDir is Dir with every separator replaced by "_". With -group-by
+	// root, Root is left out since it's already the output subdirectory.
+	FlatDir string
+	Name    string
+	// Base is Name without Ext, which is a known multi-part extension like
+	// .tar.gz or the last one, see splitExt.
+	Base    string
+	Ext     string
+	Size    int64
+	ModTime time.Time
+	// ExifDate is the DateTimeOriginal of the photo, or ModTime without one.
+	ExifDate time.Time
+	Camera   string
+	// RunID is the -run-id of the run.
+	RunID string
+}
+
+// namePath is the slash separated directory names encode for dir, which is
+// relative to the working directory: dir itself, or its path relative to
+// -relative-to.
+func namePath(dir string) (string, error) {
+	if relativeTo == "" {
+		return filepath.ToSlash(dir), nil
+	}
+	rel, err := filepath.Rel(relativeTo, filepath.Join(workingDirectory, dir))
+	if err != nil || rel != "." && !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%q is outside of -relative-to %q", dir, relativeTo)
+	}
+	if rel == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func newNameData(fullPath, fileName string) (nameData, error) {
+	dir, err := namePath(fullPath)
+	if err != nil {
+		return nameData{}, err
+	}
+	dir = portableName(dir)
+	name := portableName(fileName)
+	data := nameData{
+		Prefix:  namePrefix,
+		RunID:   runID,
+		Dir:     dir,
+		FlatDir: pathReplacer.ReplaceAllString(dir, "_"),
+		Name:    name,
+	}
+	data.Base, data.Ext = splitExt(name)
+	data.Root, _, _ = strings.Cut(data.Dir, "/")
+	if groupBy.value == "root" {
+		rest := strings.TrimPrefix(strings.TrimPrefix(data.Dir, data.Root), "/")
+		data.FlatDir = pathReplacer.ReplaceAllString(rest, "_")
+	}
+
+	if compiledNameTemplate == nil && compiledOutputTemplate == nil && !readExifData && groupBy.value != "size" {
+		return data, nil
+	}
+
+	srcName := filepath.Join(fullPath, fileName)
+	info, err := statSource(srcName)
+	if err != nil {
+		return data, err
+	}
+	data.Size = info.Size()
+	data.ModTime = info.ModTime()
+	data.ExifDate = info.ModTime()
+
+	if readExifData && hasExifExtension(fileName) {
+		exif, err := readExif(srcName)
+		if err != nil {
+			verbosef("no usable EXIF in %q, using its mtime: %v\n", srcName, err)
+		} else {
+			if !exif.DateTimeOriginal.IsZero() {
+				data.ExifDate = exif.DateTimeOriginal
+			}
+			data.Camera = exif.Model
+		}
+	}
+	return data, nil
+}
+
+// destinationName is the slash separated, flattened path of a file relative
+// to the output directory.
+func destinationName(fullPath, copyingFileName string) (string, error) {
+	name, err := namedDestination(fullPath, copyingFileName)
+	if err != nil {
+		return "", err
+	}
+	return priorAssignments.lookup(filepath.Join(fullPath, copyingFileName), name), nil
+}
+
+// namedDestination is the name the naming flags give a file.
+func namedDestination(fullPath, copyingFileName string) (string, error) {
+	data, err := newNameData(fullPath, copyingFileName)
+	if err != nil {
+		return "", err
+	}
+
+	name, err := mapDestination(data)
+	if err != nil {
+		return "", err
+	}
+
+	group, err := groupDirectory(data)
+	if err != nil {
+		return "", err
+	}
+	if group != "" {
+		name = path.Join(group, name)
+	}
+	return fatSafe(name), nil
+}
+
+// groupDirectory is the slash separated output subdirectory of a file from
+// -group-by or -output-template, "" for the output directory itself.
+func groupDirectory(data nameData) (string, error) {
+	if compiledOutputTemplate != nil {
+		var b bytes.Buffer
+		if err := compiledOutputTemplate.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("-output-template: %w", err)
+		}
+		dir := path.Clean(strings.ReplaceAll(b.String(), `\`, "/"))
+		if dir == "." {
+			return "", nil
+		}
+		if !filepath.IsLocal(filepath.FromSlash(dir)) {
+			return "", fmt.Errorf("-output-template produced %q for %q, directories must stay inside -x", b.String(), path.Join(data.Dir, data.Name))
+		}
+		return dir, nil
+	}
+
+	switch groupBy.value {
+	case "root":
+		return data.Root, nil
+	case "exif-date":
+		return data.ExifDate.Format("2006-01-02"), nil
+	case "size":
+		return sizeBucketName(data.Size), nil
+	}
+	return "", nil
+}
+
+// sidecarDestination keeps a sidecar next to its primary: it gets the
+// primary's destination with the sidecar's own suffix, so IMG_1.CR2 and
+// IMG_1.xmp keep sharing a stem however the primary was named. An
+// AppleDouble file gets "._" and the primary's destination. The suffix can
+// take a capped primary name over the cap again, so it's capped once more.
+func sidecarDestination(primaryDest, primary, sidecar string) string {
+	if isAppleDouble(sidecar) && sidecar[2:] == primary {
+		return capDestination(sidecar, fatSafe(appleDoubleDestination(primaryDest)))
+	}
+	if strings.HasPrefix(sidecar, primary) {
+		return capDestination(sidecar, fatSafe(primaryDest+portableName(sidecar[len(primary):])))
+	}
+	primaryStem := strings.TrimSuffix(primary, filepath.Ext(primary))
+	return capDestination(sidecar, fatSafe(strings.TrimSuffix(primaryDest, portableName(filepath.Ext(primary)))+portableName(sidecar[len(primaryStem):])))
+}
+
+// createdOutputDirs holds the slash separated output subdirectories created
+// so far. The walk leaves them out, see isOutputDirectory.
+var createdOutputDirs sync.Map
+
+// ensureDestinationDir creates the output subdirectory of a destination name
+// the first time it's needed.
+func ensureDestinationDir(destName string) error {
+	dir := path.Dir(destName)
+	if dir == "." {
+		return nil
+	}
+	if _, done := createdOutputDirs.Load(dir); done {
+		return nil
+	}
+	// recorded before it exists, so a walk listing its parent meanwhile
+	// already skips it
+	createdOutputDirs.Store(dir, struct{}{})
+	return os.MkdirAll(filepath.Join(outputDirectory, filepath.FromSlash(dir)), os.FileMode(dirMode))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSplitExt(t *testing.T) {
+	tests := []struct{ name, base, ext string }{
+		{"report.pdf", "report", ".pdf"},
+		{"archive.tar.gz", "archive", ".tar.gz"},
+		{"ARCHIVE.TAR.ZST", "ARCHIVE", ".TAR.ZST"},
+		{"notes.v2.txt", "notes.v2", ".txt"},
+		{"data.gz", "data", ".gz"},
+		{"Makefile", "Makefile", ""},
+		{".bashrc", ".bashrc", ""},
+		{".config.json", ".config", ".json"},
+		{"trailing.", "trailing", "."},
+	}
+	for _, test := range tests {
+		if base, ext := splitExt(test.name); base != test.base || ext != test.ext {
+			t.Errorf("splitExt(%q) = %q, %q, want %q, %q", test.name, base, ext, test.base, test.ext)
+		}
+	}
+}
+
+func TestBeforeExt(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []string
+		want  string
+	}{
+		{"report.pdf", []string{"_", "2"}, "report_2.pdf"},
+		{"report_2.pdf", []string{"_", "3"}, "report_2_3.pdf"},
+		{"archive.tar.gz", []string{"_", "r1"}, "archive_r1.tar.gz"},
+		{".bashrc", []string{"_", "2"}, ".bashrc_2"},
+		{"Makefile", nil, "Makefile"},
+	}
+	for _, test := range tests {
+		if got := beforeExt(test.name, test.parts...); got != test.want {
+			t.Errorf("beforeExt(%q, %q) = %q, want %q", test.name, test.parts, got, test.want)
+		}
+	}
+}
+
+func TestSizeBucketName(t *testing.T) {
+	saved := sizeBuckets
+	t.Cleanup(func() { sizeBuckets = saved })
+	sizeBuckets = sizeList{1 << 10, 1 << 20}
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{0, "tiny"},
+		{1<<10 - 1, "tiny"},
+		{1 << 10, "small"},
+		{1<<20 - 1, "small"},
+		{1 << 20, "medium"},
+		{1 << 40, "medium"},
+	}
+	for _, test := range tests {
+		if got := sizeBucketName(test.size); got != test.want {
+			t.Errorf("sizeBucketName(%d) = %q, want %q", test.size, got, test.want)
+		}
+	}
+}
+
+func init() {
+	copyCases["naming"] = copyCase{source: fstest.MapFS{
+		"docs/report.pdf":       testFile("pdf"),
+		"backup/archive.tar.gz": testFile("tar"),
+		"backup/old/.bashrc":    testFile("rc"),
+		"photos/Café.txt":       testFile("café"),
+		"big/data.bin":          testFile(strings.Repeat("x", 2048)),
+	}}
+}
+
+// TestCopyNaming flattens one tree with every naming mode.
+func TestCopyNaming(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "flat",
+			want: []string{"backup_archive.tar.gz", "backup_old_.bashrc", "big_data.bin", "docs_report.pdf", "photos_Café.txt"},
+		},
+		{
+			name: "group by root",
+			args: []string{"-group-by", "root"},
+			want: []string{"backup/archive.tar.gz", "backup/old_.bashrc", "big/data.bin", "docs/report.pdf", "photos/Café.txt"},
+		},
+		{
+			name: "group by size",
+			args: []string{"-group-by", "size", "-size-buckets", "1K"},
+			want: []string{"small/big_data.bin", "tiny/backup_archive.tar.gz", "tiny/backup_old_.bashrc", "tiny/docs_report.pdf", "tiny/photos_Café.txt"},
+		},
+		{
+			name: "group by exif date",
+			args: []string{"-group-by", "exif-date"},
+			want: []string{"2024-03-01/backup_archive.tar.gz", "2024-03-01/backup_old_.bashrc", "2024-03-01/big_data.bin", "2024-03-01/docs_report.pdf", "2024-03-01/photos_Café.txt"},
+		},
+		{
+			name: "run id before the extension",
+			args: []string{"-name-template", `{{beforeExt .Name "_" .RunID}}`, "-run-id", "r1"},
+			want: []string{".bashrc_r1", "Café_r1.txt", "archive_r1.tar.gz", "data_r1.bin", "report_r1.pdf"},
+		},
+		{
+			name: "compression last",
+			args: []string{"-compress", "gzip"},
+			want: []string{"backup_archive.tar.gz", "backup_old_.bashrc.gz", "big_data.bin.gz", "docs_report.pdf.gz", "photos_Café.txt.gz"},
+		},
+		{
+			name: "prefix",
+			args: []string{"-prefix", "x"},
+			want: []string{"x_backup_archive.tar.gz", "x_backup_old_.bashrc", "x_big_data.bin", "x_docs_report.pdf", "x_photos_Café.txt"},
+		},
+		{
+			name: "transliterated",
+			args: []string{"-transliterate"},
+			want: []string{"backup_archive.tar.gz", "backup_old_.bashrc", "big_data.bin", "docs_report.pdf", "photos_Cafe.txt"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := runCopyTest(t, "naming", test.args...)
+			if r.code != exitOK {
+				t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+			}
+			sort.Strings(test.want)
+			if got := r.names(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("output has %q, want %q", got, test.want)
+			}
+		})
+	}
+}
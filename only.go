@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// onlyRoots is -only, the slash separated directories under the source
+// root the walk is restricted to, nil without it.
+var onlyRoots rootList
+
+// onlyCounts are the files found and copied under each of onlyRoots, by
+// index. A file under nested roots counts for the innermost one.
+var onlyCounts []onlyCount
+
+type onlyCount struct {
+	found  atomic.Uint64
+	copied atomic.Uint64
+}
+
+// rootList is a comma separated list of directories, the flag can be
+// repeated to add more.
+type rootList []string
+
+func (l *rootList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *rootList) Set(s string) error {
+	for _, root := range strings.Split(s, ",") {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		clean := path.Clean(filepath.ToSlash(root))
+		if path.IsAbs(clean) || filepath.IsAbs(root) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("%q is not a directory under the source root", root)
+		}
+		*l = append(*l, clean)
+	}
+	return nil
+}
+
+func (l *rootList) repeatable() {}
+
+// prepareOnlyRoots checks that every -only root is a directory of the
+// source, which has to be open by then.
+func prepareOnlyRoots() error {
+	onlyCounts = make([]onlyCount, len(onlyRoots))
+	var errs []error
+	for _, root := range onlyRoots {
+		info, err := statSource(filepath.FromSlash(root))
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("-only %q: %w", root, err))
+		case !info.IsDir():
+			errs = append(errs, fmt.Errorf("-only %q: not a directory", root))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// inOnlyScope reports whether the walk has to enter dirName: when it's
+// under one of onlyRoots, or on the way to one.
+func inOnlyScope(dirName string) bool {
+	if len(onlyRoots) == 0 {
+		return true
+	}
+	name := filepath.ToSlash(dirName)
+	for _, root := range onlyRoots {
+		if underRoot(name, root) || underRoot(root, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyRootOf returns the index of the innermost of onlyRoots holding
+// name, -1 if none does.
+func onlyRootOf(name string) int {
+	name = filepath.ToSlash(name)
+	found := -1
+	for i, root := range onlyRoots {
+		if underRoot(name, root) && (found < 0 || len(root) > len(onlyRoots[found])) {
+			found = i
+		}
+	}
+	return found
+}
+
+func underRoot(name, root string) bool {
+	return name == root || strings.HasPrefix(name, root+"/")
+}
+
+// onlySelected reports whether -only, if given, selects the file name.
+func onlySelected(name string) bool {
+	return len(onlyRoots) == 0 || onlyRootOf(name) >= 0
+}
+
+// countOnlyFound and countOnlyCopied count n files of the directory dirName.
+func countOnlyFound(dirName string, n int) {
+	if i := onlyRootOf(dirName); i >= 0 {
+		onlyCounts[i].found.Add(uint64(n))
+	}
+}
+
+func countOnlyCopied(dirName string, n int) {
+	if i := onlyRootOf(dirName); i >= 0 {
+		onlyCounts[i].copied.Add(uint64(n))
+	}
+}
+
+// onlyRootSummary are the counts of one -only root in the JSON summary.
+type onlyRootSummary struct {
+	Root   string `json:"root"`
+	Found  uint64 `json:"found"`
+	Copied uint64 `json:"copied"`
+}
+
+func onlyRootSummaries() []onlyRootSummary {
+	if len(onlyCounts) == 0 {
+		return nil
+	}
+	summaries := make([]onlyRootSummary, len(onlyRoots))
+	for i, root := range onlyRoots {
+		summaries[i] = onlyRootSummary{Root: root, Found: onlyCounts[i].found.Load(), Copied: onlyCounts[i].copied.Load()}
+	}
+	return summaries
+}
+
+// logOnlyRoots prints the counts of every -only root.
+func logOnlyRoots() {
+	for _, root := range onlyRootSummaries() {
+		summaryf("-only %q: found '%d', copied '%d'\n", root.Root, root.Found, root.Copied)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+)
+
+// dirMode is -dir-mode, the permissions of the directories created in and
+// for the output directory, before the umask.
+var dirMode = modeValue(0755)
+
+// modeValue is an octal permission flag like 755.
+type modeValue os.FileMode
+
+func (m *modeValue) String() string {
+	return fmt.Sprintf("%#o", os.FileMode(*m))
+}
+
+func (m *modeValue) Set(s string) error {
+	bits, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || bits > 0777 {
+		return fmt.Errorf("%q is not an octal mode like 755", s)
+	}
+	if bits&0700 != 0700 {
+		return fmt.Errorf("%q leaves the owner unable to write into the directories", s)
+	}
+	*m = modeValue(bits)
+	return nil
+}
+
+// createOutputDirectory creates the output directory and its missing
+// parents, unless it exists, and checks a file can be written into it.
+func createOutputDirectory() error {
+	info, err := os.Stat(outputDirectory)
+	switch {
+	case err == nil && !info.IsDir():
+		return fmt.Errorf("the output directory %q exists and is not a directory", outputDirectory)
+	case err != nil:
+		// a parent that's a file fails the stat too, MkdirAll says which
+		if err := os.MkdirAll(outputDirectory, os.FileMode(dirMode)); err != nil {
+			// MkdirAll names the component it failed at
+			var pathErr *fs.PathError
+			if errors.As(err, &pathErr) && pathErr.Path != outputDirectory {
+				return fmt.Errorf("could not create the output directory %q at %q: %w", outputDirectory, pathErr.Path, pathErr.Err)
+			}
+			return fmt.Errorf("could not create the output directory: %w", err)
+		}
+	}
+	return probeWritable(outputDirectory)
+}
+
+// probeWritable creates and removes a file in dir, a lone directory
+// permission check misses read-only mounts and ACLs.
+func probeWritable(dir string) error {
+	probe, err := os.CreateTemp(dir, ".flatten-probe-*")
+	if err != nil {
+		return fmt.Errorf("the output directory %q is not writable: %w", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// outputMarkerName is written into every output directory, so a later run
+// over a tree containing it leaves it out instead of copying it again.
+const outputMarkerName = ".flatten-output.json"
+
+var (
+	includePreviousOutput bool
+	// forceSource is -force, copying a source root that is the output of
+	// an earlier run.
+	forceSource bool
+)
+
+type outputMarker struct {
+	Version    int       `json:"version"`
+	Build      buildInfo `json:"build"`
+	CreatedAt  time.Time `json:"created_at"`
+	SourceRoot string    `json:"source_root"`
+	// Runs are the runs into the directory, oldest first, so remove-run
+	// can find their manifests.
+	Runs []markerRun `json:"runs,omitempty"`
+}
+
+type markerRun struct {
+	ID         string    `json:"id"`
+	StartedAt  time.Time `json:"started_at"`
+	SourceRoot string    `json:"source_root"`
+	// Manifest is the absolute path of the run's manifest, if it wrote one.
+	Manifest string `json:"manifest,omitempty"`
+}
+
+// writeOutputMarker records the run in dir, keeping the runs recorded
+// before. Not having a marker only costs the protection and remove-run, so
+// failing to write one is a warning.
+func writeOutputMarker(dir, sourceRoot, runID, manifestName string) {
+	run := markerRun{ID: runID, StartedAt: runClock.Now(), SourceRoot: sourceRoot}
+	if manifestName != "" {
+		run.Manifest, _ = filepath.Abs(manifestName)
+	}
+	marker := outputMarker{Version: 1, Build: readBuildInfo(), CreatedAt: run.StartedAt, SourceRoot: sourceRoot}
+	if previous, err := readOutputMarker(dir); err == nil {
+		for _, earlier := range previous.Runs {
+			if earlier.ID != runID {
+				marker.Runs = append(marker.Runs, earlier)
+			}
+		}
+	}
+	marker.Runs = append(marker.Runs, run)
+	if err := marker.writeFile(dir); err != nil {
+		warnf("Could not write the output marker into %q: %v\n", dir, err)
+	}
+}
+
+func readOutputMarker(dir string) (*outputMarker, error) {
+	data, err := os.ReadFile(filepath.Join(dir, outputMarkerName))
+	if err != nil {
+		return nil, err
+	}
+	marker := &outputMarker{}
+	if err := json.Unmarshal(data, marker); err != nil {
+		return nil, fmt.Errorf("could not parse %q: %w", filepath.Join(dir, outputMarkerName), err)
+	}
+	return marker, nil
+}
+
+func (m *outputMarker) writeFile(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, outputMarkerName), append(data, '\n'), 0644)
+}
+
+// isPreviousOutput reports whether dir, relative to the working directory,
+// is the output directory of an earlier run that should be left out. It
+// looks for the marker itself instead of in the listing, so the walk can
+// tell before reading a huge directory.
+func isPreviousOutput(dir string) bool {
+	if includePreviousOutput {
+		return false
+	}
+	info, err := statSource(filepath.Join(dir, outputMarkerName))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// checkSourceRoot refuses a source root wd that is the output of a run:
+// flattening it again flattens the flattened names a second time. It's the
+// output directory of this run, holds the marker of an earlier one, or is
+// the output directory -state recorded, or inside it. -force lets the
+// last two through, copying into the source root itself never makes sense.
+func checkSourceRoot(wd string) error {
+	if sourceFS != nil {
+		return nil
+	}
+	if sameDirectory(wd, outputDirectory) {
+		return fmt.Errorf("the source root %q is the output directory, every file would be copied beside itself; pass -x with another directory", wd)
+	}
+	if forceSource {
+		return nil
+	}
+	if info, err := os.Stat(filepath.Join(wd, outputMarkerName)); err == nil && info.Mode().IsRegular() {
+		from := ""
+		if marker, err := readOutputMarker(wd); err == nil && marker.SourceRoot != "" {
+			from = fmt.Sprintf(", flattened from %q", marker.SourceRoot)
+		}
+		return fmt.Errorf("the source root %q holds %s, it's the output of an earlier run%s. Pass -force to flatten it again", wd, outputMarkerName, from)
+	}
+	if stateFile == "" {
+		return nil
+	}
+	state, err := readState(stateFile)
+	if err != nil || state.OutputDir == "" {
+		// a missing or broken state is reported where it's used
+		return nil
+	}
+	if rel, err := filepath.Rel(state.OutputDir, wd); sameDirectory(wd, state.OutputDir) || (err == nil && filepath.IsLocal(rel)) {
+		return fmt.Errorf("the source root %q is in %q, the output directory of the run recorded in %q. Pass -force to flatten it again", wd, state.OutputDir, stateFile)
+	}
+	return nil
+}
+
+// sameDirectory reports whether a and b are the same existing directory,
+// through links and bind mounts too.
+func sameDirectory(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	return err == nil && os.SameFile(aInfo, bInfo)
+}
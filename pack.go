@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// packMaxSize is the size after which a pack is finished and the next one
+// started.
+const packMaxSize = 1 << 30
+
+// packSmall is -pack-small, 0 when small files get their own files.
+var packSmall sizeValue
+
+// packs receives the files under -pack-small, nil without it.
+var packs *packWriter
+
+// packWriter appends small files to zip files ("packs") in the output
+// directory, stored without compression so each file's content is a plain
+// byte range of its pack. The manifest records that range, restore and
+// verify read it directly. A pack of an interrupted run has no central
+// directory and doesn't open as a zip, but its recorded ranges are intact.
+type packWriter struct {
+	mu      sync.Mutex
+	file    *os.File
+	counter *countingWriter
+	buf     *bufio.Writer
+	zw      *zip.Writer
+	name    string
+	next    int
+}
+
+func newPackWriter() *packWriter {
+	return &packWriter{next: 1}
+}
+
+// store copies srcName into the current pack as destName.
+func (p *packWriter) store(srcName, destName string) (manifestEntry, error) {
+	if err := claimDestination(destName, srcName); err != nil {
+		return manifestEntry{}, err
+	}
+
+	srcFile, err := openSource(srcName)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	defer srcFile.Close()
+	info, err := srcFile.Stat()
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	events.fileStart(srcName, destName, info.Size())
+	source, transform, err := transformText(countingReader{srcFile})
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	hasher := newHasher(hashAlgorithm.value)
+	if hasher != nil {
+		source = io.TeeReader(source, hasher)
+	}
+	if !streamIntoPack(info.Size()) {
+		// read outside the lock, workers only wait for each other's writes,
+		// as long as -archive-buffer has room for what they read
+		defer archiveBudget.release(archiveBudget.acquire(info.Size()))
+		var content bytes.Buffer
+		if _, err := io.Copy(&content, source); err != nil {
+			return manifestEntry{}, err
+		}
+		source = &content
+	}
+
+	entry := manifestEntry{
+		Source:      filepath.ToSlash(srcName),
+		Destination: destName,
+		ModTime:     info.ModTime(),
+		Mode:        info.Mode().Perm(),
+	}
+	written, err := p.write(&entry, info, source)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	if err := checkCopiedSize(srcName, info.Size(), transform.sourceRead(written)); err != nil {
+		return manifestEntry{}, err
+	}
+	entry.Size = recordedSize(srcName, info.Size(), transform.sourceRead(written))
+	transform.record(&entry, written)
+	if hasher != nil {
+		entry.Hash = hashSum(hasher)
+	}
+	return entry, nil
+}
+
+// write appends content to the current pack as entry's destination and
+// records where it starts. A streamed file that fails midway leaves its
+// partial content in the pack, the manifest doesn't list it.
+func (p *packWriter) write(entry *manifestEntry, info fs.FileInfo, content io.Reader) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.zw == nil || p.counter.n >= packMaxSize {
+		if err := p.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	header := &zip.FileHeader{Name: entry.Destination, Method: zip.Store, Modified: info.ModTime()}
+	header.SetMode(info.Mode())
+	w, err := p.zw.CreateHeader(header)
+	if err != nil {
+		return 0, err
+	}
+	// the zip writer buffers, the content starts after what was flushed
+	if err := p.zw.Flush(); err != nil {
+		return 0, err
+	}
+	if err := p.buf.Flush(); err != nil {
+		return 0, err
+	}
+	entry.Pack = p.name
+	entry.PackOffset = p.counter.n
+	return io.Copy(w, content)
+}
+
+// rotate finishes the current pack and starts the next one whose name is
+// still free, packs of an earlier run into the same directory are kept.
+func (p *packWriter) rotate() error {
+	if err := p.finish(); err != nil {
+		return err
+	}
+	for ; ; p.next++ {
+		name := fmt.Sprintf("flatten-pack-%04d.zip", p.next)
+		if _, err := os.Lstat(filepath.Join(outputDirectory, name)); !errors.Is(err, fs.ErrNotExist) || !copyDestinations.claim(name) {
+			continue
+		}
+		file, err := os.OpenFile(filepath.Join(outputDirectory, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		p.file, p.name = file, name
+		p.counter = &countingWriter{w: file}
+		p.buf = bufio.NewWriter(p.counter)
+		p.zw = zip.NewWriter(p.buf)
+		p.next++
+		verbosef("packing small files into %q\n", name)
+		return nil
+	}
+}
+
+func (p *packWriter) finish() error {
+	if p.zw == nil {
+		return nil
+	}
+	err := p.zw.Close()
+	if err == nil {
+		err = p.buf.Flush()
+	}
+	if closeErr := p.file.Close(); err == nil {
+		err = closeErr
+	}
+	p.zw = nil
+	return err
+}
+
+// close finishes the last pack.
+func (p *packWriter) close() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.finish()
+}
+
+// openStored opens the flattened content of entry, stored at name: the
+// file itself, or its range of the pack named name.
+func openStored(name string, entry manifestEntry) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil || entry.Pack == "" {
+		return f, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, entry.PackOffset, entry.Size), f}, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"testing/fstest"
+)
+
+// BenchmarkPackSmall stores one tiny file per op into the output directory,
+// a file each or into a -pack-small pack. A synthetic tree of 1M of them:
+//
+//	go test -run '^$' -bench PackSmall -benchtime 1000000x
+func BenchmarkPackSmall(b *testing.B) {
+	savedSource, savedOutput, savedClaimed, savedExisting := sourceFS, outputDirectory, copyDestinations, existingDestinations
+	b.Cleanup(func() {
+		sourceFS, outputDirectory, copyDestinations, existingDestinations = savedSource, savedOutput, savedClaimed, savedExisting
+	})
+	sourceFS = fstest.MapFS{"node_modules/index.js": testFile("module.exports = {}\n")}
+
+	for _, mode := range []string{"files", "pack"} {
+		b.Run(mode, func(b *testing.B) {
+			outputDirectory = b.TempDir()
+			copyDestinations, existingDestinations = newDestinationSet(), newDestinationSet()
+			pack := newPackWriter()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				destName := "node_modules_" + strconv.Itoa(i) + "_index.js"
+				var err error
+				if mode == "pack" {
+					_, err = pack.store("node_modules/index.js", destName)
+				} else {
+					_, err = storeFile("node_modules/index.js", destName, "", "")
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := pack.close(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
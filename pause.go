@@ -0,0 +1,191 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// stateChange is a pause, resume or cancel of a copy run, and who asked
+// for it.
+type stateChange struct {
+	At    time.Time `json:"at"`
+	State string    `json:"state"`
+	By    string    `json:"by"`
+}
+
+// pauseGate holds the copy workers back between files while the run is
+// paused. Copies already started finish, the walk goes on filling the
+// queue until it's full. Once cancelled, the workers leave out the jobs
+// still queued.
+type pauseGate struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	paused    bool
+	cancelled bool
+	// firstLeftOut is the earliest primary in walk order a cancel left
+	// out, -resume has to start there
+	firstLeftOut string
+	changes      []stateChange
+}
+
+var runPause = newPauseGate()
+
+func newPauseGate() *pauseGate {
+	p := &pauseGate{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// wait blocks while the run is paused, and not once it's interrupted so
+// the copies already dispatched can finish.
+func (p *pauseGate) wait() {
+	p.mu.Lock()
+	for p.paused && !interrupted.Load() {
+		p.cond.Wait()
+	}
+	p.mu.Unlock()
+}
+
+// wake lets waiting workers see that the run was interrupted.
+func (p *pauseGate) wake() {
+	p.mu.Lock()
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// pause reports false if the run was already paused or is stopping.
+func (p *pauseGate) pause(by string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused || interrupted.Load() {
+		return false
+	}
+	p.paused = true
+	p.record("paused", by)
+	infof("Paused by %s: the copies already started finish, no new one starts until resumed\n", by)
+	return true
+}
+
+// resume reports false if the run wasn't paused.
+func (p *pauseGate) resume(by string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return false
+	}
+	p.paused = false
+	p.record("resumed", by)
+	p.cond.Broadcast()
+	infof("Resumed by %s\n", by)
+	return true
+}
+
+// cancel stops the run like an interrupt, but the jobs waiting in the queue
+// are left out too: only the copies already started finish. It reports
+// false if the run was already stopping.
+func (p *pauseGate) cancel(by string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !interrupted.CompareAndSwap(false, true) {
+		return false
+	}
+	p.paused = false
+	p.cancelled = true
+	p.record("cancelled", by)
+	p.cond.Broadcast()
+	infof("Cancelled by %s, finishing the copies already started and stopping\n", by)
+	return true
+}
+
+// leaveOut reports whether a worker must not start job because the run was
+// cancelled.
+func (p *pauseGate) leaveOut(job copyJob) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.cancelled {
+		return false
+	}
+	primary := filepath.ToSlash(filepath.Join(job.dir, job.files[0]))
+	if p.firstLeftOut == "" || walkOrderLess(primary, p.firstLeftOut) {
+		p.firstLeftOut = primary
+	}
+	return true
+}
+
+// resumeAt is where a -resume of a cancelled run has to start, "" if no
+// queued job was left out.
+func (p *pauseGate) resumeAt() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.firstLeftOut
+}
+
+func (p *pauseGate) record(state, by string) {
+	change := stateChange{At: runClock.Now(), State: state, By: by}
+	p.changes = append(p.changes, change)
+	control.broadcastState(change)
+	withBar(func(bar *progressbar.ProgressBar) {
+		if state == "paused" {
+			bar.Describe("PAUSED, r resumes")
+		} else {
+			bar.Describe("")
+		}
+	})
+}
+
+// state is running, paused or cancelled.
+func (p *pauseGate) state() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case interrupted.Load():
+		return "cancelled"
+	case p.paused:
+		return "paused"
+	}
+	return "running"
+}
+
+func (p *pauseGate) snapshot() []stateChange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]stateChange(nil), p.changes...)
+}
+
+// pausedFor adds up the time between each pause and the change after it,
+// or now for a pause still going on.
+func pausedFor(changes []stateChange, now time.Time) (pauses int, total time.Duration) {
+	var since time.Time
+	for _, change := range changes {
+		switch {
+		case change.State == "paused":
+			pauses++
+			since = change.At
+		case !since.IsZero():
+			total += change.At.Sub(since)
+			since = time.Time{}
+		}
+	}
+	if !since.IsZero() {
+		total += now.Sub(since)
+	}
+	return pauses, total
+}
+
+// pausedTime is how long the run was paused so far, left out of its rates
+// and ETAs.
+func (p *pauseGate) pausedTime() time.Duration {
+	_, total := pausedFor(p.snapshot(), runClock.Now())
+	return total
+}
+
+// logPauses says how often and how long the run was paused.
+func logPauses() {
+	pauses, total := pausedFor(runPause.snapshot(), runClock.Now())
+	if pauses > 0 {
+		summaryf("Paused '%d' times for %s in total\n", pauses, formatDuration(total))
+	}
+}
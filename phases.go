@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// phaseTiming is how long one phase of a copy run took.
+type phaseTiming struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// phaseTimer times the phases of a run one after the other: scan is the
+// scout, plan sets up the output directory with its existing destinations
+// and the manifest, copy walks and copies, and finalize writes the lists,
+// the manifest and the summary. Names are chosen while copying, so their
+// time is part of copy.
+type phaseTimer struct {
+	mu      sync.Mutex
+	done    []phaseTiming
+	current string
+	start   time.Time
+}
+
+var phases phaseTimer
+
+// begin ends the running phase, if any, and starts name.
+func (p *phaseTimer) begin(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := runClock.Now()
+	p.finish(now)
+	p.current, p.start = name, now
+}
+
+// end ends the running phase.
+func (p *phaseTimer) end() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finish(runClock.Now())
+}
+
+func (p *phaseTimer) finish(now time.Time) {
+	if p.current == "" {
+		return
+	}
+	p.done = append(p.done, phaseTiming{Name: p.current, Seconds: now.Sub(p.start).Seconds()})
+	p.current = ""
+}
+
+func (p *phaseTimer) snapshot() []phaseTiming {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]phaseTiming(nil), p.done...)
+}
+
+// logPhases prints the phase table of -time.
+func logPhases() {
+	timings := phases.snapshot()
+	if len(timings) == 0 {
+		return
+	}
+	var total float64
+	for _, phase := range timings {
+		total += phase.Seconds
+	}
+	infof("%-10s %9s %6s\n", "phase", "time", "share")
+	for _, phase := range timings {
+		share := 0.0
+		if total > 0 {
+			share = 100 * phase.Seconds / total
+		}
+		infof("%-10s %9s %5.1f%%\n", phase.Name, formatDuration(time.Duration(phase.Seconds*float64(time.Second))), share)
+	}
+}
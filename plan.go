@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var planCommand = newCommand("plan", "", "Print every copy the copy command would perform, without touching the output directory.",
+	outputFlags, logFlags, sourceFlags, namingFlags, filterFlags, compressionFlags)
+
+var planOutput string
+
+func init() {
+	planCommand.flags.StringVar(&planOutput, "o", "", "also write the plan to this JSON file, to be executed later with apply")
+	planCommand.run = runPlan
+}
+
+func runPlan(args []string) int {
+	deterministicWalk = true
+	if err := prepareNaming(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := prepareFilters(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := validateCompression(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := validateEncryption(planCommand.flags); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := openSourceTree(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := prepareOnlyRoots(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	var plan *operationsPlan
+	if planOutput != "" {
+		plan = &operationsPlan{
+			Version:    planVersion,
+			Build:      readBuildInfo(),
+			CreatedAt:  runClock.Now(),
+			SourceRoot: sourceRoot(workingDirectory),
+			OutputDir:  outputDirectory,
+			RunID:      runID,
+		}
+	}
+
+	total := 0
+	err := walkNestedFiles(func(dirName string, group []string) error {
+		primaryDest, err := destinationName(dirName, group[0])
+		if err != nil {
+			errorf("%v\n", err)
+			return nil
+		}
+		for _, fileName := range group {
+			total++
+			compression := compressionFor(fileName)
+			destName := sidecarDestination(primaryDest, group[0], fileName) + compressionExtension(compression) + encryptionExtension(encryptTo.String())
+			fmt.Printf("%s -> %s\n", filepath.Join(dirName, fileName), filepath.Join(outputDirectory, filepath.FromSlash(destName)))
+
+			if plan == nil {
+				continue
+			}
+			info, err := statSource(filepath.Join(dirName, fileName))
+			if err != nil {
+				errorf("%v\n", err)
+				continue
+			}
+			entry := plannedCopy{
+				Source:      filepath.ToSlash(filepath.Join(dirName, fileName)),
+				Destination: destName,
+				Size:        info.Size(),
+				ModTime:     info.ModTime(),
+				Compression: compression,
+				Encryption:  encryptTo.String(),
+			}
+			if fileName != group[0] {
+				entry.Group = filepath.ToSlash(filepath.Join(dirName, group[0]))
+			}
+			plan.Entries = append(plan.Entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		errorf("%v\n", err)
+		return exitFailed
+	}
+
+	if plan != nil {
+		if err := plan.writeFile(planOutput); err != nil {
+			errorf("Could not write plan %q: %v\n", planOutput, err)
+			return exitFailed
+		}
+	}
+
+	infof("Planned: '%d' nested items to copy\n", total)
+	return exitOK
+}
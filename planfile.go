@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const planVersion = 1
+
+// operationsPlan is what plan -o writes and apply executes: every copy a
+// copy run would do, with the decisions made for it.
+type operationsPlan struct {
+	Version    int           `json:"version"`
+	Build      buildInfo     `json:"build"`
+	CreatedAt  time.Time     `json:"created_at"`
+	SourceRoot string        `json:"source_root"`
+	OutputDir  string        `json:"output_dir"`
+	RunID      string        `json:"run_id,omitempty"`
+	Entries    []plannedCopy `json:"entries"`
+}
+
+type plannedCopy struct {
+	// Source is the slash separated path relative to SourceRoot.
+	Source string `json:"source"`
+	// Destination is the slash separated path relative to OutputDir,
+	// including the extensions of Compression and Encryption.
+	Destination string `json:"destination"`
+	// Size and ModTime are the source's when it was planned, apply refuses
+	// sources that changed since unless -allow-drift is given.
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	Compression string    `json:"compression,omitempty"`
+	Encryption  string    `json:"encryption,omitempty"`
+	// Group is the Source of the primary file when this entry is one of its sidecars.
+	Group string `json:"group,omitempty"`
+}
+
+func (p *operationsPlan) writeFile(name string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0644)
+}
+
+func readPlan(name string) (*operationsPlan, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &operationsPlan{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("could not parse plan %q: %w", name, err)
+	}
+	if p.Version > planVersion {
+		return nil, fmt.Errorf("plan %q has version %d, this build understands up to %d", name, p.Version, planVersion)
+	}
+	if !filepath.IsAbs(p.SourceRoot) || !filepath.IsAbs(p.OutputDir) {
+		return nil, fmt.Errorf("plan %q needs absolute source_root and output_dir", name)
+	}
+
+	for _, entry := range p.Entries {
+		if !filepath.IsLocal(filepath.FromSlash(entry.Source)) || !filepath.IsLocal(filepath.FromSlash(entry.Destination)) {
+			return nil, fmt.Errorf("plan %q contains a path escaping its root: %q -> %q", name, entry.Source, entry.Destination)
+		}
+	}
+	return p, nil
+}
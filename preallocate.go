@@ -0,0 +1,27 @@
+package main
+
+import "os"
+
+// preallocateMode is -preallocate. auto only preallocates files of at
+// least preallocateAutoSize, where fragmentation costs the most.
+var preallocateMode = newChoiceValue("auto", "auto", "on", "off")
+
+const preallocateAutoSize = 64 << 20
+
+// preallocate reserves size bytes for a destination about to be written,
+// without changing its length. It reports whether it did; filesystems and
+// platforms without support are silently left alone.
+func preallocate(f *os.File, size int64, compression string) bool {
+	switch {
+	case preallocateMode.value == "off", compression != "", size <= 0:
+		// compressed output is smaller by an unknown amount
+		return false
+	case preallocateMode.value == "auto" && size < preallocateAutoSize:
+		return false
+	}
+	if err := allocate(f, size); err != nil {
+		verbosef("Could not preallocate %q: %v\n", f.Name(), err)
+		return false
+	}
+	return true
+}
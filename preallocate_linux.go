@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE: allocate without growing the file.
+const fallocKeepSize = 0x01
+
+func allocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+}
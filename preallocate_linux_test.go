@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// fsIocFiemap is FS_IOC_FIEMAP, which maps the extents of a file.
+const fsIocFiemap = 0xc020660b
+
+// fileExtents is the number of extents f's data is stored in.
+func fileExtents(f *os.File) (int, error) {
+	// struct fiemap without room for extents only counts them
+	var fiemap struct {
+		start, length                      uint64
+		flags, mapped, extentCount, unused uint32
+	}
+	fiemap.length = ^uint64(0)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&fiemap))); errno != 0 {
+		return 0, errno
+	}
+	return int(fiemap.mapped), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func fileExtents(f *os.File) (int, error) {
+	return 0, errors.ErrUnsupported
+}
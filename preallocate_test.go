@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// BenchmarkPreallocate writes 4 files of 64MiB side by side in 1MiB
+// pieces, as copy workers do, with -preallocate off and on. It reports the
+// throughput and, where the filesystem tells, the extents per file.
+func BenchmarkPreallocate(b *testing.B) {
+	const files, size, piece = 4, 64 << 20, 1 << 20
+	saved := preallocateMode.value
+	b.Cleanup(func() { preallocateMode.value = saved })
+	data := make([]byte, piece)
+
+	for _, mode := range []string{"off", "on"} {
+		b.Run(mode, func(b *testing.B) {
+			preallocateMode.value = mode
+			b.SetBytes(files * size)
+			extents := 0
+			for i := 0; i < b.N; i++ {
+				dir := b.TempDir()
+				var wg sync.WaitGroup
+				errs := make([]error, files)
+				counts := make([]int, files)
+				for n := 0; n < files; n++ {
+					wg.Add(1)
+					go func(n int) {
+						defer wg.Done()
+						f, err := os.Create(filepath.Join(dir, fmt.Sprint(n)))
+						if err != nil {
+							errs[n] = err
+							return
+						}
+						defer f.Close()
+						preallocate(f, size, "")
+						for written := 0; written < size && err == nil; written += piece {
+							_, err = f.Write(data)
+						}
+						if err == nil {
+							err = f.Sync()
+						}
+						errs[n] = err
+						counts[n], _ = fileExtents(f)
+					}(n)
+				}
+				wg.Wait()
+				for n, err := range errs {
+					if err != nil {
+						b.Fatal(err)
+					}
+					extents += counts[n]
+				}
+			}
+			b.ReportMetric(float64(extents)/float64(b.N*files), "extents/file")
+		})
+	}
+}
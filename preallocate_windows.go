@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"unsafe"
+)
+
+var procSetFileInformationByHandle = kernel32.NewProc("SetFileInformationByHandle")
+
+// fileAllocationInfo is the FileAllocationInfo FILE_INFO_BY_HANDLE_CLASS,
+// it sets the allocation size without moving the end of the file.
+const fileAllocationInfo = 5
+
+func allocate(f *os.File, size int64) error {
+	r, _, err := procSetFileInformationByHandle.Call(f.Fd(), fileAllocationInfo, uintptr(unsafe.Pointer(&size)), unsafe.Sizeof(size))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+var (
+	removeRunManifest string
+	removeRunDryRun   bool
+)
+
+var removeRunCommand = newCommand("remove-run", "LABEL", "Remove the files the run with this -run-id created in the output directory, found through\n"+
+	"its manifest. Files whose size or, if the manifest has them, hash changed since are left alone.",
+	outputFlags, logFlags, hashWorkerFlags)
+
+func init() {
+	fs := removeRunCommand.flags
+	fs.StringVar(&removeRunManifest, "manifest", "", "manifest of the run, found through the output directory's marker by default")
+	fs.BoolVar(&removeRunDryRun, "dry-run", false, "only print the files that would be removed")
+	removeRunCommand.run = runRemoveRun
+}
+
+func runRemoveRun(args []string) int {
+	if len(args) != 1 {
+		removeRunCommand.flags.Usage()
+		return exitUsage
+	}
+	label := args[0]
+	if hashWorkers < 1 {
+		fmt.Fprintln(os.Stderr, "flatten remove-run: -hash-workers must be at least 1")
+		return exitUsage
+	}
+
+	manifestName := removeRunManifest
+	if manifestName == "" {
+		marker, err := readOutputMarker(outputDirectory)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "flatten remove-run: %v\n", err)
+			return exitUsage
+		}
+		for _, run := range marker.Runs {
+			if run.ID == label {
+				manifestName = run.Manifest
+				if manifestName == "" {
+					fmt.Fprintf(os.Stderr, "flatten remove-run: run %q wrote no manifest, its files can't be told apart\n", label)
+					return exitUsage
+				}
+			}
+		}
+		if manifestName == "" {
+			fmt.Fprintf(os.Stderr, "flatten remove-run: %q has no run %q\n", outputDirectory, label)
+			return exitUsage
+		}
+	}
+	m, err := readManifest(manifestName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "flatten remove-run: %v\n", err)
+		return exitUsage
+	}
+	if m.RunID != label {
+		fmt.Fprintf(os.Stderr, "flatten remove-run: manifest %q is of run %q, not %q\n", manifestName, m.RunID, label)
+		return exitUsage
+	}
+	outputDir := ""
+	if flagWasSet(removeRunCommand.flags, "x") {
+		outputDir = outputDirectory
+	}
+
+	// a pack is only removed if none of its entries changed
+	var remove []manifestEntry
+	packIntact := map[string]bool{}
+	left := 0
+	verifyEntries(m, outputDir, m.HashAlgorithm, func(entry manifestEntry, err error) {
+		if entry.Pack != "" {
+			if _, seen := packIntact[entry.Pack]; !seen {
+				packIntact[entry.Pack] = true
+			}
+			packIntact[entry.Pack] = packIntact[entry.Pack] && err == nil
+			return
+		}
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			verbosef("%q is already gone\n", m.destinationPath(outputDir, entry))
+		case err != nil:
+			errorf("%q changed since run %q, leaving it: %v\n", m.destinationPath(outputDir, entry), label, err)
+			left++
+		default:
+			remove = append(remove, entry)
+		}
+	})
+	for pack, intact := range packIntact {
+		entry := manifestEntry{Pack: pack}
+		if intact {
+			remove = append(remove, entry)
+		} else {
+			errorf("%q changed since run %q, leaving it\n", m.destinationPath(outputDir, entry), label)
+			left++
+		}
+	}
+
+	removed := 0
+	for _, entry := range remove {
+		dst := m.destinationPath(outputDir, entry)
+		if removeRunDryRun {
+			infof("Would remove %q\n", dst)
+			continue
+		}
+		if err := os.Remove(dst); err != nil {
+			errorf("%v\n", err)
+			left++
+			continue
+		}
+		removed++
+	}
+	markersRemoved, markersLeft := removeEmptyDirMarkers(m, outputDir, false, removeRunDryRun)
+	removed += markersRemoved
+	left += markersLeft
+
+	if left == 0 && !removeRunDryRun {
+		forgetRun(m.destinationPath(outputDir, manifestEntry{}), label)
+	}
+
+	infof("Removed: '%d' files of run %q, '%d' left in place\n", removed, label, left)
+	if left > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// forgetRun drops a removed run from the marker of the output directory dir.
+func forgetRun(dir, label string) {
+	marker, err := readOutputMarker(dir)
+	if err != nil {
+		return
+	}
+	runs := marker.Runs[:0]
+	for _, run := range marker.Runs {
+		if run.ID != label {
+			runs = append(runs, run)
+		}
+	}
+	marker.Runs = runs
+	if err := marker.writeFile(dir); err != nil {
+		warnf("Could not update the output marker in %q: %v\n", dir, err)
+	}
+}
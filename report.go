@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportVersion is bumped whenever the -report columns change.
+const reportVersion = 1
+
+var (
+	reportFile string
+
+	opsReport *operationsReport
+)
+
+type reportOutcome string
+
+const (
+	outcomeCopied  reportOutcome = "copied"
+	outcomeSkipped reportOutcome = "skipped"
+	outcomeFailed  reportOutcome = "failed"
+)
+
+// reportRow is one file of a -report, the whole sidecar group once per member.
+type reportRow struct {
+	Source      string        `json:"source"`
+	Destination string        `json:"destination,omitempty"`
+	Size        int64         `json:"size"`
+	Start       time.Time     `json:"start"`
+	Duration    time.Duration `json:"duration_ns"`
+	// Throughput is in bytes per second.
+	Throughput float64       `json:"throughput"`
+	Worker     int           `json:"worker"`
+	Outcome    reportOutcome `json:"outcome"`
+	Error      string        `json:"error,omitempty"`
+}
+
+var reportColumns = []string{"source", "destination", "size", "start", "duration_ns", "throughput", "worker", "outcome", "error"}
+
+// operationsReport streams rows to the -report file as copies finish, each
+// one flushed right away so an interrupted run still leaves a usable report.
+// Files ending in .json get JSON lines after a header object, anything else
+// CSV after a "# flatten report" comment line.
+type operationsReport struct {
+	mu   sync.Mutex
+	file *os.File
+	csv  *csv.Writer
+	json *json.Encoder
+	err  error
+}
+
+func openReport(name string) (*operationsReport, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &operationsReport{file: file}
+
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		r.json = json.NewEncoder(file)
+		err = r.json.Encode(map[string]any{"report_version": reportVersion, "columns": reportColumns})
+	} else {
+		r.csv = csv.NewWriter(file)
+		if _, err = file.WriteString("# flatten report version " + strconv.Itoa(reportVersion) + "\n"); err == nil {
+			r.csv.Write(reportColumns)
+			r.csv.Flush()
+			err = r.csv.Error()
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// add is safe to call from several copy goroutines. Write errors are kept
+// for close instead of failing the copy.
+func (r *operationsReport) add(rows ...reportRow) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+
+	for _, row := range rows {
+		if row.Duration > 0 {
+			row.Throughput = float64(row.Size) / row.Duration.Seconds()
+		}
+		if r.json != nil {
+			r.err = r.json.Encode(row)
+		} else {
+			r.csv.Write([]string{
+				row.Source, row.Destination, strconv.FormatInt(row.Size, 10), row.Start.Format(time.RFC3339Nano),
+				strconv.FormatInt(int64(row.Duration), 10), strconv.FormatFloat(row.Throughput, 'f', 0, 64),
+				strconv.Itoa(row.Worker), string(row.Outcome), row.Error,
+			})
+			r.csv.Flush()
+			r.err = r.csv.Error()
+		}
+		if r.err != nil {
+			return
+		}
+	}
+}
+
+// recordResults hands finished files to the -report, the -failed-list and
+// the events.
+func recordResults(rows ...reportRow) {
+	opsReport.add(rows...)
+	failures.add(rows...)
+	events.fileDone(rows...)
+}
+
+// recordGroup records every file of a group that wasn't attempted.
+func recordGroup(worker int, dir string, group []string, outcome reportOutcome, err error) {
+	recordResults(groupRows(worker, dir, group, outcome, err)...)
+}
+
+// groupRows are the rows of every file of a group that wasn't attempted.
+func groupRows(worker int, dir string, group []string, outcome reportOutcome, err error) []reportRow {
+	now := time.Now()
+	rows := make([]reportRow, len(group))
+	for i, name := range group {
+		rows[i] = reportRow{Source: filepath.ToSlash(filepath.Join(dir, name)), Start: now, Worker: worker, Outcome: outcome, Error: err.Error()}
+	}
+	return rows
+}
+
+func (r *operationsReport) close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.file.Close(); r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
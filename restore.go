@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+var (
+	restoreTarget    string
+	restoreManifest  string
+	restoreOverwrite bool
+	restoreWorkers   int
+)
+
+var restoreCommand = newCommand("restore", "", "Copy flattened files back into their original directory layout using a manifest.\n"+
+	"-x overrides the output directory recorded in the manifest.", outputFlags, logFlags, decryptFlags)
+
+func init() {
+	fs := restoreCommand.flags
+	fs.StringVar(&restoreManifest, "manifest", "", "manifest written by a previous copy run")
+	fs.StringVar(&restoreTarget, "to", "restored", "directory the original layout is recreated in")
+	fs.BoolVar(&restoreOverwrite, "overwrite", false, "overwrite files already present in the restore directory")
+	fs.IntVar(&restoreWorkers, "c", runtime.NumCPU(), "number of files restored at once")
+	lowPriorityFlag(fs)
+	restoreCommand.run = runRestore
+}
+
+func runRestore(args []string) int {
+	m, outputDir, ok := loadManifestFlag(restoreCommand, restoreManifest)
+	if !ok {
+		return exitUsage
+	}
+	if restoreWorkers < 1 {
+		fmt.Fprintln(os.Stderr, "flatten restore: -c must be at least 1")
+		return exitUsage
+	}
+	applyLowPriority(restoreCommand.flags, &restoreWorkers)
+	infof("restore workers: '%d', CPUs: '%d'\n", restoreWorkers, runtime.NumCPU())
+	return restoreEntries(m, outputDir)
+}
+
+// errRestoreEscape fails a manifest path that would be restored outside
+// of -to.
+var errRestoreEscape = errors.New("path escapes the restore directory")
+
+// restorePath is where the slash separated manifest path source is
+// restored to. readManifest already refuses such manifests, this keeps a
+// manifest built any other way from writing outside of -to.
+func restorePath(source string) (string, error) {
+	local := filepath.FromSlash(source)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("%w: %q", errRestoreEscape, source)
+	}
+	return filepath.Join(restoreTarget, local), nil
+}
+
+// restoreEntries restores the files and directories of m from outputDir,
+// or the output directory m recorded if it's empty.
+func restoreEntries(m *manifest, outputDir string) int {
+	// every directory is created once, parents first, before any file
+	failedDirs := 0
+	for _, dir := range restoreDirectories(m) {
+		dst, err := restorePath(dir)
+		if err == nil {
+			err = os.MkdirAll(dst, 0755)
+		}
+		if err != nil {
+			errorf("Could not create directory %q: %v\n", dir, err)
+			copyErrors.record(dir, err)
+			failedDirs++
+		}
+	}
+
+	var totalBytes int64
+	for _, entry := range m.Entries {
+		totalBytes += entry.Size
+	}
+	rawBar := progressbar.DefaultBytes(totalBytes)
+	progressBar.Store(rawBar)
+	bar := newBatchedBar(rawBar, totalBytes)
+
+	entries := make(chan manifestEntry, restoreWorkers)
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(restoreWorkers)
+	for i := 0; i < restoreWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for entry := range entries {
+				if abortCopy.Load() {
+					failed.Add(1)
+					continue
+				}
+				src := m.destinationPath(outputDir, entry)
+				dst, err := restorePath(entry.Source)
+				if err == nil {
+					err = restoreFile(src, dst, entry, bar)
+				}
+				if err != nil {
+					errorf("Could not restore %q: %v\n", entry.Source, err)
+					copyErrors.record(entry.Source, err)
+					failed.Add(1)
+					continue
+				}
+				verbosef("restored %q -> %q\n", src, dst)
+			}
+		}()
+	}
+	for _, entry := range m.Entries {
+		entries <- entry
+	}
+	close(entries)
+	wg.Wait()
+	bar.close(false)
+	if failed.Load() == 0 {
+		barMu.Lock()
+		rawBar.Finish()
+		barMu.Unlock()
+	}
+	progressBar.Store(nil)
+
+	infof("Restored: '%d' of '%d' items into %q\n", len(m.Entries)-int(failed.Load()), len(m.Entries), restoreTarget)
+	if errorsSummary := copyErrors.String(); errorsSummary != "" {
+		summaryf("Errors by category: %s\n", errorsSummary)
+	}
+	if failed.Load() > 0 || failedDirs > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// restoreDirectories are the slash separated directories a restore of m
+// creates: those of its files and its empty directories, sorted so every
+// parent comes before its children.
+func restoreDirectories(m *manifest) []string {
+	seen := map[string]bool{}
+	var dirs []string
+	add := func(dir string) {
+		if dir != "." && dir != "" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, entry := range m.Entries {
+		add(path.Dir(entry.Source))
+	}
+	for _, dir := range m.EmptyDirs {
+		add(dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// progressWriter counts the bytes written through it on a byte bar.
+type progressWriter struct {
+	w   io.Writer
+	bar *batchedBar
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.bar.add(n)
+	return n, err
+}
+
+func restoreFile(src, dst string, entry manifestEntry, bar *batchedBar) (err error) {
+	if !restoreOverwrite {
+		if _, err := os.Lstat(dst); err == nil {
+			return fmt.Errorf("%q already exists, use -overwrite to replace it", dst)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	if entry.LinkTarget != "" {
+		if restoreOverwrite {
+			os.Remove(dst)
+		}
+		return os.Symlink(entry.LinkTarget, dst)
+	}
+
+	srcFile, err := openStored(src, entry)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	mode := entry.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	plain, err := newDecryptor(entry.Encryption, srcFile)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	content, err := newDecompressor(entry.Compression, plain)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	dstFile, putBack, err := createRestored(dst, mode)
+	if err != nil {
+		return err
+	}
+	if putBack != nil {
+		// the file there was read-only, the one replacing it is too, even
+		// if it couldn't be written completely
+		defer func() {
+			if putBackErr := putBack(); err == nil {
+				err = putBackErr
+			}
+		}()
+	}
+
+	if _, err := io.Copy(progressWriter{dstFile, bar}, content); err != nil {
+		dstFile.Close()
+		return err
+	}
+	if err := dstFile.Close(); err != nil {
+		return err
+	}
+	if err := restoreACL(dst, entry); err != nil {
+		warnf("Could not restore the ACL of %q: %v\n", dst, err)
+	}
+	return os.Chtimes(dst, entry.ModTime, entry.ModTime)
+}
+
+// createRestored opens dst for writing. With -overwrite a link or other
+// file that isn't regular is removed first, the open would follow a link
+// out of -to, and a read-only file already there is made writable, see
+// openWritable, and a function putting its permissions back is returned.
+func createRestored(dst string, mode os.FileMode) (*os.File, func() error, error) {
+	const flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if !restoreOverwrite {
+		file, err := os.OpenFile(dst, flags, mode)
+		return file, nil, err
+	}
+	if info, err := os.Lstat(dst); err == nil && !info.Mode().IsRegular() {
+		if err := os.Remove(dst); err != nil {
+			return nil, nil, err
+		}
+	}
+	file, putBack, err := openWritable(dst, flags, mode)
+	if err != nil || putBack == nil {
+		return file, nil, err
+	}
+	return file, func() error { return putBack(dst) }, nil
+}
+
+// openWritable is os.OpenFile for writing to name. A read-only file
+// already there, like one copied from optical media or with the Windows
+// read-only attribute, is made writable first, and putBack gives the file
+// it ends up as its permissions back once it's written. putBack is nil
+// when nothing was changed. Any other permission error is returned as is.
+func openWritable(name string, flag int, perm os.FileMode) (file *os.File, putBack func(name string) error, err error) {
+	file, err = os.OpenFile(name, flag, perm)
+	if err == nil || !errors.Is(err, fs.ErrPermission) {
+		return file, nil, err
+	}
+	info, statErr := os.Lstat(name)
+	if statErr != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0200 != 0 {
+		return nil, nil, err
+	}
+	readOnly := info.Mode().Perm()
+	// on Windows the owner write bit is the read-only attribute
+	if err := os.Chmod(name, readOnly|0200); err != nil {
+		return nil, nil, fmt.Errorf("%q is read-only and can't be made writable: %w", name, err)
+	}
+	file, err = os.OpenFile(name, flag, perm)
+	if err != nil {
+		os.Chmod(name, readOnly)
+		return nil, nil, err
+	}
+	verbosef("Made the read-only %q writable to overwrite it\n", name)
+	return file, func(name string) error { return os.Chmod(name, readOnly) }, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func init() {
+	copyCases["round trip"] = copyCase{source: fstest.MapFS{
+		"a/one.txt":      {Data: []byte("one"), Mode: 0644, ModTime: testEpoch},
+		"a/b/secret.txt": {Data: []byte("only mine"), Mode: 0600, ModTime: testEpoch.Add(-time.Hour)},
+		"a/b/run.sh":     {Data: []byte("#!/bin/sh\necho hi\n"), Mode: 0755, ModTime: testEpoch.Add(-48 * time.Hour)},
+		"c/same.txt":     {Data: []byte("one"), Mode: 0644, ModTime: testEpoch.Add(time.Minute)},
+		"c/d/empty.txt":  {Data: nil, Mode: 0644, ModTime: testEpoch},
+		"c/d/big.bin":    {Data: bytes.Repeat([]byte("0123456789"), 100000), Mode: 0640, ModTime: testEpoch},
+	}}
+}
+
+// TestRestoreRoundTrip flattens a tree with a manifest and restores it: the
+// restored files have the content, mode and mtime of the sources. Restoring
+// again with -overwrite replaces a link at a file's place instead of writing
+// where it points.
+func TestRestoreRoundTrip(t *testing.T) {
+	source := copyCases["round trip"].source.(fstest.MapFS)
+	for name, args := range map[string][]string{"plain": nil, "compressed": {"-compress", "gzip"}} {
+		t.Run(name, func(t *testing.T) {
+			r := runCopyTest(t, "round trip", append([]string{"-manifest", "manifest.json"}, args...)...)
+			if r.code != exitOK {
+				t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+			}
+			m, err := readManifest(filepath.Join(r.wd, "manifest.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			restoreTarget = filepath.Join(r.wd, "restored")
+			restoreWorkers = 2
+			restoreOverwrite = false
+			if code := restoreEntries(m, filepath.Join(r.wd, "out")); code != exitOK {
+				t.Fatalf("restoreEntries = %d, want %d", code, exitOK)
+			}
+			compareRestored(t, source)
+
+			outside := filepath.Join(r.wd, "outside.txt")
+			if err := os.WriteFile(outside, []byte("not restored"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			linked := filepath.Join(restoreTarget, "a", "one.txt")
+			if err := os.Remove(linked); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(outside, linked); err != nil {
+				t.Fatal(err)
+			}
+			restoreOverwrite = true
+			if code := restoreEntries(m, filepath.Join(r.wd, "out")); code != exitOK {
+				t.Fatalf("restoreEntries -overwrite = %d, want %d", code, exitOK)
+			}
+			compareRestored(t, source)
+			if content, err := os.ReadFile(outside); err != nil || string(content) != "not restored" {
+				t.Errorf("the file a link pointed to = %q, %v, want it untouched", content, err)
+			}
+		})
+	}
+}
+
+// compareRestored compares every file of source with the one in
+// restoreTarget.
+func compareRestored(t *testing.T, source fstest.MapFS) {
+	t.Helper()
+	for name, file := range source {
+		restored := filepath.Join(restoreTarget, filepath.FromSlash(name))
+		info, err := os.Lstat(restored)
+		if err != nil {
+			t.Errorf("%s wasn't restored: %v", name, err)
+			continue
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm() != file.Mode.Perm() {
+			t.Errorf("%s has mode %v, want %v", name, info.Mode(), file.Mode)
+		}
+		if !info.ModTime().Equal(file.ModTime) {
+			t.Errorf("%s has mtime %v, want %v", name, info.ModTime(), file.ModTime)
+		}
+		if content, err := os.ReadFile(restored); err != nil || !bytes.Equal(content, file.Data) {
+			t.Errorf("%s has %d bytes, %v, want the %d of the source", name, len(content), err, len(file.Data))
+		}
+	}
+}
+
+func TestRestorePath(t *testing.T) {
+	restoreTarget = "restored"
+	tests := []struct {
+		source string
+		want   string
+		escape bool
+	}{
+		{source: "a/b.txt", want: filepath.Join("restored", "a", "b.txt")},
+		{source: "a/../b.txt", want: filepath.Join("restored", "b.txt")},
+		{source: "../x", escape: true},
+		{source: "../../etc/x", escape: true},
+		{source: "a/../../x", escape: true},
+		{source: "/etc/x", escape: true},
+		{source: "", escape: true},
+	}
+	for _, test := range tests {
+		got, err := restorePath(test.source)
+		if test.escape {
+			if !errors.Is(err, errRestoreEscape) {
+				t.Errorf("restorePath(%q) = %q, %v, want errRestoreEscape", test.source, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("restorePath(%q) = %q, %v, want %q", test.source, got, err, test.want)
+		}
+	}
+}
+
+// TestRestoreHostileManifest restores a manifest whose entries point out of
+// -to: they fail, the rest is restored and nothing is written outside. Read
+// from a file, such a manifest, or one with a pack out of its output
+// directory, is refused.
+func TestRestoreHostileManifest(t *testing.T) {
+	root := t.TempDir()
+	outputDir := filepath.Join(root, "output")
+	restoreTarget = filepath.Join(root, "deep", "restored")
+	restoreWorkers = 2
+	restoreOverwrite = false
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"good", "evil"} {
+		if err := os.WriteFile(filepath.Join(outputDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &manifest{
+		OutputDir: outputDir,
+		Entries: []manifestEntry{
+			{Source: "a/good.txt", Destination: "good", Size: 4, Mode: 0644},
+			{Source: "../../evil.txt", Destination: "evil", Size: 4, Mode: 0644},
+			{Source: "../escaped/evil.txt", Destination: "evil", Size: 4, Mode: 0644},
+			{Source: filepath.ToSlash(filepath.Join(root, "absolute.txt")), Destination: "evil", Size: 4, Mode: 0644},
+		},
+		EmptyDirs: []string{"../../emptied"},
+	}
+
+	if code := restoreEntries(m, ""); code != exitFailed {
+		t.Errorf("restoreEntries = %d, want %d", code, exitFailed)
+	}
+	if content, err := os.ReadFile(filepath.Join(restoreTarget, "a", "good.txt")); err != nil || string(content) != "good" {
+		t.Errorf("good.txt = %q, %v, want it restored", content, err)
+	}
+	filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(name, outputDir) || strings.HasPrefix(restoreTarget, name) || strings.HasPrefix(name, restoreTarget) {
+			return nil
+		}
+		t.Errorf("%q was written outside of the restore directory", name)
+		return nil
+	})
+
+	hostile := append(m.Entries[1:], manifestEntry{Source: "a/packed.txt", Destination: "packed", Pack: "../../etc/x", Size: 4, Mode: 0644})
+	for _, entry := range hostile {
+		data, err := json.Marshal(manifest{Version: 1, OutputDir: outputDir, Entries: []manifestEntry{m.Entries[0], entry}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(root, "hostile.json")
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readManifest(name); err == nil {
+			t.Errorf("readManifest accepted the entry %+v", entry)
+		}
+	}
+}
+
+// TestOpenWritable overwrites a read-only file, which keeps its mode. As
+// root it's writable to begin with and is left alone.
+func TestOpenWritable(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "read-only.txt")
+	if err := os.WriteFile(name, []byte("old"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	file, putBack, err := openWritable(name, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString("new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if (putBack == nil) != (os.Geteuid() == 0) {
+		t.Errorf("putBack = %v as uid %d, want it only when the file was made writable", putBack != nil, os.Geteuid())
+	}
+	if putBack != nil {
+		if err := putBack(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if content, err := os.ReadFile(name); err != nil || string(content) != "new" {
+		t.Errorf("content = %q, %v, want it overwritten", content, err)
+	}
+	if info, err := os.Stat(name); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0444 {
+		t.Errorf("mode = %v, want it read-only again", info.Mode().Perm())
+	}
+}
+
+// TestRestoreReadOnlyFailure overwrites a read-only file with a stored copy
+// that's cut short: the restore fails and leaves the file read-only.
+func TestRestoreReadOnlyFailure(t *testing.T) {
+	root := t.TempDir()
+	var stored bytes.Buffer
+	gz := gzip.NewWriter(&stored)
+	gz.Write(bytes.Repeat([]byte("lost "), 10000))
+	gz.Close()
+	src := filepath.Join(root, "stored.gz")
+	if err := os.WriteFile(src, stored.Bytes()[:stored.Len()/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(root, "read-only.txt")
+	if err := os.WriteFile(dst, []byte("old"), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreOverwrite = true
+	bar := newBatchedBar(discardProgressBar(0), 0)
+	entry := manifestEntry{Source: "read-only.txt", Destination: "stored.gz", Size: 50000, Mode: 0644, Compression: "gzip"}
+	if err := restoreFile(src, dst, entry, bar); err == nil {
+		t.Fatal("restoring a cut short copy succeeded")
+	}
+	if info, err := os.Stat(dst); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0444 {
+		t.Errorf("mode = %v after the failed restore, want it read-only again", info.Mode().Perm())
+	}
+}
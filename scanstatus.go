@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// scanRedrawInterval is how often the scan spinner shows new counts,
+// scanLogInterval how often they're logged when stderr isn't a terminal.
+const (
+	scanRedrawInterval = 250 * time.Millisecond
+	scanLogInterval    = 10 * time.Second
+)
+
+// scoutedDirs and scoutedFiles count what scoutDirectory went through so
+// far, for the scan progress and its events.
+var scoutedDirs, scoutedFiles atomic.Uint64
+
+// scanElapsed is how long the scout took.
+var scanElapsed time.Duration
+
+// showScanProgress shows the counts of the scout while it runs: a spinner
+// on a terminal, a log line every scanLogInterval otherwise. The returned
+// func stops it and records scanElapsed.
+func showScanProgress() func() {
+	started := runClock.Now()
+	stop, done := make(chan struct{}), make(chan struct{})
+	onTerminal := stderrIsTerminal()
+	interval := scanLogInterval
+	if onTerminal {
+		interval = scanRedrawInterval
+		progressBar.Store(newProgressBar(-1, scanDescription()))
+	}
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if onTerminal {
+					withBar(func(spinner *progressbar.ProgressBar) { spinner.Describe(scanDescription()) })
+				} else {
+					infof("%s\n", scanDescription())
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		withBar(func(spinner *progressbar.ProgressBar) { spinner.Clear() })
+		progressBar.Store(nil)
+		scanElapsed = runClock.Now().Sub(started)
+	}
+}
+
+func scanDescription() string {
+	return "scanning... " + formatCount(scoutedFiles.Load()) + " files in " + formatCount(scoutedDirs.Load()) + " dirs"
+}
+
+// formatCount writes n with thousands separators, 41,203.
+func formatCount(n uint64) string {
+	digits := strconv.FormatUint(n, 10)
+	out := make([]byte, 0, len(digits)+len(digits)/3)
+	for i := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			out = append(out, ',')
+		}
+		out = append(out, digits[i])
+	}
+	return string(out)
+}
+
+func stderrIsTerminal() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// logScan says what the scout went through and how long it took.
+func logScan() {
+	summaryf("Scanned '%d' directories with '%d' files in %s\n", scoutedDirs.Load(), scoutedFiles.Load(), formatDuration(scanElapsed))
+}
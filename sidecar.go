@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// extensionList is a comma separated list of file extensions, matched case
+// insensitively. A missing leading dot is added.
+type extensionList []string
+
+func (l *extensionList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *extensionList) Set(s string) error {
+	*l = (*l)[:0]
+	for _, ext := range strings.Split(s, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		*l = append(*l, ext)
+	}
+	return nil
+}
+
+func (l extensionList) contains(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, candidate := range l {
+		if candidate == ext {
+			return true
+		}
+	}
+	return false
+}
+
+var sidecarExtensions extensionList
+
+// groupSidecars splits the file names of one directory into copy units. A
+// sidecar belongs to the file sharing its name without extension, both for
+// IMG_1234.CR2 + IMG_1234.xmp and IMG_1234.CR2 + IMG_1234.CR2.xmp, and with
+// -mac-metadata an AppleDouble "._X" belongs to X. The primary always
+// comes first in its group; sidecars without primary are copied on their
+// own. Groups are sorted by their first file.
+func groupSidecars(fileNames []string) [][]string {
+	if len(sidecarExtensions) == 0 && !macMetadata {
+		groups := make([][]string, len(fileNames))
+		for i, name := range fileNames {
+			groups[i] = []string{name}
+		}
+		return groups
+	}
+
+	primaries := map[string]int{}
+	var groups [][]string
+	for _, name := range fileNames {
+		if isSidecar(name) {
+			continue
+		}
+		primaries[name] = len(groups)
+		if stem := strings.TrimSuffix(name, filepath.Ext(name)); stem != name {
+			if _, taken := primaries[stem]; !taken {
+				primaries[stem] = len(groups)
+			}
+		}
+		groups = append(groups, []string{name})
+	}
+
+	for _, name := range fileNames {
+		if !isSidecar(name) {
+			continue
+		}
+		primary := strings.TrimSuffix(name, filepath.Ext(name))
+		if isAppleDouble(name) {
+			primary = name[2:]
+		}
+		if i, ok := primaries[primary]; ok && (!isAppleDouble(name) || groups[i][0] == primary) {
+			groups[i] = append(groups[i], name)
+		} else {
+			groups = append(groups, []string{name})
+		}
+	}
+	sortGroups(groups)
+	return groups
+}
+
+// isSidecar reports whether name is copied with a primary, if it has one.
+func isSidecar(name string) bool {
+	return sidecarExtensions.contains(name) || isAppleDouble(name)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseSize parses byte sizes like 512, 64K, 256M or 1.5G. Suffixes are
+// binary multiples, an optional trailing "B" or "iB" is ignored.
+func parseSize(s string) (int64, error) {
+	trimmed := strings.ToUpper(strings.TrimSpace(s))
+	trimmed = strings.TrimSuffix(strings.TrimSuffix(trimmed, "B"), "I")
+
+	multiplier := int64(1)
+	if n := len(trimmed); n > 0 {
+		if i := strings.IndexByte("KMGTPE", trimmed[n-1]); i >= 0 {
+			multiplier = int64(1) << (10 * (i + 1))
+			trimmed = trimmed[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(trimmed), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// sizeValue is a flag holding a byte size parsed with parseSize.
+type sizeValue int64
+
+func (v *sizeValue) String() string {
+	if v == nil {
+		return "0"
+	}
+	return formatBytes(int64(*v))
+}
+
+func (v *sizeValue) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*v = sizeValue(n)
+	return nil
+}
+
+func (v *sizeValue) Get() any { return int64(*v) }
+
+// sizeList is a flag holding comma separated, increasing byte sizes.
+type sizeList []int64
+
+func (l *sizeList) String() string {
+	if l == nil {
+		return ""
+	}
+	sizes := make([]string, len(*l))
+	for i, size := range *l {
+		sizes[i] = formatBytes(size)
+	}
+	return strings.Join(sizes, ",")
+}
+
+func (l *sizeList) Set(s string) error {
+	var sizes sizeList
+	for _, field := range strings.Split(s, ",") {
+		size, err := parseSize(field)
+		if err != nil {
+			return err
+		}
+		if len(sizes) > 0 && size <= sizes[len(sizes)-1] {
+			return fmt.Errorf("sizes must increase, %q doesn't", field)
+		}
+		sizes = append(sizes, size)
+	}
+	*l = sizes
+	return nil
+}
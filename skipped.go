@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// skipReason says why a file or directory was not copied. The values are
+// written to -skipped-list and the JSON summary and don't change.
+type skipReason string
+
+const (
+	skipFiltered       skipReason = "filtered"
+	skipLink           skipReason = "link"
+	skipPreviousOutput skipReason = "previous_output"
+	skipLoop           skipReason = "loop"
+	skipDuplicateDir   skipReason = "duplicate_directory"
+	skipLocked         skipReason = "locked"
+	skipTimeout        skipReason = "timeout"
+	skipUnstable       skipReason = "unstable"
+	skipEarlierRun     skipReason = "earlier_run"
+	// skipConflict is a source whose destination was taken, skipped by
+	// -on-conflict.
+	skipConflict skipReason = "conflict"
+	// skipSameFile is a source its destination resolves to.
+	skipSameFile skipReason = "same_file"
+	// skipSuperseded is an older version -merge-latest left out.
+	skipSuperseded skipReason = "superseded"
+	// skipUnreadable is a directory that couldn't be read.
+	skipUnreadable skipReason = "unreadable"
+	// skipBinary and skipText are files -only-text or -only-binary left
+	// out.
+	skipBinary skipReason = "binary"
+	skipText   skipReason = "text"
+)
+
+// skippedListRotateSize is the size at which -skipped-list moves on to a
+// new numbered file, none is ever deleted.
+const skippedListRotateSize = 64 << 20
+
+var skippedList string
+
+// skipRecorder counts skips by reason and, with -skipped-list, hands each
+// one to a single writer goroutine.
+type skipRecorder struct {
+	mu     sync.Mutex
+	counts map[skipReason]int
+
+	lines chan string
+	done  chan struct{}
+	err   error
+}
+
+var skips = &skipRecorder{counts: map[skipReason]int{}}
+
+// recordSkip records that path, relative to the source root, was left out.
+// Directories left out as a whole are one record.
+func recordSkip(path string, reason skipReason, detail string) {
+	skips.mu.Lock()
+	skips.counts[reason]++
+	skips.mu.Unlock()
+	if skips.lines != nil {
+		skips.lines <- tsvField(path) + "\t" + string(reason) + "\t" + tsvField(detail) + "\n"
+	}
+}
+
+// tsvField keeps a value on one line and in one column.
+func tsvField(s string) string {
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(s)
+}
+
+// openSkippedList starts writing -skipped-list, if given.
+func openSkippedList() error {
+	if skippedList == "" {
+		return nil
+	}
+	w := &rotatingWriter{name: skippedList}
+	if err := w.open(); err != nil {
+		return err
+	}
+	skips.lines = make(chan string, 1024)
+	skips.done = make(chan struct{})
+	go func() {
+		defer close(skips.done)
+		for line := range skips.lines {
+			if skips.err == nil {
+				skips.err = w.write(line)
+			}
+		}
+		if err := w.close(); skips.err == nil {
+			skips.err = err
+		}
+	}()
+	return nil
+}
+
+// closeSkippedList waits for every record to be written.
+func closeSkippedList() error {
+	if skips.lines == nil {
+		return nil
+	}
+	close(skips.lines)
+	<-skips.done
+	return skips.err
+}
+
+func (r *skipRecorder) snapshot() map[skipReason]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[skipReason]int, len(r.counts))
+	for reason, n := range r.counts {
+		counts[reason] = n
+	}
+	return counts
+}
+
+// rotatingWriter writes TSV lines with a header to name, and once a file
+// reaches skippedListRotateSize continues in name.1, name.2 and so on.
+type rotatingWriter struct {
+	name    string
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	rotated int
+}
+
+func (r *rotatingWriter) open() error {
+	name := r.name
+	if r.rotated > 0 {
+		name = fmt.Sprintf("%s.%d", r.name, r.rotated)
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	r.file, r.w, r.size = file, bufio.NewWriter(file), 0
+	return r.write("path\treason\tdetail\n")
+}
+
+func (r *rotatingWriter) write(line string) error {
+	if r.size >= skippedListRotateSize {
+		if err := r.close(); err != nil {
+			return err
+		}
+		r.rotated++
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	n, err := r.w.WriteString(line)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingWriter) close() error {
+	err := r.w.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
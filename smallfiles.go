@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+var (
+	smallFileSize  = sizeValue(64 << 10)
+	smallBatchSize = 128
+)
+
+// smallBatching reports whether small files are batched. -stable-for puts
+// back single jobs, so it copies every file on its own.
+func smallBatching() bool {
+	return smallBatchSize > 1 && stableFor <= 0
+}
+
+// smallBatcher collects the admitted small files of a directory into one
+// batched job, one queue operation and one round of result recording per
+// -small-batch files instead of per file. BenchmarkCopySmallFiles puts the
+// gain at a few percent with creating the destinations left out, next to
+// which it doesn't show. Files at least -small-file-size big and sidecar
+// groups are sent as they come, they'd hold up a batch or need their group.
+type smallBatcher struct {
+	queue *jobQueue
+	job   copyJob
+}
+
+// add takes job into the current batch and reports whether it did.
+func (b *smallBatcher) add(job copyJob) bool {
+	if !smallBatching() || len(job.files) != 1 {
+		return false
+	}
+	info, err := statSource(filepath.Join(job.dir, job.files[0]))
+	if err != nil || !info.Mode().IsRegular() || !smallByStat(info.Size(), int64(smallFileSize)) {
+		return false
+	}
+	if b.job.dir != job.dir {
+		b.flush()
+	}
+	b.job.dir = job.dir
+	b.job.files = append(b.job.files, job.files[0])
+	if len(b.job.files) >= smallBatchSize {
+		b.flush()
+	}
+	return true
+}
+
+// flush sends the current batch, if there is one.
+func (b *smallBatcher) flush() {
+	if len(b.job.files) == 0 {
+		return
+	}
+	b.job.batch = true
+	b.queue.send(b.job)
+	b.job = copyJob{}
+}
+
+// copyBatch copies the files of a batched job one after the other, each
+// as its own group, and records their results together.
+func copyBatch(worker int, dir string, files []string) (copied int64) {
+	rows := make([]reportRow, 0, len(files))
+	for _, name := range files {
+		n, groupRows := copyGroup(worker, dir, []string{name})
+		copied += n
+		rows = append(rows, groupRows...)
+	}
+	recordResults(rows...)
+	return copied
+}
+
+// copyBuffers hold the buffers storeFile copies through, reused across
+// files instead of io.Copy allocating one per file.
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, 32<<10)
+	return &buf
+}}
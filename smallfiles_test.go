@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func init() {
+	// the small files are written to the null device, creating files
+	// costs the same with and without batching and would hide the rest
+	copyCases["small"] = copyCase{source: manyFiles(5000), setup: func() {
+		createDestination = func(string) (*os.File, error) { return os.OpenFile(os.DevNull, os.O_WRONLY, 0) }
+	}}
+}
+
+// BenchmarkCopySmallFiles copies 5000 tiny files in 5 directories a job
+// each and in batched jobs of -small-batch files, and reports the time per
+// file, the child process included.
+func BenchmarkCopySmallFiles(b *testing.B) {
+	for _, batch := range []string{"1", "128"} {
+		b.Run("-small-batch="+batch, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				r := runCopyTest(b, "small", "-small-batch", batch, "-c", "1")
+				if r.code != exitOK || r.summary.CopiedItems != 5000 {
+					b.Fatalf("exit code %d, copied %d\n%s", r.code, r.summary.CopiedItems, r.log)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*5000), "ns/file")
+		})
+	}
+}
+
+// BenchmarkCopyBuffers copies a small file through a pooled buffer, as
+// storeFile does, and with io.Copy allocating one per file.
+func BenchmarkCopyBuffers(b *testing.B) {
+	content := bytes.Repeat([]byte("x"), 2<<10)
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := copyBuffers.Get().(*[]byte)
+			io.CopyBuffer(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{bytes.NewReader(content)}, *buf)
+			copyBuffers.Put(buf)
+		}
+	})
+	b.Run("io.Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			io.Copy(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{bytes.NewReader(content)})
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var copySnapshot bool
+
+// snapshotStableFor is the -stable-for used when -snapshot can't take one.
+const snapshotStableFor = time.Minute
+
+var errSnapshotUnsupported = errors.New("the source isn't on btrfs or ZFS")
+
+// sourceSnapshot is a read-only snapshot of the source root. path is the
+// directory in it matching the source root.
+type sourceSnapshot struct {
+	path   string
+	remove func() error
+}
+
+var snapshotNameReplacer = regexp.MustCompile(`[^A-Za-z0-9_.:-]`)
+
+// enterSnapshot takes a snapshot of root, the working directory, and
+// changes into it for the walk. Names, the manifest and the output marker
+// keep using root: paths are relative to the working directory, and
+// workingDirectory stays root. The file flags are made absolute first.
+// The returned function removes the snapshot again. Without snapshot
+// support it warns and falls back to -stable-for.
+func enterSnapshot(root string) (func(), error) {
+	if sourceArchive != "" {
+		return nil, errors.New("-snapshot can't be combined with -src")
+	}
+	snapshot, err := createSnapshot(root, "flatten-"+snapshotNameReplacer.ReplaceAllString(runID, "_"))
+	if err != nil {
+		if stableFor == 0 {
+			stableFor = snapshotStableFor
+		}
+		warnf("Could not take a snapshot of %q, copying the live tree and only files unchanged for %s: %v\n", root, stableFor, err)
+		return func() {}, nil
+	}
+
+	for _, name := range []*string{&manifestFile, &reportFile, &jsonSummary, &stateFile, &skippedList, &deniedList, &failedListName, &mapStreamName} {
+		if *name != "" {
+			if *name, err = filepath.Abs(*name); err != nil {
+				snapshot.remove()
+				return nil, err
+			}
+		}
+	}
+	if err := os.Chdir(snapshot.path); err != nil {
+		snapshot.remove()
+		return nil, err
+	}
+	infof("Copying from the snapshot %q\n", snapshot.path)
+	return func() {
+		os.Chdir(root)
+		if err := snapshot.remove(); err != nil {
+			errorf("Could not remove the snapshot %q: %v\n", snapshot.path, err)
+		}
+	}, nil
+}
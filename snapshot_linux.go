@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	btrfsSuperMagic = 0x9123683e
+	zfsSuperMagic   = 0x2fc12fc1
+	// btrfsSubvolumeInode is the inode of every btrfs subvolume's root.
+	btrfsSubvolumeInode = 256
+)
+
+// createSnapshot snapshots the btrfs subvolume or ZFS dataset root is in,
+// through the btrfs and zfs commands, which need the privileges for it.
+func createSnapshot(root, name string) (*sourceSnapshot, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err != nil {
+		return nil, err
+	}
+	switch st.Type {
+	case btrfsSuperMagic:
+		return createBtrfsSnapshot(root, name)
+	case zfsSuperMagic:
+		return createZFSSnapshot(root, name)
+	}
+	return nil, errSnapshotUnsupported
+}
+
+// createBtrfsSnapshot puts the snapshot next to the subvolume root is in.
+func createBtrfsSnapshot(root, name string) (*sourceSnapshot, error) {
+	subvolume := root
+	for {
+		info, err := os.Stat(subvolume)
+		if err != nil {
+			return nil, err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Ino == btrfsSubvolumeInode {
+			break
+		}
+		parent := filepath.Dir(subvolume)
+		if parent == subvolume {
+			return nil, fmt.Errorf("no btrfs subvolume contains %q", root)
+		}
+		subvolume = parent
+	}
+	rel, err := filepath.Rel(subvolume, root)
+	if err != nil {
+		return nil, err
+	}
+
+	target := filepath.Join(filepath.Dir(subvolume), "."+name)
+	if err := runSnapshotCommand("btrfs", "subvolume", "snapshot", "-r", subvolume, target); err != nil {
+		return nil, err
+	}
+	return &sourceSnapshot{
+		path:   filepath.Join(target, rel),
+		remove: func() error { return runSnapshotCommand("btrfs", "subvolume", "delete", target) },
+	}, nil
+}
+
+// createZFSSnapshot reads the snapshot through the .zfs directory of the
+// dataset's mountpoint, which works whether or not it's visible.
+func createZFSSnapshot(root, name string) (*sourceSnapshot, error) {
+	out, err := exec.Command("zfs", "list", "-H", "-o", "name,mountpoint", root).Output()
+	if err != nil {
+		return nil, fmt.Errorf("zfs list: %w", err)
+	}
+	dataset, mountpoint, ok := strings.Cut(strings.TrimSpace(string(out)), "\t")
+	if !ok {
+		return nil, fmt.Errorf("unexpected zfs list output %q", out)
+	}
+	rel, err := filepath.Rel(mountpoint, root)
+	if err != nil || !filepath.IsLocal(rel) && rel != "." {
+		return nil, fmt.Errorf("%q isn't below the mountpoint %q of %s", root, mountpoint, dataset)
+	}
+
+	snapshot := dataset + "@" + name
+	if err := runSnapshotCommand("zfs", "snapshot", snapshot); err != nil {
+		return nil, err
+	}
+	return &sourceSnapshot{
+		path:   filepath.Join(mountpoint, ".zfs", "snapshot", name, rel),
+		remove: func() error { return runSnapshotCommand("zfs", "destroy", snapshot) },
+	}, nil
+}
+
+func runSnapshotCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
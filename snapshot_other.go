@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func createSnapshot(root, name string) (*sourceSnapshot, error) {
+	return nil, errSnapshotUnsupported
+}
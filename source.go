@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	sourceArchive   string
+	sourceTarBuffer = sizeValue(256 << 20)
+
+	// sourceFS is the tree of -src, nil when copying the working directory.
+	// Paths into it are the same relative paths the walk uses for the
+	// working directory.
+	sourceFS fs.FS
+)
+
+func sourceFlags(fs *flag.FlagSet) {
+	fs.StringVar(&sourceArchive, "src", "", "copy the nested files of this .zip, .tar, .tar.gz or .tgz archive instead of the working directory")
+	fs.Var(&sourceTarBuffer, "src-buffer", "memory holding the content of compressed tar -src members read ahead while indexing,\n"+
+		"so copy workers don't wait for the single decompressing stream")
+}
+
+// openSourceTree opens -src as sourceFS, if it's given.
+func openSourceTree() error {
+	if sourceArchive == "" {
+		return nil
+	}
+	name, err := filepath.Abs(sourceArchive)
+	if err != nil {
+		return err
+	}
+	sourceArchive = name
+	if copyACLs {
+		return errors.New("-acls can't be combined with -src, archives don't carry ACLs")
+	}
+
+	start := time.Now()
+	switch archiveKind(name) {
+	case "zip":
+		r, err := zip.OpenReader(name)
+		if err != nil {
+			return err
+		}
+		sourceFS = r
+	case "tar", "tar.gz":
+		t, err := openTarFS(name, archiveKind(name) == "tar.gz", int64(sourceTarBuffer))
+		if err != nil {
+			return err
+		}
+		sourceFS = t
+	default:
+		return fmt.Errorf("-src %q must be a .zip, .tar, .tar.gz or .tgz archive", sourceArchive)
+	}
+	verbosef("indexed %q in %s\n", name, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func archiveKind(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// sourceRoot is what manifests and plans record as the root of the copied
+// tree: the archive or the working directory wd.
+func sourceRoot(wd string) string {
+	if sourceArchive != "" {
+		return sourceArchive
+	}
+	return wd
+}
+
+// sourcePath turns a walk path into a path into sourceFS.
+func sourcePath(name string) string {
+	return filepath.ToSlash(filepath.Clean(name))
+}
+
+// readSourceDir lists a source directory, sorted by name like os.ReadDir.
+func readSourceDir(name string) ([]fs.DirEntry, error) {
+	if sourceFS != nil {
+		return fs.ReadDir(sourceFS, sourcePath(name))
+	}
+	return os.ReadDir(name)
+}
+
+func statSource(name string) (fs.FileInfo, error) {
+	if sourceFS != nil {
+		return fs.Stat(sourceFS, sourcePath(name))
+	}
+	return os.Stat(name)
+}
+
+func openSourceFile(name string) (fs.File, error) {
+	if sourceFS != nil {
+		return sourceFS.Open(sourcePath(name))
+	}
+	return os.Open(name)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	stableFor time.Duration
+
+	skippedItems atomic.Uint64
+
+	errSourceLocked   = errors.New("skipped: locked")
+	errSourceUnstable = errors.New("skipped: unstable")
+)
+
+// stableForGiveUp bounds how long a file that keeps changing is waited for,
+// as a multiple of -stable-for.
+const stableForGiveUp = 10
+
+// Retries for sources another process holds open without sharing (Windows).
+const (
+	lockedRetries = 3
+	lockedBackoff = 500 * time.Millisecond
+)
+
+// defaultQueueSize bounds the memory of walked jobs waiting for a worker,
+// while keeping workers busy through directories that are slow to list.
+const defaultQueueSize = 4096
+
+var queueSize int
+
+// jobQueue tracks every job handed to the copy workers, so jobs that were
+// put back because their files are still being written can be sent again
+// once the walk is over.
+type jobQueue struct {
+	jobs    chan copyJob
+	pending sync.WaitGroup
+	// peak is the most jobs seen waiting in jobs.
+	peak atomic.Int64
+
+	mu      sync.Mutex
+	waiting []copyJob
+
+	// fair orders the jobs with -fair, nil without it.
+	fair *fairScheduler
+}
+
+func newJobQueue(size int) *jobQueue {
+	return &jobQueue{jobs: make(chan copyJob, size)}
+}
+
+// send blocks while the queue is full, with -fair it never blocks.
+func (q *jobQueue) send(job copyJob) {
+	if job.firstSeen.IsZero() {
+		job.firstSeen = time.Now()
+	}
+	q.pending.Add(1)
+	if q.fair != nil {
+		q.fair.add(job)
+		return
+	}
+	q.push(job)
+}
+
+func (q *jobQueue) push(job copyJob) {
+	q.jobs <- job
+	if depth := int64(len(q.jobs)); depth > q.peak.Load() {
+		q.peak.Store(depth)
+	}
+}
+
+// depth is the number of jobs waiting for a worker.
+func (q *jobQueue) depth() int {
+	return len(q.jobs)
+}
+
+// done must be called by a worker once per received job.
+func (q *jobQueue) done(job copyJob) {
+	q.fair.release(job.dir)
+	q.pending.Done()
+}
+
+// putBack queues a job not to be sent again before readyAt. It must be
+// called before the job's done.
+func (q *jobQueue) putBack(job copyJob, readyAt time.Time) {
+	job.readyAt = readyAt
+	q.mu.Lock()
+	q.waiting = append(q.waiting, job)
+	q.mu.Unlock()
+}
+
+// drain resends put back jobs until none are left, then closes the channel.
+func (q *jobQueue) drain() {
+	for {
+		q.pending.Wait()
+
+		q.mu.Lock()
+		waiting := q.waiting
+		q.waiting = nil
+		q.mu.Unlock()
+		if len(waiting) == 0 {
+			q.fair.stop()
+			close(q.jobs)
+			return
+		}
+
+		sort.Slice(waiting, func(i, j int) bool { return waiting[i].readyAt.Before(waiting[j].readyAt) })
+		for _, job := range waiting {
+			time.Sleep(time.Until(job.readyAt))
+			q.send(job)
+		}
+	}
+}
+
+// unstableFor returns how much longer the job's files have to stay
+// untouched to be older than -stable-for, 0 once they all are.
+func unstableFor(job copyJob) time.Duration {
+	if stableFor <= 0 {
+		return 0
+	}
+
+	var wait time.Duration
+	for _, name := range job.files {
+		info, err := statSource(filepath.Join(job.dir, name))
+		if err != nil {
+			// let the copy report it
+			continue
+		}
+		if remaining := stableFor - time.Since(info.ModTime()); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait
+}
+
+type stability int
+
+const (
+	jobStable stability = iota
+	jobPutBack
+	jobUnstable
+)
+
+// waitForStable puts the job back if its files changed too recently. Jobs
+// that don't settle are eventually skipped as unstable.
+func waitForStable(queue *jobQueue, job copyJob) stability {
+	wait := unstableFor(job)
+	if wait <= 0 {
+		return jobStable
+	}
+
+	if time.Since(job.firstSeen) > stableForGiveUp*stableFor {
+		errorf("%s kept changing for %s, skipped: unstable\n", filepath.Join(job.dir, job.files[0]), time.Since(job.firstSeen).Round(time.Second))
+		skippedItems.Add(uint64(len(job.files)))
+		for _, name := range job.files {
+			recordSkip(filepath.ToSlash(filepath.Join(job.dir, name)), skipUnstable, "modified within -stable-for "+stableFor.String())
+		}
+		return jobUnstable
+	}
+
+	verbosef("%s was modified less than %s ago, retrying in %s\n", filepath.Join(job.dir, job.files[0]), stableFor, wait.Round(time.Millisecond))
+	queue.putBack(job, time.Now().Add(wait))
+	return jobPutBack
+}
+
+// openSource opens a file to copy, retrying a few times while another
+// process holds it locked.
+func openSource(name string) (fs.File, error) {
+	if sourceFS != nil {
+		return openSourceFile(name)
+	}
+	for attempt := 0; ; attempt++ {
+		f, err := openWithTimeout(name)
+		if err == nil {
+			return f, nil
+		}
+		if !isLocked(err) {
+			return nil, err
+		}
+		if attempt == lockedRetries {
+			return nil, fmt.Errorf("%w: %v", errSourceLocked, err)
+		}
+		time.Sleep(lockedBackoff << attempt)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestJobQueueBound sends more jobs than the queue holds to a slow worker:
+// the walk waits for it instead of queueing them.
+func TestJobQueueBound(t *testing.T) {
+	const size, jobs = 4, 100
+	queue := newJobQueue(size)
+	sent := make(chan int, jobs)
+	go func() {
+		for i := 0; i < jobs; i++ {
+			queue.send(copyJob{dir: fmt.Sprint(i)})
+			sent <- i
+		}
+	}()
+
+	// with no worker receiving, the walk stops once the queue is full
+	time.Sleep(50 * time.Millisecond)
+	if n := len(sent); n != size {
+		t.Fatalf("%d jobs were sent to a queue of %d with no worker", n, size)
+	}
+
+	for i := 0; i < jobs; i++ {
+		job := <-queue.jobs
+		if depth := queue.depth(); depth > size {
+			t.Fatalf("%d jobs waiting, -queue-size is %d", depth, size)
+		}
+		queue.done(job)
+		time.Sleep(100 * time.Microsecond)
+	}
+	if peak := queue.peak.Load(); peak > size {
+		t.Errorf("peak depth %d, -queue-size is %d", peak, size)
+	}
+}
+
+func init() {
+	copyCases["slow"] = copyCase{
+		source: manyFiles(60),
+		setup: func() {
+			createDestination = func(name string) (*os.File, error) {
+				time.Sleep(2 * time.Millisecond)
+				return os.Create(name)
+			}
+		},
+	}
+}
+
+// TestCopyQueueSize copies to a slow destination, the walk outruns the
+// workers and the queue stays within -queue-size.
+func TestCopyQueueSize(t *testing.T) {
+	for _, size := range []int{1, 3} {
+		r := runCopyTest(t, "slow", "-queue-size", fmt.Sprint(size), "-c", "1", "-small-batch", "1")
+		if r.code != exitOK {
+			t.Fatalf("-queue-size %d: exit code %d, want %d\n%s", size, r.code, exitOK, r.log)
+		}
+		if s := r.summary; s.CopiedItems != 60 || s.PeakQueueDepth < 1 || s.PeakQueueDepth > int64(size) {
+			t.Errorf("-queue-size %d: copied %d, peak depth %d, want 60 within the queue size", size, s.CopiedItems, s.PeakQueueDepth)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	maxFiles      uint64
+	maxBytes      sizeValue
+	stateFile     string
+	resumeFromCut bool
+)
+
+func stateFlags(fs *flag.FlagSet) {
+	fs.Uint64Var(&maxFiles, "max-files", 0, "stop dispatching copies after this many files, 0 means no limit")
+	fs.Var(&maxBytes, "max-bytes", "stop dispatching copies after this many bytes, e.g. 100G, 0 means no limit")
+	fs.Var(&minFree, "min-free", "stop dispatching copies once the output filesystem has less free space than this, e.g. 5G or 5%")
+	fs.StringVar(&stateFile, "state", "", "record where the run stopped in the provided file")
+	fs.BoolVar(&resumeFromCut, "resume", false, "continue from where the run recorded in -state stopped, and the interrupted copies\n"+
+		"of files over -chunk-threshold from their last checkpoint")
+	fs.Var(&chunkThreshold, "chunk-threshold", "copy files at least this big to a partial file with a journal of checkpoints, so\n"+
+		"an interrupted copy can be resumed, 0 disables it. Only for uncompressed, untransformed copies")
+	fs.Var(&checkpointEvery, "checkpoint-every", "how much of a journaled copy is written between checkpoints, each syncs the file")
+}
+
+const stateVersion = 1
+
+// runState is what -state records about a run, so that -resume can pick up
+// where a capped run stopped.
+type runState struct {
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Cutoff is the slash separated source path of the first file that was
+	// not dispatched, in walk order. Empty once a run got through everything.
+	Cutoff   string `json:"cutoff,omitempty"`
+	Complete bool   `json:"complete"`
+	// OutputDir is the absolute output directory of the run, a later run
+	// refuses it as its source.
+	OutputDir string `json:"output_dir,omitempty"`
+}
+
+func readState(name string) (runState, error) {
+	var state runState
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("could not parse state %q: %w", name, err)
+	}
+	if state.Version > stateVersion {
+		return state, fmt.Errorf("state %q has version %d, this build understands up to %d", name, state.Version, stateVersion)
+	}
+	return state, nil
+}
+
+func (s runState) writeFile(name string) error {
+	s.Version = stateVersion
+	s.UpdatedAt = runClock.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write and rename so a crash never leaves a truncated state behind
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// dispatchLimiter decides which walked jobs get dispatched: with -resume it
+// skips everything before the recorded cutoff, with -max-files/-max-bytes
+// it stops once a cap would be exceeded, with -min-free once lowSpace is set,
+// and once the run was interrupted.
+type dispatchLimiter struct {
+	resumeAt string
+	files    uint64
+	bytes    int64
+
+	// cutoff is set once a cap stopped the walk
+	cutoff string
+}
+
+func newDispatchLimiter() (*dispatchLimiter, error) {
+	limiter := &dispatchLimiter{}
+	if !resumeFromCut {
+		return limiter, nil
+	}
+	if stateFile == "" {
+		return nil, errors.New("-resume needs -state")
+	}
+
+	state, err := readState(stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return limiter, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if state.Complete {
+		infof("The run recorded in %q completed, starting over\n", stateFile)
+		return limiter, nil
+	}
+	limiter.resumeAt = state.Cutoff
+	infof("Resuming at %q\n", state.Cutoff)
+	return limiter, nil
+}
+
+// admit reports whether a job may be dispatched. It returns errStopWalk
+// once a cap is reached.
+func (l *dispatchLimiter) admit(job copyJob) (bool, error) {
+	primary := filepath.ToSlash(filepath.Join(job.dir, job.files[0]))
+	if l.resumeAt != "" {
+		if walkOrderLess(primary, l.resumeAt) {
+			return false, nil
+		}
+		l.resumeAt = ""
+	}
+
+	var size int64
+	if maxBytes > 0 {
+		for _, name := range job.files {
+			if info, err := statSource(filepath.Join(job.dir, name)); err == nil {
+				size += info.Size()
+			}
+		}
+	}
+
+	// the first job always goes, so a single file over -max-bytes can't stall every run
+	overFiles := maxFiles > 0 && l.files+uint64(len(job.files)) > maxFiles
+	overBytes := maxBytes > 0 && l.files > 0 && l.bytes+size > int64(maxBytes)
+	if overFiles || overBytes || lowSpace.Load() || interrupted.Load() {
+		l.cutoff = primary
+		return false, errStopWalk
+	}
+
+	l.files += uint64(len(job.files))
+	l.bytes += size
+	return true, nil
+}
+
+// leftOut moves the cutoff back to primary, the earliest of the dispatched
+// jobs a cancel left out.
+func (l *dispatchLimiter) leftOut(primary string) {
+	if primary != "" && (l.cutoff == "" || walkOrderLess(primary, l.cutoff)) {
+		l.cutoff = primary
+	}
+}
+
+func (l *dispatchLimiter) state() runState {
+	outputDir := outputDirectory
+	if finalOutputDirectory != "" {
+		outputDir = finalOutputDirectory
+	}
+	return runState{Cutoff: l.cutoff, Complete: l.cutoff == "", OutputDir: outputDir}
+}
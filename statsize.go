@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// trustStatSize is -trust-stat-size. Without it the size stat reports is
+// only a hint: files stat calls empty may still stream content, like in
+// /sys or on some FUSE and network filesystems, so manifests record the
+// bytes read and stat size 0 doesn't make a file small.
+var trustStatSize = true
+
+// errSourceSize fails a copy that read a different number of bytes than
+// the source has, with -trust-stat-size.
+var errSourceSize = errors.New("source size mismatch")
+
+// expectedBytes and verifiedBytes are the bytes the copies that got to the
+// end expected by stat and read.
+var expectedBytes, verifiedBytes atomic.Int64
+
+// sizeDivergences are the files that read a different number of bytes
+// than stat reported without -trust-stat-size, the first
+// maxSizeDivergences are kept for the summary.
+var sizeDivergences struct {
+	mu      sync.Mutex
+	count   int
+	samples []sizeDivergence
+}
+
+const maxSizeDivergences = 10
+
+type sizeDivergence struct {
+	Source   string `json:"source"`
+	StatSize int64  `json:"stat_size"`
+	ReadSize int64  `json:"read_size"`
+}
+
+// recordedSize is the size a copy records for a source stat called
+// statSize that read readSize bytes, noting any difference.
+func recordedSize(srcName string, statSize, readSize int64) int64 {
+	if statSize != readSize {
+		sizeDivergences.mu.Lock()
+		sizeDivergences.count++
+		if len(sizeDivergences.samples) < maxSizeDivergences {
+			sizeDivergences.samples = append(sizeDivergences.samples, sizeDivergence{srcName, statSize, readSize})
+		}
+		sizeDivergences.mu.Unlock()
+	}
+	if trustStatSize {
+		return statSize
+	}
+	return readSize
+}
+
+// checkCopiedSize fails a copy of srcName that read readSize bytes when
+// that's not the statSize it had when opened, or not its size now: another
+// process truncated or appended to it, or a read came back short. Without
+// -trust-stat-size the sizes are only hints and any difference is noted
+// by recordedSize instead.
+func checkCopiedSize(srcName string, statSize, readSize int64) error {
+	expectedBytes.Add(statSize)
+	verifiedBytes.Add(readSize)
+	if !trustStatSize {
+		return nil
+	}
+	if readSize != statSize {
+		return fmt.Errorf("%w: read %d bytes of %s, which had %d when opened (-trust-stat-size=false records the bytes read)",
+			errSourceSize, readSize, srcName, statSize)
+	}
+	info, err := statSource(srcName)
+	if err != nil {
+		return fmt.Errorf("%w: could not stat %s after copying it: %v", errSourceSize, srcName, err)
+	}
+	if info.Size() != readSize {
+		return fmt.Errorf("%w: read %d bytes of %s, which has %d after the copy", errSourceSize, readSize, srcName, info.Size())
+	}
+	return nil
+}
+
+// smallByStat reports whether a file of statSize bytes can be taken to be
+// smaller than limit: without -trust-stat-size an empty one can't.
+func smallByStat(statSize, limit int64) bool {
+	return statSize < limit && (trustStatSize || statSize > 0)
+}
+
+// logSizeDivergences prints the files whose size changed from stat to read.
+func logSizeDivergences() {
+	sizeDivergences.mu.Lock()
+	defer sizeDivergences.mu.Unlock()
+	if sizeDivergences.count == 0 {
+		return
+	}
+	summaryf("'%d' files read a different size than stat reported:\n", sizeDivergences.count)
+	for _, d := range sizeDivergences.samples {
+		summaryf("  %s: stat %s, read %s\n", d.Source, formatBytes(d.StatSize), formatBytes(d.ReadSize))
+	}
+}
+
+// logVerifiedBytes says how many bytes the copies read against what they
+// expected, when they differ.
+func logVerifiedBytes() {
+	expected, verified := expectedBytes.Load(), verifiedBytes.Load()
+	if expected != verified {
+		summaryf("Read %s of the %s the copied files had when opened\n", formatBytes(verified), formatBytes(expected))
+	}
+}
+
+// sizeDivergenceSummary is the JSON summary's view of sizeDivergences.
+func sizeDivergenceSummary() (int, []sizeDivergence) {
+	sizeDivergences.mu.Lock()
+	defer sizeDivergences.mu.Unlock()
+	return sizeDivergences.count, append([]sizeDivergence(nil), sizeDivergences.samples...)
+}
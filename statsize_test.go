@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// resizedFS is a source whose files in opened had another size when they
+// were opened than they have when they're read: they shrank or grew
+// during the copy.
+type resizedFS struct {
+	fstest.MapFS
+	opened map[string]int64
+}
+
+type resizedFile struct {
+	fs.File
+	size int64
+}
+
+type resizedInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (f resizedFS) Open(name string) (fs.File, error) {
+	file, err := f.MapFS.Open(name)
+	if size, ok := f.opened[name]; ok && err == nil {
+		return resizedFile{File: file, size: size}, nil
+	}
+	return file, err
+}
+
+func (f resizedFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return resizedInfo{FileInfo: info, size: f.size}, nil
+}
+
+func (i resizedInfo) Size() int64 { return i.size }
+
+func init() {
+	copyCases["resized"] = copyCase{source: resizedFS{
+		MapFS: fstest.MapFS{
+			"a/shrunk.txt": testFile("short"),
+			"a/grown.txt":  testFile("longer now"),
+			"a/same.txt":   testFile("same"),
+		},
+		opened: map[string]int64{"a/shrunk.txt": 12, "a/grown.txt": 3},
+	}}
+}
+
+// TestCopyResizedSource copies files that shrank and grew while they were
+// copied: they fail unless -trust-stat-size=false records what was read.
+func TestCopyResizedSource(t *testing.T) {
+	r := runCopyTest(t, "resized")
+	if r.code != exitFailed {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitFailed, r.log)
+	}
+	if len(r.files) != 1 || r.files["a_same.txt"] != "same" {
+		t.Errorf("output has %q, want only a_same.txt", r.names())
+	}
+	if s := r.summary; s.FailedItems != 2 || s.Errors[errSizeChange] != 2 {
+		t.Errorf("failed %d with errors %v, want 2 size mismatches", s.FailedItems, s.Errors)
+	}
+	if !strings.Contains(r.log, "read 5 bytes of a/shrunk.txt, which had 12 when opened") {
+		t.Errorf("the log doesn't report the shrunk file:\n%s", r.log)
+	}
+
+	r = runCopyTest(t, "resized", "-trust-stat-size=false")
+	if r.code != exitOK {
+		t.Fatalf("-trust-stat-size=false: exit code %d, want %d\n%s", r.code, exitOK, r.log)
+	}
+	if r.files["a_shrunk.txt"] != "short" || r.files["a_grown.txt"] != "longer now" {
+		t.Errorf("-trust-stat-size=false: output has %q, want every file with what was read", r.names())
+	}
+	if s := r.summary; s.CopiedItems != 3 || s.SizeDivergences != 2 {
+		t.Errorf("-trust-stat-size=false: copied %d with %d size divergences, want 3 and 2", s.CopiedItems, s.SizeDivergences)
+	}
+}
+
+func TestSmallByStat(t *testing.T) {
+	saved := trustStatSize
+	t.Cleanup(func() { trustStatSize = saved })
+	tests := []struct {
+		size  int64
+		trust bool
+		want  bool
+	}{
+		{size: 10, trust: true, want: true},
+		{size: 10, trust: false, want: true},
+		{size: 0, trust: true, want: true},
+		// an empty stat size may still stream content
+		{size: 0, trust: false, want: false},
+		{size: 100, trust: true, want: false},
+	}
+	for _, test := range tests {
+		trustStatSize = test.trust
+		if got := smallByStat(test.size, 100); got != test.want {
+			t.Errorf("smallByStat(%d, 100) with -trust-stat-size=%v = %v, want %v", test.size, test.trust, got, test.want)
+		}
+	}
+}
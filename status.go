@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+var (
+	// copiedBytes counts bytes read from sources, storedBytes bytes written
+	// to the output directory, completedBytes the source size of every file
+	// that was copied completely
+	copiedBytes    atomic.Int64
+	storedBytes    atomic.Int64
+	completedBytes atomic.Int64
+)
+
+// runStatus is a snapshot source for the status line printed on
+// -status-interval ticks and, on Unix, on SIGUSR1.
+type runStatus struct {
+	startedAt  time.Time
+	totalItems uint
+	queue      *jobQueue
+	// current holds the file each copy worker is busy with, indexed by worker id
+	current []atomic.Pointer[string]
+}
+
+func newRunStatus(startedAt time.Time, totalItems uint, workers int, queue *jobQueue) *runStatus {
+	return &runStatus{
+		startedAt:  startedAt,
+		totalItems: totalItems,
+		queue:      queue,
+		current:    make([]atomic.Pointer[string], workers),
+	}
+}
+
+func (s *runStatus) setCurrent(worker int, name string) {
+	if name == "" {
+		s.current[worker].Store(nil)
+		return
+	}
+	s.current[worker].Store(&name)
+}
+
+// logLines logs the status line, and a line for every busy worker, each
+// as its own entry so every one gets the log's timestamp and colors.
+func (s *runStatus) logLines() {
+	for _, line := range s.lines() {
+		infof("%s\n", line)
+	}
+}
+
+// lines are the status line and the file of every busy worker.
+func (s *runStatus) lines() []string {
+	done := copiedItems.Load() + failedItems.Load() + skippedItems.Load()
+	elapsed := runClock.Since(s.startedAt)
+	// the time spent paused says nothing about how fast files are copied
+	active := elapsed - runPause.pausedTime()
+
+	eta := "unknown"
+	if done > 0 && uint64(s.totalItems) >= done {
+		remaining := time.Duration(float64(active) / float64(done) * float64(uint64(s.totalItems)-done))
+		eta = formatDuration(remaining)
+	}
+
+	var b strings.Builder
+	b.WriteString("Status: ")
+	if runPause.state() == "paused" {
+		b.WriteString("PAUSED, ")
+	}
+	fmt.Fprintf(&b, "%d/%d files, %s copied, %d errors, %d/%d queued, elapsed %s, eta %s",
+		done, s.totalItems, formatBytes(copiedBytes.Load()), failedItems.Load(), s.queue.depth(), queueSize, formatDuration(elapsed), eta)
+	if packs != nil {
+		fmt.Fprintf(&b, ", %s buffered for packs", formatBytes(archiveBudget.inUse()))
+	}
+	lines := []string{b.String()}
+	for worker := range s.current {
+		if name := s.current[worker].Load(); name != nil {
+			lines = append(lines, fmt.Sprintf("  worker %d: %s", worker, *name))
+		}
+	}
+	return lines
+}
+
+// report prints the status line every interval (if non zero) and whenever
+// one of the platform's status signals arrives, until stop is closed.
+func (s *runStatus) report(interval time.Duration, stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	if sigs := statusSignals(); len(sigs) > 0 {
+		signal.Notify(signals, sigs...)
+		defer signal.Stop(signals)
+	}
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick:
+		case <-signals:
+		}
+		s.logLines()
+	}
+}
+
+// progressBar is the bar of the running copy, if any, see barWriter.
+var progressBar atomic.Pointer[progressbar.ProgressBar]
+
+// barMu serializes everything drawing the bar: log lines written around
+// it, redraws and the progress the batched bar hands it, so none of them
+// splice into another.
+var barMu sync.Mutex
+
+// withBar calls f with the shown bar, if any, holding barMu.
+func withBar(f func(bar *progressbar.ProgressBar)) {
+	barMu.Lock()
+	defer barMu.Unlock()
+	if bar := progressBar.Load(); bar != nil {
+		f(bar)
+	}
+}
+
+// newProgressBar makes the bar of a copy of max files, it can be replaced
+// by one drawing to an io.Discard.
+var newProgressBar = progressbar.Default
+
+// formatDuration is how durations read in the log: 1h12m03s, 4m05s, 3.2s
+// or 420ms, precise enough to tell short runs apart.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	}
+	d = d.Round(time.Second)
+	h, m, s := int(d/time.Hour), int(d/time.Minute)%60, int(d/time.Second)%60
+	if h > 0 {
+		return fmt.Sprintf("%dh%02dm%02ds", h, m, s)
+	}
+	return fmt.Sprintf("%dm%02ds", m, s)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// statusSignals is empty where SIGUSR1 doesn't exist, -status-interval
+// is the only way to get a status line there.
+func statusSignals() []os.Signal {
+	return nil
+}
+
+// resizeSignals is empty without SIGWINCH, the bar picks up a new terminal
+// width on its next draw.
+func resizeSignals() []os.Signal {
+	return nil
+}
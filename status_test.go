@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCopyStatusLines prints status lines while a slow copy runs, they and
+// the lines of the busy workers are logged like every other line.
+func TestCopyStatusLines(t *testing.T) {
+	r := runCopyTest(t, "slow", "-status-interval", "20ms", "-c", "1", "-small-batch", "1", "-log-timestamps", "rfc3339")
+	if r.code != exitOK {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+	}
+	stamp := testEpoch.Format(time.RFC3339) + " [INFO] "
+	statusLines, workerLines := 0, 0
+	for _, line := range strings.Split(r.log, "\n") {
+		switch {
+		case strings.Contains(line, "Status: "):
+			statusLines++
+			if !strings.HasPrefix(line, stamp+"Status: ") {
+				t.Errorf("status line %q isn't logged like the others", line)
+			}
+		case strings.Contains(line, "worker 0: "):
+			workerLines++
+			if !strings.HasPrefix(line, stamp+"  worker 0: ") {
+				t.Errorf("worker line %q isn't logged like the others", line)
+			}
+		}
+	}
+	if statusLines == 0 || workerLines == 0 {
+		t.Errorf("%d status and %d worker lines in the log, want some of both:\n%s", statusLines, workerLines, r.log)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals are the signals that print an on-demand status line.
+func statusSignals() []os.Signal {
+	return []os.Signal{syscall.SIGUSR1}
+}
+
+// resizeSignals are the signals telling that the terminal was resized.
+func resizeSignals() []os.Signal {
+	return []os.Signal{syscall.SIGWINCH}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var errTestClose = errors.New("injected close failure")
+
+func init() {
+	copyCases["close"] = copyCase{
+		source: fstest.MapFS{
+			"a/kept.txt":  testFile("kept"),
+			"a/quota.txt": testFile("over quota"),
+		},
+		setup: func() {
+			// the write-behind error of a full quota only shows up on Close
+			closeDestination = func(f *os.File) error {
+				err := f.Close()
+				if filepath.Base(f.Name()) == "a_quota.txt" {
+					return errTestClose
+				}
+				return err
+			}
+		},
+	}
+}
+
+// TestCopyCloseFailure fails the Close of one destination: that file fails
+// and is removed, the others are copied.
+func TestCopyCloseFailure(t *testing.T) {
+	r := runCopyTest(t, "close")
+	if r.code != exitFailed {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitFailed, r.log)
+	}
+	if len(r.files) != 1 || r.files["a_kept.txt"] != "kept" {
+		t.Errorf("output has %q, want only a_kept.txt", r.names())
+	}
+	if s := r.summary; s.CopiedItems != 1 || s.FailedItems != 1 || !s.Accounting.Balanced {
+		t.Errorf("copied/failed = %d/%d, accounting %+v, want 1/1 balanced", s.CopiedItems, s.FailedItems, s.Accounting)
+	}
+	if !strings.Contains(r.log, errTestClose.Error()) {
+		t.Errorf("the log doesn't report the close failure:\n%s", r.log)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	copiedItems atomic.Uint64
+	failedItems atomic.Uint64
+)
+
+// runSummary is the machine-readable report written with -json-summary.
+type runSummary struct {
+	buildInfo
+
+	StartedAt      time.Time `json:"started_at"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	OutputDir      string    `json:"output_dir"`
+	FoundItems     uint      `json:"found_items"`
+	CopiedItems    uint64    `json:"copied_items"`
+	FailedItems    uint64    `json:"failed_items"`
+	SkippedItems   uint64    `json:"skipped_items"`
+	// SkippedByReason counts every skip record, see -skipped-list.
+	SkippedByReason map[skipReason]int `json:"skipped_by_reason,omitempty"`
+	// TimedOutOps are directory reads and file opens given up on after -io-timeout.
+	TimedOutOps uint64 `json:"timed_out_ops"`
+	// ExistingDestinations are files not copied because their destination
+	// was already in the output directory before the run.
+	ExistingDestinations uint64 `json:"existing_destinations"`
+	// IdenticalDuplicates and ConflictingContent are the name collisions
+	// -conflict-compare found to have the same or different content.
+	IdenticalDuplicates uint64 `json:"identical_duplicates"`
+	ConflictingContent  uint64 `json:"conflicting_content"`
+	SourceBytes         int64  `json:"source_bytes"`
+	StoredBytes         int64  `json:"stored_bytes"`
+	// ExpectedBytes and VerifiedBytes are what the copies that got to the
+	// end expected by stat and read, see checkCopiedSize.
+	ExpectedBytes int64 `json:"expected_bytes"`
+	VerifiedBytes int64 `json:"verified_bytes"`
+	// PackBufferPeak is the most file data that waited for the pack writer,
+	// see -archive-buffer.
+	PackBufferPeak int64 `json:"pack_buffer_peak,omitempty"`
+	// BytesPerSecond is SourceBytes over the elapsed time.
+	BytesPerSecond float64      `json:"bytes_per_second"`
+	Workers        []workerStat `json:"workers,omitempty"`
+	// Concurrency is the number of copy workers, for -c auto the final one.
+	Concurrency int `json:"concurrency,omitempty"`
+	// PeakQueueDepth is the most walked files that waited for a copy worker.
+	PeakQueueDepth int64 `json:"peak_queue_depth"`
+
+	Errors  map[errorCategory]int `json:"errors"`
+	Filters map[string]string     `json:"filters"`
+	// SizeDivergences counts the files that read a different size than
+	// stat reported, SizeDivergenceSamples are the first of them.
+	SizeDivergences       int              `json:"size_divergences"`
+	SizeDivergenceSamples []sizeDivergence `json:"size_divergence_samples,omitempty"`
+	// StateChanges are the pauses, resumes and cancels of the run.
+	StateChanges []stateChange `json:"state_changes,omitempty"`
+	// ScanSeconds is how long the scan before the copy took.
+	ScanSeconds float64 `json:"scan_seconds"`
+	// TextTransformed counts the files -text-transform changed.
+	TextTransformed uint64 `json:"text_transformed,omitempty"`
+	// UnreadableDirs are the source directories that couldn't be read,
+	// FoundItems and the rest don't count anything below them.
+	UnreadableDirs []unreadableDir `json:"unreadable_dirs,omitempty"`
+	// OnlyRoots are the files found and copied under each -only root.
+	OnlyRoots []onlyRootSummary `json:"only_roots,omitempty"`
+	// Phases are the durations of the phases of the run, see phaseTimer.
+	Phases []phaseTiming `json:"phases,omitempty"`
+	// Accounting says where every file found went.
+	Accounting accountingSummary `json:"accounting"`
+	// Tree are the extremes of the source tree the scout and copy saw.
+	Tree treeSummary `json:"tree"`
+	// EmptyDirs are only listed with -empty-dirs list or marker.
+	EmptyDirs []string `json:"empty_dirs,omitempty"`
+}
+
+func newRunSummary(startedAt time.Time, foundItems uint) runSummary {
+	elapsed := runClock.Since(startedAt)
+	divergences, divergenceSamples := sizeDivergenceSummary()
+	return runSummary{
+		buildInfo:             readBuildInfo(),
+		StartedAt:             startedAt,
+		ElapsedSeconds:        elapsed.Seconds(),
+		OutputDir:             outputDirectory,
+		FoundItems:            foundItems,
+		CopiedItems:           copiedItems.Load(),
+		FailedItems:           failedItems.Load(),
+		SkippedItems:          skippedItems.Load(),
+		SkippedByReason:       skips.snapshot(),
+		TimedOutOps:           timedOutOps.Load(),
+		ExistingDestinations:  existingCollisions.Load(),
+		IdenticalDuplicates:   identicalDuplicates.Load(),
+		ConflictingContent:    conflictingContent.Load(),
+		SourceBytes:           copiedBytes.Load(),
+		StoredBytes:           storedBytes.Load(),
+		ExpectedBytes:         expectedBytes.Load(),
+		VerifiedBytes:         verifiedBytes.Load(),
+		PackBufferPeak:        archiveBudget.peakUse(),
+		BytesPerSecond:        throughput(copiedBytes.Load(), elapsed),
+		Workers:               workerStats,
+		Concurrency:           settledWorkers,
+		PeakQueueDepth:        peakQueueDepth,
+		Errors:                copyErrors.snapshot(),
+		SizeDivergences:       divergences,
+		SizeDivergenceSamples: divergenceSamples,
+		StateChanges:          runPause.snapshot(),
+		ScanSeconds:           scanElapsed.Seconds(),
+		TextTransformed:       transformedFiles.Load(),
+		UnreadableDirs:        unreadable.snapshot(),
+		OnlyRoots:             onlyRootSummaries(),
+		Phases:                phases.snapshot(),
+		Accounting:            runAccounting,
+		Tree:                  tree.summary(),
+		Filters:               activeFilters(copyCommand.flags),
+		EmptyDirs:             emptyDirectories,
+	}
+}
+
+// writeSummary hands the summary to the events and writes the
+// -json-summary file, if one was requested.
+func writeSummary(startedAt time.Time, foundItems uint) {
+	summary := newRunSummary(startedAt, foundItems)
+	events.summary(summary)
+	if jsonSummary == "" {
+		return
+	}
+	if err := summary.writeFile(jsonSummary); err != nil {
+		errorf("Could not write summary %q: %v\n", jsonSummary, err)
+	}
+}
+
+func (s runSummary) writeFile(name string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0644)
+}
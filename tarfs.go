@@ -0,0 +1,274 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tarFS serves the members of a tar archive as an fs.FS. Opening it reads
+// every header once to index the tree. Members of an uncompressed archive
+// are then read in place and in parallel. A compressed archive can only be
+// read front to back, so the first members up to a memory budget are kept
+// while indexing and the rest share one decompressing stream, see cursor.
+type tarFS struct {
+	name       string
+	compressed bool
+	// file is the uncompressed archive, members are sections of it
+	file *os.File
+
+	entries map[string]*tarEntry
+	dirs    map[string][]fs.DirEntry
+
+	// mu guards the stream, held by an open member without data until it's
+	// closed
+	mu     sync.Mutex
+	stream io.Closer
+	cursor *tar.Reader
+	next   int
+}
+
+type tarEntry struct {
+	info  fs.FileInfo
+	index int
+	// offset of the member's content in the uncompressed archive, -1 for
+	// sparse members that can't be read in place
+	offset int64
+	data   []byte
+}
+
+func openTarFS(name string, compressed bool, budget int64) (*tarFS, error) {
+	t := &tarFS{
+		name:       name,
+		compressed: compressed,
+		entries:    map[string]*tarEntry{},
+		dirs:       map[string][]fs.DirEntry{},
+	}
+	stream, counter, err := t.open()
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	tr := tar.NewReader(counter)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if !fs.ValidPath(name) || name == "." {
+			verbosef("ignoring tar member %q\n", hdr.Name)
+			continue
+		}
+		entry := &tarEntry{info: hdr.FileInfo(), index: index, offset: counter.n}
+		if hdr.Typeflag == tar.TypeLink {
+			// a hard link has the content of the member it links to
+			target, ok := t.entries[path.Clean(strings.TrimPrefix(hdr.Linkname, "/"))]
+			if !ok {
+				verbosef("ignoring tar member %q, a hard link to the missing %q\n", hdr.Name, hdr.Linkname)
+				continue
+			}
+			entry = &tarEntry{info: tarLinkInfo{target.info, path.Base(name)}, index: target.index, offset: target.offset, data: target.data}
+		}
+		if hdr.Typeflag == tar.TypeGNUSparse || len(hdr.PAXRecords) > 0 && hdr.PAXRecords["GNU.sparse.map"] != "" {
+			entry.offset = -1
+		}
+		if compressed && hdr.Typeflag == tar.TypeReg && hdr.Size <= budget {
+			if entry.data, err = io.ReadAll(tr); err != nil {
+				return nil, err
+			}
+			budget -= hdr.Size
+		}
+		t.add(name, entry)
+	}
+
+	for dir := range t.dirs {
+		sort.Slice(t.dirs[dir], func(i, j int) bool { return t.dirs[dir][i].Name() < t.dirs[dir][j].Name() })
+	}
+	if !compressed {
+		if t.file, err = os.Open(name); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// open starts reading the archive from the front. reader counts the
+// uncompressed bytes read.
+func (t *tarFS) open() (io.Closer, *tarCounter, error) {
+	file, err := os.Open(t.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !t.compressed {
+		return file, &tarCounter{r: file}, nil
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, &tarCounter{r: gz}, nil
+}
+
+// add records a member and every parent directory the archive doesn't
+// list itself. A later member of the same name replaces an earlier one,
+// like extracting would.
+func (t *tarFS) add(name string, entry *tarEntry) {
+	_, existed := t.entries[name]
+	t.entries[name] = entry
+	if existed {
+		dir := path.Dir(name)
+		for i, child := range t.dirs[dir] {
+			if child.Name() == path.Base(name) {
+				t.dirs[dir][i] = fs.FileInfoToDirEntry(entry.info)
+			}
+		}
+		return
+	}
+	for name != "." {
+		dir := path.Dir(name)
+		t.dirs[dir] = append(t.dirs[dir], fs.FileInfoToDirEntry(entry.info))
+		if _, ok := t.entries[dir]; ok || dir == "." {
+			return
+		}
+		entry = &tarEntry{info: tarImpliedDir(path.Base(dir)), index: -1, offset: -1}
+		t.entries[dir] = entry
+		name = dir
+	}
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, ok := t.entries[name]
+	if name == "." {
+		entry, ok = &tarEntry{info: tarImpliedDir("."), index: -1}, true
+	}
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	switch {
+	case entry.info.IsDir() || !entry.info.Mode().IsRegular():
+		return &tarFile{info: entry.info, r: strings.NewReader("")}, nil
+	case entry.data != nil:
+		return &tarFile{info: entry.info, r: bytes.NewReader(entry.data)}, nil
+	case t.file != nil && entry.offset >= 0:
+		return &tarFile{info: entry.info, r: io.NewSectionReader(t.file, entry.offset, entry.info.Size())}, nil
+	}
+	return t.openFromCursor(name, entry)
+}
+
+// openFromCursor positions the shared stream at the member, restarting it
+// when the member is behind it, and keeps it until the member is closed.
+func (t *tarFS) openFromCursor(name string, entry *tarEntry) (fs.File, error) {
+	t.mu.Lock()
+	if t.cursor == nil || t.next > entry.index {
+		if t.stream != nil {
+			t.stream.Close()
+		}
+		stream, counter, err := t.open()
+		if err != nil {
+			t.mu.Unlock()
+			return nil, err
+		}
+		t.stream, t.cursor, t.next = stream, tar.NewReader(counter), 0
+	}
+	for t.next <= entry.index {
+		if _, err := t.cursor.Next(); err != nil {
+			t.cursor = nil
+			t.mu.Unlock()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		t.next++
+	}
+	return &tarFile{info: entry.info, r: t.cursor, unlock: t.mu.Unlock}, nil
+}
+
+func (t *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, ok := t.entries[name]
+	if name != "." && (!ok || !entry.info.IsDir()) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]fs.DirEntry(nil), t.dirs[name]...), nil
+}
+
+func (t *tarFS) Stat(name string) (fs.FileInfo, error) {
+	if name == "." {
+		return tarImpliedDir("."), nil
+	}
+	entry, ok := t.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return entry.info, nil
+}
+
+// tarFile is an open member.
+type tarFile struct {
+	info   fs.FileInfo
+	r      io.Reader
+	unlock func()
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *tarFile) Read(p []byte) (int, error) { return f.r.Read(p) }
+
+func (f *tarFile) Close() error {
+	if f.unlock == nil {
+		return nil
+	}
+	f.unlock()
+	f.unlock = nil
+	return nil
+}
+
+// tarCounter counts the bytes read through it: after tar.Reader.Next it
+// is at the start of the member's content, tar reads whole blocks directly
+// from it.
+type tarCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *tarCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// tarImpliedDir describes a directory the archive only implies.
+type tarImpliedDir string
+
+// tarLinkInfo is the FileInfo of the member a hard link links to, under the
+// link's own name.
+type tarLinkInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (l tarLinkInfo) Name() string { return l.name }
+
+func (d tarImpliedDir) Name() string       { return string(d) }
+func (d tarImpliedDir) Size() int64        { return 0 }
+func (d tarImpliedDir) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
+func (d tarImpliedDir) ModTime() time.Time { return time.Time{} }
+func (d tarImpliedDir) IsDir() bool        { return true }
+func (d tarImpliedDir) Sys() any           { return nil }
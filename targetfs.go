@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// targetFS is -target-fs. FAT and exFAT reject some characters in names,
+// compare names without case and keep mtimes at 2 second precision.
+var targetFS = newChoiceValue("auto", "auto", "native", "fat")
+
+// fatTarget is set by prepareTargetFS when the output directory is, or is
+// taken to be, on FAT or exFAT.
+var fatTarget bool
+
+func prepareTargetFS() {
+	switch targetFS.value {
+	case "fat":
+		fatTarget = true
+	case "auto":
+		fatTarget = isFATDirectory(existingAncestor(outputDirectory))
+		if fatTarget {
+			infof("The output directory %q is on FAT or exFAT, sanitizing names and comparing them without case\n", outputDirectory)
+		}
+	}
+}
+
+// existingAncestor is dir or its closest parent that exists, the output
+// directory may not have been created yet.
+func existingAncestor(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// fatReplacer replaces what FAT doesn't allow in names: control
+// characters and "*:<>?\| .
+var fatReplacer = strings.NewReplacer(`"`, "_", "*", "_", ":", "_", "<", "_", ">", "_", "?", "_", `\`, "_", "|", "_")
+
+// fatSafe makes every component of a slash separated destination valid on
+// FAT, without -target-fs fat it returns name unchanged. Trailing dots and
+// spaces are replaced too, FAT would drop them and merge names.
+func fatSafe(name string) string {
+	if !fatTarget {
+		return name
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		part = fatReplacer.Replace(strings.Map(func(r rune) rune {
+			if r < 0x20 {
+				return '_'
+			}
+			return r
+		}, part))
+		if trimmed := strings.TrimRight(part, ". "); len(trimmed) < len(part) && part != "." && part != ".." {
+			part = trimmed + strings.Repeat("_", len(part)-len(trimmed))
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, "/")
+}
+
+// collisionKey is what destination names are compared by: FAT can't hold
+// two names differing only in case.
+func collisionKey(name string) string {
+	if fatTarget {
+		return strings.ToLower(name)
+	}
+	return name
+}
@@ -0,0 +1,27 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+func isFATDirectory(dir string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return false
+	}
+	var name strings.Builder
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name.WriteByte(byte(c))
+	}
+	switch name.String() {
+	case "msdos", "msdosfs", "exfat":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,16 @@
+package main
+
+import "syscall"
+
+const (
+	msdosSuperMagic = 0x4d44
+	exfatSuperMagic = 0x2011bab0
+)
+
+func isFATDirectory(dir string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return false
+	}
+	return st.Type == msdosSuperMagic || st.Type == exfatSuperMagic
+}
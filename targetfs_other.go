@@ -0,0 +1,5 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+func isFATDirectory(dir string) bool { return false }
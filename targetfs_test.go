@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestFATSafe(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"plain.txt", "plain.txt"},
+		{"2024-03-01 12:00:00.log", "2024-03-01 12_00_00.log"},
+		{`a"b*c<d>e?f\g|h.txt`, "a_b_c_d_e_f_g_h.txt"},
+		{"tab\there.txt", "tab_here.txt"},
+		{"trailing dot.", "trailing dot_"},
+		{"trailing spaces  ", "trailing spaces__"},
+		{"dir./name: x", "dir_/name_ x"},
+		{"../up", "../up"},
+		{"ünïcödé.txt", "ünïcödé.txt"},
+	}
+	saved := fatTarget
+	t.Cleanup(func() { fatTarget = saved })
+
+	fatTarget = true
+	for _, test := range tests {
+		if got := fatSafe(test.name); got != test.want {
+			t.Errorf("fatSafe(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+	fatTarget = false
+	for _, test := range tests {
+		if got := fatSafe(test.name); got != test.name {
+			t.Errorf("fatSafe(%q) = %q off FAT, want it unchanged", test.name, got)
+		}
+	}
+}
+
+func TestCollisionKey(t *testing.T) {
+	saved := fatTarget
+	t.Cleanup(func() { fatTarget = saved })
+	for _, fat := range []bool{false, true} {
+		fatTarget = fat
+		if same := collisionKey("a_Report.TXT") == collisionKey("a_report.txt"); same != fat {
+			t.Errorf("on FAT %v: names differing in case collide = %v, want %v", fat, same, fat)
+		}
+	}
+}
+
+func init() {
+	copyCases["fat"] = copyCase{source: fstest.MapFS{
+		"a/Report.TXT":      testFile("upper"),
+		"a/report.txt":      testFile("lower"),
+		"logs/12:00:00.log": testFile("colons"),
+		"x/dot.":            testFile("dot"),
+	}}
+}
+
+// TestCopyTargetFAT copies to an output directory taken to be FAT: names
+// are sanitized and collide without regard to case.
+func TestCopyTargetFAT(t *testing.T) {
+	r := runCopyTest(t, "fat", "-target-fs", "fat", "-on-conflict", "skip")
+	if r.code != exitOK {
+		t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+	}
+	want := map[string]string{"a_Report.TXT": "upper", "logs_12_00_00.log": "colons", "x_dot_": "dot"}
+	for name, content := range want {
+		if r.files[name] != content {
+			t.Errorf("%s = %q, want %q", name, r.files[name], content)
+		}
+	}
+	if len(r.files) != len(want) {
+		t.Errorf("output has %q, want %d files", r.names(), len(want))
+	}
+	if s := r.summary; s.CopiedItems != 3 || s.Accounting.Skipped[skipConflict] != 1 {
+		t.Errorf("copied %d, accounting %+v, want 3 copied and a/report.txt skipped as a conflict", s.CopiedItems, s.Accounting)
+	}
+
+	native := runCopyTest(t, "fat", "-target-fs", "native")
+	if native.code != exitOK || len(native.files) != 4 {
+		t.Errorf("-target-fs native: exit code %d, output %q, want all 4 files", native.code, native.names())
+	}
+}
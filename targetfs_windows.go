@@ -0,0 +1,27 @@
+package main
+
+import (
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var procGetVolumeInformationW = kernel32.NewProc("GetVolumeInformationW")
+
+func isFATDirectory(dir string) bool {
+	root, err := syscall.UTF16PtrFromString(filepath.VolumeName(dir) + `\`)
+	if err != nil {
+		return false
+	}
+	var fsName [syscall.MAX_PATH + 1]uint16
+	r, _, _ := procGetVolumeInformationW.Call(uintptr(unsafe.Pointer(root)), 0, 0, 0, 0, 0,
+		uintptr(unsafe.Pointer(&fsName[0])), uintptr(len(fsName)))
+	if r == 0 {
+		return false
+	}
+	switch syscall.UTF16ToString(fsName[:]) {
+	case "FAT", "FAT32", "exFAT":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+)
+
+// textDetectSize is how much of a file is looked at to tell text from
+// binary.
+const textDetectSize = 8 << 10
+
+var (
+	onlyText   bool
+	onlyBinary bool
+
+	errSkippedBinary = errors.New("skipped: binary")
+	errSkippedText   = errors.New("skipped: text")
+)
+
+// textEncoding is what SniffText found: the code unit width, its byte
+// order and the length of the BOM, 0 without one.
+type textEncoding struct {
+	width     int
+	bigEndian bool
+	bom       int
+}
+
+// SniffText tells text from binary by the start of a file. sample holds up
+// to textDetectSize+1 bytes, one more than is looked at so a file of exactly
+// textDetectSize isn't taken as cut off. Text is UTF-8 without NUL bytes, or
+// UTF-16 with a BOM. UTF-16 without a BOM is binary, its NULs can't be told
+// apart from binary data. An empty file is text.
+func SniffText(sample []byte) (textEncoding, bool) {
+	truncated := len(sample) > textDetectSize
+	if truncated {
+		sample = sample[:textDetectSize]
+	}
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xef, 0xbb, 0xbf}) && validUTF8(sample[3:], truncated):
+		return textEncoding{width: 1, bom: 3}, true
+	case bytes.HasPrefix(sample, []byte{0xff, 0xfe}) && validUTF16(sample[2:], false, truncated):
+		return textEncoding{width: 2, bom: 2}, true
+	case bytes.HasPrefix(sample, []byte{0xfe, 0xff}) && validUTF16(sample[2:], true, truncated):
+		return textEncoding{width: 2, bigEndian: true, bom: 2}, true
+	case bytes.IndexByte(sample, 0) < 0 && validUTF8(sample, truncated):
+		return textEncoding{width: 1}, true
+	}
+	return textEncoding{}, false
+}
+
+// sourceIsText reads the start of a source file for SniffText.
+func sourceIsText(name string) (bool, error) {
+	f, err := openSource(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sample := make([]byte, textDetectSize+1)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, err
+	}
+	_, isText := SniffText(sample[:n])
+	return isText, nil
+}
+
+func validateContentFilter() error {
+	if onlyText && onlyBinary {
+		return errors.New("-only-text and -only-binary exclude each other")
+	}
+	return nil
+}
+
+// filterContent returns the files of job -only-text or -only-binary let
+// through, the others are recorded as skipped. A sidecar group goes with
+// its primary, the files of a batch are looked at one by one.
+func filterContent(worker int, job copyJob) []string {
+	if !onlyText && !onlyBinary {
+		return job.files
+	}
+	if !job.batch {
+		if keepContent(worker, job.dir, job.files) {
+			return job.files
+		}
+		return nil
+	}
+	var kept []string
+	for _, name := range job.files {
+		if keepContent(worker, job.dir, []string{name}) {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// keepContent reports whether group is copied, judging by its primary. A
+// file that can't be read is, so the copy reports the error.
+func keepContent(worker int, dir string, group []string) bool {
+	isText, err := sourceIsText(filepath.Join(dir, group[0]))
+	if err != nil || isText == onlyText {
+		return true
+	}
+	reason, detail, skipErr := skipBinary, "not text, -only-text", errSkippedBinary
+	if isText {
+		reason, detail, skipErr = skipText, "text, -only-binary", errSkippedText
+	}
+	verbosef("%s %v\n", filepath.Join(dir, group[0]), skipErr)
+	skippedItems.Add(uint64(len(group)))
+	for _, name := range group {
+		recordSkip(filepath.ToSlash(filepath.Join(dir, name)), reason, detail)
+	}
+	recordGroup(worker, dir, group, outcomeSkipped, skipErr)
+	return false
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func utf16Bytes(s string, bigEndian bool) []byte {
+	var b []byte
+	for _, unit := range utf16.Encode([]rune(s)) {
+		if bigEndian {
+			b = append(b, byte(unit>>8), byte(unit))
+		} else {
+			b = append(b, byte(unit), byte(unit>>8))
+		}
+	}
+	return b
+}
+
+func TestSniffText(t *testing.T) {
+	text := strings.Repeat("plain text, ", 100)
+	// a rune cut off by the end of the window of a longer file
+	cutRune := append(bytes.Repeat([]byte("a"), textDetectSize-1), "é and more"...)[:textDetectSize+1]
+
+	tests := []struct {
+		name     string
+		sample   []byte
+		isText   bool
+		encoding textEncoding
+	}{
+		{name: "empty", sample: nil, isText: true, encoding: textEncoding{width: 1}},
+		{name: "ASCII", sample: []byte(text), isText: true, encoding: textEncoding{width: 1}},
+		{name: "UTF-8", sample: []byte("naïve café ☕"), isText: true, encoding: textEncoding{width: 1}},
+		{name: "UTF-8 with BOM", sample: append([]byte{0xef, 0xbb, 0xbf}, "café"...), isText: true, encoding: textEncoding{width: 1, bom: 3}},
+		{name: "UTF-16LE with BOM", sample: append([]byte{0xff, 0xfe}, utf16Bytes("café", false)...), isText: true, encoding: textEncoding{width: 2, bom: 2}},
+		{name: "UTF-16BE with BOM", sample: append([]byte{0xfe, 0xff}, utf16Bytes("café", true)...), isText: true, encoding: textEncoding{width: 2, bigEndian: true, bom: 2}},
+		{name: "UTF-16 without BOM", sample: utf16Bytes("café", false)},
+		{name: "invalid UTF-8", sample: []byte("caf\xe9")},
+		{name: "NUL at the start", sample: []byte("\x00ELF")},
+		{name: "NUL after 512 bytes", sample: append([]byte(text[:600]), 0)},
+		{name: "NUL past the window", sample: append(bytes.Repeat([]byte("a"), textDetectSize), 0), isText: true, encoding: textEncoding{width: 1}},
+		{name: "rune cut off by the window", sample: cutRune, isText: true, encoding: textEncoding{width: 1}},
+		{name: "rune cut off at the end of the file", sample: []byte("caf\xc3")},
+	}
+	for _, test := range tests {
+		encoding, isText := SniffText(test.sample)
+		if isText != test.isText || encoding != test.encoding {
+			t.Errorf("%s: SniffText = %+v, %v, want %+v, %v", test.name, encoding, isText, test.encoding, test.isText)
+		}
+	}
+}
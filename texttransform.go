@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// textTransformNames are the steps -text-transform can apply, in the order
+// the manifest lists them.
+var textTransformNames = []string{"strip-bom", "crlf-to-lf", "lf-to-crlf"}
+
+// textTransformSet is -text-transform, a comma separated list of names.
+type textTransformSet map[string]bool
+
+var textTransforms = textTransformSet{}
+
+// transformedFiles counts the files whose content -text-transform changed.
+var transformedFiles atomic.Uint64
+
+func (t *textTransformSet) String() string {
+	if t == nil {
+		return ""
+	}
+	return strings.Join(t.names(), ",")
+}
+
+func (t *textTransformSet) Set(s string) error {
+	steps := textTransformSet{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, candidate := range textTransformNames {
+			known = known || name == candidate
+		}
+		if !known {
+			return fmt.Errorf("unknown text transform %q, use %s", name, strings.Join(textTransformNames, ", "))
+		}
+		steps[name] = true
+	}
+	if steps["crlf-to-lf"] && steps["lf-to-crlf"] {
+		return errors.New("crlf-to-lf and lf-to-crlf exclude each other")
+	}
+	*t = steps
+	return nil
+}
+
+// names are the steps in textTransformNames order.
+func (t textTransformSet) names() []string {
+	var names []string
+	for _, name := range textTransformNames {
+		if t[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// textTransformer rewrites a text file as it's read, one code unit at a
+// time so memory doesn't grow with the file. UTF-16 is handled in its own
+// byte order.
+type textTransformer struct {
+	r         *bufio.Reader
+	width     int
+	bigEndian bool
+	prevCR    bool
+	unit      [2]byte
+	pending   []byte
+	// in counts the bytes read from the source, applied has the steps
+	// that changed something.
+	in      int64
+	applied map[string]bool
+}
+
+// transformText wraps a source for -text-transform. The transformer is nil
+// when no step is asked for or the file doesn't look like text, r is then
+// copied as it is.
+func transformText(r io.Reader) (io.Reader, *textTransformer, error) {
+	if len(textTransforms) == 0 {
+		return r, nil, nil
+	}
+	br := bufio.NewReaderSize(r, textDetectSize+1)
+	sample, err := br.Peek(textDetectSize + 1)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, nil, err
+	}
+	encoding, isText := SniffText(sample)
+	if !isText || len(sample) == 0 {
+		return br, nil, nil
+	}
+	t := &textTransformer{r: br, width: encoding.width, bigEndian: encoding.bigEndian, applied: map[string]bool{}}
+	if encoding.bom > 0 && textTransforms["strip-bom"] {
+		n, _ := br.Discard(encoding.bom)
+		t.in += int64(n)
+		t.applied["strip-bom"] = true
+	}
+	return t, t, nil
+}
+
+// validUTF8 reports whether b is UTF-8, allowing a rune cut off at the end
+// when b is only the start of the file.
+func validUTF8(b []byte, truncated bool) bool {
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size == 1 {
+			return truncated && !utf8.FullRune(b)
+		}
+		b = b[size:]
+	}
+	return true
+}
+
+// validUTF16 reports whether b is UTF-16 without unpaired surrogates,
+// allowing a unit or pair cut off at the end when b is only the start of
+// the file.
+func validUTF16(b []byte, bigEndian, truncated bool) bool {
+	if len(b)%2 != 0 && !truncated {
+		return false
+	}
+	highPending := false
+	for i := 0; i+1 < len(b); i += 2 {
+		unit := unit16(b[i:], bigEndian)
+		switch {
+		case unit >= 0xd800 && unit < 0xdc00:
+			if highPending {
+				return false
+			}
+			highPending = true
+		case unit >= 0xdc00 && unit < 0xe000:
+			if !highPending {
+				return false
+			}
+			highPending = false
+		default:
+			if highPending {
+				return false
+			}
+		}
+	}
+	return !highPending || truncated
+}
+
+func unit16(b []byte, bigEndian bool) uint16 {
+	if bigEndian {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return uint16(b[1])<<8 | uint16(b[0])
+}
+
+// encode is the code unit c in the file's encoding.
+func (t *textTransformer) encode(c uint16) []byte {
+	if t.width == 1 {
+		return []byte{byte(c)}
+	}
+	if t.bigEndian {
+		return []byte{byte(c >> 8), byte(c)}
+	}
+	return []byte{byte(c), byte(c >> 8)}
+}
+
+// next reads one code unit, the bytes are only valid until the next call. A
+// file ending in half a UTF-16 unit gets the
+// byte back as it is, with unit -1.
+func (t *textTransformer) next() (int, []byte, error) {
+	raw := t.unit[:t.width]
+	n, err := io.ReadFull(t.r, raw)
+	t.in += int64(n)
+	if n == 0 {
+		return 0, nil, err
+	}
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, nil, err
+	}
+	if n < t.width {
+		return -1, raw[:n], nil
+	}
+	if t.width == 1 {
+		return int(raw[0]), raw, nil
+	}
+	return int(unit16(raw, t.bigEndian)), raw, nil
+}
+
+// peekLF reports whether the next code unit is a line feed.
+func (t *textTransformer) peekLF() bool {
+	raw, err := t.r.Peek(t.width)
+	if err != nil {
+		return false
+	}
+	if t.width == 1 {
+		return raw[0] == '\n'
+	}
+	return unit16(raw, t.bigEndian) == '\n'
+}
+
+func (t *textTransformer) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(t.pending) > 0 {
+			copied := copy(p[n:], t.pending)
+			t.pending = t.pending[copied:]
+			n += copied
+			continue
+		}
+		unit, raw, err := t.next()
+		if err != nil {
+			return n, err
+		}
+		switch {
+		case unit == '\r' && textTransforms["crlf-to-lf"] && t.peekLF():
+			t.applied["crlf-to-lf"] = true
+		case unit == '\n' && textTransforms["lf-to-crlf"] && !t.prevCR:
+			t.applied["lf-to-crlf"] = true
+			t.pending = append(t.encode('\r'), raw...)
+		default:
+			t.pending = raw
+		}
+		t.prevCR = unit == '\r'
+	}
+	return n, nil
+}
+
+// sourceRead is how much of the source was read for the written bytes a
+// copy got out of it.
+func (t *textTransformer) sourceRead(written int64) int64 {
+	if t == nil {
+		return written
+	}
+	return t.in
+}
+
+// record notes the steps that changed the file in its manifest entry, with
+// Size the source size, which becomes OriginalSize.
+func (t *textTransformer) record(entry *manifestEntry, written int64) {
+	if t == nil || len(t.applied) == 0 {
+		return
+	}
+	entry.TextTransform = strings.Join(textTransformSet(t.applied).names(), ",")
+	entry.OriginalSize, entry.Size = entry.Size, written
+	transformedFiles.Add(1)
+}
+
+// logTextTransforms says how many files -text-transform changed.
+func logTextTransforms() {
+	if len(textTransforms) == 0 {
+		return
+	}
+	summaryf("-text-transform %s changed '%d' text files\n", textTransforms.String(), transformedFiles.Load())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+)
+
+// workerStat is what one copy worker did during a run. Every worker only
+// writes its own, they're read once all workers are done.
+type workerStat struct {
+	Worker int     `json:"worker"`
+	Files  uint64  `json:"files"`
+	Bytes  int64   `json:"bytes"`
+	Busy   float64 `json:"busy_seconds"`
+	// Idle is the time spent waiting for the walker to send a job.
+	Idle float64 `json:"idle_seconds"`
+
+	busy, idle time.Duration
+}
+
+var (
+	// workerStats are the finished run's workers, nil while copying.
+	workerStats []workerStat
+	// settledWorkers is the number of copy workers at the end of the run, where
+	// -c auto ended up.
+	settledWorkers int
+	// peakQueueDepth is the finished run's jobQueue peak.
+	peakQueueDepth int64
+)
+
+func (s *workerStat) finish() {
+	s.Busy = s.busy.Seconds()
+	s.Idle = s.idle.Seconds()
+}
+
+// throughput returns bytes per second over elapsed.
+func throughput(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / elapsed.Seconds()
+}
+
+func logThroughput(elapsed time.Duration, stats []workerStat) {
+	var total int64
+	for _, s := range stats {
+		total += s.Bytes
+	}
+	summaryf("Copied %s in %s, %s/s\n", formatBytes(total), formatDuration(elapsed), formatBytes(int64(throughput(total, elapsed))))
+
+	summaryf("%6s %8s %10s %8s %8s\n", "worker", "files", "bytes", "busy", "idle")
+	for _, s := range stats {
+		if autoConcurrency && s.Files == 0 {
+			// never unparked by -c auto
+			continue
+		}
+		summaryf("%6d %8d %10s %8s %8s\n", s.Worker, s.Files, formatBytes(s.Bytes),
+			formatDuration(s.busy), formatDuration(s.idle))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"container/heap"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// largestFilesKept is how many of the largest files the tree statistics list.
+const largestFilesKept = 10
+
+// treeStats collects the extremes of the source tree for the summary: the
+// scout records paths, sizes and directories, the copy the destination
+// names. Everything is bounded, the largest files are a min-heap.
+type treeStats struct {
+	mu sync.Mutex
+
+	deepestPath  string
+	deepestDepth int
+
+	longestDestination string
+
+	busiestDir     string
+	busiestEntries int
+
+	largest fileHeap
+}
+
+var tree = &treeStats{}
+
+// treeFile is one of the largest files, its path slash separated.
+type treeFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type fileHeap []treeFile
+
+func (h fileHeap) Len() int           { return len(h) }
+func (h fileHeap) Less(i, j int) bool { return h[i].Size < h[j].Size }
+func (h fileHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *fileHeap) Push(x any)        { *h = append(*h, x.(treeFile)) }
+func (h *fileHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// file records a selected file, name relative to the source root.
+func (t *treeStats) file(name string, size int64) {
+	name = filepath.ToSlash(name)
+	depth := strings.Count(name, "/") + 1
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if depth > t.deepestDepth {
+		t.deepestPath, t.deepestDepth = name, depth
+	}
+	switch {
+	case len(t.largest) < largestFilesKept:
+		heap.Push(&t.largest, treeFile{name, size})
+	case size > t.largest[0].Size:
+		t.largest[0] = treeFile{name, size}
+		heap.Fix(&t.largest, 0)
+	}
+}
+
+// directory records a directory with its number of direct children.
+func (t *treeStats) directory(name string, entries int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entries > t.busiestEntries {
+		t.busiestDir, t.busiestEntries = filepath.ToSlash(name), entries
+	}
+}
+
+// destination records a destination name the copy generated.
+func (t *treeStats) destination(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(name) > len(t.longestDestination) {
+		t.longestDestination = name
+	}
+}
+
+// treeSummary is the tree statistics section of the JSON summary.
+type treeSummary struct {
+	DeepestPath  string `json:"deepest_path,omitempty"`
+	DeepestDepth int    `json:"deepest_depth,omitempty"`
+	// LongestDestination is the longest destination name, relative to
+	// the output directory.
+	LongestDestination string `json:"longest_destination,omitempty"`
+	// BusiestDir is the directory with the most direct children, files
+	// and directories, BusiestDirEntries their number.
+	BusiestDir        string     `json:"busiest_dir,omitempty"`
+	BusiestDirEntries int        `json:"busiest_dir_entries,omitempty"`
+	Largest           []treeFile `json:"largest,omitempty"`
+}
+
+func (t *treeStats) summary() treeSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	largest := append([]treeFile(nil), t.largest...)
+	sort.Slice(largest, func(i, j int) bool { return largest[i].Size > largest[j].Size })
+	return treeSummary{
+		DeepestPath:        t.deepestPath,
+		DeepestDepth:       t.deepestDepth,
+		LongestDestination: t.longestDestination,
+		BusiestDir:         t.busiestDir,
+		BusiestDirEntries:  t.busiestEntries,
+		Largest:            largest,
+	}
+}
+
+// logTreeStats prints the tree statistics section of the summary.
+func logTreeStats() {
+	s := tree.summary()
+	if s.DeepestPath == "" {
+		return
+	}
+	summaryf("Tree statistics:\n")
+	summaryf("  deepest path (%d levels): %s\n", s.DeepestDepth, s.DeepestPath)
+	if s.LongestDestination != "" {
+		summaryf("  longest destination (%d bytes): %s\n", len(s.LongestDestination), s.LongestDestination)
+	}
+	summaryf("  most direct children (%d): %s\n", s.BusiestDirEntries, s.BusiestDir)
+	summaryf("  largest files:\n")
+	for _, f := range s.Largest {
+		summaryf("  %10s %s\n", formatBytes(f.Size), f.Path)
+	}
+}
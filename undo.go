@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+var (
+	undoManifest string
+	undoForce    bool
+	undoDryRun   bool
+)
+
+var undoCommand = newCommand("undo", "", "Remove the files a copy run created, as recorded in its manifest.\n"+
+	"Files whose size no longer matches the manifest are left alone unless -force is given.", outputFlags, logFlags)
+
+func init() {
+	fs := undoCommand.flags
+	fs.StringVar(&undoManifest, "manifest", "", "manifest written by a previous copy run")
+	fs.BoolVar(&undoForce, "force", false, "also remove files that changed since they were copied")
+	fs.BoolVar(&undoDryRun, "dry-run", false, "only print the files that would be removed")
+	undoCommand.run = runUndo
+}
+
+func runUndo(args []string) int {
+	m, outputDir, ok := loadManifestFlag(undoCommand, undoManifest)
+	if !ok {
+		return exitUsage
+	}
+
+	removed, failed := 0, 0
+	// a pack goes as a whole with its first entry, the rest share its outcome
+	packRemoved := map[string]bool{}
+	for _, entry := range m.Entries {
+		dst := m.destinationPath(outputDir, entry)
+		if entry.Pack != "" {
+			if gone, seen := packRemoved[entry.Pack]; seen {
+				if gone {
+					removed++
+				}
+				continue
+			}
+			packRemoved[entry.Pack] = false
+		}
+
+		info, err := os.Lstat(dst)
+		if errors.Is(err, fs.ErrNotExist) {
+			verbosef("%q is already gone\n", dst)
+			continue
+		}
+		if err != nil {
+			errorf("%q: %v\n", dst, err)
+			failed++
+			continue
+		}
+		isLink := info.Mode()&fs.ModeSymlink != 0
+		changed := isLink != (entry.LinkTarget != "") || !isLink && info.Size() != entry.storedSize()
+		if entry.Pack != "" {
+			changed = info.Size() < entry.PackOffset+entry.Size
+		}
+		if changed && !undoForce {
+			errorf("%q changed since it was copied, skipping...\n", dst)
+			failed++
+			continue
+		}
+
+		if undoDryRun {
+			infof("Would remove %q\n", dst)
+			continue
+		}
+		if err := os.Remove(dst); err != nil {
+			errorf("%v\n", err)
+			failed++
+			continue
+		}
+		if entry.Pack != "" {
+			packRemoved[entry.Pack] = true
+		}
+		removed++
+	}
+	markersRemoved, markersLeft := removeEmptyDirMarkers(m, outputDir, undoForce, undoDryRun)
+	removed += markersRemoved
+	failed += markersLeft
+
+	infof("Removed: '%d' items, '%d' left in place\n", removed, failed)
+	if failed > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// unreadableDir is a source directory that couldn't be read, nothing below
+// it was counted or copied.
+type unreadableDir struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// unreadableDirs records every unreadable directory once, whether the
+// scout or the walk found it. The walk doesn't retry a directory the scout
+// couldn't read.
+type unreadableDirs struct {
+	mu   sync.Mutex
+	dirs []unreadableDir
+	seen map[string]bool
+}
+
+var unreadable = &unreadableDirs{seen: map[string]bool{}}
+
+// record adds dir, it reports false if it was already recorded.
+func (u *unreadableDirs) record(dir string, err error) bool {
+	name := filepath.ToSlash(dir)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.seen[name] {
+		return false
+	}
+	u.seen[name] = true
+	u.dirs = append(u.dirs, unreadableDir{Path: name, Error: err.Error()})
+	return true
+}
+
+func (u *unreadableDirs) contains(dir string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.seen[filepath.ToSlash(dir)]
+}
+
+func (u *unreadableDirs) snapshot() []unreadableDir {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]unreadableDir(nil), u.dirs...)
+}
+
+// logUnreadable lists the subtrees the output is missing.
+func logUnreadable() {
+	dirs := unreadable.snapshot()
+	if len(dirs) == 0 {
+		return
+	}
+	summaryf("'%d' directories could not be read, the output misses everything below them:\n", len(dirs))
+	for _, dir := range dirs {
+		summaryf("  %s: %s\n", dir.Path, dir.Error)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+)
+
+var (
+	verifyManifest string
+	verifySkipHash bool
+	hashWorkers    int
+)
+
+var verifyCommand = newCommand("verify", "", "Check that every file recorded in a manifest is present in the output directory with the recorded size,\n"+
+	"and with the recorded hash when the copy ran with -hash.", outputFlags, logFlags, hashWorkerFlags, decryptFlags)
+
+func init() {
+	verifyCommand.flags.StringVar(&verifyManifest, "manifest", "", "manifest written by a previous copy run")
+	verifyCommand.flags.BoolVar(&verifySkipHash, "skip-hash", false, "only compare sizes, even if the manifest has hashes")
+	verifyCommand.run = runVerify
+}
+
+// hashWorkerFlags sizes the hashing pool separately from -c: hashing is CPU
+// bound, copying IO bound.
+func hashWorkerFlags(fs *flag.FlagSet) {
+	fs.IntVar(&hashWorkers, "hash-workers", runtime.NumCPU(), "number of files hashed in parallel")
+}
+
+func runVerify(args []string) int {
+	m, outputDir, ok := loadManifestFlag(verifyCommand, verifyManifest)
+	if !ok {
+		return exitUsage
+	}
+	if hashWorkers < 1 {
+		fmt.Fprintln(os.Stderr, "flatten verify: -hash-workers must be at least 1")
+		return exitUsage
+	}
+
+	algorithm := m.HashAlgorithm
+	if verifySkipHash {
+		algorithm = ""
+	}
+
+	var problems, checked int
+	verifyEntries(m, outputDir, algorithm, func(entry manifestEntry, err error) {
+		checked++
+		if err != nil {
+			problems++
+			errorf("%q: %v\n", entry.Destination, err)
+		} else {
+			verbosef("%q ok\n", entry.Destination)
+		}
+	})
+
+	infof("Verified: '%d' items, '%d' problems\n", checked, problems)
+	if problems > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// verifyEntries checks every entry of m on -hash-workers goroutines and
+// calls done with the result of each, one call at a time.
+func verifyEntries(m *manifest, outputDir, algorithm string, done func(entry manifestEntry, err error)) {
+	jobs := make(chan manifestEntry)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < hashWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				err := verifyEntry(m, outputDir, entry, algorithm)
+				mu.Lock()
+				done(entry, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, entry := range m.Entries {
+		jobs <- entry
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+var (
+	errSizeMismatch = errors.New("size mismatch")
+	errHashMismatch = errors.New("hash mismatch")
+	errLinkMismatch = errors.New("link mismatch")
+)
+
+func verifyEntry(m *manifest, outputDir string, entry manifestEntry, algorithm string) error {
+	dst := m.destinationPath(outputDir, entry)
+
+	if entry.LinkTarget != "" {
+		target, err := os.Readlink(dst)
+		if err != nil {
+			return err
+		}
+		if target != entry.LinkTarget {
+			return fmt.Errorf("%w: links to %q, manifest recorded %q", errLinkMismatch, target, entry.LinkTarget)
+		}
+		return nil
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	if entry.Pack != "" {
+		if info.Size() < entry.PackOffset+entry.Size {
+			return fmt.Errorf("%w: pack %q ends at %d, manifest recorded content up to %d", errSizeMismatch, entry.Pack, info.Size(), entry.PackOffset+entry.Size)
+		}
+	} else if info.Size() != entry.storedSize() {
+		return fmt.Errorf("%w: size is %d, manifest recorded %d", errSizeMismatch, info.Size(), entry.storedSize())
+	}
+
+	if algorithm == "" || entry.Hash == "" {
+		return nil
+	}
+	sum, size, err := hashStoredFile(dst, algorithm, entry)
+	if err != nil {
+		return err
+	}
+	if size != entry.Size {
+		return fmt.Errorf("%w: content is %d bytes, manifest recorded %d", errSizeMismatch, size, entry.Size)
+	}
+	if sum != entry.Hash {
+		return fmt.Errorf("%w: %s is %s, manifest recorded %s", errHashMismatch, algorithm, sum, entry.Hash)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the semantic version of this build. Release builds override it with
+//
+//	go build -ldflags "-X main.version=v1.2.3"
+var version = "v0.0.0-dev"
+
+// buildInfo describes the binary that is running, mostly for bug reports.
+type buildInfo struct {
+	Version    string `json:"version"`
+	Revision   string `json:"revision,omitempty"`
+	CommitTime string `json:"commit_time,omitempty"`
+	Modified   bool   `json:"modified,omitempty"`
+	GoVersion  string `json:"go_version"`
+	OS         string `json:"os"`
+	Arch       string `json:"arch"`
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.CommitTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+func (b buildInfo) String() string {
+	s := fmt.Sprintf("flatten %s", b.Version)
+	if b.Revision != "" {
+		s += fmt.Sprintf(" (%s", b.Revision)
+		if b.Modified {
+			s += "-dirty"
+		}
+		if b.CommitTime != "" {
+			s += ", " + b.CommitTime
+		}
+		s += ")"
+	}
+	return s + fmt.Sprintf(" %s %s/%s", b.GoVersion, b.OS, b.Arch)
+}
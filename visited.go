@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// dirID identifies a physical directory: device and inode on Unix, volume
+// serial number and file index on Windows.
+type dirID struct {
+	device, file uint64
+}
+
+// visitedDirs remembers the directories a walk went into, so one reached a
+// second time through a bind mount or a followed link isn't copied twice.
+type visitedDirs struct {
+	mu      sync.Mutex
+	seen    map[dirID]struct{}
+	skipped atomic.Uint64
+}
+
+func newVisitedDirs() *visitedDirs {
+	return &visitedDirs{seen: map[dirID]struct{}{}}
+}
+
+// first reports whether dir wasn't visited yet and records it. Directories
+// that can't be identified, like those of a -src archive, always are new.
+func (v *visitedDirs) first(dir string) bool {
+	if sourceFS != nil {
+		return true
+	}
+	id, ok := directoryID(dir)
+	if !ok {
+		return true
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, seen := v.seen[id]; seen {
+		v.skipped.Add(1)
+		return false
+	}
+	v.seen[id] = struct{}{}
+	return true
+}
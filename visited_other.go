@@ -0,0 +1,7 @@
+//go:build !unix && !windows
+
+package main
+
+func directoryID(dir string) (dirID, bool) {
+	return dirID{}, false
+}
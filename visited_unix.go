@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func directoryID(dir string) (dirID, bool) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return dirID{}, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return dirID{}, false
+	}
+	return dirID{device: uint64(st.Dev), file: uint64(st.Ino)}, true
+}
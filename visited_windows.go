@@ -0,0 +1,23 @@
+package main
+
+import "syscall"
+
+func directoryID(dir string) (dirID, bool) {
+	name, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return dirID{}, false
+	}
+	// FILE_FLAG_BACKUP_SEMANTICS is needed to open a directory
+	handle, err := syscall.CreateFile(name, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return dirID{}, false
+	}
+	defer syscall.CloseHandle(handle)
+
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(handle, &info); err != nil {
+		return dirID{}, false
+	}
+	return dirID{device: uint64(info.VolumeSerialNumber), file: uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow)}, true
+}
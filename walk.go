@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// errStopWalk can be returned by a walkNestedFiles callback to end the walk early.
+var errStopWalk = errors.New("stop walk")
+
+// walkNestedFiles calls fn for every group of files (see groupSidecars) the
+// copy command would copy, without any concurrency. With sortedWalk the
+// order is stable across runs and described by walkOrderLess: a
+// directory's files before its subdirectories, both by name. Otherwise
+// files come in directory order as they're read, so a directory with
+// millions of entries is never held in memory, and there are no sidecars.
+func walkNestedFiles(fn func(dirName string, group []string) error) error {
+	entries, err := readSourceDir(".")
+	if err != nil {
+		return err
+	}
+
+	visited := newVisitedDirs()
+	defer func() {
+		if n := visited.skipped.Load(); n > 0 {
+			verbosef("'%d' directories deduplicated, they were already reached through another path\n", n)
+		}
+	}()
+
+	var walk func(dirName string, ancestors []os.FileInfo) error
+	walk = func(dirName string, ancestors []os.FileInfo) error {
+		if isOutputDirectory(dirName) {
+			return nil
+		}
+		if !inOnlyScope(dirName) {
+			recordSkip(filepath.ToSlash(dirName), skipFiltered, "outside of -only")
+			return nil
+		}
+		if unreadable.contains(dirName) {
+			recordSkip(filepath.ToSlash(dirName), skipUnreadable, "could not be read by the scan")
+			return nil
+		}
+		ancestors, ok := enterDirectory(dirName, ancestors)
+		if !ok {
+			errorf("%q links back to one of its parent directories, not descending\n", dirName)
+			recordSkip(filepath.ToSlash(dirName), skipLoop, "links back to one of its parent directories")
+			return nil
+		}
+		if !visited.first(dirName) {
+			verbosef("Not descending into %q, the same directory was already copied through another path\n", dirName)
+			recordSkip(filepath.ToSlash(dirName), skipDuplicateDir, "same directory already reached through another path")
+			return nil
+		}
+		if isPreviousOutput(dirName) {
+			infof("Leaving out %q, it's the output of an earlier run. Pass -include-previous-output to copy it\n", dirName)
+			recordSkip(filepath.ToSlash(dirName), skipPreviousOutput, "holds "+outputMarkerName)
+			return nil
+		}
+
+		var fileNames, subdirs []string
+		var fnErr error
+		// a sorted walk groups a directory's files once all are known,
+		// otherwise every batch is handed on as it's read
+		err := readDirBatches(dirName, func(entries []os.DirEntry) error {
+			batch := fileNames[:0]
+			if sortedWalk() {
+				batch = fileNames
+			}
+			for _, entry := range entries {
+				entryPath := filepath.Join(dirName, entry.Name())
+				switch classifyEntry(entryPath, entry) {
+				case entryDir:
+					subdirs = append(subdirs, entryPath)
+				case entryFile:
+					if !selected(entryPath, entry) {
+						recordSkip(filepath.ToSlash(entryPath), skipFiltered, filterSkipDetail(entryPath, entry))
+					} else if newer := supersededBy(entryPath); newer != "" {
+						leaveOutSuperseded(entryPath, newer)
+					} else {
+						batch = append(batch, entry.Name())
+					}
+				case entrySkipped:
+					recordSkip(filepath.ToSlash(entryPath), skipLink, "-symlinks "+symlinkPolicy.value)
+				}
+			}
+			fileNames = batch
+			if sortedWalk() {
+				return nil
+			}
+			for _, name := range fileNames {
+				if fnErr = fn(dirName, []string{name}); fnErr != nil {
+					return fnErr
+				}
+			}
+			return nil
+		})
+		if fnErr != nil {
+			return fnErr
+		}
+		if err != nil {
+			if unreadable.record(dirName, err) {
+				errorf("Could not read directory %q, skipping the rest of it: %v\n", dirName, err)
+				copyErrors.record(dirName, err)
+				recordSkip(filepath.ToSlash(dirName), skipUnreadable, err.Error())
+			}
+			return nil
+		}
+
+		if sortedWalk() {
+			sort.Strings(fileNames)
+			sort.Strings(subdirs)
+			for _, group := range groupSidecars(fileNames) {
+				if err := fn(dirName, group); err != nil {
+					return err
+				}
+			}
+		}
+		for _, subdir := range subdirs {
+			if err := walk(subdir, ancestors); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	root := rootAncestors()
+	for _, entry := range entries {
+		if classifyEntry(entry.Name(), entry) == entryDir {
+			if err := walk(entry.Name(), root); err != nil {
+				if errors.Is(err, errStopWalk) {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deterministicWalk is -deterministic, plan always walks sorted.
+var deterministicWalk bool
+
+// sortedWalk reports whether walkNestedFiles has to read whole directories
+// to sort them: for -deterministic, for -sidecars and -mac-metadata, which
+// need a directory's names together, and for -state, whose cutoff is a
+// position in the sorted order.
+func sortedWalk() bool {
+	return deterministicWalk || len(sidecarExtensions) > 0 || macMetadata || stateFile != ""
+}
+
+// rootAncestors are the ancestors of the working directory's entries for
+// enterDirectory: just the working directory itself.
+func rootAncestors() []os.FileInfo {
+	if sourceFS != nil {
+		return nil
+	}
+	info, err := os.Stat(".")
+	if err != nil {
+		return nil
+	}
+	return []os.FileInfo{info}
+}
+
+// walkOrderLess reports whether walkNestedFiles visits the file with
+// slash separated path a before b. Sidecars are ordered by their primary.
+func walkOrderLess(a, b string) bool {
+	aDir, aName := path.Split(a)
+	bDir, bName := path.Split(b)
+	if aDir == bDir {
+		return aName < bName
+	}
+
+	aParts := strings.Split(strings.TrimSuffix(aDir, "/"), "/")
+	bParts := strings.Split(strings.TrimSuffix(bDir, "/"), "/")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] != bParts[i] {
+			return aParts[i] < bParts[i]
+		}
+	}
+	// one directory contains the other, its own files come first
+	return len(aParts) < len(bParts)
+}
+
+// sortGroups orders sidecar groups by their primary's name.
+func sortGroups(groups [][]string) {
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// deepTree is a source of width directories per level, depth levels deep,
+// with files files in every directory.
+func deepTree(depth, width, files int) fstest.MapFS {
+	tree := fstest.MapFS{}
+	var fill func(dir string, level int)
+	fill = func(dir string, level int) {
+		for i := 0; i < files; i++ {
+			tree[path.Join(dir, fmt.Sprintf("f%d.txt", i))] = testFile(dir)
+		}
+		if level == depth {
+			return
+		}
+		for i := 0; i < width; i++ {
+			fill(path.Join(dir, fmt.Sprintf("d%d", i)), level+1)
+		}
+	}
+	for i := 0; i < width; i++ {
+		fill(fmt.Sprintf("top%d", i), 1)
+	}
+	return tree
+}
+
+func init() {
+	copyCases["deep"] = copyCase{source: deepTree(6, 3, 1)}
+}
+
+// TestCopyDeepTreeStress copies a deep tree with every worker setup: the
+// run may only end once every walked file was copied. Run it with -race.
+func TestCopyDeepTreeStress(t *testing.T) {
+	const files = 3 + 9 + 27 + 81 + 243 + 729
+	for _, args := range [][]string{
+		{"-c", "1"},
+		{"-c", "8"},
+		{"-c", "32", "-small-batch", "1"},
+		{"-c", "8", "-fair"},
+		{"-c", "8", "-queue-size", "1"},
+	} {
+		t.Run(fmt.Sprint(args), func(t *testing.T) {
+			r := runCopyTest(t, "deep", args...)
+			if r.code != exitOK {
+				t.Fatalf("exit code %d, want %d\n%s", r.code, exitOK, r.log)
+			}
+			s := r.summary
+			if s.FoundItems != files || s.CopiedItems != files || len(r.files) != files {
+				t.Errorf("found %d, copied %d, output %d files, want %d", s.FoundItems, s.CopiedItems, len(r.files), files)
+			}
+			if !s.Accounting.Balanced {
+				t.Errorf("accounting = %+v, want balanced", s.Accounting)
+			}
+		})
+	}
+}
+
+// BenchmarkReadDir lists a directory of 1M files the way the scout and the
+// walk do, in readDirBatch entries at a time, and at once with os.ReadDir
+// and its sort as they used to. It reports the heap held by the listing at
+// its peak and how long the first entries took to arrive.
+func BenchmarkReadDir(b *testing.B) {
+	const entries = 1 << 20
+	dir := b.TempDir()
+	for i := 0; i < entries; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("spool-%07d.msg", i)), nil, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	heap := func() int64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return int64(stats.HeapAlloc)
+	}
+	report := func(b *testing.B, peak int64, first time.Duration) {
+		b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+		b.ReportMetric(float64(first.Microseconds())/1000, "first-entry-ms")
+	}
+
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			runtime.GC()
+			base, peak, n := heap(), int64(0), 0
+			start := time.Now()
+			var first time.Duration
+			err := readDirBatches(dir, func(batch []os.DirEntry) error {
+				if n == 0 {
+					first = time.Since(start)
+				}
+				n += len(batch)
+				peak = max(peak, heap()-base)
+				return nil
+			})
+			if err != nil || n != entries {
+				b.Fatalf("listed %d of %d entries: %v", n, entries, err)
+			}
+			report(b, peak, first)
+		}
+	})
+	b.Run("whole", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			runtime.GC()
+			base := heap()
+			start := time.Now()
+			listed, err := os.ReadDir(dir)
+			if err != nil || len(listed) != entries {
+				b.Fatalf("listed %d of %d entries: %v", len(listed), entries, err)
+			}
+			report(b, heap()-base, time.Since(start))
+			runtime.KeepAlive(listed)
+		}
+	})
+}